@@ -0,0 +1,194 @@
+package bitcask
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrBackupCorrupt = errors.New("backup does not match its manifest")
+
+// ManifestName is the file describing a backup, it is written last so a
+// directory without it holds an incomplete backup.
+const ManifestName = "MANIFEST.json"
+
+// Manifest describes the files of a backup and how to verify them.
+type Manifest struct {
+	CreatedAt     time.Time      `json:"created_at"`
+	FormatVersion int            `json:"format_version"`
+	Keys          int            `json:"keys"`
+	Files         []ManifestFile `json:"files"`
+}
+
+// ManifestFile is a file of the backup with its size and SHA-256 checksum.
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Backup copies a consistent point-in-time snapshot of the database to dir
+// without stopping writers. The data file is append-only, so everything up to
+// the offset of the last commit is immutable: the snapshot is that sealed
+// prefix, read through its own file descriptor while new writes keep going to
+// the end of the file.
+func (b *Bitcask) Backup(dir string) (*Manifest, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, ManifestName)); err == nil {
+		return nil, fmt.Errorf("%s already holds a backup", dir)
+	}
+
+	// Seal the snapshot: writeMu keeps the committer and merges out while the
+	// offset is read and the file is opened, so the offset is a commit boundary
+	// of the file we hold. A later merge renames a new file over the path but
+	// our descriptor keeps the old one alive.
+	b.writeMu.Lock()
+	select {
+	case <-b.closed:
+		b.writeMu.Unlock()
+		return nil, ErrClosed
+	default:
+	}
+	file, err := os.Open(b.dbPath)
+	size := int64(b.offset)
+	keys := b.keyDir.Len()
+	b.writeMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database file: %w", err)
+	}
+	defer file.Close()
+
+	name := filepath.Base(b.dbPath)
+	checksum, err := copyFile(filepath.Join(dir, name), io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return nil, fmt.Errorf("error copying database file: %w", err)
+	}
+
+	manifest := &Manifest{
+		CreatedAt:     time.Now().UTC(),
+		FormatVersion: formatVersion,
+		Keys:          keys,
+		Files:         []ManifestFile{{Name: name, Size: size, SHA256: checksum}},
+	}
+	if err := writeManifest(dir, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// VerifyBackup checks every file of the backup in dir against the manifest.
+func VerifyBackup(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: invalid manifest: %v", ErrBackupCorrupt, err)
+	}
+	if manifest.FormatVersion != formatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, manifest.FormatVersion)
+	}
+	if len(manifest.Files) != 1 {
+		return nil, fmt.Errorf("%w: expected 1 data file, found %d", ErrBackupCorrupt, len(manifest.Files))
+	}
+
+	for _, mf := range manifest.Files {
+		if mf.Name != filepath.Base(mf.Name) {
+			return nil, fmt.Errorf("%w: invalid file name %q", ErrBackupCorrupt, mf.Name)
+		}
+		file, err := os.Open(filepath.Join(dir, mf.Name))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBackupCorrupt, err)
+		}
+		hash := sha256.New()
+		n, err := io.Copy(hash, file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		if n != mf.Size || hex.EncodeToString(hash.Sum(nil)) != mf.SHA256 {
+			return nil, fmt.Errorf("%w: checksum mismatch for %s", ErrBackupCorrupt, mf.Name)
+		}
+	}
+	return &manifest, nil
+}
+
+// Restore verifies the backup in dir and installs it at dbPath. The database
+// must not be open. An existing file at dbPath is replaced atomically, only
+// once the restored copy has been verified and synced.
+func Restore(dir, dbPath string) (*Manifest, error) {
+	manifest, err := VerifyBackup(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := os.Open(filepath.Join(dir, manifest.Files[0].Name))
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	// checksum the copy itself, not just the source
+	restorePath := dbPath + ".restore"
+	checksum, err := copyFile(restorePath, source)
+	if err != nil {
+		os.Remove(restorePath)
+		return nil, fmt.Errorf("error copying backup: %w", err)
+	}
+	if checksum != manifest.Files[0].SHA256 {
+		os.Remove(restorePath)
+		return nil, fmt.Errorf("%w: restored copy differs from the backup", ErrBackupCorrupt)
+	}
+	if err := os.Rename(restorePath, dbPath); err != nil {
+		os.Remove(restorePath)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// copyFile writes everything from r to a new file at path, syncs it and
+// returns the hex SHA-256 of what was written.
+func copyFile(path string, r io.Reader) (string, error) {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), r); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeManifest atomically writes the manifest to dir.
+func writeManifest(dir string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dir, ManifestName+".tmp")
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, ManifestName)); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// maxGroupCommit caps how many queued writes share a single write and fsync.
+const maxGroupCommit = 256
+
+// WriteBatch collects puts and deletes that are committed atomically: after a
+// crash either every operation of the batch is visible or none is.
+type WriteBatch struct {
+	entries []*Entry
+}
+
+// NewWriteBatch creates an empty batch.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put adds a write of key to the batch.
+func (wb *WriteBatch) Put(key, value []byte) {
+	wb.entries = append(wb.entries, NewEntry(key, value))
+}
+
+// PutWithTTL adds a write of key that expires after ttl to the batch.
+func (wb *WriteBatch) PutWithTTL(key, value []byte, ttl time.Duration) {
+	wb.entries = append(wb.entries, NewEntryWithTTL(key, value, ttl))
+}
+
+// Delete adds a delete of key to the batch. Deleting a missing key is a no-op.
+func (wb *WriteBatch) Delete(key []byte) {
+	wb.entries = append(wb.entries, NewTombstone(key))
+}
+
+// Len returns the number of operations in the batch.
+func (wb *WriteBatch) Len() int {
+	return len(wb.entries)
+}
+
+// Reset empties the batch so it can be reused.
+func (wb *WriteBatch) Reset() {
+	wb.entries = wb.entries[:0]
+}
+
+// Write commits the batch atomically.
+func (b *Bitcask) Write(wb *WriteBatch) error {
+	if wb.Len() == 0 {
+		return nil
+	}
+	return b.commit(wb.entries, true)
+}
+
+// newBatchMarker creates the entry written in front of a batch of count
+// entries. On recovery a batch whose entries don't all make it to disk is
+// discarded as a whole.
+func newBatchMarker(count int) *Entry {
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, uint32(count))
+	entry := NewEntry(nil, value)
+	entry.Flags = FlagBatch
+	return entry
+}
+
+// batchCount returns the number of entries announced by a batch marker.
+func batchCount(e *Entry) (int, error) {
+	if len(e.Value) != 4 {
+		return 0, fmt.Errorf("%w: invalid batch marker", ErrCorruptFile)
+	}
+	return int(binary.LittleEndian.Uint32(e.Value)), nil
+}
+
+// commitRequest is a write waiting for the committer goroutine.
+type commitRequest struct {
+	entries []*Entry
+	batch   bool
+	done    chan error
+}
+
+// commit hands the entries to the committer and waits until they are written
+// (and synced, depending on the sync policy).
+func (b *Bitcask) commit(entries []*Entry, batch bool) error {
+	req := &commitRequest{entries: entries, batch: batch, done: make(chan error, 1)}
+	select {
+	case b.commits <- req:
+	case <-b.closed:
+		return ErrClosed
+	}
+	return <-req.done
+}
+
+// runCommitter is the only goroutine appending to the active file.
+// Requests that queue up while a write and fsync are in flight are committed
+// together in the next round, so concurrent writers share one fsync (group
+// commit) instead of paying for one each.
+func (b *Bitcask) runCommitter() {
+	defer b.wg.Done()
+	for {
+		var req *commitRequest
+		select {
+		case req = <-b.commits:
+		case <-b.closed:
+			return
+		}
+
+		reqs := []*commitRequest{req}
+	drain:
+		for len(reqs) < maxGroupCommit {
+			select {
+			case req := <-b.commits:
+				reqs = append(reqs, req)
+			default:
+				break drain
+			}
+		}
+
+		errs := b.writeGroup(reqs)
+		for i, req := range reqs {
+			req.done <- errs[i]
+		}
+	}
+}
+
+// keyDirUpdate is a change to apply to the KeyDir once a group is on disk.
+type keyDirUpdate struct {
+	key       string
+	entry     KeyDirEntry
+	tombstone bool
+}
+
+// writeGroup appends the entries of every request with a single write, syncs
+// according to the policy and then publishes the new positions in the KeyDir.
+// Each request is encoded on its own first, so one that fails to encode only
+// fails its writer. It returns the error of each request.
+func (b *Bitcask) writeGroup(reqs []*commitRequest) []error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
+	errs := make([]error, len(reqs))
+	var buf bytes.Buffer
+	var updates []keyDirUpdate
+	offset := b.offset
+	for i, req := range reqs {
+		encoded, reqUpdates, err := b.encodeRequest(req, offset)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		buf.Write(encoded)
+		updates = append(updates, reqUpdates...)
+		offset += uint64(len(encoded))
+	}
+
+	if buf.Len() == 0 {
+		return errs
+	}
+	// failWritten fails the requests that were part of the write
+	failWritten := func(err error) []error {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs
+	}
+	if _, err := b.activeFile.Write(buf.Bytes()); err != nil {
+		// drop whatever part of the group made it to the file
+		b.activeFile.Truncate(int64(b.offset))
+		return failWritten(fmt.Errorf("error writing to database file: %w", err))
+	}
+	if b.opts.SyncPolicy == SyncAlways {
+		if err := b.activeFile.Sync(); err != nil {
+			b.activeFile.Truncate(int64(b.offset))
+			return failWritten(fmt.Errorf("error syncing database file: %w", err))
+		}
+	}
+
+	// publish the whole group at once so readers never see half a batch
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, update := range updates {
+		if update.tombstone {
+			b.keyDir.Delete(update.key)
+		} else {
+			b.keyDir.Put(update.key, update.entry)
+		}
+	}
+	b.offset = offset
+
+	return errs
+}
+
+// encodeRequest encodes the entries of the request, preceded by a marker for
+// a batch, as they are written at offset. It returns the bytes to write and
+// the KeyDir updates to apply once they are on disk.
+func (b *Bitcask) encodeRequest(req *commitRequest, offset uint64) ([]byte, []keyDirUpdate, error) {
+	var buf bytes.Buffer
+	var updates []keyDirUpdate
+
+	appendEntry := func(entry *Entry) error {
+		encoded, err := entry.Encode()
+		if err != nil {
+			return fmt.Errorf("error encoding entry: %w", err)
+		}
+		buf.Write(encoded)
+		offset += uint64(len(encoded))
+		return nil
+	}
+
+	if req.batch {
+		if err := appendEntry(newBatchMarker(len(req.entries))); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, entry := range req.entries {
+		// compress and encrypt the value, the caller's entry is left as is
+		entry, err := b.codec.encode(entry)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error encoding value: %w", err)
+		}
+		// Value position = entry position + header + key length
+		valuePos := offset + entry.valueOffset()
+		if err := appendEntry(entry); err != nil {
+			return nil, nil, err
+		}
+		updates = append(updates, keyDirUpdate{
+			key: string(entry.Key),
+			entry: KeyDirEntry{
+				FileID:    b.fileID,
+				ValuePos:  valuePos,
+				ValueSize: entry.ValueLength,
+				Timestamp: entry.Timestamp,
+				Expiry:    entry.Expiry,
+				Flags:     entry.Flags,
+			},
+			tombstone: entry.IsTombstone(),
+		})
+	}
+	return buf.Bytes(), updates, nil
+}
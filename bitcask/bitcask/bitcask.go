@@ -1,27 +1,62 @@
 package bitcask
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"sync"
+	"time"
 )
 
 var (
-	ErrKeyNotFound      = errors.New("key not found")
-	ErrChecksumMismatch = errors.New("checksum mismatch")
-	ErrCorruptFile      = errors.New("corrupt file")
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrChecksumMismatch   = errors.New("checksum mismatch")
+	ErrCorruptFile        = errors.New("corrupt file")
+	ErrClosed             = errors.New("database is closed")
+	ErrInvalidTTL         = errors.New("ttl must be positive")
+	ErrLegacyFormat       = errors.New("database file uses the v1 format, run migrate first")
+	ErrUnsupportedVersion = errors.New("unsupported file format version")
 )
 
 type Bitcask struct {
 	dbPath     string
+	opts       Options
 	keyDir     *KeyDir
 	activeFile *os.File // Keep active file open for writes
 	fileID     uint32   // Current active file ID
+	offset     uint64   // Size of the active file, where the next entry goes
+	codec      *valueCodec
+
+	// mu serialises writers and merges against readers so the database can
+	// be shared between goroutines (e.g. the connections of the server).
+	mu sync.RWMutex
+	// writeMu is held by whoever appends to or replaces the active file: the
+	// committer, the background syncer, Merge and Close.
+	writeMu sync.Mutex
+
+	commits   chan *commitRequest
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
+// NewBitcask opens the database with the default options.
 func NewBitcask(dbPath string) (*Bitcask, error) {
-	b := &Bitcask{dbPath: dbPath, keyDir: NewKeyDir()}
+	return Open(dbPath, DefaultOptions())
+}
+
+// Open opens (or creates) the database at dbPath.
+func Open(dbPath string, opts Options) (*Bitcask, error) {
+	b := &Bitcask{
+		dbPath:  dbPath,
+		opts:    opts,
+		keyDir:  NewKeyDir(),
+		commits: make(chan *commitRequest),
+		closed:  make(chan struct{}),
+	}
 
 	// Load existing data into KeyDir
 	err := b.loadKeyDir()
@@ -30,9 +65,33 @@ func NewBitcask(dbPath string) (*Bitcask, error) {
 	}
 
 	// Open active file for writing
-	// ...
+	b.activeFile, err = os.OpenFile(b.dbPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database file: %w", err)
+	}
+
+	// A new file starts with the file header
+	if b.offset == 0 {
+		if b.codec == nil {
+			b.codec, err = newValueCodec(opts.Encoding, newSalt())
+			if err != nil {
+				b.activeFile.Close()
+				return nil, err
+			}
+		}
+		if _, err := b.activeFile.Write(encodeFileHeader(b.codec.salt)); err != nil {
+			b.activeFile.Close()
+			return nil, fmt.Errorf("error writing file header: %w", err)
+		}
+		b.offset = fileHeaderSize
+	}
 
-	fmt.Printf("KeyDir: %+v\n", b.keyDir)
+	b.wg.Add(1)
+	go b.runCommitter()
+	if opts.SyncPolicy == SyncInterval && opts.SyncInterval > 0 {
+		b.wg.Add(1)
+		go b.runSyncer()
+	}
 
 	return b, nil
 }
@@ -49,221 +108,411 @@ func (b *Bitcask) loadKeyDir() error {
 	}
 	defer file.Close()
 
-	var offset uint64 = 0
+	reader := bufio.NewReader(file)
+	if _, err := reader.Peek(1); err == io.EOF {
+		// empty file, the header is written when it is opened for writing
+		return nil
+	}
+	salt, err := readFileHeader(reader)
+	if err != nil {
+		return err
+	}
+	b.codec, err = newValueCodec(b.opts.Encoding, salt)
+	if err != nil {
+		return err
+	}
+
+	// The first encrypted value tells whether the passphrase is right, a
+	// wrong one is reported here rather than by every Get
+	verified := false
+	verify := func(entry *Entry) error {
+		if verified || entry.Flags&FlagEncrypted == 0 {
+			return nil
+		}
+		if _, err := b.codec.decode(entry.Key, entry.Flags, entry.Value); err != nil {
+			return err
+		}
+		verified = true
+		return nil
+	}
+
+	var offset uint64 = fileHeaderSize
 	for {
 		// Remember position BEFORE reading entry
 		entryPos := offset
-		entry, err := DecodeEntry(file)
+		entry, err := DecodeEntry(reader)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
+			if err == io.ErrUnexpectedEOF {
+				// a write torn by a crash, drop the partial entry
+				return b.truncateTail(entryPos)
+			}
 			return fmt.Errorf("error decoding entry: %w", err)
 		}
+		offset += entry.Size()
 
-		// Calculate where the VALUE starts
-		// Entry format: [CRC:4][Timestamp:4][KeyLen:4][ValLen:4][Key:n][Value:m]
-		// Value starts at: entryPos + 16 + keyLength
-		valuePos := uint64(entryPos) + 16 + uint64(entry.KeyLength)
-
-		// Check if this is a tombstone
-		if entry.IsTombstone() {
-			// Remove from KeyDir (key was deleted)
-			b.keyDir.Delete(string(entry.Key))
-		} else {
-			// Normal entry - add/update KeyDir
-			// Add to KeyDir
-			b.keyDir.Put(string(entry.Key), KeyDirEntry{
-				FileID:    b.fileID,
-				ValuePos:  valuePos,
-				ValueSize: uint32(entry.ValueLength),
-				Timestamp: entry.Timestamp,
-			})
+		if !entry.IsBatchMarker() {
+			if err := verify(entry); err != nil {
+				return err
+			}
+			b.applyEntry(entry, entryPos)
+			continue
 		}
 
-		// Move to next entry
-		offset += uint64(16 + entry.KeyLength + entry.ValueLength)
+		// A batch is only applied once every one of its entries has been read
+		count, err := batchCount(entry)
+		if err != nil {
+			return err
+		}
+		batch := make([]*Entry, 0, count)
+		positions := make([]uint64, 0, count)
+		for i := 0; i < count; i++ {
+			batchEntry, err := DecodeEntry(reader)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// the batch didn't make it to disk entirely, discard all of it
+				return b.truncateTail(entryPos)
+			}
+			if err != nil {
+				return fmt.Errorf("error decoding batch entry: %w", err)
+			}
+			batch = append(batch, batchEntry)
+			positions = append(positions, offset)
+			offset += batchEntry.Size()
+		}
+		for i, batchEntry := range batch {
+			if err := verify(batchEntry); err != nil {
+				return err
+			}
+			b.applyEntry(batchEntry, positions[i])
+		}
 	}
 
+	b.offset = offset
 	return nil
 }
 
-func (b *Bitcask) Set(key, value string) error {
-	dbFile, err := os.OpenFile(b.dbPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-	if err != nil {
-		return fmt.Errorf("error opening database file: %w", err)
-	}
-	defer dbFile.Close()
-
-	// Get current file position (where entry will be written)
-	entryPos, err := dbFile.Seek(0, io.SeekEnd)
-	if err != nil {
-		return fmt.Errorf("error seeking to end of database file: %w", err)
-	}
-
-	entry := NewEntry([]byte(key), []byte(value))
-	encoded, err := entry.Encode()
-	if err != nil {
-		return fmt.Errorf("error encoding entry: %w", err)
-	}
-
-	_, err = dbFile.Write(encoded)
-	if err != nil {
-		return fmt.Errorf("error writing to database file: %w", err)
+// applyEntry replays an entry read from the log at entryPos into the KeyDir.
+func (b *Bitcask) applyEntry(entry *Entry, entryPos uint64) {
+	// Check if this is a tombstone, or the latest value already expired
+	if entry.IsTombstone() || entry.IsExpired(time.Now()) {
+		// Remove from KeyDir (key was deleted)
+		b.keyDir.Delete(string(entry.Key))
+		return
 	}
 
-	// Update KeyDir
-	// Value position = entry position + 16 (header) + key length
-	valuePos := uint64(entryPos) + 16 + uint64(entry.KeyLength)
-	b.keyDir.Put(key, KeyDirEntry{
+	// Calculate where the VALUE starts
+	// Entry format: [CRC:4][Timestamp:8][Flags:1][Expiry:8][KeyLen:4][ValLen:4][Key:n][Value:m]
+	// Value starts at: entryPos + 29 + keyLength
+	valuePos := entryPos + entry.valueOffset()
+	b.keyDir.Put(string(entry.Key), KeyDirEntry{
 		FileID:    b.fileID,
 		ValuePos:  valuePos,
 		ValueSize: entry.ValueLength,
 		Timestamp: entry.Timestamp,
+		Expiry:    entry.Expiry,
+		Flags:     entry.Flags,
 	})
+}
 
-	return dbFile.Sync()
+// truncateTail cuts the log at offset, dropping an entry or a batch that was
+// only partially written when the process crashed.
+func (b *Bitcask) truncateTail(offset uint64) error {
+	log.Printf("bitcask: discarding incomplete write at offset %d", offset)
+	if err := os.Truncate(b.dbPath, int64(offset)); err != nil {
+		return fmt.Errorf("error truncating database file: %w", err)
+	}
+	b.offset = offset
+	return nil
 }
 
-func (b *Bitcask) Get(key string) (string, error) {
-	// O(1) lookup in KeyDir
-	kdEntry, exists := b.keyDir.Get(key)
-	if !exists {
-		return "", fmt.Errorf("key not found")
+func (b *Bitcask) Set(key, value []byte) error {
+	return b.commit([]*Entry{NewEntry(key, value)}, false)
+}
+
+// SetWithTTL sets the key to a value that expires after ttl. Expired keys are
+// treated as missing and are dropped by the next merge.
+func (b *Bitcask) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
 	}
+	return b.commit([]*Entry{NewEntryWithTTL(key, value, ttl)}, false)
+}
 
-	// Open file and seek directly to value
-	dbFile, err := os.Open(b.dbPath)
-	if err != nil {
-		return "", err
+func (b *Bitcask) Get(key []byte) ([]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	// O(1) lookup in KeyDir
+	kdEntry, exists := b.keyDir.Get(string(key))
+	if !exists || kdEntry.IsExpired(time.Now()) {
+		return nil, ErrKeyNotFound
 	}
-	defer dbFile.Close()
 
-	// Seek to value position
-	_, err = dbFile.Seek(int64(kdEntry.ValuePos), io.SeekStart)
+	// Read the value directly at its position and undo its encoding
+	return b.readValue(key, kdEntry)
+}
+
+// readValue reads the value of key and decodes it with the active codec.
+func (b *Bitcask) readValue(key []byte, kdEntry KeyDirEntry) ([]byte, error) {
+	value, err := readValue(b.activeFile, kdEntry)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return b.codec.decode(key, kdEntry.Flags, value)
+}
 
-	// Read exactly ValueSize bytes
+// readValue reads exactly ValueSize bytes at the value position.
+func readValue(r io.ReaderAt, kdEntry KeyDirEntry) ([]byte, error) {
 	value := make([]byte, kdEntry.ValueSize)
-	_, err = io.ReadFull(dbFile, value)
+	_, err := r.ReadAt(value, int64(kdEntry.ValuePos))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	return string(value), nil
+	return value, nil
 }
 
-func (b *Bitcask) Delete(key string) error {
-	_, exists := b.keyDir.Get(key)
-	if !exists {
+func (b *Bitcask) Delete(key []byte) error {
+	if !b.Exists(key) {
 		return ErrKeyNotFound
 	}
 
-	// Write tombstone entry to disk
-	dbFile, err := os.OpenFile(b.dbPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-	if err != nil {
-		return err
+	// Write tombstone entry to disk, the committer removes it from the KeyDir
+	return b.commit([]*Entry{NewTombstone(key)}, false)
+}
+
+// Exists reports whether the key is present in the database and not expired.
+func (b *Bitcask) Exists(key []byte) bool {
+	kdEntry, exists := b.keyDir.Get(string(key))
+	return exists && !kdEntry.IsExpired(time.Now())
+}
+
+// TTL returns how long the key has left before it expires, ok is false when
+// the key has no expiry.
+func (b *Bitcask) TTL(key []byte) (ttl time.Duration, ok bool, err error) {
+	now := time.Now()
+	kdEntry, exists := b.keyDir.Get(string(key))
+	if !exists || kdEntry.IsExpired(now) {
+		return 0, false, ErrKeyNotFound
 	}
-	defer dbFile.Close()
+	if kdEntry.Expiry == 0 {
+		return 0, false, nil
+	}
+	return time.Duration(int64(kdEntry.Expiry) - now.UnixNano()), true, nil
+}
 
-	tombstone := NewTombstone([]byte(key))
-	encoded, err := tombstone.Encode()
-	if err != nil {
-		return err
+// Len returns the number of keys, expired keys count until they are merged away.
+func (b *Bitcask) Len() int {
+	return b.keyDir.Len()
+}
+
+// Keys returns all the live keys in ascending order.
+func (b *Bitcask) Keys() [][]byte {
+	return toBytes(b.keyDir.Keys())
+}
+
+// PrefixScan returns the live keys starting with prefix in ascending order.
+func (b *Bitcask) PrefixScan(prefix []byte) [][]byte {
+	return toBytes(b.keyDir.PrefixScan(string(prefix)))
+}
+
+// Range returns the live keys in [start, end) in ascending order, an empty end
+// means there is no upper bound.
+func (b *Bitcask) Range(start, end []byte) [][]byte {
+	return toBytes(b.keyDir.Range(string(start), string(end)))
+}
+
+// Fold calls fn for every live key and its value in ascending key order,
+// stopping at the first error fn returns. Writers are blocked while folding,
+// so fn must not call back into the database.
+func (b *Bitcask) Fold(fn func(key, value []byte) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, key := range b.keyDir.Keys() {
+		kdEntry, _ := b.keyDir.Get(key)
+		value, err := b.readValue([]byte(key), kdEntry)
+		if err != nil {
+			return fmt.Errorf("error reading value of %q: %w", key, err)
+		}
+		if err := fn([]byte(key), value); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	_, err = dbFile.Write(encoded)
-	if err != nil {
-		return err
+func toBytes(keys []string) [][]byte {
+	result := make([][]byte, len(keys))
+	for i, key := range keys {
+		result[i] = []byte(key)
 	}
+	return result
+}
 
-	// Remove from KeyDir
-	b.keyDir.Delete(key)
+// Merge compacts the database, rewriting the live keys with the current
+// encoding.
+func (b *Bitcask) Merge() error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	return b.merge(b.opts.Encoding)
+}
 
-	return dbFile.Sync()
+// MergeWithEncoding compacts the database and rewrites every value with enc,
+// e.g. to change the compression or the passphrase. Later writes use enc too.
+func (b *Bitcask) MergeWithEncoding(enc Encoding) error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	return b.merge(enc)
 }
 
-func (b *Bitcask) Merge() error {
-	// 1. create merge file
-	mergeFile, err := os.Create(b.dbPath + ".merge")
+// merge must be called with writeMu held, which keeps the committer out
+// while the active file is replaced.
+func (b *Bitcask) merge(enc Encoding) error {
+	// the merged file gets a new salt, so a new key when encrypted
+	codec, err := newValueCodec(enc, newSalt())
 	if err != nil {
 		return err
 	}
 
-	// 2. Open original database file
-	oldFile, err := os.Open(b.dbPath)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// 1. create merge file
+	mergePath := b.dbPath + ".merge"
+	mergeFile, err := os.Create(mergePath)
 	if err != nil {
-		mergeFile.Close()
 		return err
 	}
+	writer := bufio.NewWriter(mergeFile)
+	writer.Write(encodeFileHeader(codec.salt))
 
-	// 3. Track position in new file
-	var newOffset uint64 = 0
+	// 2. Track position in new file, after the file header
+	var newOffset uint64 = fileHeaderSize
+	merged := make(map[string]KeyDirEntry, b.keyDir.Len())
 
-	// 4. Iterate over all keys in KeyDir
-	for key, kdEntry := range b.keyDir.Entries {
-		// Read value from old file
-		_, err := oldFile.Seek(int64(kdEntry.ValuePos), io.SeekStart)
-		if err != nil {
-			oldFile.Close()
-			mergeFile.Close()
-			return fmt.Errorf("error seeking to value position: %w", err)
-		}
+	// 3. Drop the expired keys, they are not copied to the merged file
+	b.keyDir.DeleteExpired(time.Now())
 
-		// Read value
-		value := make([]byte, kdEntry.ValueSize)
-		_, err = io.ReadFull(oldFile, value)
+	// 4. Iterate over all keys in KeyDir, in order
+	for _, key := range b.keyDir.Keys() {
+		kdEntry, _ := b.keyDir.Get(key)
+
+		// Read and decode the value from the active file
+		value, err := b.readValue([]byte(key), kdEntry)
 		if err != nil {
-			oldFile.Close()
 			mergeFile.Close()
+			os.Remove(mergePath)
 			return fmt.Errorf("error reading value: %w", err)
 		}
 
-		// create new entry
+		// create new entry, keeping its expiry, and encode it again
 		entry := NewEntry([]byte(key), value)
+		entry.Expiry = kdEntry.Expiry
+		entry, err = codec.encode(entry)
+		if err != nil {
+			mergeFile.Close()
+			os.Remove(mergePath)
+			return fmt.Errorf("error encoding value: %w", err)
+		}
 		encoded, err := entry.Encode()
 		if err != nil {
-			oldFile.Close()
 			mergeFile.Close()
+			os.Remove(mergePath)
 			return fmt.Errorf("error encoding entry: %w", err)
 		}
 
 		// write entry to merge file
-		_, err = mergeFile.Write(encoded)
-		if err != nil {
-			oldFile.Close()
+		if _, err := writer.Write(encoded); err != nil {
 			mergeFile.Close()
+			os.Remove(mergePath)
 			return fmt.Errorf("error writing entry to merge file: %w", err)
 		}
 
-		// update KeyDir
-		b.keyDir.Put(key, KeyDirEntry{
+		// the value starts after the header and the key
+		merged[key] = KeyDirEntry{
 			FileID:    b.fileID,
-			ValuePos:  newOffset,
+			ValuePos:  newOffset + entry.valueOffset(),
 			ValueSize: entry.ValueLength,
 			Timestamp: entry.Timestamp,
-		})
+			Expiry:    entry.Expiry,
+			Flags:     entry.Flags,
+		}
 
 		// update new offset
 		newOffset += uint64(len(encoded))
 	}
-	// 5. Close files
-	oldFile.Close()
-	mergeFile.Sync()
+
+	// 5. Flush and close the merge file
+	if err := writer.Flush(); err != nil {
+		mergeFile.Close()
+		os.Remove(mergePath)
+		return fmt.Errorf("error writing merge file: %w", err)
+	}
+	if err := mergeFile.Sync(); err != nil {
+		mergeFile.Close()
+		os.Remove(mergePath)
+		return fmt.Errorf("error syncing merge file: %w", err)
+	}
 	mergeFile.Close()
 
-	// 6. Replace old file with merge file
-	err = os.Remove(b.dbPath)
-	if err != nil {
-		return fmt.Errorf("failed to remove old database file: %w", err)
+	// 6. Replace old file with merge file (rename is atomic)
+	if err := os.Rename(mergePath, b.dbPath); err != nil {
+		return fmt.Errorf("failed to rename merge file: %w", err)
 	}
 
-	err = os.Rename(b.dbPath+".merge", b.dbPath)
+	// 7. Reopen the active file and point the KeyDir at the merged entries
+	activeFile, err := os.OpenFile(b.dbPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to rename merge file: %w", err)
+		return fmt.Errorf("error opening database file: %w", err)
+	}
+	b.activeFile.Close()
+	b.activeFile = activeFile
+	b.offset = newOffset
+	b.codec = codec
+	b.opts.Encoding = enc
+	for key, kdEntry := range merged {
+		b.keyDir.Put(key, kdEntry)
 	}
 
 	return nil
 }
+
+// runSyncer flushes the active file every SyncInterval.
+func (b *Bitcask) runSyncer() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.writeMu.Lock()
+			if err := b.activeFile.Sync(); err != nil {
+				log.Printf("bitcask: error syncing database file: %v", err)
+			}
+			b.writeMu.Unlock()
+		case <-b.closed:
+			return
+		}
+	}
+}
+
+// Close waits for the pending writes, syncs and closes the database.
+func (b *Bitcask) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		b.wg.Wait()
+
+		b.writeMu.Lock()
+		defer b.writeMu.Unlock()
+		if syncErr := b.activeFile.Sync(); syncErr != nil {
+			err = fmt.Errorf("error syncing database file: %w", syncErr)
+		}
+		if closeErr := b.activeFile.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
@@ -0,0 +1,523 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T, path string) *Bitcask {
+	t.Helper()
+	db, err := NewBitcask(path)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	return db
+}
+
+func assertValue(t *testing.T, db *Bitcask, key, expected string) {
+	t.Helper()
+	value, err := db.Get([]byte(key))
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	if string(value) != expected {
+		t.Errorf("Get(%q) = %q, expected %q", key, value, expected)
+	}
+}
+
+func assertMissing(t *testing.T, db *Bitcask, key string) {
+	t.Helper()
+	if _, err := db.Get([]byte(key)); err != ErrKeyNotFound {
+		t.Errorf("Get(%q): expected ErrKeyNotFound, got %v", key, err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	db.Set([]byte("name"), []byte("Islam"))
+	db.Set([]byte("city"), []byte("Cairo"))
+	db.Set([]byte("name"), []byte("Ghany"))
+	db.Delete([]byte("city"))
+	db.Close()
+
+	db = openTestDB(t, path)
+	defer db.Close()
+	assertValue(t, db, "name", "Ghany")
+	assertMissing(t, db, "city")
+}
+
+func TestMerge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	for i := 0; i < 10; i++ {
+		db.Set([]byte("counter"), []byte(fmt.Sprint(i)))
+	}
+	db.Set([]byte("name"), []byte("Islam"))
+	db.Set([]byte("gone"), []byte("soon"))
+	db.Delete([]byte("gone"))
+
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	// the KeyDir must point into the merged file without reopening
+	assertValue(t, db, "counter", "9")
+	assertValue(t, db, "name", "Islam")
+	assertMissing(t, db, "gone")
+
+	// and writes keep appending to it
+	db.Set([]byte("after"), []byte("merge"))
+	db.Close()
+
+	db = openTestDB(t, path)
+	defer db.Close()
+	assertValue(t, db, "counter", "9")
+	assertValue(t, db, "after", "merge")
+}
+
+func TestWriteBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	db.Set([]byte("a"), []byte("1"))
+
+	batch := NewWriteBatch()
+	batch.Put([]byte("b"), []byte("2"))
+	batch.Put([]byte("c"), []byte("3"))
+	batch.Delete([]byte("a"))
+	if err := db.Write(batch); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	assertMissing(t, db, "a")
+	assertValue(t, db, "b", "2")
+	db.Close()
+
+	db = openTestDB(t, path)
+	defer db.Close()
+	assertMissing(t, db, "a")
+	assertValue(t, db, "b", "2")
+	assertValue(t, db, "c", "3")
+}
+
+func TestGroupWithAnEntryFailingToEncode(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	// values from 100 bytes fail to compress
+	db.codec = &valueCodec{compression: Compression(99), threshold: 100}
+
+	reqs := []*commitRequest{
+		{entries: []*Entry{NewEntry([]byte("a"), []byte("1"))}},
+		{entries: []*Entry{NewEntry([]byte("b"), []byte("2")), NewEntry([]byte("big"), make([]byte, 100))}, batch: true},
+		{entries: []*Entry{NewEntry([]byte("c"), []byte("3"))}},
+	}
+	errs := db.writeGroup(reqs)
+	if errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Fatalf("expected only the batch with the big value to fail, got %v", errs)
+	}
+	assertValue(t, db, "a", "1")
+	assertValue(t, db, "c", "3")
+	assertMissing(t, db, "b")
+	assertMissing(t, db, "big")
+}
+
+func TestPartialBatchIsDiscarded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	db.Set([]byte("before"), []byte("batch"))
+
+	batch := NewWriteBatch()
+	batch.Put([]byte("b"), []byte("2"))
+	batch.Put([]byte("c"), []byte("3"))
+	db.Write(batch)
+	db.Close()
+
+	// simulate a crash in the middle of the last entry of the batch
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, path)
+	assertValue(t, db, "before", "batch")
+	assertMissing(t, db, "b")
+	assertMissing(t, db, "c")
+
+	// the torn batch is cut off so new writes start on a clean tail
+	db.Set([]byte("after"), []byte("crash"))
+	db.Close()
+
+	db = openTestDB(t, path)
+	defer db.Close()
+	assertValue(t, db, "after", "crash")
+	assertMissing(t, db, "b")
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				key := fmt.Sprintf("key-%d-%d", i, j)
+				if err := db.Set([]byte(key), []byte(key)); err != nil {
+					t.Errorf("Set(%q): %v", key, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	db.Close()
+
+	db = openTestDB(t, path)
+	defer db.Close()
+	if db.Len() != 1000 {
+		t.Fatalf("expected 1000 keys, got %d", db.Len())
+	}
+	assertValue(t, db, "key-7-13", "key-7-13")
+}
+
+func BenchmarkSetParallel(b *testing.B) {
+	db, err := NewBitcask(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			db.Set([]byte(fmt.Sprint(i)), []byte("value"))
+			i++
+		}
+	})
+}
+
+func TestTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	db.Set([]byte("forever"), []byte("1"))
+	if err := db.SetWithTTL([]byte("short"), []byte("2"), 50*time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+	db.SetWithTTL([]byte("long"), []byte("3"), time.Hour)
+
+	assertValue(t, db, "short", "2")
+	if ttl, ok, _ := db.TTL([]byte("long")); !ok || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("unexpected TTL for long: %v %v", ttl, ok)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	assertMissing(t, db, "short")
+	if db.Exists([]byte("short")) {
+		t.Error("expected expired key to not exist")
+	}
+	if keys := db.Keys(); len(keys) != 2 || string(keys[0]) != "forever" || string(keys[1]) != "long" {
+		t.Errorf("expected expired key to be skipped, got %v", keys)
+	}
+
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	if db.Len() != 2 {
+		t.Errorf("expected merge to drop the expired key, got %d keys", db.Len())
+	}
+	db.Close()
+
+	db = openTestDB(t, path)
+	defer db.Close()
+	assertMissing(t, db, "short")
+	assertValue(t, db, "long", "3")
+	if _, ok, _ := db.TTL([]byte("long")); !ok {
+		t.Error("expected merge to keep the expiry of long")
+	}
+}
+
+func TestEmptyValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	// an empty value is a value, deletes are flagged explicitly
+	db.Set([]byte("empty"), []byte{})
+	db.Set([]byte("bin\x00key"), []byte("\x00\xff"))
+	db.Close()
+
+	db = openTestDB(t, path)
+	defer db.Close()
+	assertValue(t, db, "empty", "")
+	assertValue(t, db, "bin\x00key", "\x00\xff")
+}
+
+func TestEntryEncoding(t *testing.T) {
+	entry := NewEntryWithTTL([]byte("key"), []byte("value"), time.Minute)
+	encoded, _ := entry.Encode()
+	if len(encoded) != headerSize+3+5 {
+		t.Errorf("expected %d bytes, got %d", headerSize+3+5, len(encoded))
+	}
+	decoded, err := DecodeEntry(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("DecodeEntry: %v", err)
+	}
+	if decoded.Timestamp != entry.Timestamp || decoded.Expiry != entry.Expiry ||
+		string(decoded.Key) != "key" || string(decoded.Value) != "value" {
+		t.Errorf("expected %+v, got %+v", entry, decoded)
+	}
+
+	encoded[len(encoded)-1] ^= 0xff
+	if _, err := DecodeEntry(bytes.NewReader(encoded)); err != ErrChecksumMismatch {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+// encodeV1 encodes an entry in the v1 format, an expiry of 0 writes the
+// original entry version.
+func encodeV1(key, value string, expiry uint64) []byte {
+	headerLength := v1HeaderSize
+	keyField := uint32(len(key))
+	if expiry != 0 {
+		headerLength += v1ExpirySize
+		keyField |= v1EntryVersionTTL << v1VersionShift
+	}
+	buf := make([]byte, headerLength+len(key)+len(value))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(time.Now().Unix()))
+	binary.LittleEndian.PutUint32(buf[8:12], keyField)
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(len(value)))
+	if expiry != 0 {
+		binary.LittleEndian.PutUint64(buf[16:24], expiry)
+	}
+	copy(buf[headerLength:], key)
+	copy(buf[headerLength+len(key):], value)
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	later := uint64(time.Now().Add(time.Hour).UnixNano())
+	earlier := uint64(time.Now().Add(-time.Hour).UnixNano())
+
+	var v1 []byte
+	v1 = append(v1, encodeV1("name", "Islam", 0)...)
+	v1 = append(v1, encodeV1("city", "Cairo", 0)...)
+	v1 = append(v1, encodeV1("city", "", 0)...) // tombstone
+	v1 = append(v1, encodeV1("session", "abc", later)...)
+	v1 = append(v1, encodeV1("expired", "old", earlier)...)
+	// a batch of two entries that only made it half way to disk
+	marker := make([]byte, 4)
+	binary.LittleEndian.PutUint32(marker, 2)
+	v1 = append(v1, encodeV1(v1BatchMarkerKey, string(marker), 0)...)
+	v1 = append(v1, encodeV1("torn", "1", 0)...)
+	if err := os.WriteFile(path, v1, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewBitcask(path); !errors.Is(err, ErrLegacyFormat) {
+		t.Fatalf("expected ErrLegacyFormat, got %v", err)
+	}
+	if err := Migrate(path); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+
+	db := openTestDB(t, path)
+	defer db.Close()
+	assertValue(t, db, "name", "Islam")
+	assertValue(t, db, "session", "abc")
+	assertMissing(t, db, "city")
+	assertMissing(t, db, "expired")
+	assertMissing(t, db, "torn")
+	if ttl, ok, _ := db.TTL([]byte("session")); !ok || ttl <= 0 {
+		t.Errorf("expected the expiry to be migrated, got %v %v", ttl, ok)
+	}
+}
+
+// jsonBlob returns a large value that compresses well, like the JSON
+// documents values usually are.
+func jsonBlob(n int) string {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, `{"id":%d,"name":"user-%d","active":true,"tags":["a","b"]},`, i, i)
+	}
+	buf.WriteString("{}]")
+	return buf.String()
+}
+
+func TestCompression(t *testing.T) {
+	value := jsonBlob(200)
+	for _, compression := range []Compression{CompressionSnappy, CompressionFlate} {
+		t.Run(compression.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			opts := DefaultOptions()
+			opts.Compression = compression
+			db, err := Open(path, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Set([]byte("doc"), []byte(value))
+			db.Set([]byte("small"), []byte("tiny"))
+			db.Close()
+
+			info, _ := os.Stat(path)
+			if info.Size() >= int64(len(value)) {
+				t.Errorf("file is %d bytes, expected the %d byte value to be compressed", info.Size(), len(value))
+			}
+
+			// the flags in the entry header are enough to decode the values
+			db = openTestDB(t, path)
+			defer db.Close()
+			assertValue(t, db, "doc", value)
+			assertValue(t, db, "small", "tiny")
+		})
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	opts := DefaultOptions()
+	opts.Passphrase = "secret"
+	db, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("card"), []byte("4111-1111-1111-1111"))
+	db.Close()
+
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte("4111")) {
+		t.Error("the value is stored in plain text")
+	}
+
+	if _, err := NewBitcask(path); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("expected ErrPassphraseRequired, got %v", err)
+	}
+	wrong := opts
+	wrong.Passphrase = "guess"
+	if _, err := Open(path, wrong); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("expected ErrWrongPassphrase, got %v", err)
+	}
+
+	db, err = Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	assertValue(t, db, "card", "4111-1111-1111-1111")
+}
+
+func TestMergeWithEncoding(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	value := jsonBlob(100)
+	db := openTestDB(t, path)
+	db.Set([]byte("doc"), []byte(value))
+	db.Set([]byte("name"), []byte("Islam"))
+
+	enc := Encoding{Compression: CompressionFlate, Passphrase: "secret"}
+	if err := db.MergeWithEncoding(enc); err != nil {
+		t.Fatalf("MergeWithEncoding: %v", err)
+	}
+	assertValue(t, db, "doc", value)
+	// later writes use the new encoding as well
+	db.Set([]byte("after"), []byte("merge"))
+	db.Close()
+
+	if _, err := NewBitcask(path); !errors.Is(err, ErrPassphraseRequired) {
+		t.Fatalf("expected ErrPassphraseRequired, got %v", err)
+	}
+	opts := DefaultOptions()
+	opts.Encoding = enc
+	db, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	assertValue(t, db, "doc", value)
+	assertValue(t, db, "name", "Islam")
+	assertValue(t, db, "after", "merge")
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db := openTestDB(t, path)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		db.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprint(i)))
+	}
+
+	// writers keep going while the backup is taken
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			db.Set([]byte(fmt.Sprintf("late-%d", i)), []byte("x"))
+		}
+	}()
+
+	backupDir := filepath.Join(dir, "backup")
+	manifest, err := db.Backup(backupDir)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if _, err := db.Backup(backupDir); err == nil {
+		t.Error("expected a second backup into the same directory to fail")
+	}
+
+	restored := filepath.Join(dir, "restored.db")
+	if _, err := Restore(backupDir, restored); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	rdb := openTestDB(t, restored)
+	defer rdb.Close()
+	if rdb.Len() != manifest.Keys {
+		t.Errorf("restored %d keys, the manifest says %d", rdb.Len(), manifest.Keys)
+	}
+	assertValue(t, rdb, "key-000", "0")
+	assertValue(t, rdb, "key-099", "99")
+}
+
+func TestRestoreRejectsCorruptBackup(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, filepath.Join(dir, "test.db"))
+	db.Set([]byte("name"), []byte("Islam"))
+	backupDir := filepath.Join(dir, "backup")
+	manifest, err := db.Backup(backupDir)
+	db.Close()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+
+	// flip a byte of the value in the backup
+	backupFile := filepath.Join(backupDir, manifest.Files[0].Name)
+	data, _ := os.ReadFile(backupFile)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(backupFile, data, 0644)
+
+	restored := filepath.Join(dir, "restored.db")
+	if _, err := Restore(backupDir, restored); !errors.Is(err, ErrBackupCorrupt) {
+		t.Fatalf("expected ErrBackupCorrupt, got %v", err)
+	}
+	if _, err := os.Stat(restored); !os.IsNotExist(err) {
+		t.Error("a corrupt backup must not be restored")
+	}
+}
@@ -0,0 +1,272 @@
+package bitcask
+
+import "sort"
+
+// minDegree is the minimum degree of the B-tree: every node except the root
+// holds between minDegree-1 and 2*minDegree-1 keys.
+const minDegree = 32
+
+const maxKeys = 2*minDegree - 1
+
+// btree is an in-memory B-tree of keys. The KeyDir uses it as a secondary
+// ordered index next to its hash map, so keys can be listed in order and
+// scanned by prefix or range without sorting the whole map.
+type btree struct {
+	root   *btreeNode
+	length int
+}
+
+type btreeNode struct {
+	keys     []string
+	children []*btreeNode
+}
+
+func newBTree() *btree {
+	return &btree{}
+}
+
+// Len returns the number of keys in the tree.
+func (t *btree) Len() int {
+	return t.length
+}
+
+// Insert adds the key to the tree, it returns false if the key already exists.
+func (t *btree) Insert(key string) bool {
+	if t.root == nil {
+		t.root = &btreeNode{keys: []string{key}}
+		t.length++
+		return true
+	}
+	// split a full root first so insert never has to walk back up
+	if len(t.root.keys) == maxKeys {
+		old := t.root
+		t.root = &btreeNode{children: []*btreeNode{old}}
+		t.root.splitChild(0)
+	}
+	if !t.root.insert(key) {
+		return false
+	}
+	t.length++
+	return true
+}
+
+// Delete removes the key from the tree, it returns false if the key is missing.
+func (t *btree) Delete(key string) bool {
+	if t.root == nil {
+		return false
+	}
+	removed := t.root.remove(key)
+	// the root shrinks when its last key moved down into a merged child
+	if len(t.root.keys) == 0 {
+		if t.root.leaf() {
+			t.root = nil
+		} else {
+			t.root = t.root.children[0]
+		}
+	}
+	if removed {
+		t.length--
+	}
+	return removed
+}
+
+// Ascend calls fn for every key >= start in ascending order until fn returns
+// false.
+func (t *btree) Ascend(start string, fn func(key string) bool) {
+	if t.root == nil {
+		return
+	}
+	t.root.ascend(start, fn)
+}
+
+func (n *btreeNode) leaf() bool {
+	return len(n.children) == 0
+}
+
+// search returns the index of the first key >= key and whether it is equal.
+func (n *btreeNode) search(key string) (int, bool) {
+	i := sort.SearchStrings(n.keys, key)
+	return i, i < len(n.keys) && n.keys[i] == key
+}
+
+func (n *btreeNode) insert(key string) bool {
+	i, found := n.search(key)
+	if found {
+		return false
+	}
+	if n.leaf() {
+		n.keys = insertAt(n.keys, i, key)
+		return true
+	}
+	if len(n.children[i].keys) == maxKeys {
+		n.splitChild(i)
+		// the median moved up to position i, decide which half to descend
+		switch {
+		case key == n.keys[i]:
+			return false
+		case key > n.keys[i]:
+			i++
+		}
+	}
+	return n.children[i].insert(key)
+}
+
+// splitChild splits the full child at index i in two and moves its median
+// key up into n.
+func (n *btreeNode) splitChild(i int) {
+	child := n.children[i]
+	mid := minDegree - 1
+	median := child.keys[mid]
+
+	right := &btreeNode{keys: append([]string(nil), child.keys[mid+1:]...)}
+	if !child.leaf() {
+		right.children = append([]*btreeNode(nil), child.children[mid+1:]...)
+		child.children = child.children[: mid+1 : mid+1]
+	}
+	child.keys = child.keys[:mid:mid]
+
+	n.keys = insertAt(n.keys, i, median)
+	n.children = insertAt(n.children, i+1, right)
+}
+
+// remove deletes key from the subtree rooted at n. Before descending into a
+// child it makes sure the child has at least minDegree keys, so a key can
+// always be removed without walking back up the tree.
+func (n *btreeNode) remove(key string) bool {
+	i, found := n.search(key)
+	if n.leaf() {
+		if found {
+			n.keys = removeAt(n.keys, i)
+		}
+		return found
+	}
+
+	if found {
+		switch {
+		case len(n.children[i].keys) >= minDegree:
+			// replace the key with its predecessor
+			pred := n.children[i].max()
+			n.keys[i] = pred
+			return n.children[i].remove(pred)
+		case len(n.children[i+1].keys) >= minDegree:
+			// replace the key with its successor
+			succ := n.children[i+1].min()
+			n.keys[i] = succ
+			return n.children[i+1].remove(succ)
+		default:
+			n.merge(i)
+			return n.children[i].remove(key)
+		}
+	}
+
+	if len(n.children[i].keys) < minDegree {
+		i = n.fill(i)
+	}
+	return n.children[i].remove(key)
+}
+
+// fill grows the child at index i to at least minDegree keys by borrowing from
+// a sibling or merging with one. It returns the index of the child that now
+// covers the original key range.
+func (n *btreeNode) fill(i int) int {
+	switch {
+	case i > 0 && len(n.children[i-1].keys) >= minDegree:
+		n.borrowFromLeft(i)
+		return i
+	case i < len(n.children)-1 && len(n.children[i+1].keys) >= minDegree:
+		n.borrowFromRight(i)
+		return i
+	case i < len(n.children)-1:
+		n.merge(i)
+		return i
+	default:
+		n.merge(i - 1)
+		return i - 1
+	}
+}
+
+func (n *btreeNode) borrowFromLeft(i int) {
+	child, left := n.children[i], n.children[i-1]
+	last := len(left.keys) - 1
+
+	child.keys = insertAt(child.keys, 0, n.keys[i-1])
+	n.keys[i-1] = left.keys[last]
+	left.keys = left.keys[:last]
+
+	if !left.leaf() {
+		lastChild := len(left.children) - 1
+		child.children = insertAt(child.children, 0, left.children[lastChild])
+		left.children = left.children[:lastChild]
+	}
+}
+
+func (n *btreeNode) borrowFromRight(i int) {
+	child, right := n.children[i], n.children[i+1]
+
+	child.keys = append(child.keys, n.keys[i])
+	n.keys[i] = right.keys[0]
+	right.keys = removeAt(right.keys, 0)
+
+	if !right.leaf() {
+		child.children = append(child.children, right.children[0])
+		right.children = removeAt(right.children, 0)
+	}
+}
+
+// merge folds the key at index i and the child at i+1 into the child at i.
+func (n *btreeNode) merge(i int) {
+	left, right := n.children[i], n.children[i+1]
+	left.keys = append(left.keys, n.keys[i])
+	left.keys = append(left.keys, right.keys...)
+	left.children = append(left.children, right.children...)
+
+	n.keys = removeAt(n.keys, i)
+	n.children = removeAt(n.children, i+1)
+}
+
+func (n *btreeNode) min() string {
+	for !n.leaf() {
+		n = n.children[0]
+	}
+	return n.keys[0]
+}
+
+func (n *btreeNode) max() string {
+	for !n.leaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.keys[len(n.keys)-1]
+}
+
+// ascend walks the subtree in order starting at the first key >= start, it
+// returns false once fn asked to stop.
+func (n *btreeNode) ascend(start string, fn func(key string) bool) bool {
+	i, _ := n.search(start)
+	for ; i < len(n.keys); i++ {
+		if !n.leaf() && !n.children[i].ascend(start, fn) {
+			return false
+		}
+		if !fn(n.keys[i]) {
+			return false
+		}
+	}
+	if !n.leaf() {
+		return n.children[len(n.keys)].ascend(start, fn)
+	}
+	return true
+}
+
+func insertAt[T any](s []T, i int, v T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func removeAt[T any](s []T, i int) []T {
+	copy(s[i:], s[i+1:])
+	var zero T
+	s[len(s)-1] = zero
+	return s[:len(s)-1]
+}
@@ -0,0 +1,76 @@
+package bitcask
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestBTreeInsertDelete(t *testing.T) {
+	tree := newBTree()
+	expected := map[string]bool{}
+	rng := rand.New(rand.NewSource(1))
+
+	// random inserts and deletes, large enough to split and merge nodes
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key-%05d", rng.Intn(5000))
+		if rng.Intn(3) == 0 {
+			if tree.Delete(key) != expected[key] {
+				t.Fatalf("Delete(%q) disagrees with the expected set", key)
+			}
+			delete(expected, key)
+		} else {
+			if tree.Insert(key) == expected[key] {
+				t.Fatalf("Insert(%q) disagrees with the expected set", key)
+			}
+			expected[key] = true
+		}
+	}
+
+	want := make([]string, 0, len(expected))
+	for key := range expected {
+		want = append(want, key)
+	}
+	sort.Strings(want)
+
+	got := []string{}
+	tree.Ascend("", func(key string) bool {
+		got = append(got, key)
+		return true
+	})
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected %d ordered keys, got %d", len(want), len(got))
+	}
+	if tree.Len() != len(want) {
+		t.Errorf("expected length %d, got %d", len(want), tree.Len())
+	}
+}
+
+func TestKeyDirPrefixAndRange(t *testing.T) {
+	kd := NewKeyDir()
+	for _, key := range []string{"user:2", "order:1", "user:1", "user:10", "zebra", "apple"} {
+		kd.Put(key, KeyDirEntry{})
+	}
+	kd.Delete("user:10")
+
+	testCases := []struct {
+		name     string
+		got      []string
+		expected []string
+	}{
+		{"keys", kd.Keys(), []string{"apple", "order:1", "user:1", "user:2", "zebra"}},
+		{"prefix", kd.PrefixScan("user:"), []string{"user:1", "user:2"}},
+		{"missing prefix", kd.PrefixScan("nope"), []string{}},
+		{"range", kd.Range("b", "user:2"), []string{"order:1", "user:1"}},
+		{"open range", kd.Range("user:2", ""), []string{"user:2", "zebra"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if !slices.Equal(tc.got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, tc.got)
+			}
+		})
+	}
+}
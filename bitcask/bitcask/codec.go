@@ -0,0 +1,164 @@
+package bitcask
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	ErrPassphraseRequired = errors.New("database is encrypted, a passphrase is required")
+	ErrWrongPassphrase    = errors.New("wrong passphrase")
+)
+
+const (
+	saltSize = 16
+	// keyIterations is the PBKDF2 work factor for deriving the AES key from
+	// the passphrase, paid once per open.
+	keyIterations = 200_000
+)
+
+// valueCodec compresses and encrypts values on their way to disk and undoes
+// it on the way back. The flags it sets are stored in the entry header, so
+// every value is decoded the way it was written whatever the current options
+// are.
+type valueCodec struct {
+	compression Compression
+	threshold   int
+	salt        []byte
+	aead        cipher.AEAD // nil when encryption is off
+}
+
+// newValueCodec builds the codec for a data file, the encryption key is
+// derived from the passphrase and the salt of the file header.
+func newValueCodec(enc Encoding, salt []byte) (*valueCodec, error) {
+	c := &valueCodec{
+		compression: enc.Compression,
+		threshold:   enc.CompressionThreshold,
+		salt:        salt,
+	}
+	if enc.Passphrase == "" {
+		return c, nil
+	}
+	key, err := pbkdf2.Key(sha256.New, enc.Passphrase, salt, keyIterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving encryption key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	c.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newSalt returns a random salt for a new data file.
+func newSalt() []byte {
+	salt := make([]byte, saltSize)
+	rand.Read(salt)
+	return salt
+}
+
+// encode returns a copy of the entry with its value compressed and encrypted
+// according to the codec. Tombstones and batch markers are left alone.
+func (c *valueCodec) encode(entry *Entry) (*Entry, error) {
+	if entry.Flags&(FlagTombstone|FlagBatch) != 0 {
+		return entry, nil
+	}
+	encoded := *entry
+	if c.compression != CompressionNone && len(encoded.Value) >= c.threshold {
+		compressed, flag, err := compress(c.compression, encoded.Value)
+		if err != nil {
+			return nil, err
+		}
+		// keep the raw value when compressing doesn't pay off
+		if len(compressed) < len(encoded.Value) {
+			encoded.Value = compressed
+			encoded.Flags |= flag
+		}
+	}
+	if c.aead != nil {
+		nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(encoded.Value)+c.aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("error generating nonce: %w", err)
+		}
+		// the key is authenticated too, so a value can't be moved to another key
+		encoded.Value = c.aead.Seal(nonce, nonce, encoded.Value, encoded.Key)
+		encoded.Flags |= FlagEncrypted
+	}
+	encoded.ValueLength = uint32(len(encoded.Value))
+	return &encoded, nil
+}
+
+// decode turns a value read from disk back into the value that was written.
+func (c *valueCodec) decode(key []byte, flags uint8, value []byte) ([]byte, error) {
+	if flags&FlagEncrypted != 0 {
+		if c.aead == nil {
+			return nil, ErrPassphraseRequired
+		}
+		nonceSize := c.aead.NonceSize()
+		if len(value) < nonceSize {
+			return nil, fmt.Errorf("%w: encrypted value too short", ErrCorruptFile)
+		}
+		var err error
+		value, err = c.aead.Open(nil, value[:nonceSize], value[nonceSize:], key)
+		if err != nil {
+			return nil, ErrWrongPassphrase
+		}
+	}
+	switch {
+	case flags&FlagSnappy != 0:
+		decoded, err := snappyDecode(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptFile, err)
+		}
+		return decoded, nil
+	case flags&FlagFlate != 0:
+		decoded, err := io.ReadAll(flate.NewReader(bytes.NewReader(value)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptFile, err)
+		}
+		return decoded, nil
+	}
+	return value, nil
+}
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// compress compresses value with the codec and returns the flag recording it.
+func compress(compression Compression, value []byte) ([]byte, uint8, error) {
+	switch compression {
+	case CompressionSnappy:
+		return snappyEncode(value), FlagSnappy, nil
+	case CompressionFlate:
+		var buf bytes.Buffer
+		w := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(w)
+		w.Reset(&buf)
+		if _, err := w.Write(value); err != nil {
+			return nil, 0, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, 0, err
+		}
+		return buf.Bytes(), FlagFlate, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown compression %v", compression)
+	}
+}
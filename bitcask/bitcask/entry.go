@@ -7,8 +7,28 @@ import (
 	"time"
 )
 
+// headerSize is the size of the fixed entry header:
+// crc (4) + timestamp (8) + flags (1) + expiry (8) + key length (4) + value length (4).
+const headerSize = 29
+
+// Entry flags, stored in a single byte of the header.
+const (
+	// FlagTombstone marks the deletion of the key.
+	FlagTombstone uint8 = 1 << iota
+	// FlagBatch marks the entry written in front of a batch, its value holds
+	// the number of entries in the batch.
+	FlagBatch
+	// FlagSnappy and FlagFlate record the codec the value is compressed with.
+	FlagSnappy
+	FlagFlate
+	// FlagEncrypted marks a value sealed with AES-GCM, the nonce comes first.
+	FlagEncrypted
+)
+
 type Entry struct {
-	Timestamp   uint32 // Timestamp of the entry in seconds since epoch
+	Timestamp   uint64 // Unix time in nanoseconds when the entry was written
+	Flags       uint8  // Tombstone, batch marker, compression, encryption
+	Expiry      uint64 // Unix time in nanoseconds when the entry expires, 0 = never
 	KeyLength   uint32 // Length of the key
 	ValueLength uint32 // Length of the value
 	Key         []byte // Key of the entry
@@ -17,7 +37,7 @@ type Entry struct {
 
 // NewEntry creates a new entry for the database
 func NewEntry(key []byte, value []byte) *Entry {
-	timestamp := uint32(time.Now().Unix())
+	timestamp := uint64(time.Now().UnixNano())
 	// Calculate the length of the key and value
 	keyLength := uint32(len(key))
 	valueLength := uint32(len(value))
@@ -32,20 +52,31 @@ func NewEntry(key []byte, value []byte) *Entry {
 	}
 }
 
+// NewEntryWithTTL creates a new entry that expires after ttl.
+func NewEntryWithTTL(key []byte, value []byte, ttl time.Duration) *Entry {
+	entry := NewEntry(key, value)
+	entry.Expiry = uint64(time.Now().Add(ttl).UnixNano())
+	return entry
+}
+
 // Encode to binary
 func (e *Entry) Encode() ([]byte, error) {
-	bufSize := e.KeyLength + e.ValueLength + 16 // 4 bytes for length, 4 bytes for timestamp, 4 bytes for crc, 4 bytes for key length, 4 bytes for value length
+	bufSize := headerSize + e.KeyLength + e.ValueLength
 	buf := make([]byte, bufSize)
 	// Put the timestamp into the buffer
-	binary.LittleEndian.PutUint32(buf[4:8], e.Timestamp)
+	binary.LittleEndian.PutUint64(buf[4:12], e.Timestamp)
+	// Put the flags into the buffer
+	buf[12] = e.Flags
+	// Put the expiry into the buffer
+	binary.LittleEndian.PutUint64(buf[13:21], e.Expiry)
 	// Put the key length into the buffer
-	binary.LittleEndian.PutUint32(buf[8:12], e.KeyLength)
+	binary.LittleEndian.PutUint32(buf[21:25], e.KeyLength)
 	// Put the value length into the buffer
-	binary.LittleEndian.PutUint32(buf[12:16], e.ValueLength)
+	binary.LittleEndian.PutUint32(buf[25:29], e.ValueLength)
 	// Put the key into the buffer
-	copy(buf[16:], e.Key)
+	copy(buf[headerSize:], e.Key)
 	// Put the value into the buffer
-	copy(buf[16+e.KeyLength:], e.Value)
+	copy(buf[headerSize+e.KeyLength:], e.Value)
 
 	// Put the checksum into the buffer
 	checksum := crc32.ChecksumIEEE(buf[4:])
@@ -55,42 +86,83 @@ func (e *Entry) Encode() ([]byte, error) {
 }
 
 // Decode from binary
+// It returns io.EOF at the clean end of the log and io.ErrUnexpectedEOF when
+// the log ends in the middle of an entry (e.g. a write torn by a crash).
 func DecodeEntry(r io.Reader) (*Entry, error) {
-	// Read header (16 bytes: crc + timestamp + keySize + valueSize)
-	header := make([]byte, 16)
+	// Read header (29 bytes: crc + timestamp + flags + expiry + keySize + valueSize)
+	header := make([]byte, headerSize)
 	_, err := io.ReadFull(r, header)
 	if err != nil {
 		return nil, err
 	}
 	crc := binary.LittleEndian.Uint32(header[0:4])
-	timestamp := binary.LittleEndian.Uint32(header[4:8])
-	keyLength := binary.LittleEndian.Uint32(header[8:12])
-	valueLength := binary.LittleEndian.Uint32(header[12:16])
-	// Read key and value
-	key := make([]byte, keyLength)
-	io.ReadFull(r, key)
+	entry := &Entry{
+		Timestamp:   binary.LittleEndian.Uint64(header[4:12]),
+		Flags:       header[12],
+		Expiry:      binary.LittleEndian.Uint64(header[13:21]),
+		KeyLength:   binary.LittleEndian.Uint32(header[21:25]),
+		ValueLength: binary.LittleEndian.Uint32(header[25:29]),
+	}
 
-	value := make([]byte, valueLength)
-	io.ReadFull(r, value)
+	// Read key and value
+	entry.Key = make([]byte, entry.KeyLength)
+	if _, err := io.ReadFull(r, entry.Key); err != nil {
+		return nil, unexpectedEOF(err)
+	}
 
-	fullBuffer := append(append(append([]byte{}, header[4:]...), key...), value...)
+	entry.Value = make([]byte, entry.ValueLength)
+	if _, err := io.ReadFull(r, entry.Value); err != nil {
+		return nil, unexpectedEOF(err)
+	}
 
-	if crc != crc32.ChecksumIEEE(fullBuffer) {
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[4:])
+	checksum.Write(entry.Key)
+	checksum.Write(entry.Value)
+	if crc != checksum.Sum32() {
 		return nil, ErrChecksumMismatch
 	}
-	return &Entry{Timestamp: timestamp, KeyLength: keyLength, ValueLength: valueLength, Key: key, Value: value}, nil
+	return entry, nil
 }
 
 func (e *Entry) IsTombstone() bool {
-	return e.ValueLength == 0
+	return e.Flags&FlagTombstone != 0
+}
+
+// IsBatchMarker reports whether the entry opens a batch.
+func (e *Entry) IsBatchMarker() bool {
+	return e.Flags&FlagBatch != 0
+}
+
+// IsExpired reports whether the entry has an expiry that passed.
+func (e *Entry) IsExpired(now time.Time) bool {
+	return isExpired(e.Expiry, now)
 }
 
 func NewTombstone(key []byte) *Entry {
-	return &Entry{
-		Timestamp:   uint32(time.Now().Unix()),
-		KeyLength:   uint32(len(key)),
-		ValueLength: 0, // Empty value = tombstone
-		Key:         key,
-		Value:       []byte{},
+	entry := NewEntry(key, nil)
+	entry.Flags = FlagTombstone
+	return entry
+}
+
+// Size returns the number of bytes the entry takes on disk.
+func (e *Entry) Size() uint64 {
+	return uint64(headerSize + e.KeyLength + e.ValueLength)
+}
+
+// valueOffset returns where the value starts relative to the entry position.
+func (e *Entry) valueOffset() uint64 {
+	return uint64(headerSize + e.KeyLength)
+}
+
+func isExpired(expiry uint64, now time.Time) bool {
+	return expiry != 0 && uint64(now.UnixNano()) >= expiry
+}
+
+// unexpectedEOF reports an EOF after the header as a torn entry.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
 	}
+	return err
 }
@@ -0,0 +1,56 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Every v2 data file starts with a fixed size header:
+//
+//	┌────────────┬─────────────┬────────────┬───────────────┐
+//	│ Magic (4B) │ Version (2) │ Salt (16B) │ Reserved (10) │
+//	└────────────┴─────────────┴────────────┴───────────────┘
+//
+// The salt is random per file and is used to derive the encryption key from
+// the passphrase.
+//
+// Files without the magic number are v1 files, written before the header
+// existed, and have to be converted with Migrate.
+const (
+	fileHeaderSize = 32
+	formatVersion  = 2
+)
+
+var fileMagic = []byte("BCSK")
+
+// encodeFileHeader returns the header written at the start of a data file.
+func encodeFileHeader(salt []byte) []byte {
+	header := make([]byte, fileHeaderSize)
+	copy(header[0:4], fileMagic)
+	binary.LittleEndian.PutUint16(header[4:6], formatVersion)
+	copy(header[6:6+saltSize], salt)
+	return header
+}
+
+// readFileHeader reads and validates the header of a data file, it returns
+// the salt of the file.
+func readFileHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, fileHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if n < len(fileMagic) || !bytes.Equal(header[0:4], fileMagic) {
+		return nil, ErrLegacyFormat
+	}
+	if err != nil {
+		// the magic is there but the header was torn
+		return nil, fmt.Errorf("%w: truncated file header", ErrCorruptFile)
+	}
+	if version := binary.LittleEndian.Uint16(header[4:6]); version != formatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	return header[6 : 6+saltSize], nil
+}
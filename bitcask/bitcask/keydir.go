@@ -1,22 +1,38 @@
 package bitcask
 
-import "sync"
+import (
+	"strings"
+	"sync"
+	"time"
+)
 
 type KeyDirEntry struct {
 	FileID    uint32 // Which file contains the value (for multiple files later)
 	ValuePos  uint64 // Byte offset where the VALUE starts in the file
 	ValueSize uint32 // Size of the value in bytes
-	Timestamp uint32 // When this entry was written (for conflict resolution)
+	Timestamp uint64 // When this entry was written, Unix nanoseconds (for conflict resolution)
+	Expiry    uint64 // Unix time in nanoseconds when the key expires, 0 = never
+	Flags     uint8  // How the value is compressed and encrypted
 }
 
+// IsExpired reports whether the key has an expiry that passed.
+func (e KeyDirEntry) IsExpired(now time.Time) bool {
+	return isExpired(e.Expiry, now)
+}
+
+// KeyDir maps every live key to the location of its latest value.
+// Lookups go through the hash map, while the B-tree keeps the same keys in
+// order for listing, prefix scans and range queries.
 type KeyDir struct {
 	Entries map[string]KeyDirEntry
+	index   *btree
 	mu      sync.RWMutex
 }
 
 func NewKeyDir() *KeyDir {
 	return &KeyDir{
 		Entries: make(map[string]KeyDirEntry),
+		index:   newBTree(),
 		mu:      sync.RWMutex{},
 	}
 }
@@ -24,6 +40,9 @@ func NewKeyDir() *KeyDir {
 func (kd *KeyDir) Put(key string, entry KeyDirEntry) {
 	kd.mu.Lock()
 	defer kd.mu.Unlock()
+	if _, exists := kd.Entries[key]; !exists {
+		kd.index.Insert(key)
+	}
 	kd.Entries[key] = entry
 }
 
@@ -37,5 +56,71 @@ func (kd *KeyDir) Get(key string) (KeyDirEntry, bool) {
 func (kd *KeyDir) Delete(key string) {
 	kd.mu.Lock()
 	defer kd.mu.Unlock()
+	if _, exists := kd.Entries[key]; exists {
+		kd.index.Delete(key)
+	}
 	delete(kd.Entries, key)
 }
+
+// DeleteExpired removes every key that expired before now.
+func (kd *KeyDir) DeleteExpired(now time.Time) {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	for key, entry := range kd.Entries {
+		if entry.IsExpired(now) {
+			kd.index.Delete(key)
+			delete(kd.Entries, key)
+		}
+	}
+}
+
+// Len returns the number of keys in the KeyDir, including the expired keys
+// that haven't been merged away yet.
+func (kd *KeyDir) Len() int {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+	return len(kd.Entries)
+}
+
+// Keys returns all the keys in ascending order.
+// Expired keys are skipped by Keys, PrefixScan and Range.
+func (kd *KeyDir) Keys() []string {
+	return kd.Range("", "")
+}
+
+// PrefixScan returns the keys starting with prefix in ascending order.
+func (kd *KeyDir) PrefixScan(prefix string) []string {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+	now := time.Now()
+	keys := []string{}
+	kd.index.Ascend(prefix, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if !kd.Entries[key].IsExpired(now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// Range returns the keys in [start, end) in ascending order, an empty end
+// means there is no upper bound.
+func (kd *KeyDir) Range(start, end string) []string {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+	now := time.Now()
+	keys := make([]string, 0, kd.index.Len())
+	kd.index.Ascend(start, func(key string) bool {
+		if end != "" && key >= end {
+			return false
+		}
+		if !kd.Entries[key].IsExpired(now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
@@ -0,0 +1,220 @@
+package bitcask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// The v1 format has no file header. Its entries use 32-bit timestamps in
+// seconds, an empty value marks a tombstone and a batch starts with an entry
+// under a reserved key:
+//
+//	[CRC:4][Timestamp:4][Version|KeyLen:4][ValLen:4]([Expiry:8])[Key:n][Value:m]
+//
+// The top 4 bits of the key length hold the entry version, version 1 entries
+// carry an expiry in Unix nanoseconds after the header.
+const (
+	v1HeaderSize       = 16
+	v1ExpirySize       = 8
+	v1VersionShift     = 28
+	v1KeyLengthMask    = 1<<v1VersionShift - 1
+	v1EntryVersionTTL  = 1
+	v1BatchMarkerKey   = "\x00bitcask:batch"
+	v1BatchMarkerValue = 4
+)
+
+// v1Entry is an entry decoded from a v1 file.
+type v1Entry struct {
+	*Entry
+	headerLength uint64
+}
+
+func (e v1Entry) size() uint64 {
+	return e.headerLength + uint64(e.KeyLength) + uint64(e.ValueLength)
+}
+
+// decodeEntryV1 decodes a v1 entry into the current Entry representation.
+func decodeEntryV1(r io.Reader) (v1Entry, error) {
+	header := make([]byte, v1HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return v1Entry{}, err
+	}
+	crc := binary.LittleEndian.Uint32(header[0:4])
+	timestamp := binary.LittleEndian.Uint32(header[4:8])
+	keyField := binary.LittleEndian.Uint32(header[8:12])
+	valueLength := binary.LittleEndian.Uint32(header[12:16])
+
+	entry := &Entry{
+		Timestamp:   uint64(timestamp) * 1e9,
+		KeyLength:   keyField & v1KeyLengthMask,
+		ValueLength: valueLength,
+	}
+
+	switch version := keyField >> v1VersionShift; version {
+	case 0:
+	case v1EntryVersionTTL:
+		expiry := make([]byte, v1ExpirySize)
+		if _, err := io.ReadFull(r, expiry); err != nil {
+			return v1Entry{}, unexpectedEOF(err)
+		}
+		header = append(header, expiry...)
+		entry.Expiry = binary.LittleEndian.Uint64(expiry)
+	default:
+		return v1Entry{}, fmt.Errorf("%w: unknown entry version %d", ErrCorruptFile, version)
+	}
+
+	entry.Key = make([]byte, entry.KeyLength)
+	if _, err := io.ReadFull(r, entry.Key); err != nil {
+		return v1Entry{}, unexpectedEOF(err)
+	}
+	entry.Value = make([]byte, entry.ValueLength)
+	if _, err := io.ReadFull(r, entry.Value); err != nil {
+		return v1Entry{}, unexpectedEOF(err)
+	}
+
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[4:])
+	checksum.Write(entry.Key)
+	checksum.Write(entry.Value)
+	if crc != checksum.Sum32() {
+		return v1Entry{}, ErrChecksumMismatch
+	}
+
+	switch {
+	case string(entry.Key) == v1BatchMarkerKey:
+		entry.Flags = FlagBatch
+	case entry.ValueLength == 0:
+		entry.Flags = FlagTombstone
+	}
+	return v1Entry{Entry: entry, headerLength: uint64(len(header))}, nil
+}
+
+// Migrate converts a v1 database file to the v2 format in place. Only the
+// live keys are copied, like a merge, and their timestamps and expiries are
+// kept. A batch left incomplete at the end of the v1 file is dropped.
+func Migrate(dbPath string) error {
+	file, err := os.Open(dbPath)
+	if err != nil {
+		return fmt.Errorf("error opening database file: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if _, err := readFileHeader(reader); err != ErrLegacyFormat {
+		if err == nil {
+			return fmt.Errorf("%s is already in the v%d format", dbPath, formatVersion)
+		}
+		if err != io.EOF {
+			return err
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Replay the v1 log into a KeyDir pointing at the values in the v1 file
+	keyDir := NewKeyDir()
+	apply := func(entry v1Entry, entryPos uint64) {
+		if entry.IsTombstone() {
+			keyDir.Delete(string(entry.Key))
+			return
+		}
+		keyDir.Put(string(entry.Key), KeyDirEntry{
+			ValuePos:  entryPos + entry.headerLength + uint64(entry.KeyLength),
+			ValueSize: entry.ValueLength,
+			Timestamp: entry.Timestamp,
+			Expiry:    entry.Expiry,
+		})
+	}
+
+	reader.Reset(file)
+	var offset uint64
+replay:
+	for {
+		entry, err := decodeEntryV1(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error decoding entry at offset %d: %w", offset, err)
+		}
+		entryPos := offset
+		offset += entry.size()
+
+		if !entry.IsBatchMarker() {
+			apply(entry, entryPos)
+			continue
+		}
+		if len(entry.Value) != v1BatchMarkerValue {
+			return fmt.Errorf("%w: invalid batch marker", ErrCorruptFile)
+		}
+		count := int(binary.LittleEndian.Uint32(entry.Value))
+		batch := make([]v1Entry, 0, count)
+		positions := make([]uint64, 0, count)
+		for i := 0; i < count; i++ {
+			batchEntry, err := decodeEntryV1(reader)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// incomplete batch at the end of the log
+				break replay
+			}
+			if err != nil {
+				return fmt.Errorf("error decoding batch entry: %w", err)
+			}
+			batch = append(batch, batchEntry)
+			positions = append(positions, offset)
+			offset += batchEntry.size()
+		}
+		for i, batchEntry := range batch {
+			apply(batchEntry, positions[i])
+		}
+	}
+
+	// Write the live keys to a v2 file and swap it in
+	migratePath := dbPath + ".migrate"
+	out, err := os.Create(migratePath)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		out.Close()
+		os.Remove(migratePath)
+		return err
+	}
+
+	writer := bufio.NewWriter(out)
+	writer.Write(encodeFileHeader(newSalt()))
+
+	for _, key := range keyDir.Keys() {
+		kdEntry, _ := keyDir.Get(key)
+		value, err := readValue(file, kdEntry)
+		if err != nil {
+			return fail(fmt.Errorf("error reading value of %q: %w", key, err))
+		}
+		entry := NewEntry([]byte(key), value)
+		entry.Timestamp = kdEntry.Timestamp
+		entry.Expiry = kdEntry.Expiry
+		encoded, err := entry.Encode()
+		if err != nil {
+			return fail(fmt.Errorf("error encoding entry: %w", err))
+		}
+		if _, err := writer.Write(encoded); err != nil {
+			return fail(fmt.Errorf("error writing entry: %w", err))
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fail(fmt.Errorf("error writing migrated file: %w", err))
+	}
+	if err := out.Sync(); err != nil {
+		return fail(fmt.Errorf("error syncing migrated file: %w", err))
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(migratePath)
+		return err
+	}
+	return os.Rename(migratePath, dbPath)
+}
@@ -0,0 +1,113 @@
+package bitcask
+
+import (
+	"fmt"
+	"time"
+)
+
+// SyncPolicy decides when appended entries are flushed to disk with fsync.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs before a write returns. Concurrent writers share a
+	// single fsync through group commit.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in the background every SyncInterval, a crash can
+	// lose the writes of the last interval.
+	SyncInterval
+	// SyncNone leaves flushing to the operating system, the database is only
+	// synced on Close.
+	SyncNone
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNone:
+		return "none"
+	default:
+		return fmt.Sprintf("SyncPolicy(%d)", int(p))
+	}
+}
+
+// ParseSyncPolicy parses "always", "interval" or "none".
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "none":
+		return SyncNone, nil
+	default:
+		return 0, fmt.Errorf("invalid sync policy %q (always, interval or none)", s)
+	}
+}
+
+// Compression selects the codec values are compressed with.
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	// CompressionSnappy is fast with a moderate ratio.
+	CompressionSnappy
+	// CompressionFlate is slower but compresses better.
+	CompressionFlate
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionFlate:
+		return "flate"
+	default:
+		return fmt.Sprintf("Compression(%d)", int(c))
+	}
+}
+
+// ParseCompression parses "none", "snappy" or "flate".
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "none":
+		return CompressionNone, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	case "flate":
+		return CompressionFlate, nil
+	default:
+		return 0, fmt.Errorf("invalid compression %q (none, snappy or flate)", s)
+	}
+}
+
+// Encoding decides how new values are stored. Values already on disk keep
+// the encoding they were written with until a merge rewrites them.
+type Encoding struct {
+	Compression          Compression
+	CompressionThreshold int    // Values smaller than this are stored as is
+	Passphrase           string // Encrypts values with AES-GCM when set
+}
+
+// Options configures how the database is opened.
+type Options struct {
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration // Used by SyncInterval
+	Encoding
+}
+
+// DefaultOptions syncs every write before returning and stores values as is.
+func DefaultOptions() Options {
+	return Options{
+		SyncPolicy:   SyncAlways,
+		SyncInterval: time.Second,
+		Encoding: Encoding{
+			Compression:          CompressionNone,
+			CompressionThreshold: 256,
+		},
+	}
+}
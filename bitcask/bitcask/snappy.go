@@ -0,0 +1,171 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// snappyEncode compresses src into the snappy block format: the uncompressed
+// length as a uvarint followed by literal and copy elements. It trades ratio
+// for speed, matches are only looked up through a small hash table of 4 byte
+// sequences and never reach back more than 64KB.
+//
+// Element tags, the low 2 bits of the first byte:
+//
+//	00 literal: length-1 in the upper 6 bits, or 60..63 for 1..4 length bytes
+//	01 copy:    length 4..11 and an 11 bit offset
+//	10 copy:    length 1..64 and a 2 byte offset
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+
+	const (
+		tableBits   = 14
+		maxOffset   = 1<<16 - 1
+		inputMargin = 4
+	)
+	if len(src) < inputMargin+1 {
+		return appendLiteral(dst, src)
+	}
+
+	// table holds the last position+1 of every hashed sequence, 0 = empty
+	var table [1 << tableBits]uint32
+	hash := func(u uint32) uint32 {
+		return (u * 0x1e35a7bd) >> (32 - tableBits)
+	}
+
+	lit := 0 // start of the pending literal
+	for s := 0; s+inputMargin <= len(src); {
+		u := binary.LittleEndian.Uint32(src[s:])
+		h := hash(u)
+		candidate := int(table[h]) - 1
+		table[h] = uint32(s + 1)
+
+		if candidate < 0 || s-candidate > maxOffset ||
+			binary.LittleEndian.Uint32(src[candidate:]) != u {
+			// skip faster through data that doesn't compress
+			s += 1 + (s-lit)>>5
+			continue
+		}
+
+		dst = appendLiteral(dst, src[lit:s])
+		length := inputMargin
+		for s+length < len(src) && src[candidate+length] == src[s+length] {
+			length++
+		}
+		dst = appendCopy(dst, s-candidate, length)
+		s += length
+		lit = s
+	}
+	return appendLiteral(dst, src[lit:])
+}
+
+func appendLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func appendCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := min(length, 64)
+		if n >= 4 && n <= 11 && offset < 1<<11 {
+			dst = append(dst, byte(offset>>8)<<5|byte(n-4)<<2|1, byte(offset))
+		} else {
+			dst = append(dst, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+		}
+		length -= n
+	}
+	return dst
+}
+
+var errSnappyCorrupt = errors.New("corrupt snappy block")
+
+// snappyDecode decompresses a block written by snappyEncode.
+func snappyDecode(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > uint64(len(src))*255 {
+		return nil, errSnappyCorrupt
+	}
+	src = src[n:]
+	dst := make([]byte, 0, length)
+
+	for len(src) > 0 {
+		tag := src[0]
+		switch tag & 3 {
+		case 0:
+			n := int(tag >> 2)
+			src = src[1:]
+			if n >= 60 {
+				extra := n - 59
+				if len(src) < extra {
+					return nil, errSnappyCorrupt
+				}
+				n = 0
+				for i := extra - 1; i >= 0; i-- {
+					n = n<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			n++
+			if n > len(src) || len(dst)+n > int(length) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:n]...)
+			src = src[n:]
+		case 1:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			n, offset := 4+int(tag>>2&7), int(tag>>5)<<8|int(src[1])
+			src = src[2:]
+			var ok bool
+			if dst, ok = appendMatch(dst, offset, n, int(length)); !ok {
+				return nil, errSnappyCorrupt
+			}
+		case 2:
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			n, offset := 1+int(tag>>2), int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+			var ok bool
+			if dst, ok = appendMatch(dst, offset, n, int(length)); !ok {
+				return nil, errSnappyCorrupt
+			}
+		default:
+			// 4 byte offsets are never written, blocks are small enough
+			return nil, errSnappyCorrupt
+		}
+	}
+	if len(dst) != int(length) {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
+
+// appendMatch copies n bytes starting offset bytes back, byte by byte since
+// the match may overlap what it produces. It reports false for an invalid copy.
+func appendMatch(dst []byte, offset, n, limit int) ([]byte, bool) {
+	if offset == 0 || offset > len(dst) || len(dst)+n > limit {
+		return dst, false
+	}
+	start := len(dst) - offset
+	for i := 0; i < n; i++ {
+		dst = append(dst, dst[start+i])
+	}
+	return dst, true
+}
@@ -0,0 +1,41 @@
+package bitcask
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestSnappyRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 10000)
+	rng.Read(random)
+
+	inputs := map[string][]byte{
+		"empty":     nil,
+		"short":     []byte("abc"),
+		"repeated":  bytes.Repeat([]byte("a"), 100000),
+		"text":      bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 500),
+		"random":    random,
+		"far apart": append(append(append([]byte{}, random...), make([]byte, 70000)...), random...),
+		"json":      []byte(jsonBlob(500)),
+	}
+	for name, input := range inputs {
+		encoded := snappyEncode(input)
+		decoded, err := snappyDecode(encoded)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", name, err)
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Errorf("%s: round trip changed the input", name)
+		}
+	}
+
+	// corrupt blocks are rejected instead of panicking
+	encoded := snappyEncode([]byte(jsonBlob(50)))
+	for i := 1; i < len(encoded); i += 7 {
+		if _, err := snappyDecode(encoded[:i]); err == nil {
+			t.Errorf("decoding a block truncated at %d succeeded", i)
+		}
+	}
+}
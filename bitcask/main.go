@@ -2,9 +2,13 @@ package main
 
 import (
 	"bitcask/bitcask"
+	"bitcask/server"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -18,8 +22,16 @@ func main() {
 
 func run() error {
 	var dbPath string
+	var syncPolicy string
+	var compression string
+	opts := bitcask.DefaultOptions()
 
 	flag.StringVar(&dbPath, "db", "bitcask.db", "Path to the database file")
+	flag.StringVar(&syncPolicy, "sync", opts.SyncPolicy.String(), "When to fsync writes: always, interval or none")
+	flag.DurationVar(&opts.SyncInterval, "sync-interval", opts.SyncInterval, "How often to fsync with -sync interval")
+	flag.StringVar(&compression, "compression", opts.Compression.String(), "Compress new values with: none, snappy or flate")
+	flag.IntVar(&opts.CompressionThreshold, "compression-threshold", opts.CompressionThreshold, "Only compress values of at least this many bytes")
+	flag.StringVar(&opts.Passphrase, "passphrase", os.Getenv("BITCASK_PASSPHRASE"), "Encrypt values with a key derived from this passphrase (default $BITCASK_PASSPHRASE)")
 	flag.Parse()
 
 	if dbPath == "" {
@@ -36,21 +48,57 @@ func run() error {
 
 	cmd := args[0]
 
-	db, err := bitcask.NewBitcask(dbPath)
+	policy, err := bitcask.ParseSyncPolicy(syncPolicy)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	opts.SyncPolicy = policy
+
+	opts.Compression, err = bitcask.ParseCompression(compression)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	// migrate converts the file before it can be opened
+	if cmd == "migrate" {
+		if err := bitcask.Migrate(dbPath); err != nil {
+			fmt.Println("Error migrating database:", err)
+			return err
+		}
+		fmt.Println("Database migrated successfully")
+		return nil
+	}
+
+	// restore replaces the file, the database must not be open
+	if cmd == "restore" {
+		return restore(dbPath, args[1:])
+	}
+
+	db, err := bitcask.Open(dbPath, opts)
 	if err != nil {
 		fmt.Println("Error creating database:", err)
 		return err
 	}
+	defer db.Close()
 
 	switch cmd {
 	case "set":
-		if len(args) < 3 {
-			fmt.Println("Usage: bitcask -db <path> set <key> <value>")
+		fs := flag.NewFlagSet("set", flag.ContinueOnError)
+		ttl := fs.Duration("ttl", 0, "Expire the key after this duration (e.g. 30s, 1h)")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() < 2 {
+			fmt.Println("Usage: bitcask -db <path> set [-ttl duration] <key> <value>")
 			return fmt.Errorf("Invalid number of arguments")
 		}
-		key := args[1]
-		value := args[2]
-		err := db.Set(key, value)
+		key := []byte(fs.Arg(0))
+		value := []byte(fs.Arg(1))
+		var err error
+		if *ttl > 0 {
+			err = db.SetWithTTL(key, value, *ttl)
+		} else {
+			err = db.Set(key, value)
+		}
 		if err != nil {
 			fmt.Println("Error setting key:", err)
 			return err
@@ -61,35 +109,139 @@ func run() error {
 			fmt.Println("Usage: bitcask -db <path> get <key>")
 			return fmt.Errorf("Invalid number of arguments")
 		}
-		key := args[1]
+		key := []byte(args[1])
 		value, err := db.Get(key)
 		if err != nil {
 			fmt.Println("Error getting key:", err)
 			return err
 		}
-		fmt.Println(value)
+		fmt.Println(string(value))
 	case "del":
 		if len(args) < 2 {
 			fmt.Println("Usage: bitcask -db <path> del <key>")
 			return fmt.Errorf("Invalid number of arguments")
 		}
-		key := args[1]
+		key := []byte(args[1])
 		err := db.Delete(key)
 		if err != nil {
 			fmt.Println("Error deleting key:", err)
 			return err
 		}
 		fmt.Println("Key deleted successfully")
+	case "list":
+		// list [prefix]
+		keys := db.Keys()
+		if len(args) > 1 {
+			keys = db.PrefixScan([]byte(args[1]))
+		}
+		for _, key := range keys {
+			fmt.Println(string(key))
+		}
+	case "scan":
+		if len(args) < 2 {
+			fmt.Println("Usage: bitcask -db <path> scan <start> [end]")
+			return fmt.Errorf("Invalid number of arguments")
+		}
+		start, end := []byte(args[1]), []byte(nil)
+		if len(args) > 2 {
+			end = []byte(args[2])
+		}
+		for _, key := range db.Range(start, end) {
+			value, err := db.Get(key)
+			if err != nil {
+				fmt.Println("Error getting key:", err)
+				return err
+			}
+			fmt.Printf("%s %s\n", key, value)
+		}
 	case "merge":
-		err := db.Merge()
+		// merge [-new-passphrase p | -decrypt], values are rewritten with the
+		// compression flags given to this run
+		fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+		newPassphrase := fs.String("new-passphrase", "", "Encrypt the merged values with this passphrase instead")
+		decrypt := fs.Bool("decrypt", false, "Store the merged values unencrypted")
+		if err := fs.Parse(args[1:]); err != nil {
+			fmt.Println("Usage: bitcask -db <path> merge [-new-passphrase passphrase | -decrypt]")
+			return err
+		}
+		enc := opts.Encoding
+		switch {
+		case *decrypt:
+			enc.Passphrase = ""
+		case *newPassphrase != "":
+			enc.Passphrase = *newPassphrase
+		}
+		err := db.MergeWithEncoding(enc)
 		if err != nil {
 			fmt.Println("Error merging database:", err)
 			return err
 		}
 		fmt.Println("Database merged successfully")
+	case "backup":
+		if len(args) < 2 {
+			fmt.Println("Usage: bitcask -db <path> backup <dir>")
+			return fmt.Errorf("Invalid number of arguments")
+		}
+		manifest, err := db.Backup(args[1])
+		if err != nil {
+			fmt.Println("Error backing up database:", err)
+			return err
+		}
+		fmt.Printf("Backed up %d keys to %s\n", manifest.Keys, args[1])
+	case "serve":
+		return serve(db, args[1:])
 	default:
 		fmt.Println("Invalid command")
 		return fmt.Errorf("Invalid command")
 	}
 	return nil
 }
+
+// restore verifies the backup in a directory and installs it as the database.
+func restore(dbPath string, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	force := fs.Bool("force", false, "Replace an existing database")
+	if err := fs.Parse(args); err != nil || fs.NArg() < 1 {
+		fmt.Println("Usage: bitcask -db <path> restore [-force] <dir>")
+		return fmt.Errorf("Invalid number of arguments")
+	}
+	if _, err := os.Stat(dbPath); err == nil && !*force {
+		fmt.Println("Database already exists, use -force to replace it")
+		return fmt.Errorf("database already exists")
+	}
+
+	manifest, err := bitcask.Restore(fs.Arg(0), dbPath)
+	if err != nil {
+		fmt.Println("Error restoring database:", err)
+		return err
+	}
+	fmt.Printf("Restored %d keys from the backup of %s\n", manifest.Keys, manifest.CreatedAt.Format(time.RFC3339))
+	return nil
+}
+
+// serve exposes the database over TCP using the redis protocol until the
+// process is interrupted.
+func serve(db *bitcask.Bitcask, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", ":6380", "Address to listen on")
+	backupRoot := fs.String("backup-root", "", "Directory BACKUP writes under, BACKUP is disabled without it")
+	if err := fs.Parse(args); err != nil {
+		fmt.Println("Usage: bitcask -db <path> serve [-addr host:port] [-backup-root dir]")
+		return err
+	}
+
+	srv := server.New(*addr, db)
+	srv.BackupRoot = *backupRoot
+
+	// Handle graceful shutdown
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+
+		fmt.Println("Shutting down server...")
+		srv.Close()
+	}()
+
+	return srv.Start()
+}
@@ -0,0 +1,108 @@
+package server
+
+// matchPattern reports whether the key matches a redis style glob pattern.
+// '*' matches any sequence of characters (including '/'), '?' matches a
+// single character, "[abc]" matches one of the characters ("[^abc]" negates
+// and "[a-z]" is a range) and '\\' escapes the next character.
+func matchPattern(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// collapse consecutive stars
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if matchPattern(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			matched, rest, ok := matchClass(pattern[1:], key[0])
+			if !ok {
+				// unterminated class, treat '[' as a literal
+				if key[0] != '[' {
+					return false
+				}
+				pattern, key = pattern[1:], key[1:]
+				continue
+			}
+			if !matched {
+				return false
+			}
+			pattern, key = rest, key[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		}
+	}
+	return len(key) == 0
+}
+
+// matchClass matches c against the character class at the start of pattern
+// (just after the '['). It returns whether c matched, the pattern after the
+// closing ']' and false if the class is not terminated.
+func matchClass(pattern string, c byte) (bool, string, bool) {
+	negate := false
+	if len(pattern) > 0 && pattern[0] == '^' {
+		negate = true
+		pattern = pattern[1:]
+	}
+	matched := false
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == ']':
+			return matched != negate, pattern[i+1:], true
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			if pattern[i] == c {
+				matched = true
+			}
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				matched = true
+			}
+			i += 2
+		default:
+			if pattern[i] == c {
+				matched = true
+			}
+		}
+	}
+	return false, "", false
+}
+
+// literalPrefix returns the part of the pattern before its first special
+// character, every key matching the pattern starts with it.
+func literalPrefix(pattern string) string {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[', '\\':
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrProtocol = errors.New("protocol error")
+)
+
+// maxBulkLength caps the size of a single bulk string sent by a client, the
+// same limit redis uses (512MB).
+const maxBulkLength = 512 * 1024 * 1024
+
+// maxMultibulkLength caps the number of arguments of a command, the same
+// limit redis uses, so a client can't make the server allocate for a huge
+// count it never sends.
+const maxMultibulkLength = 1 << 20
+
+// maxInlineLength caps the length of a line: an inline command or the header
+// of a multibulk or bulk string. Redis uses the same limit (64KB).
+const maxInlineLength = 64 * 1024
+
+// readCommand reads a single command from the client.
+// Clients normally send an array of bulk strings:
+//
+//	*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n
+//
+// but the inline form (e.g. "PING\r\n" typed through telnet) is accepted too.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 || count > maxMultibulkLength {
+		return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+	}
+
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", ErrProtocol, line)
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > maxBulkLength {
+			return nil, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+		}
+		// read the string and the trailing \r\n
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:length]))
+	}
+	return args, nil
+}
+
+// readLine reads a line terminated by \r\n (or \n) and strips the terminator.
+// Lines longer than maxInlineLength are a protocol error, so a client can't
+// make the server buffer a line that never ends.
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxInlineLength+2 {
+			return "", fmt.Errorf("%w: too big inline request", ErrProtocol)
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func writeSimpleString(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, msg string) {
+	w.WriteString("-" + msg + "\r\n")
+}
+
+func writeInteger(w *bufio.Writer, n int) {
+	w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func writeBulkString(w *bufio.Writer, s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func writeNil(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+func writeArrayHeader(w *bufio.Writer, length int) {
+	w.WriteString("*" + strconv.Itoa(length) + "\r\n")
+}
+
+func writeStringArray(w *bufio.Writer, elems []string) {
+	writeArrayHeader(w, len(elems))
+	for _, elem := range elems {
+		writeBulkString(w, elem)
+	}
+}
@@ -0,0 +1,476 @@
+package server
+
+import (
+	"bitcask/bitcask"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultScanCount is the number of keys SCAN returns when COUNT is omitted.
+	defaultScanCount = 10
+	// maxScanCursors bounds the SCAN cursors remembered, the oldest ones are
+	// forgotten first.
+	maxScanCursors = 4096
+)
+
+// Server exposes a Bitcask database over TCP using the redis protocol (RESP),
+// so redis-cli and the existing redis client libraries can talk to it.
+type Server struct {
+	// BackupRoot is the directory the backups taken with BACKUP are written
+	// under, BACKUP is refused when it is empty.
+	BackupRoot string
+
+	addr     string
+	db       *bitcask.Bitcask
+	listener net.Listener
+	conns    sync.WaitGroup
+	closed   chan struct{}
+	once     sync.Once
+
+	cursors scanCursors
+}
+
+// scanCursors maps the SCAN cursors handed to the clients to the last key
+// they examined. Clients such as redis-cli expect an integer cursor, so the
+// key can't be the cursor itself.
+type scanCursors struct {
+	mu    sync.Mutex
+	last  uint64
+	keys  map[uint64]string
+	order []uint64 // cursors from the oldest
+}
+
+// add remembers where an iteration resumes and returns its cursor.
+func (c *scanCursors) add(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys == nil {
+		c.keys = make(map[uint64]string)
+	}
+	if len(c.order) == maxScanCursors {
+		delete(c.keys, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.last++
+	c.keys[c.last] = key
+	c.order = append(c.order, c.last)
+	return c.last
+}
+
+// key returns the last key examined before the cursor.
+func (c *scanCursors) key(cursor uint64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.keys[cursor]
+	return key, ok
+}
+
+// New creates a new server for the database listening on addr.
+func New(addr string, db *bitcask.Bitcask) *Server {
+	return &Server{
+		addr:   addr,
+		db:     db,
+		closed: make(chan struct{}),
+	}
+}
+
+// Start listens on the server address and serves connections until Close is
+// called.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on the listener, each connection is handled in
+// its own goroutine.
+func (s *Server) Serve(ln net.Listener) error {
+	s.listener = ln
+	log.Printf("bitcask server listening on %s", ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+				return nil
+			default:
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Printf("Temporary error accepting connection %v", netErr)
+				continue
+			}
+			return fmt.Errorf("accepting connection: %w", err)
+		}
+
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+// Close stops accepting new connections and waits for the open ones to finish
+// their current command.
+func (s *Server) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closed)
+		if s.listener != nil {
+			err = s.listener.Close()
+		}
+		s.conns.Wait()
+	})
+	return err
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	// closing the connection unblocks the reader when the server shuts down
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.closed:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			if errors.Is(err, ErrProtocol) {
+				writeError(writer, "ERR "+err.Error())
+				writer.Flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error reading command from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := s.execute(writer, args)
+
+		// Pipelined clients send several commands before reading the replies,
+		// only flush once every buffered command has been answered.
+		if reader.Buffered() == 0 || quit {
+			if err := writer.Flush(); err != nil {
+				log.Printf("Error writing response to %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// execute runs a single command and writes its reply, it returns true when
+// the client asked to close the connection.
+func (s *Server) execute(w *bufio.Writer, args []string) bool {
+	cmd := strings.ToUpper(args[0])
+	args = args[1:]
+
+	switch cmd {
+	case "PING":
+		if len(args) > 0 {
+			writeBulkString(w, args[0])
+		} else {
+			writeSimpleString(w, "PONG")
+		}
+	case "ECHO":
+		if len(args) != 1 {
+			writeArityError(w, cmd)
+			break
+		}
+		writeBulkString(w, args[0])
+	case "GET":
+		if len(args) != 1 {
+			writeArityError(w, cmd)
+			break
+		}
+		value, err := s.db.Get([]byte(args[0]))
+		if errors.Is(err, bitcask.ErrKeyNotFound) {
+			writeNil(w)
+			break
+		}
+		if err != nil {
+			writeError(w, "ERR "+err.Error())
+			break
+		}
+		writeBulkString(w, string(value))
+	case "SET":
+		s.set(w, args)
+	case "MSET":
+		if len(args) == 0 || len(args)%2 != 0 {
+			writeArityError(w, cmd)
+			break
+		}
+		// all the pairs are written atomically as one batch
+		batch := bitcask.NewWriteBatch()
+		for i := 0; i < len(args); i += 2 {
+			batch.Put([]byte(args[i]), []byte(args[i+1]))
+		}
+		if err := s.db.Write(batch); err != nil {
+			writeError(w, "ERR "+err.Error())
+			break
+		}
+		writeSimpleString(w, "OK")
+	case "DEL":
+		if len(args) == 0 {
+			writeArityError(w, cmd)
+			break
+		}
+		deleted := 0
+		for _, key := range args {
+			err := s.db.Delete([]byte(key))
+			if errors.Is(err, bitcask.ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				writeError(w, "ERR "+err.Error())
+				return false
+			}
+			deleted++
+		}
+		writeInteger(w, deleted)
+	case "EXISTS":
+		if len(args) == 0 {
+			writeArityError(w, cmd)
+			break
+		}
+		count := 0
+		for _, key := range args {
+			if s.db.Exists([]byte(key)) {
+				count++
+			}
+		}
+		writeInteger(w, count)
+	case "KEYS":
+		if len(args) != 1 {
+			writeArityError(w, cmd)
+			break
+		}
+		keys := []string{}
+		for _, key := range s.candidateKeys(args[0]) {
+			if matchPattern(args[0], key) {
+				keys = append(keys, key)
+			}
+		}
+		writeStringArray(w, keys)
+	case "SCAN":
+		s.scan(w, args)
+	case "TTL", "PTTL":
+		if len(args) != 1 {
+			writeArityError(w, cmd)
+			break
+		}
+		ttl, ok, err := s.db.TTL([]byte(args[0]))
+		switch {
+		case errors.Is(err, bitcask.ErrKeyNotFound):
+			writeInteger(w, -2)
+		case err != nil:
+			writeError(w, "ERR "+err.Error())
+		case !ok:
+			writeInteger(w, -1)
+		case cmd == "PTTL":
+			writeInteger(w, int(ttl.Milliseconds()))
+		default:
+			// round up like redis so a key with 0.5s left reports 1
+			writeInteger(w, int((ttl+time.Second-1)/time.Second))
+		}
+	case "DBSIZE":
+		writeInteger(w, s.db.Len())
+	case "MERGE":
+		if err := s.db.Merge(); err != nil {
+			writeError(w, "ERR "+err.Error())
+			break
+		}
+		writeSimpleString(w, "OK")
+	case "BACKUP":
+		// BACKUP <dir> snapshots the database while clients keep writing,
+		// dir is relative to the backup root so clients can't write anywhere
+		if len(args) != 1 {
+			writeArityError(w, cmd)
+			break
+		}
+		if s.BackupRoot == "" {
+			writeError(w, "ERR backups are disabled, the server has no backup root")
+			break
+		}
+		if !filepath.IsLocal(args[0]) {
+			writeError(w, "ERR backup directory must be relative to the backup root")
+			break
+		}
+		if _, err := s.db.Backup(filepath.Join(s.BackupRoot, args[0])); err != nil {
+			writeError(w, "ERR "+err.Error())
+			break
+		}
+		writeSimpleString(w, "OK")
+	case "COMMAND":
+		// redis-cli asks for the command docs on connect, an empty reply is
+		// enough for it to carry on.
+		writeArrayHeader(w, 0)
+	case "QUIT":
+		writeSimpleString(w, "OK")
+		return true
+	default:
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", truncateName(cmd)))
+	}
+	return false
+}
+
+// set implements SET key value [EX seconds | PX milliseconds].
+func (s *Server) set(w *bufio.Writer, args []string) {
+	if len(args) != 2 && len(args) != 4 {
+		writeArityError(w, "SET")
+		return
+	}
+
+	var ttl time.Duration
+	if len(args) == 4 {
+		n, err := strconv.Atoi(args[3])
+		if err != nil || n <= 0 {
+			writeError(w, "ERR invalid expire time in 'set' command")
+			return
+		}
+		switch strings.ToUpper(args[2]) {
+		case "EX":
+			ttl = time.Duration(n) * time.Second
+		case "PX":
+			ttl = time.Duration(n) * time.Millisecond
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+
+	var err error
+	if ttl > 0 {
+		err = s.db.SetWithTTL([]byte(args[0]), []byte(args[1]), ttl)
+	} else {
+		err = s.db.Set([]byte(args[0]), []byte(args[1]))
+	}
+	if err != nil {
+		writeError(w, "ERR "+err.Error())
+		return
+	}
+	writeSimpleString(w, "OK")
+}
+
+// scan implements SCAN cursor [MATCH pattern] [COUNT count].
+// The cursor stands for the last key examined, the next call resumes after it
+// in key order, so keys deleted or added in between don't shift the
+// iteration. 0 starts and ends an iteration.
+func (s *Server) scan(w *bufio.Writer, args []string) {
+	if len(args) == 0 {
+		writeArityError(w, "SCAN")
+		return
+	}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		writeError(w, "ERR invalid cursor")
+		return
+	}
+	var after string
+	if cursor != 0 {
+		var ok bool
+		if after, ok = s.cursors.key(cursor); !ok {
+			writeError(w, "ERR invalid cursor")
+			return
+		}
+	}
+
+	pattern := "*"
+	count := defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			writeError(w, "ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				writeError(w, "ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+
+	keys := s.candidateKeys(pattern)
+	start := 0
+	if cursor != 0 {
+		start = sort.Search(len(keys), func(i int) bool { return keys[i] > after })
+	}
+	end := min(start+count, len(keys))
+	matched := []string{}
+	for _, key := range keys[start:end] {
+		if matchPattern(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+	var next uint64
+	if end < len(keys) {
+		next = s.cursors.add(keys[end-1])
+	}
+
+	writeArrayHeader(w, 2)
+	writeBulkString(w, strconv.FormatUint(next, 10))
+	writeStringArray(w, matched)
+}
+
+// candidateKeys returns the keys that may match the pattern in ascending
+// order. Patterns with a literal prefix (e.g. "user:*") only look at the keys
+// under that prefix in the ordered index.
+func (s *Server) candidateKeys(pattern string) []string {
+	var keys [][]byte
+	if prefix := literalPrefix(pattern); prefix != "" {
+		keys = s.db.PrefixScan([]byte(prefix))
+	} else {
+		keys = s.db.Keys()
+	}
+	result := make([]string, len(keys))
+	for i, key := range keys {
+		result[i] = string(key)
+	}
+	return result
+}
+
+func writeArityError(w *bufio.Writer, cmd string) {
+	writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
+
+// truncateName shortens very long command names before echoing them back.
+func truncateName(cmd string) string {
+	if len(cmd) > 128 {
+		return cmd[:128]
+	}
+	return strings.ToLower(cmd)
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bitcask/bitcask"
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func startServer(t *testing.T) string {
+	t.Helper()
+	return startServerWithBackups(t, "")
+}
+
+// startServerWithBackups starts a server taking its backups under
+// backupRoot, none when empty.
+func startServerWithBackups(t *testing.T, backupRoot string) string {
+	t.Helper()
+	db, err := bitcask.NewBitcask(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("creating database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	srv := New(ln.Addr().String(), db)
+	srv.BackupRoot = backupRoot
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestPipelining(t *testing.T) {
+	addr := startServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+
+	// all the commands are sent before reading any reply
+	pipeline := "*3\r\n$3\r\nSET\r\n$4\r\nname\r\n$5\r\nIslam\r\n" +
+		"*2\r\n$3\r\nGET\r\n$4\r\nname\r\n" +
+		"*2\r\n$6\r\nEXISTS\r\n$4\r\nname\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$4\r\nname\r\n" +
+		"*2\r\n$3\r\nGET\r\n$4\r\nname\r\n" +
+		"PING\r\n"
+	if _, err := conn.Write([]byte(pipeline)); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+
+	expected := []string{"+OK", "$5", "Islam", ":1", ":1", "$-1", "+PONG"}
+	reader := bufio.NewReader(conn)
+	for _, want := range expected {
+		got, err := readLine(reader)
+		if err != nil {
+			t.Fatalf("reading reply: %v", err)
+		}
+		if got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	addr := startServer(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Errorf("dialing: %v", err)
+				return
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+
+			key := fmt.Sprintf("key-%d", i)
+			fmt.Fprintf(conn, "SET %s %d\r\nGET %s\r\n", key, i, key)
+			for _, want := range []string{"+OK", fmt.Sprintf("$%d", len(fmt.Sprint(i))), fmt.Sprint(i)} {
+				got, err := readLine(reader)
+				if err != nil {
+					t.Errorf("reading reply: %v", err)
+					return
+				}
+				if got != want {
+					t.Errorf("expected %q, got %q", want, got)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestBackup(t *testing.T) {
+	root := t.TempDir()
+	addr := startServerWithBackups(t, root)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	commands := []struct{ command, reply string }{
+		{"SET name Islam\r\n", "+OK"},
+		{"*2\r\n$6\r\nBACKUP\r\n$4\r\nsnap\r\n", "+OK"},
+		{"BACKUP\r\n", "-ERR wrong number of arguments for 'backup' command"},
+		{"BACKUP a b\r\n", "-ERR wrong number of arguments for 'backup' command"},
+		{"BACKUP ../escape\r\n", "-ERR backup directory must be relative to the backup root"},
+		{"BACKUP " + filepath.Join(t.TempDir(), "abs") + "\r\n", "-ERR backup directory must be relative to the backup root"},
+	}
+	for _, c := range commands {
+		if _, err := conn.Write([]byte(c.command)); err != nil {
+			t.Fatalf("writing: %v", err)
+		}
+		got, err := readLine(reader)
+		if err != nil {
+			t.Fatalf("reading reply: %v", err)
+		}
+		if got != c.reply {
+			t.Errorf("%q: expected %q, got %q", c.command, c.reply, got)
+		}
+	}
+
+	restored := filepath.Join(t.TempDir(), "restored.db")
+	if _, err := bitcask.Restore(filepath.Join(root, "snap"), restored); err != nil {
+		t.Fatalf("restoring the backup: %v", err)
+	}
+	db, err := bitcask.NewBitcask(restored)
+	if err != nil {
+		t.Fatalf("opening the restored database: %v", err)
+	}
+	defer db.Close()
+	if value, err := db.Get([]byte("name")); err != nil || string(value) != "Islam" {
+		t.Errorf("expected the backed up value, got %q (%v)", value, err)
+	}
+}
+
+func TestBackupWithoutRoot(t *testing.T) {
+	conn, err := net.Dial("tcp", startServer(t))
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "BACKUP snap\r\n")
+	got, err := readLine(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	if got != "-ERR backups are disabled, the server has no backup root" {
+		t.Errorf("expected BACKUP to be refused, got %q", got)
+	}
+}
+
+func TestMultibulkLength(t *testing.T) {
+	addr := startServer(t)
+	for _, count := range []string{"-1", "x", "1048577", "4611686018427387904"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dialing: %v", err)
+		}
+		fmt.Fprintf(conn, "*%s\r\n", count)
+		got, err := readLine(bufio.NewReader(conn))
+		conn.Close()
+		if err != nil {
+			t.Fatalf("reading reply: %v", err)
+		}
+		if got != "-ERR protocol error: invalid multibulk length" {
+			t.Errorf("%s: expected a protocol error, got %q", count, got)
+		}
+	}
+}
+
+func TestInlineLength(t *testing.T) {
+	addr := startServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	fmt.Fprintf(conn, "ECHO %s\r\n", strings.Repeat("x", 1000))
+	readLine(reader)
+	if got, _ := readLine(reader); got != strings.Repeat("x", 1000) {
+		t.Fatalf("expected the inline command to be echoed, got %q", got)
+	}
+	// the line never ends, the server gives up once it is over the limit
+	go conn.Write([]byte(strings.Repeat("x", 2*maxInlineLength)))
+	if got, _ := readLine(reader); got != "-ERR protocol error: too big inline request" {
+		t.Errorf("expected a protocol error, got %q", got)
+	}
+}
+
+func TestScanWithDeletes(t *testing.T) {
+	addr := startServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 6; i++ {
+		fmt.Fprintf(conn, "SET k%d v\r\n", i)
+		if _, err := readLine(reader); err != nil {
+			t.Fatalf("reading reply: %v", err)
+		}
+	}
+
+	// scan reads the cursor and the keys of a SCAN reply, an array of the
+	// cursor and the array of keys
+	scan := func(cursor string) (string, []string) {
+		t.Helper()
+		fmt.Fprintf(conn, "SCAN %s COUNT 2\r\n", cursor)
+		var lines []string
+		for i := 0; i < 4; i++ {
+			line, err := readLine(reader)
+			if err != nil {
+				t.Fatalf("reading reply: %v", err)
+			}
+			lines = append(lines, line)
+		}
+		var keys []string
+		n, _ := strconv.Atoi(strings.TrimPrefix(lines[3], "*"))
+		for i := 0; i < n; i++ {
+			readLine(reader)
+			key, _ := readLine(reader)
+			keys = append(keys, key)
+		}
+		return lines[2], keys
+	}
+
+	cursor, keys := scan("0")
+	seen := append([]string(nil), keys...)
+	// the keys already returned are deleted, the others must still come
+	fmt.Fprintf(conn, "DEL k0 k1\r\n")
+	readLine(reader)
+	for cursor != "0" {
+		cursor, keys = scan(cursor)
+		seen = append(seen, keys...)
+	}
+	if want := []string{"k0", "k1", "k2", "k3", "k4", "k5"}; fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, seen)
+	}
+
+	fmt.Fprintf(conn, "SCAN 12345\r\n")
+	if got, _ := readLine(reader); got != "-ERR invalid cursor" {
+		t.Errorf("expected an unknown cursor to be refused, got %q", got)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"*/*", "a/b", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+	}
+
+	for _, tc := range testCases {
+		if got := matchPattern(tc.pattern, tc.key); got != tc.match {
+			t.Errorf("matchPattern(%q, %q) = %v, expected %v", tc.pattern, tc.key, got, tc.match)
+		}
+	}
+}
@@ -0,0 +1,520 @@
+// Package client is a memcached client for the text protocol. Keys are spread
+// over the servers with a ketama ring, connections are pooled per server and
+// a server that fails is skipped for a while so its keys fail over to the
+// next servers on the ring.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTimeout       = 500 * time.Millisecond
+	DefaultMaxIdleConns  = 2
+	DefaultRetryInterval = 5 * time.Second
+)
+
+var (
+	ErrCacheMiss    = errors.New("memcache: cache miss")
+	ErrNotStored    = errors.New("memcache: item not stored")
+	ErrCASConflict  = errors.New("memcache: compare-and-swap conflict")
+	ErrNoServers    = errors.New("memcache: no servers available")
+	ErrMalformedKey = errors.New("memcache: key is too long or contains invalid characters")
+	// ErrServerError and ErrClientError wrap the SERVER_ERROR and
+	// CLIENT_ERROR replies, the message of the server follows.
+	ErrServerError = errors.New("memcache: server error")
+	ErrClientError = errors.New("memcache: client error")
+)
+
+// Item is a value stored in memcached.
+type Item struct {
+	Key   string
+	Value []byte
+	Flags uint32
+	// Expiration is the exptime sent to the server: seconds from now up to
+	// 30 days, a Unix time above that, 0 never expires.
+	Expiration int32
+	// CasID is set by Get, CompareAndSwap stores the item only if it is
+	// unchanged since.
+	CasID uint64
+}
+
+// Client talks to a set of memcached servers, it is safe for concurrent use.
+type Client struct {
+	// Timeout bounds the dial and every request.
+	Timeout time.Duration
+	// MaxIdleConns is the number of idle connections kept per server.
+	MaxIdleConns int
+	// RetryInterval is how long a server that failed is skipped.
+	RetryInterval time.Duration
+
+	ring *Ring
+
+	mu       sync.Mutex
+	freeconn map[string][]*conn
+	downTill map[string]time.Time
+}
+
+// New returns a client spreading the keys over the servers (host:port).
+func New(servers ...string) *Client {
+	return &Client{
+		Timeout:       DefaultTimeout,
+		MaxIdleConns:  DefaultMaxIdleConns,
+		RetryInterval: DefaultRetryInterval,
+		ring:          NewRing(servers...),
+		freeconn:      make(map[string][]*conn),
+		downTill:      make(map[string]time.Time),
+	}
+}
+
+// Servers returns the servers of the client.
+func (c *Client) Servers() []string {
+	return c.ring.Servers()
+}
+
+// conn is a pooled connection to a server.
+type conn struct {
+	nc   net.Conn
+	rw   *bufio.ReadWriter
+	addr string
+}
+
+func (cn *conn) extendDeadline(timeout time.Duration) {
+	cn.nc.SetDeadline(time.Now().Add(timeout))
+}
+
+// isUp reports whether the server can be used, a failed server is retried
+// once RetryInterval has passed.
+func (c *Client) isUp(addr string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	till, ok := c.downTill[addr]
+	if ok && time.Now().After(till) {
+		delete(c.downTill, addr)
+		return true
+	}
+	return !ok
+}
+
+// markDown takes the server out of the ring for RetryInterval and closes its
+// idle connections.
+func (c *Client) markDown(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.downTill[addr] = time.Now().Add(c.RetryInterval)
+	for _, cn := range c.freeconn[addr] {
+		cn.nc.Close()
+	}
+	delete(c.freeconn, addr)
+}
+
+func (c *Client) getConn(addr string) (*conn, error) {
+	c.mu.Lock()
+	if free := c.freeconn[addr]; len(free) > 0 {
+		cn := free[len(free)-1]
+		c.freeconn[addr] = free[:len(free)-1]
+		c.mu.Unlock()
+		cn.extendDeadline(c.Timeout)
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	nc, err := net.DialTimeout("tcp", addr, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{
+		nc:   nc,
+		rw:   bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
+		addr: addr,
+	}
+	cn.extendDeadline(c.Timeout)
+	return cn, nil
+}
+
+// putConn returns the connection to the pool, unless it failed: after an I/O
+// error the connection may hold part of a reply, and after an error reply the
+// server may not have read the whole request.
+func (c *Client) putConn(cn *conn, err error) {
+	if err != nil && !resumableError(err) {
+		cn.nc.Close()
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.freeconn[cn.addr]) >= c.MaxIdleConns {
+		cn.nc.Close()
+		return
+	}
+	c.freeconn[cn.addr] = append(c.freeconn[cn.addr], cn)
+}
+
+// resumableError reports whether the connection can be reused after err: the
+// server answered with a miss or a failed condition.
+func resumableError(err error) bool {
+	return errors.Is(err, ErrCacheMiss) || errors.Is(err, ErrNotStored) || errors.Is(err, ErrCASConflict)
+}
+
+// isResponseError reports whether err is an answer of the server rather than
+// a failure of the connection, the server stays up.
+func isResponseError(err error) bool {
+	return resumableError(err) || errors.Is(err, ErrServerError) || errors.Is(err, ErrClientError)
+}
+
+// withKey runs fn on a connection to the server owning key. When the server
+// can't be reached it is marked down and the request goes to the next server
+// on the ring. Once a request was sent it is only retried if it is
+// idempotent, since the server may have executed it.
+func (c *Client) withKey(key string, idempotent bool, fn func(*conn) error) error {
+	if !validKey(key) {
+		return ErrMalformedKey
+	}
+	err := ErrNoServers
+	for range c.ring.Servers() {
+		addr, ok := c.ring.Lookup(key, c.isUp)
+		if !ok {
+			return ErrNoServers
+		}
+		var cn *conn
+		if cn, err = c.getConn(addr); err != nil {
+			c.markDown(addr)
+			continue
+		}
+		err = fn(cn)
+		c.putConn(cn, err)
+		if err == nil || isResponseError(err) {
+			return err
+		}
+		c.markDown(addr)
+		if !idempotent {
+			return err
+		}
+	}
+	return err
+}
+
+// validKey checks the key is at most 250 bytes without spaces or control
+// characters.
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > 250 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns the item of key, or ErrCacheMiss.
+func (c *Client) Get(key string) (*Item, error) {
+	var item *Item
+	err := c.withKey(key, true, func(cn *conn) error {
+		items, err := c.gets(cn, []string{key})
+		if err != nil {
+			return err
+		}
+		if item = items[key]; item == nil {
+			return ErrCacheMiss
+		}
+		return nil
+	})
+	return item, err
+}
+
+// GetMulti fetches several keys with one request per server, missing keys are
+// left out of the result.
+func (c *Client) GetMulti(keys []string) (map[string]*Item, error) {
+	for _, key := range keys {
+		if !validKey(key) {
+			return nil, ErrMalformedKey
+		}
+	}
+
+	result := make(map[string]*Item)
+	pending := keys
+	for range c.ring.Servers() {
+		if len(pending) == 0 {
+			return result, nil
+		}
+		byServer := make(map[string][]string)
+		for _, key := range pending {
+			addr, ok := c.ring.Lookup(key, c.isUp)
+			if !ok {
+				return result, ErrNoServers
+			}
+			byServer[addr] = append(byServer[addr], key)
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		var firstErr error
+		pending = nil
+		for addr, keys := range byServer {
+			wg.Add(1)
+			go func(addr string, keys []string) {
+				defer wg.Done()
+				items, err := c.getFrom(addr, keys)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					for k, item := range items {
+						result[k] = item
+					}
+				case isResponseError(err):
+					if firstErr == nil {
+						firstErr = err
+					}
+				default:
+					// the server is down, its keys fail over on the next round
+					c.markDown(addr)
+					pending = append(pending, keys...)
+				}
+			}(addr, keys)
+		}
+		wg.Wait()
+		if firstErr != nil {
+			return result, firstErr
+		}
+	}
+	if len(pending) > 0 {
+		return result, ErrNoServers
+	}
+	return result, nil
+}
+
+func (c *Client) getFrom(addr string, keys []string) (map[string]*Item, error) {
+	cn, err := c.getConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	items, err := c.gets(cn, keys)
+	c.putConn(cn, err)
+	return items, err
+}
+
+// gets sends "gets <key>*" and reads the items until END.
+func (c *Client) gets(cn *conn, keys []string) (map[string]*Item, error) {
+	if _, err := fmt.Fprintf(cn.rw, "gets %s\r\n", strings.Join(keys, " ")); err != nil {
+		return nil, err
+	}
+	if err := cn.rw.Flush(); err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]*Item)
+	for {
+		line, err := readLine(cn.rw.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if line == "END" {
+			return items, nil
+		}
+		// VALUE <key> <flags> <bytes> <cas unique>
+		fields := strings.Fields(line)
+		if len(fields) != 5 || fields[0] != "VALUE" {
+			return nil, fmt.Errorf("memcache: unexpected line in get response: %q", line)
+		}
+		flags, err1 := strconv.ParseUint(fields[2], 10, 32)
+		size, err2 := strconv.Atoi(fields[3])
+		cas, err3 := strconv.ParseUint(fields[4], 10, 64)
+		if err := errors.Join(err1, err2, err3); err != nil {
+			return nil, fmt.Errorf("memcache: unexpected line in get response: %q", line)
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(cn.rw, value); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(value, []byte("\r\n")) {
+			return nil, fmt.Errorf("memcache: corrupt get response for %s", fields[1])
+		}
+		items[fields[1]] = &Item{Key: fields[1], Value: value[:size], Flags: uint32(flags), CasID: cas}
+	}
+}
+
+// Set stores the item unconditionally.
+func (c *Client) Set(item *Item) error {
+	return c.store("set", item)
+}
+
+// Add stores the item only if its key doesn't exist, ErrNotStored otherwise.
+func (c *Client) Add(item *Item) error {
+	return c.store("add", item)
+}
+
+// Replace stores the item only if its key exists, ErrNotStored otherwise.
+func (c *Client) Replace(item *Item) error {
+	return c.store("replace", item)
+}
+
+// Append adds the value after the value of an existing key.
+func (c *Client) Append(item *Item) error {
+	return c.store("append", item)
+}
+
+// Prepend adds the value before the value of an existing key.
+func (c *Client) Prepend(item *Item) error {
+	return c.store("prepend", item)
+}
+
+// CompareAndSwap stores the item only if it wasn't modified since it was
+// fetched: ErrCASConflict if it was, ErrCacheMiss if it was deleted.
+func (c *Client) CompareAndSwap(item *Item) error {
+	return c.store("cas", item)
+}
+
+func (c *Client) store(verb string, item *Item) error {
+	// storing the same value twice is harmless, except for append/prepend
+	idempotent := verb != "append" && verb != "prepend"
+	return c.withKey(item.Key, idempotent, func(cn *conn) error {
+		if verb == "cas" {
+			fmt.Fprintf(cn.rw, "cas %s %d %d %d %d\r\n", item.Key, item.Flags, item.Expiration, len(item.Value), item.CasID)
+		} else {
+			fmt.Fprintf(cn.rw, "%s %s %d %d %d\r\n", verb, item.Key, item.Flags, item.Expiration, len(item.Value))
+		}
+		cn.rw.Write(item.Value)
+		cn.rw.WriteString("\r\n")
+		line, err := roundTrip(cn)
+		if err != nil {
+			return err
+		}
+		switch line {
+		case "STORED":
+			return nil
+		case "NOT_STORED":
+			return ErrNotStored
+		case "EXISTS":
+			return ErrCASConflict
+		case "NOT_FOUND":
+			return ErrCacheMiss
+		}
+		return fmt.Errorf("memcache: unexpected response to %s: %q", verb, line)
+	})
+}
+
+// Delete removes the key, ErrCacheMiss if it didn't exist.
+func (c *Client) Delete(key string) error {
+	return c.withKey(key, true, func(cn *conn) error {
+		fmt.Fprintf(cn.rw, "delete %s\r\n", key)
+		return expect(cn, "DELETED")
+	})
+}
+
+// Touch updates the expiration of the key, ErrCacheMiss if it doesn't exist.
+func (c *Client) Touch(key string, expiration int32) error {
+	return c.withKey(key, true, func(cn *conn) error {
+		fmt.Fprintf(cn.rw, "touch %s %d\r\n", key, expiration)
+		return expect(cn, "TOUCHED")
+	})
+}
+
+// Increment adds delta to the decimal value of the key and returns the new
+// value, ErrCacheMiss if the key doesn't exist.
+func (c *Client) Increment(key string, delta uint64) (uint64, error) {
+	return c.incrDecr("incr", key, delta)
+}
+
+// Decrement subtracts delta from the decimal value of the key, stopping at 0.
+func (c *Client) Decrement(key string, delta uint64) (uint64, error) {
+	return c.incrDecr("decr", key, delta)
+}
+
+func (c *Client) incrDecr(verb, key string, delta uint64) (uint64, error) {
+	var value uint64
+	err := c.withKey(key, false, func(cn *conn) error {
+		fmt.Fprintf(cn.rw, "%s %s %d\r\n", verb, key, delta)
+		line, err := roundTrip(cn)
+		if err != nil {
+			return err
+		}
+		if line == "NOT_FOUND" {
+			return ErrCacheMiss
+		}
+		value, err = strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return fmt.Errorf("memcache: unexpected response to %s: %q", verb, line)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// FlushAll invalidates the items of every server that is up.
+func (c *Client) FlushAll() error {
+	var errs []error
+	for _, addr := range c.ring.Servers() {
+		if !c.isUp(addr) {
+			continue
+		}
+		cn, err := c.getConn(addr)
+		if err != nil {
+			c.markDown(addr)
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Fprintf(cn.rw, "flush_all\r\n")
+		err = expect(cn, "OK")
+		c.putConn(cn, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expect sends the buffered request and checks the reply, NOT_FOUND is
+// ErrCacheMiss.
+func expect(cn *conn, want string) error {
+	line, err := roundTrip(cn)
+	if err != nil {
+		return err
+	}
+	switch line {
+	case want:
+		return nil
+	case "NOT_FOUND":
+		return ErrCacheMiss
+	}
+	return fmt.Errorf("memcache: unexpected response %q", line)
+}
+
+// roundTrip sends the buffered request and returns the reply line, error
+// replies are turned into errors.
+func roundTrip(cn *conn) (string, error) {
+	if err := cn.rw.Flush(); err != nil {
+		return "", err
+	}
+	line, err := readLine(cn.rw.Reader)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case line == "ERROR":
+		return "", fmt.Errorf("%w: unknown command", ErrClientError)
+	case strings.HasPrefix(line, "CLIENT_ERROR "):
+		return "", fmt.Errorf("%w: %s", ErrClientError, strings.TrimPrefix(line, "CLIENT_ERROR "))
+	case strings.HasPrefix(line, "SERVER_ERROR "):
+		return "", fmt.Errorf("%w: %s", ErrServerError, strings.TrimPrefix(line, "SERVER_ERROR "))
+	}
+	return line, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
@@ -0,0 +1,240 @@
+package client
+
+import (
+	"bufio"
+	commandsparser "ccmemcached/parser"
+	"ccmemcached/store"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// testServer is a minimal memcached speaking the subset of the text protocol
+// the client uses.
+type testServer struct {
+	addr     string
+	listener net.Listener
+	ht       *store.HashTable
+}
+
+func startTestServer(t *testing.T) *testServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{addr: listener.Addr().String(), listener: listener, ht: store.NewHashTable()}
+	t.Cleanup(s.stop)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) stop() {
+	s.listener.Close()
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	parser := commandsparser.NewParser()
+	for {
+		cmd, err := parser.Parse(reader)
+		if err != nil {
+			return
+		}
+		results := map[store.StoreResult]string{
+			store.Stored: "STORED", store.NotStored: "NOT_STORED", store.Exists: "EXISTS", store.NotFound: "NOT_FOUND",
+		}
+		var reply string
+		switch cmd.Name {
+		case commandsparser.GetsCommand:
+			for _, key := range cmd.Keys {
+				if item, ok := s.ht.Get(key); ok {
+					reply += fmt.Sprintf("VALUE %s %d %d %d\r\n%s\r\n", key, item.Flags, len(item.Data), item.CasUnique, item.Data)
+				}
+			}
+			reply += "END"
+		case commandsparser.SetCommand:
+			reply = results[s.ht.Set(cmd.Key, cmd.Flags, cmd.Expiry, cmd.Value)]
+		case commandsparser.AddCommand:
+			reply = results[s.ht.Add(cmd.Key, cmd.Flags, cmd.Expiry, cmd.Value)]
+		case commandsparser.CasCommand:
+			res, _ := s.ht.Store(store.ModeSet, cmd.Key, cmd.Flags, cmd.Expiry, cmd.Value, cmd.CasUnique)
+			reply = results[res]
+		case commandsparser.DeleteCommand:
+			reply = map[bool]string{true: "DELETED", false: "NOT_FOUND"}[s.ht.Delete(cmd.Key)]
+		case commandsparser.IncrCommand:
+			v, err := s.ht.Incr(cmd.Key, cmd.Delta)
+			switch err {
+			case nil:
+				reply = fmt.Sprint(v)
+			case store.ErrNotFound:
+				reply = "NOT_FOUND"
+			default:
+				reply = "CLIENT_ERROR " + err.Error()
+			}
+		case commandsparser.FlushAllCommand:
+			s.ht.FlushAll(0)
+			reply = "OK"
+		default:
+			reply = "ERROR"
+		}
+		conn.Write([]byte(reply + "\r\n"))
+	}
+}
+
+func TestClientCommands(t *testing.T) {
+	s := startTestServer(t)
+	c := New(s.addr)
+
+	if _, err := c.Get("key"); err != ErrCacheMiss {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+	if err := c.Set(&Item{Key: "key", Value: []byte("value"), Flags: 42}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	item, err := c.Get("key")
+	if err != nil || string(item.Value) != "value" || item.Flags != 42 || item.CasID == 0 {
+		t.Fatalf("unexpected item %+v (%v)", item, err)
+	}
+	if err := c.Add(&Item{Key: "key", Value: []byte("other")}); err != ErrNotStored {
+		t.Errorf("expected ErrNotStored, got %v", err)
+	}
+
+	stale := *item
+	item.Value = []byte("new")
+	if err := c.CompareAndSwap(item); err != nil {
+		t.Errorf("CompareAndSwap: %v", err)
+	}
+	if err := c.CompareAndSwap(&stale); err != ErrCASConflict {
+		t.Errorf("expected ErrCASConflict, got %v", err)
+	}
+
+	c.Set(&Item{Key: "counter", Value: []byte("1")})
+	if v, err := c.Increment("counter", 2); err != nil || v != 3 {
+		t.Errorf("expected 3, got %d (%v)", v, err)
+	}
+	if _, err := c.Increment("key", 1); !errors.Is(err, ErrClientError) {
+		t.Errorf("expected a client error, got %v", err)
+	}
+
+	if err := c.Delete("key"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := c.Delete("key"); err != ErrCacheMiss {
+		t.Errorf("expected ErrCacheMiss, got %v", err)
+	}
+	if err := c.Set(&Item{Key: "bad key"}); err != ErrMalformedKey {
+		t.Errorf("expected ErrMalformedKey, got %v", err)
+	}
+}
+
+func TestClientPoolsConnections(t *testing.T) {
+	s := startTestServer(t)
+	c := New(s.addr)
+	for i := 0; i < 10; i++ {
+		c.Set(&Item{Key: "key", Value: []byte("v")})
+		c.Get("missing")
+	}
+	if n := len(c.freeconn[s.addr]); n != 1 {
+		t.Errorf("expected a single pooled connection, got %d", n)
+	}
+}
+
+func TestClientClosesConnectionsAfterErrors(t *testing.T) {
+	s := startTestServer(t)
+	c := New(s.addr)
+	c.Set(&Item{Key: "key", Value: []byte("value")})
+	if _, err := c.Increment("key", 1); !errors.Is(err, ErrClientError) {
+		t.Fatalf("expected a client error, got %v", err)
+	}
+	if n := len(c.freeconn[s.addr]); n != 0 {
+		t.Errorf("expected the connection to be closed after a client error, got %d pooled", n)
+	}
+	// the server is still up
+	if _, err := c.Get("key"); err != nil {
+		t.Errorf("Get: %v", err)
+	}
+}
+
+func TestGetMultiAcrossServers(t *testing.T) {
+	servers := []*testServer{startTestServer(t), startTestServer(t), startTestServer(t)}
+	c := New(servers[0].addr, servers[1].addr, servers[2].addr)
+
+	var keys []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		if err := c.Set(&Item{Key: key, Value: []byte(key)}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for _, s := range servers {
+		if n := s.ht.Stats().CurrItems; n == 0 {
+			t.Errorf("server %s holds no keys", s.addr)
+		}
+	}
+
+	items, err := c.GetMulti(append(keys, "missing"))
+	if err != nil || len(items) != 100 {
+		t.Fatalf("expected 100 items, got %d (%v)", len(items), err)
+	}
+	if string(items["key-7"].Value) != "key-7" {
+		t.Errorf("unexpected value %q", items["key-7"].Value)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	a, b := startTestServer(t), startTestServer(t)
+	c := New(a.addr, b.addr)
+	c.RetryInterval = time.Hour
+
+	// find a key owned by a
+	key := "key-0"
+	for i := 1; c.ring.Get(key) != a.addr; i++ {
+		key = fmt.Sprintf("key-%d", i)
+	}
+	if err := c.Set(&Item{Key: key, Value: []byte("a")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	a.stop()
+	// drop the pooled connection too, as if the server crashed
+	closeIdle(c, a.addr)
+
+	// the idempotent get fails over to b, where the key is a miss
+	if _, err := c.Get(key); err != ErrCacheMiss {
+		t.Fatalf("expected a miss on the failover server, got %v", err)
+	}
+	if err := c.Set(&Item{Key: key, Value: []byte("b")}); err != nil {
+		t.Fatalf("Set after failover: %v", err)
+	}
+	if _, ok := b.ht.Get(key); !ok {
+		t.Error("expected the key to be stored on b")
+	}
+	items, err := c.GetMulti([]string{key})
+	if err != nil || string(items[key].Value) != "b" {
+		t.Errorf("unexpected GetMulti result %v (%v)", items, err)
+	}
+
+	b.stop()
+	closeIdle(c, b.addr)
+	if _, err := c.Get(key); err == nil {
+		t.Error("expected an error once every server is down")
+	}
+}
+
+func closeIdle(c *Client, addr string) {
+	for _, cn := range c.freeconn[addr] {
+		cn.nc.Close()
+	}
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"crypto/md5"
+	"fmt"
+	"sort"
+)
+
+// pointsPerServer is the number of points a server gets on the ring, like
+// libketama: 40 md5 digests of 4 points each.
+const pointsPerServer = 160
+
+type ringPoint struct {
+	hash   uint32
+	server string
+}
+
+// Ring is a ketama consistent hashing ring. Each server owns many points of a
+// 32 bit circle and a key goes to the server of the first point at or after
+// its hash, so adding or removing a server only moves the keys of that server.
+type Ring struct {
+	points  []ringPoint
+	servers []string
+}
+
+// NewRing places the servers on the ring, the keys are spread evenly between
+// them.
+func NewRing(servers ...string) *Ring {
+	r := &Ring{servers: append([]string(nil), servers...)}
+	for _, server := range servers {
+		for i := 0; i < pointsPerServer/4; i++ {
+			digest := md5.Sum([]byte(fmt.Sprintf("%s-%d", server, i)))
+			for h := 0; h < 4; h++ {
+				r.points = append(r.points, ringPoint{hash: ketamaHash(digest, h), server: server})
+			}
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].server < r.points[j].server
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// ketamaHash reads the h-th little endian uint32 of the digest.
+func ketamaHash(digest [md5.Size]byte, h int) uint32 {
+	return uint32(digest[3+h*4])<<24 | uint32(digest[2+h*4])<<16 | uint32(digest[1+h*4])<<8 | uint32(digest[h*4])
+}
+
+// Servers returns the servers of the ring.
+func (r *Ring) Servers() []string {
+	return r.servers
+}
+
+// Get returns the server owning key, "" if the ring is empty.
+func (r *Ring) Get(key string) string {
+	server, _ := r.Lookup(key, nil)
+	return server
+}
+
+// Lookup returns the server owning key among the servers up accepts, walking
+// the ring past the points of the others. This is how keys of a dead server
+// fail over to the next servers on the ring while the other keys stay put. A
+// nil up accepts every server.
+func (r *Ring) Lookup(key string, up func(server string) bool) (string, bool) {
+	if len(r.points) == 0 {
+		return "", false
+	}
+	hash := ketamaHash(md5.Sum([]byte(key)), 0)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+
+	var down map[string]bool
+	for i := 0; i < len(r.points) && len(down) < len(r.servers); i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if down[p.server] {
+			continue
+		}
+		if up == nil || up(p.server) {
+			return p.server, true
+		}
+		if down == nil {
+			down = make(map[string]bool)
+		}
+		down[p.server] = true
+	}
+	return "", false
+}
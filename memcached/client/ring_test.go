@@ -0,0 +1,51 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingSpreadsKeys(t *testing.T) {
+	servers := []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211"}
+	r := NewRing(servers...)
+	if len(r.points) != len(servers)*pointsPerServer {
+		t.Fatalf("expected %d points, got %d", len(servers)*pointsPerServer, len(r.points))
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		counts[r.Get(fmt.Sprintf("key-%d", i))]++
+	}
+	for _, s := range servers {
+		// each server should get roughly a third of the keys
+		if counts[s] < 7000 || counts[s] > 13000 {
+			t.Errorf("%s got %d of 30000 keys", s, counts[s])
+		}
+	}
+}
+
+func TestRingMovesOnlyTheKeysOfARemovedServer(t *testing.T) {
+	all := NewRing("a:1", "b:1", "c:1", "d:1")
+	without := NewRing("a:1", "b:1", "d:1")
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before := all.Get(key)
+		if before != "c:1" && without.Get(key) != before {
+			t.Fatalf("%s moved from %s to %s", key, before, without.Get(key))
+		}
+		// skipping a server that is down is the same as removing it
+		if got, _ := all.Lookup(key, func(s string) bool { return s != "c:1" }); got != without.Get(key) {
+			t.Fatalf("%s: lookup without c:1 gave %s, expected %s", key, got, without.Get(key))
+		}
+	}
+}
+
+func TestRingWithoutServers(t *testing.T) {
+	if s := NewRing().Get("key"); s != "" {
+		t.Errorf("expected no server, got %q", s)
+	}
+	r := NewRing("a:1", "b:1")
+	if s, ok := r.Lookup("key", func(string) bool { return false }); ok {
+		t.Errorf("expected no live server, got %q", s)
+	}
+}
@@ -0,0 +1,242 @@
+// memcached-proxy fronts several memcached servers: clients speak the text
+// protocol to the proxy, which routes every key to a backend with a ketama
+// ring. When a backend dies its keys fail over to the next backends on the
+// ring until it comes back.
+package main
+
+import (
+	"bufio"
+	"ccmemcached/client"
+	commandsparser "ccmemcached/parser"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type ProxyConfig struct {
+	Port          int
+	Backends      []string
+	RetryInterval time.Duration
+	Timeout       time.Duration
+	MaxIdleConns  int
+}
+
+func parseConfig() ProxyConfig {
+	var config ProxyConfig
+	var backends string
+	flag.IntVar(&config.Port, "p", 22122, "Port to listen on")
+	flag.StringVar(&backends, "backends", "127.0.0.1:11211", "Comma separated memcached servers (host:port)")
+	flag.DurationVar(&config.RetryInterval, "retry", client.DefaultRetryInterval, "How long a failed backend is skipped")
+	flag.DurationVar(&config.Timeout, "timeout", client.DefaultTimeout, "Backend dial and request timeout")
+	flag.IntVar(&config.MaxIdleConns, "idle", 8, "Idle connections kept per backend")
+	flag.Parse()
+	for _, b := range strings.Split(backends, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			config.Backends = append(config.Backends, b)
+		}
+	}
+	return config
+}
+
+func main() {
+	config := parseConfig()
+	if len(config.Backends) == 0 {
+		slog.Error("No backends given")
+		os.Exit(2)
+	}
+	mc := client.New(config.Backends...)
+	mc.RetryInterval = config.RetryInterval
+	mc.Timeout = config.Timeout
+	mc.MaxIdleConns = config.MaxIdleConns
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
+	if err != nil {
+		slog.Error("Error starting proxy", "err", err)
+		os.Exit(1)
+	}
+	slog.Info("Starting proxy", "port", config.Port, "backends", config.Backends)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		slog.Info("Shutting down proxy...")
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("Error accepting connection", "err", err)
+			continue
+		}
+		go handleConnection(conn, mc)
+	}
+}
+
+func handleConnection(conn net.Conn, mc *client.Client) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	parser := commandsparser.NewParser()
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Minute)); err != nil {
+			return
+		}
+		cmd, err := parser.Parse(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return
+			}
+			if errors.Is(err, commandsparser.ErrTooLarge) {
+				writeResponse(writer, false, "SERVER_ERROR "+err.Error())
+			} else {
+				writeResponse(writer, false, "ERROR")
+			}
+		} else {
+			switch cmd.Name {
+			case commandsparser.QuitCommand, commandsparser.ExitCommand, commandsparser.EndCommand:
+				writer.Flush()
+				return
+			}
+			handleCommand(cmd, mc, writer)
+		}
+		// answer pipelined commands together
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				slog.Debug("Error writing response", "err", err)
+				return
+			}
+		}
+	}
+}
+
+// handleCommand forwards the command to the backend owning its key and
+// translates the outcome back to the text protocol.
+func handleCommand(cmd *commandsparser.Command, mc *client.Client, w *bufio.Writer) {
+	switch cmd.Name {
+	case commandsparser.GetCommand, commandsparser.GetsCommand:
+		items, err := mc.GetMulti(cmd.Keys)
+		if err != nil && !errors.Is(err, client.ErrNoServers) {
+			writeError(w, false, err)
+			return
+		}
+		// a key without a live backend is a miss
+		for _, key := range cmd.Keys {
+			item, ok := items[key]
+			if !ok {
+				continue
+			}
+			line := fmt.Sprintf("VALUE %s %d %d", key, item.Flags, len(item.Value))
+			if cmd.Name == commandsparser.GetsCommand {
+				line += fmt.Sprintf(" %d", item.CasID)
+			}
+			writeResponse(w, false, line)
+			writeResponse(w, false, string(item.Value))
+		}
+		writeResponse(w, false, "END")
+	case commandsparser.SetCommand, commandsparser.AddCommand, commandsparser.ReplaceCommand,
+		commandsparser.AppendCommand, commandsparser.PrependCommand, commandsparser.CasCommand:
+		item := &client.Item{
+			Key:        cmd.Key,
+			Value:      cmd.Value,
+			Flags:      cmd.Flags,
+			Expiration: int32(cmd.Expiry),
+			CasID:      cmd.CasUnique,
+		}
+		store := map[commandsparser.CommandName]func(*client.Item) error{
+			commandsparser.SetCommand:     mc.Set,
+			commandsparser.AddCommand:     mc.Add,
+			commandsparser.ReplaceCommand: mc.Replace,
+			commandsparser.AppendCommand:  mc.Append,
+			commandsparser.PrependCommand: mc.Prepend,
+			commandsparser.CasCommand:     mc.CompareAndSwap,
+		}[cmd.Name]
+		switch err := store(item); {
+		case err == nil:
+			writeResponse(w, cmd.Noreply, "STORED")
+		case errors.Is(err, client.ErrNotStored):
+			writeResponse(w, cmd.Noreply, "NOT_STORED")
+		case errors.Is(err, client.ErrCASConflict):
+			writeResponse(w, cmd.Noreply, "EXISTS")
+		case errors.Is(err, client.ErrCacheMiss):
+			writeResponse(w, cmd.Noreply, "NOT_FOUND")
+		default:
+			writeError(w, cmd.Noreply, err)
+		}
+	case commandsparser.DeleteCommand:
+		writeKeyResult(w, cmd.Noreply, "DELETED", mc.Delete(cmd.Key))
+	case commandsparser.TouchCommand:
+		writeKeyResult(w, cmd.Noreply, "TOUCHED", mc.Touch(cmd.Key, int32(cmd.Expiry)))
+	case commandsparser.IncrCommand, commandsparser.DecrCommand:
+		incr := mc.Increment
+		if cmd.Name == commandsparser.DecrCommand {
+			incr = mc.Decrement
+		}
+		value, err := incr(cmd.Key, cmd.Delta)
+		writeKeyResult(w, cmd.Noreply, strconv.FormatUint(value, 10), err)
+	case commandsparser.FlushAllCommand:
+		if err := mc.FlushAll(); err != nil {
+			writeError(w, cmd.Noreply, err)
+			return
+		}
+		writeResponse(w, cmd.Noreply, "OK")
+	case commandsparser.VersionCommand:
+		writeResponse(w, false, "VERSION memcached-proxy")
+	default:
+		writeResponse(w, false, "ERROR")
+	}
+}
+
+// writeKeyResult writes ok, NOT_FOUND on a miss or the error.
+func writeKeyResult(w *bufio.Writer, noreply bool, ok string, err error) {
+	switch {
+	case err == nil:
+		writeResponse(w, noreply, ok)
+	case errors.Is(err, client.ErrCacheMiss):
+		writeResponse(w, noreply, "NOT_FOUND")
+	default:
+		writeError(w, noreply, err)
+	}
+}
+
+// writeError reports a failure: errors of the backend are passed through,
+// failing backends are a SERVER_ERROR.
+func writeError(w *bufio.Writer, noreply bool, err error) {
+	switch {
+	case errors.Is(err, client.ErrClientError):
+		writeResponse(w, noreply, "CLIENT_ERROR "+strings.TrimPrefix(err.Error(), client.ErrClientError.Error()+": "))
+	case errors.Is(err, client.ErrServerError):
+		writeResponse(w, noreply, "SERVER_ERROR "+strings.TrimPrefix(err.Error(), client.ErrServerError.Error()+": "))
+	case errors.Is(err, client.ErrMalformedKey):
+		writeResponse(w, noreply, "CLIENT_ERROR bad command line format")
+	default:
+		slog.Warn("Backend request failed", "err", err)
+		writeResponse(w, noreply, "SERVER_ERROR backend unavailable")
+	}
+}
+
+// writeResponse writes a line terminated by \r\n unless the client asked for
+// noreply.
+func writeResponse(w *bufio.Writer, noreply bool, line string) {
+	if noreply {
+		return
+	}
+	w.WriteString(line + "\r\n")
+}
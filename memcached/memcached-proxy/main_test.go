@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"ccmemcached/client"
+	commandsparser "ccmemcached/parser"
+	"ccmemcached/store"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// backend is a memcached speaking the text commands the client sends, it
+// can be stopped like a crashed server.
+type backend struct {
+	addr     string
+	listener net.Listener
+	ht       *store.HashTable
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startBackend(t *testing.T) *backend {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &backend{addr: listener.Addr().String(), listener: listener, ht: store.NewHashTable()}
+	t.Cleanup(b.stop)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns = append(b.conns, conn)
+			b.mu.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// stop closes the listener and the open connections.
+func (b *backend) stop() {
+	b.listener.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+}
+
+func (b *backend) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	parser := commandsparser.NewParser()
+	results := map[store.StoreResult]string{
+		store.Stored: "STORED", store.NotStored: "NOT_STORED", store.Exists: "EXISTS", store.NotFound: "NOT_FOUND",
+	}
+	for {
+		cmd, err := parser.Parse(reader)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch cmd.Name {
+		case commandsparser.GetsCommand:
+			for _, key := range cmd.Keys {
+				if item, ok := b.ht.Get(key); ok {
+					reply += fmt.Sprintf("VALUE %s %d %d %d\r\n%s\r\n", key, item.Flags, len(item.Data), item.CasUnique, item.Data)
+				}
+			}
+			reply += "END"
+		case commandsparser.SetCommand:
+			reply = results[b.ht.Set(cmd.Key, cmd.Flags, cmd.Expiry, cmd.Value)]
+		case commandsparser.DeleteCommand:
+			reply = map[bool]string{true: "DELETED", false: "NOT_FOUND"}[b.ht.Delete(cmd.Key)]
+		default:
+			reply = "ERROR"
+		}
+		conn.Write([]byte(reply + "\r\n"))
+	}
+}
+
+// proxyConn is a client connection to the proxy over a pipe.
+type proxyConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func connectProxy(t *testing.T, mc *client.Client) *proxyConn {
+	t.Helper()
+	conn, remote := net.Pipe()
+	go handleConnection(conn, mc)
+	t.Cleanup(func() { remote.Close() })
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	return &proxyConn{t: t, conn: remote, reader: bufio.NewReader(remote)}
+}
+
+// expect sends the request and checks the lines of the response.
+func (c *proxyConn) expect(request string, lines ...string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(request)); err != nil {
+		c.t.Fatal(err)
+	}
+	for _, want := range lines {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("%q: %v", request, err)
+		}
+		if got := strings.TrimSuffix(line, "\r\n"); got != want {
+			c.t.Fatalf("%q: expected %q, got %q", request, want, got)
+		}
+	}
+}
+
+func TestProxyRouting(t *testing.T) {
+	backends := []*backend{startBackend(t), startBackend(t)}
+	mc := client.New(backends[0].addr, backends[1].addr)
+	c := connectProxy(t, mc)
+	ring := client.NewRing(backends[0].addr, backends[1].addr)
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		c.expect(fmt.Sprintf("set %s 3 0 %d\r\n%s\r\n", key, len(key), key), "STORED")
+		// the key is on the backend the ketama ring picks, and only there
+		for _, b := range backends {
+			if _, ok := b.ht.Get(key); ok != (ring.Get(key) == b.addr) {
+				t.Errorf("%s: stored on %s is %v, the ring picks %s", key, b.addr, ok, ring.Get(key))
+			}
+		}
+	}
+	for _, b := range backends {
+		if n := b.ht.Stats().CurrItems; n == 0 {
+			t.Errorf("backend %s holds no keys", b.addr)
+		}
+	}
+
+	c.expect("get key-1 missing key-2\r\n", "VALUE key-1 3 5", "key-1", "VALUE key-2 3 5", "key-2", "END")
+	c.expect("delete key-1\r\n", "DELETED")
+	c.expect("delete key-1\r\n", "NOT_FOUND")
+	c.expect("version\r\n", "VERSION memcached-proxy")
+}
+
+func TestProxyFailover(t *testing.T) {
+	a, b := startBackend(t), startBackend(t)
+	mc := client.New(a.addr, b.addr)
+	mc.RetryInterval = time.Hour
+	c := connectProxy(t, mc)
+	ring := client.NewRing(a.addr, b.addr)
+
+	var onA, onB string
+	for i := 0; onA == "" || onB == ""; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if ring.Get(key) == a.addr {
+			onA = key
+		} else {
+			onB = key
+		}
+	}
+	c.expect("set "+onA+" 0 0 1\r\na\r\n", "STORED")
+	c.expect("set "+onB+" 0 0 1\r\nb\r\n", "STORED")
+
+	a.stop()
+	// the keys of a fail over to b, where they are misses
+	c.expect("get "+onA+" "+onB+"\r\n", "VALUE "+onB+" 0 1", "b", "END")
+	c.expect("set "+onA+" 0 0 1\r\nc\r\n", "STORED")
+	if item, ok := b.ht.Get(onA); !ok || string(item.Data) != "c" {
+		t.Errorf("expected the key of the stopped backend to be stored on b, got %q", item.Data)
+	}
+	c.expect("get "+onA+"\r\n", "VALUE "+onA+" 0 1", "c", "END")
+
+	b.stop()
+	c.expect("set "+onB+" 0 0 1\r\nd\r\n", "SERVER_ERROR backend unavailable")
+	c.expect("get "+onB+"\r\n", "END")
+}
@@ -2,39 +2,93 @@ package commandsparser
 
 import (
 	"bufio"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
+
+	"ccmemcached/store"
 )
 
 type CommandName string
 
 const (
 	// Commands
-	SetCommand    CommandName = "set"
-	GetCommand    CommandName = "get"
-	DeleteCommand CommandName = "delete"
-	ExitCommand   CommandName = "exit"
-	EndCommand    CommandName = "end"
+	SetCommand     CommandName = "set"
+	AddCommand     CommandName = "add"
+	ReplaceCommand CommandName = "replace"
+	AppendCommand  CommandName = "append"
+	PrependCommand CommandName = "prepend"
+	CasCommand     CommandName = "cas"
+	GetCommand     CommandName = "get"
+	GetsCommand    CommandName = "gets"
+	GatCommand     CommandName = "gat"
+	GatsCommand    CommandName = "gats"
+	DeleteCommand  CommandName = "delete"
+	IncrCommand    CommandName = "incr"
+	DecrCommand    CommandName = "decr"
+	TouchCommand   CommandName = "touch"
+	StatsCommand   CommandName = "stats"
+
+	// Server commands
+	FlushAllCommand  CommandName = "flush_all"
+	VersionCommand   CommandName = "version"
+	VerbosityCommand CommandName = "verbosity"
+	QuitCommand      CommandName = "quit"
+
+	// Meta commands
+	MetaGetCommand        CommandName = "mg"
+	MetaSetCommand        CommandName = "ms"
+	MetaDeleteCommand     CommandName = "md"
+	MetaArithmeticCommand CommandName = "ma"
+	MetaNoopCommand       CommandName = "mn"
+	ExitCommand           CommandName = "exit"
+	EndCommand            CommandName = "end"
 )
 
 var (
 	ErrInvalidCommand = fmt.Errorf("invalid command")
 	ErrInvalidFormat  = fmt.Errorf("invalid command format")
+	// ErrTooLarge is returned for a data block larger than the largest item,
+	// the block is discarded so the connection stays usable
+	ErrTooLarge = fmt.Errorf("object too large for cache")
 )
 
 // StorageCommand represents a storage command
 // <command name> <key> <flags> <exptime> <bytes> [noreply]\r\n
+// cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]\r\n
 // <data block>\r\n
 type Command struct {
-	Name    CommandName
-	Key     string
-	Value   []byte
-	Flags   uint32
-	Expiry  int64
-	Bytes   uint32
-	Noreply bool
+	Name      CommandName
+	Key       string
+	Keys      []string // get/gets/gat/gats accept several keys, Key is the first
+	Value     []byte
+	Flags     uint32
+	Expiry    int64
+	Bytes     uint32
+	CasUnique uint64   // cas
+	Delta     uint64   // incr/decr, the level of verbosity
+	Args      []string // stats
+	MetaFlags []MetaFlag
+	Noreply   bool
+}
+
+// MetaFlag is a flag of a meta command: a single letter, optionally followed
+// by a token (e.g. "v", "T30", "Oopaque").
+type MetaFlag struct {
+	Name  byte
+	Token string
+}
+
+// MetaFlag returns the token of the meta flag and whether the flag was given.
+func (c *Command) MetaFlag(name byte) (string, bool) {
+	for _, f := range c.MetaFlags {
+		if f.Name == name {
+			return f.Token, true
+		}
+	}
+	return "", false
 }
 
 type Parser struct{}
@@ -57,13 +111,30 @@ func (cp *Parser) Parse(reader io.Reader) (*Command, error) {
 	cmd := &Command{Name: CommandName(fields[0])}
 
 	switch cmd.Name {
-	case SetCommand:
+	case SetCommand, AddCommand, ReplaceCommand, AppendCommand, PrependCommand, CasCommand:
 		return cp.parseSet(fields, buffReader)
-	case GetCommand:
+	case GetCommand, GetsCommand:
 		return cp.parseGet(fields)
+	case GatCommand, GatsCommand:
+		return cp.parseGat(fields)
 	case DeleteCommand:
 		return cp.parseDelete(fields)
-	case ExitCommand, EndCommand:
+	case IncrCommand, DecrCommand:
+		return cp.parseIncr(fields)
+	case TouchCommand:
+		return cp.parseTouch(fields)
+	case MetaGetCommand, MetaSetCommand, MetaDeleteCommand, MetaArithmeticCommand:
+		return cp.parseMeta(fields, buffReader)
+	case MetaNoopCommand:
+		return &Command{Name: MetaNoopCommand}, nil
+	case StatsCommand:
+		// stats [<args>]
+		return &Command{Name: StatsCommand, Args: fields[1:]}, nil
+	case FlushAllCommand:
+		return cp.parseFlushAll(fields)
+	case VerbosityCommand:
+		return cp.parseVerbosity(fields)
+	case VersionCommand, QuitCommand, ExitCommand, EndCommand:
 		return cmd, nil
 	default:
 		return nil, fmt.Errorf("Unknown command")
@@ -72,14 +143,16 @@ func (cp *Parser) Parse(reader io.Reader) (*Command, error) {
 }
 
 func (cp *Parser) parseSet(fields []string, reader *bufio.Reader) (*Command, error) {
-
-	if len(fields) < 5 {
-		return nil, ErrInvalidCommand
+	cmd := &Command{Name: CommandName(fields[0])}
+	// cas carries the unique of the fetched item before noreply
+	argc := 5
+	if cmd.Name == CasCommand {
+		argc = 6
 	}
-	cmd := &Command{
-		Name: SetCommand,
-		Key:  fields[1],
+	if len(fields) < argc {
+		return nil, ErrInvalidCommand
 	}
+	cmd.Key = fields[1]
 	var err error
 
 	if cmd.Flags, err = parseUint32(fields[2]); err != nil {
@@ -91,9 +164,29 @@ func (cp *Parser) parseSet(fields []string, reader *bufio.Reader) (*Command, err
 	if cmd.Bytes, err = parseUint32(fields[4]); err != nil {
 		return nil, fmt.Errorf("parsing bytes: %w", err)
 	}
-	cmd.Noreply = len(fields) == 6 && fields[5] == "noreply"
-	cmd.Value = make([]byte, cmd.Bytes)
-	if _, err := io.ReadFull(reader, cmd.Value); err != nil {
+	if cmd.Name == CasCommand {
+		if cmd.CasUnique, err = strconv.ParseUint(fields[5], 10, 64); err != nil {
+			return nil, fmt.Errorf("parsing cas unique: %w", err)
+		}
+	}
+	cmd.Noreply = len(fields) == argc+1 && fields[argc] == "noreply"
+	if cmd.Value, err = readValue(reader, cmd.Bytes); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// readValue reads a data block of size bytes and its trailing \r\n. A block
+// larger than the largest item is discarded rather than allocated.
+func readValue(reader *bufio.Reader, size uint32) ([]byte, error) {
+	if size > store.ItemSizeMax {
+		if _, err := reader.Discard(int(size) + 2); err != nil {
+			return nil, fmt.Errorf("discarding value: %w", err)
+		}
+		return nil, ErrTooLarge
+	}
+	value := make([]byte, size)
+	if _, err := io.ReadFull(reader, value); err != nil {
 		return nil, fmt.Errorf("reading value: %w", err)
 	}
 
@@ -101,8 +194,7 @@ func (cp *Parser) parseSet(fields []string, reader *bufio.Reader) (*Command, err
 	if _, err := reader.ReadString('\n'); err != nil {
 		return nil, fmt.Errorf("reading trailing newline: %w", err)
 	}
-
-	return cmd, nil
+	return value, nil
 }
 
 func (p *Parser) parseGet(fields []string) (*Command, error) {
@@ -111,11 +203,66 @@ func (p *Parser) parseGet(fields []string) (*Command, error) {
 	}
 
 	return &Command{
-		Name: GetCommand,
+		Name: CommandName(fields[0]),
 		Key:  fields[1],
+		Keys: fields[1:],
 	}, nil
 
 }
+
+// gat <exptime> <key>*\r\n
+func (p *Parser) parseGat(fields []string) (*Command, error) {
+	if len(fields) < 3 {
+		return nil, ErrInvalidFormat
+	}
+	expiry, err := parseInt64(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("parsing expiry: %w", err)
+	}
+
+	return &Command{
+		Name:   CommandName(fields[0]),
+		Key:    fields[2],
+		Keys:   fields[2:],
+		Expiry: expiry,
+	}, nil
+}
+
+// incr|decr <key> <value> [noreply]\r\n
+func (p *Parser) parseIncr(fields []string) (*Command, error) {
+	if len(fields) < 3 {
+		return nil, ErrInvalidFormat
+	}
+	delta, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parsing delta: %w", err)
+	}
+
+	return &Command{
+		Name:    CommandName(fields[0]),
+		Key:     fields[1],
+		Delta:   delta,
+		Noreply: len(fields) == 4 && fields[3] == "noreply",
+	}, nil
+}
+
+// touch <key> <exptime> [noreply]\r\n
+func (p *Parser) parseTouch(fields []string) (*Command, error) {
+	if len(fields) < 3 {
+		return nil, ErrInvalidFormat
+	}
+	expiry, err := parseInt64(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("parsing expiry: %w", err)
+	}
+
+	return &Command{
+		Name:    TouchCommand,
+		Key:     fields[1],
+		Expiry:  expiry,
+		Noreply: len(fields) == 4 && fields[3] == "noreply",
+	}, nil
+}
 func (p *Parser) parseDelete(fields []string) (*Command, error) {
 	if len(fields) < 2 {
 		return nil, ErrInvalidFormat
@@ -128,6 +275,83 @@ func (p *Parser) parseDelete(fields []string) (*Command, error) {
 	}, nil
 }
 
+// flush_all [delay] [noreply]\r\n
+func (p *Parser) parseFlushAll(fields []string) (*Command, error) {
+	cmd := &Command{Name: FlushAllCommand}
+	args := fields[1:]
+	if len(args) > 0 && args[len(args)-1] == "noreply" {
+		cmd.Noreply = true
+		args = args[:len(args)-1]
+	}
+	if len(args) > 1 {
+		return nil, ErrInvalidFormat
+	}
+	if len(args) == 1 {
+		delay, err := parseInt64(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("parsing delay: %w", err)
+		}
+		cmd.Expiry = delay
+	}
+	return cmd, nil
+}
+
+// verbosity <level> [noreply]\r\n
+func (p *Parser) parseVerbosity(fields []string) (*Command, error) {
+	if len(fields) < 2 {
+		return nil, ErrInvalidFormat
+	}
+	level, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parsing level: %w", err)
+	}
+
+	return &Command{
+		Name:    VerbosityCommand,
+		Delta:   level,
+		Noreply: len(fields) == 3 && fields[2] == "noreply",
+	}, nil
+}
+
+// mg|md|ma <key> <flags>*\r\n
+// ms <key> <datalen> <flags>*\r\n
+// <data block>\r\n
+func (p *Parser) parseMeta(fields []string, reader *bufio.Reader) (*Command, error) {
+	cmd := &Command{Name: CommandName(fields[0])}
+	flagsAt := 2
+	if cmd.Name == MetaSetCommand {
+		flagsAt = 3
+	}
+	if len(fields) < flagsAt {
+		return nil, ErrInvalidFormat
+	}
+	cmd.Key = fields[1]
+
+	for _, field := range fields[flagsAt:] {
+		cmd.MetaFlags = append(cmd.MetaFlags, MetaFlag{Name: field[0], Token: field[1:]})
+	}
+	// b: the key is base64 encoded, so it can hold any byte
+	if _, ok := cmd.MetaFlag('b'); ok {
+		key, err := base64.StdEncoding.DecodeString(cmd.Key)
+		if err != nil {
+			return nil, fmt.Errorf("decoding base64 key: %w", err)
+		}
+		cmd.Key = string(key)
+	}
+	_, cmd.Noreply = cmd.MetaFlag('q')
+
+	if cmd.Name == MetaSetCommand {
+		var err error
+		if cmd.Bytes, err = parseUint32(fields[2]); err != nil {
+			return nil, fmt.Errorf("parsing bytes: %w", err)
+		}
+		if cmd.Value, err = readValue(reader, cmd.Bytes); err != nil {
+			return nil, err
+		}
+	}
+	return cmd, nil
+}
+
 func parseUint32(s string) (uint32, error) {
 	v, err := strconv.ParseUint(s, 10, 32)
 	return uint32(v), err
@@ -1,9 +1,14 @@
 package commandsparser
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
+
+	"ccmemcached/store"
 )
 
 func TestNewCommandsParser(t *testing.T) {
@@ -91,3 +96,193 @@ func TestDeleteCommand(t *testing.T) {
 		t.Error("Expected value to be empty")
 	}
 }
+
+func TestCasCommand(t *testing.T) {
+	cp := NewParser()
+	reader := bytes.NewReader([]byte("cas key 3 0 5 42 noreply\r\nvalue\r\n"))
+	cmd, err := cp.Parse(reader)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cmd.Name != CasCommand {
+		t.Errorf("Expected Name to be %s, got %s", CasCommand, cmd.Name)
+	}
+	if cmd.Flags != 3 || cmd.CasUnique != 42 || !cmd.Noreply {
+		t.Errorf("Expected flags 3, cas unique 42 and noreply, got %+v", cmd)
+	}
+	if string(cmd.Value) != "value" {
+		t.Error("Expected value to be value")
+	}
+
+	// the cas unique is required
+	if _, err := cp.Parse(bytes.NewReader([]byte("cas key 0 0 5\r\nvalue\r\n"))); err == nil {
+		t.Error("Expected an error for cas without a cas unique")
+	}
+}
+
+func TestStorageCommands(t *testing.T) {
+	cp := NewParser()
+	for _, name := range []CommandName{AddCommand, ReplaceCommand, AppendCommand, PrependCommand} {
+		reader := bytes.NewReader([]byte(string(name) + " key 0 100 2\r\nab\r\n"))
+		cmd, err := cp.Parse(reader)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", name, err)
+		}
+		if cmd.Name != name || cmd.Expiry != 100 || string(cmd.Value) != "ab" {
+			t.Errorf("%s: unexpected command %+v", name, cmd)
+		}
+	}
+}
+
+func TestIncrDecrCommands(t *testing.T) {
+	cp := NewParser()
+	cmd, err := cp.Parse(bytes.NewReader([]byte("incr counter 18446744073709551615\r\n")))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cmd.Name != IncrCommand || cmd.Key != "counter" || cmd.Delta != 18446744073709551615 {
+		t.Errorf("unexpected command %+v", cmd)
+	}
+
+	cmd, err = cp.Parse(bytes.NewReader([]byte("decr counter 5 noreply\r\n")))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cmd.Name != DecrCommand || cmd.Delta != 5 || !cmd.Noreply {
+		t.Errorf("unexpected command %+v", cmd)
+	}
+
+	if _, err := cp.Parse(bytes.NewReader([]byte("incr counter -1\r\n"))); err == nil {
+		t.Error("Expected an error for a negative delta")
+	}
+}
+
+func TestTouchAndGatCommands(t *testing.T) {
+	cp := NewParser()
+	cmd, err := cp.Parse(bytes.NewReader([]byte("touch key 60\r\n")))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cmd.Name != TouchCommand || cmd.Key != "key" || cmd.Expiry != 60 {
+		t.Errorf("unexpected command %+v", cmd)
+	}
+
+	cmd, err = cp.Parse(bytes.NewReader([]byte("gats 60 key\r\n")))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cmd.Name != GatsCommand || cmd.Key != "key" || cmd.Expiry != 60 {
+		t.Errorf("unexpected command %+v", cmd)
+	}
+}
+
+func TestMultiKeyGet(t *testing.T) {
+	cp := NewParser()
+	cmd, err := cp.Parse(bytes.NewReader([]byte("get k1 k2 k3\r\n")))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(cmd.Keys) != 3 || cmd.Keys[0] != "k1" || cmd.Keys[2] != "k3" {
+		t.Errorf("Expected keys k1 k2 k3, got %v", cmd.Keys)
+	}
+
+	cmd, err = cp.Parse(bytes.NewReader([]byte("gat 10 k1 k2\r\n")))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(cmd.Keys) != 2 || cmd.Keys[1] != "k2" {
+		t.Errorf("Expected keys k1 k2, got %v", cmd.Keys)
+	}
+}
+
+func TestMetaCommands(t *testing.T) {
+	cp := NewParser()
+	cmd, err := cp.Parse(bytes.NewReader([]byte("mg key v c T30 Oabc q\r\n")))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cmd.Name != MetaGetCommand || cmd.Key != "key" || !cmd.Noreply {
+		t.Errorf("unexpected command %+v", cmd)
+	}
+	if ttl, ok := cmd.MetaFlag('T'); !ok || ttl != "30" {
+		t.Errorf("Expected T30, got %q", ttl)
+	}
+	if opaque, ok := cmd.MetaFlag('O'); !ok || opaque != "abc" {
+		t.Errorf("Expected Oabc, got %q", opaque)
+	}
+	if _, ok := cmd.MetaFlag('s'); ok {
+		t.Error("Expected no s flag")
+	}
+
+	cmd, err = cp.Parse(bytes.NewReader([]byte("ms a2V5 5 b F3 MA\r\nvalue\r\n")))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cmd.Name != MetaSetCommand || cmd.Key != "key" || string(cmd.Value) != "value" {
+		t.Errorf("unexpected command %+v", cmd)
+	}
+	if mode, _ := cmd.MetaFlag('M'); mode != "A" {
+		t.Errorf("Expected mode A, got %q", mode)
+	}
+
+	cmd, err = cp.Parse(bytes.NewReader([]byte("mn\r\n")))
+	if err != nil || cmd.Name != MetaNoopCommand {
+		t.Errorf("Expected mn, got %+v (%v)", cmd, err)
+	}
+
+	if _, err := cp.Parse(bytes.NewReader([]byte("ms key\r\n"))); err == nil {
+		t.Error("Expected an error for ms without a data length")
+	}
+}
+
+func TestValueTooLarge(t *testing.T) {
+	cp := NewParser()
+	size := store.ItemSizeMax + 1
+	value := strings.Repeat("x", size) + "\r\n"
+	requests := []string{
+		fmt.Sprintf("set key 0 0 %d\r\n", size),
+		fmt.Sprintf("ms key %d T0\r\n", size),
+	}
+	for _, request := range requests {
+		reader := bufio.NewReader(strings.NewReader(request + value + "get key\r\n"))
+		if _, err := cp.Parse(reader); !errors.Is(err, ErrTooLarge) {
+			t.Fatalf("%q: expected ErrTooLarge, got %v", request, err)
+		}
+		// the data block is discarded, the next command follows it
+		cmd, err := cp.Parse(reader)
+		if err != nil || cmd.Name != GetCommand {
+			t.Errorf("%q: expected get after the data block, got %+v (%v)", request, cmd, err)
+		}
+	}
+}
+
+func TestServerCommands(t *testing.T) {
+	cp := NewParser()
+	cmd, err := cp.Parse(bytes.NewReader([]byte("flush_all\r\n")))
+	if err != nil || cmd.Name != FlushAllCommand || cmd.Expiry != 0 || cmd.Noreply {
+		t.Errorf("unexpected command %+v (%v)", cmd, err)
+	}
+	cmd, err = cp.Parse(bytes.NewReader([]byte("flush_all 10 noreply\r\n")))
+	if err != nil || cmd.Expiry != 10 || !cmd.Noreply {
+		t.Errorf("unexpected command %+v (%v)", cmd, err)
+	}
+	cmd, err = cp.Parse(bytes.NewReader([]byte("flush_all noreply\r\n")))
+	if err != nil || cmd.Expiry != 0 || !cmd.Noreply {
+		t.Errorf("unexpected command %+v (%v)", cmd, err)
+	}
+
+	cmd, err = cp.Parse(bytes.NewReader([]byte("verbosity 1\r\n")))
+	if err != nil || cmd.Name != VerbosityCommand || cmd.Delta != 1 {
+		t.Errorf("unexpected command %+v (%v)", cmd, err)
+	}
+	if _, err := cp.Parse(bytes.NewReader([]byte("verbosity\r\n"))); err == nil {
+		t.Error("Expected an error for verbosity without a level")
+	}
+
+	for _, name := range []CommandName{VersionCommand, QuitCommand} {
+		cmd, err := cp.Parse(bytes.NewReader([]byte(string(name) + "\r\n")))
+		if err != nil || cmd.Name != name {
+			t.Errorf("Expected %s, got %+v (%v)", name, cmd, err)
+		}
+	}
+}
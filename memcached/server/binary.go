@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"ccmemcached/store"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Binary protocol, see
+// https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped.
+
+const (
+	binaryRequestMagic  = 0x80
+	binaryResponseMagic = 0x81
+	binaryHeaderSize    = 24
+	// binaryMaxBodySize bounds the body of a request, values larger than a
+	// slab page cannot be stored anyway.
+	binaryMaxBodySize = 2 << 20
+)
+
+const (
+	opGet       = 0x00
+	opSet       = 0x01
+	opAdd       = 0x02
+	opReplace   = 0x03
+	opDelete    = 0x04
+	opIncrement = 0x05
+	opDecrement = 0x06
+	opQuit      = 0x07
+	opFlush     = 0x08
+	opGetQ      = 0x09
+	opNoop      = 0x0a
+	opVersion   = 0x0b
+	opGetK      = 0x0c
+	opGetKQ     = 0x0d
+	opAppend    = 0x0e
+	opPrepend   = 0x0f
+	opSetQ      = 0x11
+	opAddQ      = 0x12
+	opReplaceQ  = 0x13
+	opDeleteQ   = 0x14
+	opIncrQ     = 0x15
+	opDecrQ     = 0x16
+	opQuitQ     = 0x17
+	opFlushQ    = 0x18
+	opAppendQ   = 0x19
+	opPrependQ  = 0x1a
+	opTouch     = 0x1c
+	opGAT       = 0x1d
+	opGATQ      = 0x1e
+	opGATK      = 0x23
+	opGATKQ     = 0x24
+)
+
+const (
+	statusOK             = 0x00
+	statusKeyNotFound    = 0x01
+	statusKeyExists      = 0x02
+	statusValueTooLarge  = 0x03
+	statusInvalidArgs    = 0x04
+	statusNotStored      = 0x05
+	statusNonNumeric     = 0x06
+	statusUnknownCommand = 0x81
+	statusOutOfMemory    = 0x82
+)
+
+// quietOpcodes maps the quiet variants to the command they are quiet for.
+var quietOpcodes = map[byte]byte{
+	opGetQ:     opGet,
+	opGetKQ:    opGetK,
+	opSetQ:     opSet,
+	opAddQ:     opAdd,
+	opReplaceQ: opReplace,
+	opDeleteQ:  opDelete,
+	opIncrQ:    opIncrement,
+	opDecrQ:    opDecrement,
+	opQuitQ:    opQuit,
+	opFlushQ:   opFlush,
+	opAppendQ:  opAppend,
+	opPrependQ: opPrepend,
+	opGATQ:     opGAT,
+	opGATKQ:    opGATK,
+}
+
+var statusMessages = map[uint16]string{
+	statusKeyNotFound:    "Not found",
+	statusKeyExists:      "Data exists for key.",
+	statusValueTooLarge:  "Too large.",
+	statusInvalidArgs:    "Invalid arguments",
+	statusNotStored:      "Not stored.",
+	statusNonNumeric:     "Non-numeric server-side value for incr or decr",
+	statusUnknownCommand: "Unknown command",
+	statusOutOfMemory:    "Out of memory",
+}
+
+var (
+	errBadMagic = errors.New("invalid request magic")
+	errBadBody  = errors.New("invalid request body length")
+)
+
+type binaryRequest struct {
+	raw    byte // opcode as sent, answered back in the response
+	opcode byte
+	quiet  bool
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    string
+	value  []byte
+}
+
+type binaryResponse struct {
+	status uint16
+	cas    uint64
+	extras []byte
+	key    string
+	value  []byte
+}
+
+// handleBinaryConnection serves a client speaking the binary protocol until it
+// quits or the connection fails. Responses are buffered and flushed once all
+// the pipelined requests read so far have been answered.
+func (s *Server) handleBinaryConnection(conn net.Conn, reader *bufio.Reader) {
+	writer := bufio.NewWriter(conn)
+	defer writer.Flush()
+
+	header := make([]byte, binaryHeaderSize)
+	for {
+		if !s.extendReadDeadline(conn) {
+			return
+		}
+		req, err := readBinaryRequest(reader, header)
+		if err != nil {
+			if err != io.EOF {
+				slog.Debug("Error reading binary request", "err", err)
+			}
+			return
+		}
+
+		res, quit := handleBinaryRequest(req, s.store)
+		if res != nil {
+			if err := writeBinaryResponse(writer, req, res); err != nil {
+				slog.Warn("Error writing response", "err", err)
+				return
+			}
+		}
+		if quit {
+			return
+		}
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				slog.Warn("Error writing response", "err", err)
+				return
+			}
+		}
+	}
+}
+
+func readBinaryRequest(reader *bufio.Reader, header []byte) (*binaryRequest, error) {
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != binaryRequestMagic {
+		return nil, errBadMagic
+	}
+	keyLen := int(binary.BigEndian.Uint16(header[2:4]))
+	extrasLen := int(header[4])
+	bodyLen := int(binary.BigEndian.Uint32(header[8:12]))
+	if bodyLen > binaryMaxBodySize || keyLen+extrasLen > bodyLen {
+		return nil, errBadBody
+	}
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	req := &binaryRequest{
+		raw:    header[1],
+		opcode: header[1],
+		opaque: binary.BigEndian.Uint32(header[12:16]),
+		cas:    binary.BigEndian.Uint64(header[16:24]),
+		extras: body[:extrasLen],
+		key:    string(body[extrasLen : extrasLen+keyLen]),
+		value:  body[extrasLen+keyLen:],
+	}
+	if op, ok := quietOpcodes[req.opcode]; ok {
+		req.opcode, req.quiet = op, true
+	}
+	return req, nil
+}
+
+// handleBinaryRequest executes the request and returns its response, nil when
+// a quiet request has nothing to report. quit is set when the connection
+// should be closed.
+func handleBinaryRequest(req *binaryRequest, ht *store.HashTable) (res *binaryResponse, quit bool) {
+	switch req.opcode {
+	case opGet, opGetK:
+		if len(req.extras) != 0 || req.key == "" || len(req.value) != 0 {
+			return binaryStatus(statusInvalidArgs), false
+		}
+		item, ok := ht.Get(req.key)
+		return binaryItem(req, item, ok), false
+	case opGAT, opGATK:
+		if len(req.extras) != 4 || req.key == "" {
+			return binaryStatus(statusInvalidArgs), false
+		}
+		item, ok := ht.GetAndTouch(req.key, int64(binary.BigEndian.Uint32(req.extras)))
+		return binaryItem(req, item, ok), false
+	case opSet, opAdd, opReplace:
+		if len(req.extras) != 8 || req.key == "" {
+			return binaryStatus(statusInvalidArgs), false
+		}
+		mode := map[byte]store.StoreMode{opSet: store.ModeSet, opAdd: store.ModeAdd, opReplace: store.ModeReplace}[req.opcode]
+		flags := binary.BigEndian.Uint32(req.extras[0:4])
+		exptime := int64(binary.BigEndian.Uint32(req.extras[4:8]))
+		result, cas := ht.Store(mode, req.key, flags, exptime, req.value, req.cas)
+		return binaryStoreResult(req, result, cas), false
+	case opAppend, opPrepend:
+		if len(req.extras) != 0 || req.key == "" {
+			return binaryStatus(statusInvalidArgs), false
+		}
+		mode := store.ModeAppend
+		if req.opcode == opPrepend {
+			mode = store.ModePrepend
+		}
+		result, cas := ht.Store(mode, req.key, 0, 0, req.value, req.cas)
+		return binaryStoreResult(req, result, cas), false
+	case opDelete:
+		if len(req.extras) != 0 || req.key == "" || len(req.value) != 0 {
+			return binaryStatus(statusInvalidArgs), false
+		}
+		switch ht.CompareAndDelete(req.key, req.cas) {
+		case store.Stored:
+			if req.quiet {
+				return nil, false
+			}
+			return &binaryResponse{}, false
+		case store.Exists:
+			return binaryStatus(statusKeyExists), false
+		default:
+			return binaryStatus(statusKeyNotFound), false
+		}
+	case opIncrement, opDecrement:
+		if len(req.extras) != 20 || req.key == "" || len(req.value) != 0 {
+			return binaryStatus(statusInvalidArgs), false
+		}
+		delta := binary.BigEndian.Uint64(req.extras[0:8])
+		initial := binary.BigEndian.Uint64(req.extras[8:16])
+		exptime := binary.BigEndian.Uint32(req.extras[16:20])
+		// an expiration of all ones asks not to create a missing counter
+		vivify := exptime != 0xffffffff
+		value, cas, err := incrOrCreate(ht, req.key, delta, req.opcode == opDecrement, vivify, initial, int64(exptime))
+		switch err {
+		case nil:
+			if req.quiet {
+				return nil, false
+			}
+			res := &binaryResponse{cas: cas, value: make([]byte, 8)}
+			binary.BigEndian.PutUint64(res.value, value)
+			return res, false
+		case store.ErrNotFound:
+			return binaryStatus(statusKeyNotFound), false
+		case store.ErrNotNumeric:
+			return binaryStatus(statusNonNumeric), false
+		default:
+			return binaryStatus(statusOutOfMemory), false
+		}
+	case opTouch:
+		if len(req.extras) != 4 || req.key == "" {
+			return binaryStatus(statusInvalidArgs), false
+		}
+		if !ht.Touch(req.key, int64(binary.BigEndian.Uint32(req.extras))) {
+			return binaryStatus(statusKeyNotFound), false
+		}
+		return &binaryResponse{}, false
+	case opFlush:
+		// the delay in seconds is optional
+		var delay uint32
+		switch len(req.extras) {
+		case 0:
+		case 4:
+			delay = binary.BigEndian.Uint32(req.extras)
+		default:
+			return binaryStatus(statusInvalidArgs), false
+		}
+		ht.FlushAll(time.Duration(delay) * time.Second)
+		if req.quiet {
+			return nil, false
+		}
+		return &binaryResponse{}, false
+	case opNoop:
+		return &binaryResponse{}, false
+	case opVersion:
+		return &binaryResponse{value: []byte(version)}, false
+	case opQuit:
+		if req.quiet {
+			return nil, true
+		}
+		return &binaryResponse{}, true
+	default:
+		return binaryStatus(statusUnknownCommand), false
+	}
+}
+
+// binaryItem answers the get commands, the quiet variants leave misses out.
+func binaryItem(req *binaryRequest, item store.HashTableITem, ok bool) *binaryResponse {
+	if !ok {
+		if req.quiet {
+			return nil
+		}
+		res := binaryStatus(statusKeyNotFound)
+		if req.opcode == opGetK || req.opcode == opGATK {
+			res.key = req.key
+		}
+		return res
+	}
+	res := &binaryResponse{cas: item.CasUnique, extras: make([]byte, 4), value: item.Data}
+	binary.BigEndian.PutUint32(res.extras, item.Flags)
+	if req.opcode == opGetK || req.opcode == opGATK {
+		res.key = req.key
+	}
+	return res
+}
+
+// binaryStoreResult answers the storage commands, the quiet variants only
+// report failures.
+func binaryStoreResult(req *binaryRequest, result store.StoreResult, cas uint64) *binaryResponse {
+	switch result {
+	case store.Stored:
+		if req.quiet {
+			return nil
+		}
+		return &binaryResponse{cas: cas}
+	case store.NotStored:
+		switch req.opcode {
+		case opAdd:
+			return binaryStatus(statusKeyExists)
+		case opReplace:
+			return binaryStatus(statusKeyNotFound)
+		default:
+			return binaryStatus(statusNotStored)
+		}
+	case store.Exists:
+		return binaryStatus(statusKeyExists)
+	case store.NotFound:
+		return binaryStatus(statusKeyNotFound)
+	case store.TooLarge:
+		return binaryStatus(statusValueTooLarge)
+	default:
+		return binaryStatus(statusOutOfMemory)
+	}
+}
+
+// binaryStatus returns an error response, its body is the status message.
+func binaryStatus(status uint16) *binaryResponse {
+	return &binaryResponse{status: status, value: []byte(statusMessages[status])}
+}
+
+func writeBinaryResponse(w *bufio.Writer, req *binaryRequest, res *binaryResponse) error {
+	header := make([]byte, binaryHeaderSize)
+	header[0] = binaryResponseMagic
+	header[1] = req.raw
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(res.key)))
+	header[4] = byte(len(res.extras))
+	binary.BigEndian.PutUint16(header[6:8], res.status)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(res.extras)+len(res.key)+len(res.value)))
+	binary.BigEndian.PutUint32(header[12:16], req.opaque)
+	binary.BigEndian.PutUint64(header[16:24], res.cas)
+
+	w.Write(header)
+	w.Write(res.extras)
+	w.WriteString(res.key)
+	_, err := w.Write(res.value)
+	return err
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// binaryPacket is a request or response of the binary protocol.
+type binaryPacket struct {
+	opcode byte
+	status uint16 // responses only
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    string
+	value  []byte
+}
+
+func (p binaryPacket) encode() []byte {
+	body := len(p.extras) + len(p.key) + len(p.value)
+	b := make([]byte, binaryHeaderSize, binaryHeaderSize+body)
+	b[0] = binaryRequestMagic
+	b[1] = p.opcode
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(p.key)))
+	b[4] = byte(len(p.extras))
+	binary.BigEndian.PutUint32(b[8:12], uint32(body))
+	binary.BigEndian.PutUint32(b[12:16], p.opaque)
+	binary.BigEndian.PutUint64(b[16:24], p.cas)
+	b = append(b, p.extras...)
+	b = append(b, p.key...)
+	return append(b, p.value...)
+}
+
+// roundTrip sends the requests in one write and reads n responses.
+func (c *testConn) roundTrip(n int, requests ...binaryPacket) []binaryPacket {
+	c.t.Helper()
+	var data []byte
+	for _, req := range requests {
+		data = append(data, req.encode()...)
+	}
+	go c.conn.Write(data)
+	var responses []binaryPacket
+	header := make([]byte, binaryHeaderSize)
+	for i := 0; i < n; i++ {
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			c.t.Fatalf("reading response %d: %v", i, err)
+		}
+		if header[0] != binaryResponseMagic {
+			c.t.Fatalf("unexpected magic %#x", header[0])
+		}
+		keyLen := int(binary.BigEndian.Uint16(header[2:4]))
+		extrasLen := int(header[4])
+		body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+		if _, err := io.ReadFull(c.reader, body); err != nil {
+			c.t.Fatal(err)
+		}
+		responses = append(responses, binaryPacket{
+			opcode: header[1],
+			status: binary.BigEndian.Uint16(header[6:8]),
+			opaque: binary.BigEndian.Uint32(header[12:16]),
+			cas:    binary.BigEndian.Uint64(header[16:24]),
+			extras: body[:extrasLen],
+			key:    string(body[extrasLen : extrasLen+keyLen]),
+			value:  body[extrasLen+keyLen:],
+		})
+	}
+	return responses
+}
+
+func storeExtras(flags, exptime uint32) []byte {
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras[0:4], flags)
+	binary.BigEndian.PutUint32(extras[4:8], exptime)
+	return extras
+}
+
+func counterExtras(delta, initial uint64, exptime uint32) []byte {
+	extras := make([]byte, 20)
+	binary.BigEndian.PutUint64(extras[0:8], delta)
+	binary.BigEndian.PutUint64(extras[8:16], initial)
+	binary.BigEndian.PutUint32(extras[16:20], exptime)
+	return extras
+}
+
+func TestBinaryGetSet(t *testing.T) {
+	c := connect(t, newTestServer(ServerConfig{}))
+	res := c.roundTrip(1, binaryPacket{opcode: opSet, opaque: 7, extras: storeExtras(42, 0), key: "key", value: []byte("value")})
+	if res[0].status != statusOK || res[0].opcode != opSet || res[0].opaque != 7 || res[0].cas == 0 {
+		t.Fatalf("unexpected set response %+v", res[0])
+	}
+	cas := res[0].cas
+
+	res = c.roundTrip(3,
+		binaryPacket{opcode: opGet, key: "key"},
+		binaryPacket{opcode: opGetK, key: "key"},
+		binaryPacket{opcode: opGet, key: "missing"},
+	)
+	if res[0].status != statusOK || string(res[0].value) != "value" || res[0].key != "" || res[0].cas != cas ||
+		binary.BigEndian.Uint32(res[0].extras) != 42 {
+		t.Errorf("unexpected get response %+v", res[0])
+	}
+	if res[1].key != "key" || string(res[1].value) != "value" {
+		t.Errorf("expected getk to return the key, got %+v", res[1])
+	}
+	if res[2].status != statusKeyNotFound || string(res[2].value) != "Not found" {
+		t.Errorf("expected a miss, got %+v", res[2])
+	}
+
+	res = c.roundTrip(4,
+		binaryPacket{opcode: opAdd, extras: storeExtras(0, 0), key: "key", value: []byte("x")},
+		binaryPacket{opcode: opReplace, extras: storeExtras(0, 0), key: "missing", value: []byte("x")},
+		binaryPacket{opcode: opAppend, key: "key", value: []byte("!")},
+		binaryPacket{opcode: opSet, extras: storeExtras(0, 0)},
+	)
+	for i, want := range []uint16{statusKeyExists, statusKeyNotFound, statusOK, statusInvalidArgs} {
+		if res[i].status != want {
+			t.Errorf("response %d: expected status %#x, got %+v", i, want, res[i])
+		}
+	}
+	if res = c.roundTrip(1, binaryPacket{opcode: 0x42}); res[0].status != statusUnknownCommand {
+		t.Errorf("expected an unknown command, got %+v", res[0])
+	}
+}
+
+func TestBinaryCAS(t *testing.T) {
+	c := connect(t, newTestServer(ServerConfig{}))
+	cas := c.roundTrip(1, binaryPacket{opcode: opSet, extras: storeExtras(0, 0), key: "key", value: []byte("a")})[0].cas
+
+	res := c.roundTrip(3,
+		binaryPacket{opcode: opSet, cas: cas + 100, extras: storeExtras(0, 0), key: "key", value: []byte("b")},
+		binaryPacket{opcode: opSet, cas: cas, extras: storeExtras(0, 0), key: "key", value: []byte("c")},
+		binaryPacket{opcode: opSet, cas: cas, extras: storeExtras(0, 0), key: "missing", value: []byte("d")},
+	)
+	if res[0].status != statusKeyExists {
+		t.Errorf("expected a stale cas to fail, got %+v", res[0])
+	}
+	if res[1].status != statusOK || res[1].cas == cas {
+		t.Errorf("expected the cas to succeed with a new unique, got %+v", res[1])
+	}
+	if res[2].status != statusKeyNotFound {
+		t.Errorf("expected a cas on a missing key to fail, got %+v", res[2])
+	}
+
+	res = c.roundTrip(3,
+		binaryPacket{opcode: opDelete, cas: cas, key: "key"},
+		binaryPacket{opcode: opDelete, cas: res[1].cas, key: "key"},
+		binaryPacket{opcode: opGet, key: "key"},
+	)
+	for i, want := range []uint16{statusKeyExists, statusOK, statusKeyNotFound} {
+		if res[i].status != want {
+			t.Errorf("response %d: expected status %#x, got %+v", i, want, res[i])
+		}
+	}
+}
+
+func TestBinaryIncrDecr(t *testing.T) {
+	c := connect(t, newTestServer(ServerConfig{}))
+	res := c.roundTrip(5,
+		// a missing counter is created with the initial value
+		binaryPacket{opcode: opIncrement, key: "n", extras: counterExtras(5, 10, 0)},
+		binaryPacket{opcode: opIncrement, key: "n", extras: counterExtras(5, 10, 0)},
+		binaryPacket{opcode: opDecrement, key: "n", extras: counterExtras(100, 0, 0)},
+		// unless its expiration is all ones
+		binaryPacket{opcode: opIncrement, key: "m", extras: counterExtras(1, 0, 0xffffffff)},
+		binaryPacket{opcode: opIncrement, key: "n", extras: counterExtras(1, 0, 0)[:8]},
+	)
+	for i, want := range []uint64{10, 15, 0} {
+		if res[i].status != statusOK || len(res[i].value) != 8 || binary.BigEndian.Uint64(res[i].value) != want {
+			t.Errorf("response %d: expected %d, got %+v", i, want, res[i])
+		}
+	}
+	if res[3].status != statusKeyNotFound || res[4].status != statusInvalidArgs {
+		t.Errorf("unexpected responses %+v %+v", res[3], res[4])
+	}
+
+	c.roundTrip(1, binaryPacket{opcode: opSet, extras: storeExtras(0, 0), key: "s", value: []byte("abc")})
+	if res := c.roundTrip(1, binaryPacket{opcode: opIncrement, key: "s", extras: counterExtras(1, 0, 0)}); res[0].status != statusNonNumeric {
+		t.Errorf("expected a non numeric value, got %+v", res[0])
+	}
+}
+
+func TestBinaryQuietOpcodes(t *testing.T) {
+	c := connect(t, newTestServer(ServerConfig{}))
+	// the quiet commands only answer failures and hits, noop flushes them
+	res := c.roundTrip(4,
+		binaryPacket{opcode: opSetQ, opaque: 1, extras: storeExtras(0, 0), key: "a", value: []byte("1")},
+		binaryPacket{opcode: opAddQ, opaque: 2, extras: storeExtras(0, 0), key: "a", value: []byte("2")},
+		binaryPacket{opcode: opGetQ, opaque: 3, key: "missing"},
+		binaryPacket{opcode: opGetKQ, opaque: 4, key: "a"},
+		binaryPacket{opcode: opIncrQ, opaque: 5, key: "a", extras: counterExtras(1, 0, 0)},
+		binaryPacket{opcode: opDeleteQ, opaque: 6, key: "missing"},
+		binaryPacket{opcode: opNoop, opaque: 7},
+	)
+	want := []struct {
+		opcode byte
+		opaque uint32
+		status uint16
+	}{
+		{opAddQ, 2, statusKeyExists},
+		{opGetKQ, 4, statusOK},
+		{opDeleteQ, 6, statusKeyNotFound},
+		{opNoop, 7, statusOK},
+	}
+	for i, w := range want {
+		if res[i].opcode != w.opcode || res[i].opaque != w.opaque || res[i].status != w.status {
+			t.Errorf("response %d: expected %+v, got %+v", i, w, res[i])
+		}
+	}
+	if res[1].key != "a" || string(res[1].value) != "1" {
+		t.Errorf("expected getkq to return the item before the increment, got %+v", res[1])
+	}
+
+	res = c.roundTrip(2,
+		binaryPacket{opcode: opGet, key: "a"},
+		binaryPacket{opcode: opVersion},
+	)
+	if string(res[0].value) != "2" || string(res[1].value) != version {
+		t.Errorf("unexpected responses %+v %+v", res[0], res[1])
+	}
+
+	if res := c.roundTrip(1, binaryPacket{opcode: opFlushQ}, binaryPacket{opcode: opGet, key: "a"}); res[0].status != statusKeyNotFound {
+		t.Errorf("expected flushq to remove the item, got %+v", res[0])
+	}
+	c.roundTrip(0, binaryPacket{opcode: opQuitQ})
+	if _, err := c.reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected quitq to close the connection, got %v", err)
+	}
+}
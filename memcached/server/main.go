@@ -4,35 +4,124 @@ import (
 	"bufio"
 	commandsparser "ccmemcached/parser"
 	"ccmemcached/store"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
+// reapInterval is how often expired items are removed in the background,
+// between two runs they are removed lazily when accessed.
+const reapInterval = 30 * time.Second
+
+// version is reported by the version commands.
+const version = "1.6.0-ccmemcached"
+
+// levelTrace logs every command received, enabled with -vv.
+const levelTrace = slog.LevelDebug - 4
+
 type ServerConfig struct {
-	Port int
+	Port        int
+	MemoryLimit int // In megabytes
+	MaxConns    int
+	// SnapshotFile keeps the cache across restarts: written on shutdown and
+	// loaded on start when set
+	SnapshotFile string
+	Verbosity    int // 0 logs warnings and lifecycle events, 1 connections, 2 commands
 }
 
 func parseConfig() ServerConfig {
 	var config ServerConfig
+	var verbose, veryVerbose bool
 	flag.IntVar(&config.Port, "p", 11211, "Port to listen on")
+	flag.IntVar(&config.MemoryLimit, "m", 64, "Item memory in megabytes")
+	flag.IntVar(&config.MaxConns, "c", 1024, "Max simultaneous connections")
+	flag.StringVar(&config.SnapshotFile, "e", "", "File the cache is saved to on shutdown and restored from on start")
+	flag.BoolVar(&verbose, "v", false, "Verbose (log connections)")
+	flag.BoolVar(&veryVerbose, "vv", false, "Very verbose (also log commands)")
 	flag.Parse()
+	switch {
+	case veryVerbose:
+		config.Verbosity = 2
+	case verbose:
+		config.Verbosity = 1
+	}
 	return config
 }
 
+// Server holds the cache and the connection counters reported by "stats".
+type Server struct {
+	config   ServerConfig
+	store    *store.HashTable
+	started  time.Time
+	logLevel *slog.LevelVar
+
+	verbosity     atomic.Uint64
+	currConns     atomic.Int64
+	totalConns    atomic.Uint64
+	rejectedConns atomic.Uint64
+
+	// open connections, drained on shutdown
+	connsMu  sync.Mutex
+	conns    map[net.Conn]struct{}
+	handlers sync.WaitGroup
+	draining atomic.Bool
+}
+
+func NewServer(config ServerConfig, logLevel *slog.LevelVar) *Server {
+	s := &Server{
+		config:   config,
+		store:    store.NewHashTableWithLimit(int64(config.MemoryLimit) << 20),
+		started:  time.Now(),
+		logLevel: logLevel,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.setVerbosity(uint64(config.Verbosity))
+	return s
+}
+
+// setVerbosity changes the log level, as "verbosity" does at runtime.
+func (s *Server) setVerbosity(verbosity uint64) {
+	s.verbosity.Store(verbosity)
+	switch verbosity {
+	case 0:
+		s.logLevel.Set(slog.LevelInfo)
+	case 1:
+		s.logLevel.Set(slog.LevelDebug)
+	default:
+		s.logLevel.Set(levelTrace)
+	}
+}
+
 func main() {
 	config := parseConfig()
-	log.Printf("Starting server on port %d\n", config.Port)
+	logLevel := new(slog.LevelVar)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && a.Value.Any() == levelTrace {
+				a.Value = slog.StringValue("TRACE")
+			}
+			return a
+		},
+	})))
+	server := NewServer(config, logLevel)
+	slog.Info("Starting server", "port", config.Port, "memory_limit_mb", config.MemoryLimit, "max_conns", config.MaxConns)
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
 	if err != nil {
-		log.Fatalf("Error starting server %v", err)
+		slog.Error("Error starting server", "err", err)
+		os.Exit(1)
 	}
 	defer listener.Close()
 
@@ -42,109 +131,404 @@ func main() {
 
 	go func() {
 		<-stop
-		log.Println("Shutting down server...")
+		slog.Info("Shutting down server...")
 		listener.Close()
 	}()
 
-	store := store.NewHashTable()
+	if config.SnapshotFile != "" {
+		server.loadSnapshot()
+	}
+	stopReaper := server.store.StartReaper(reapInterval)
+	defer stopReaper()
+
+	if err := server.Serve(listener); err != nil {
+		slog.Error("Error accepting connection", "err", err)
+		os.Exit(1)
+	}
+	// the snapshot has to hold the commands already answered
+	server.drain()
+	if config.SnapshotFile != "" {
+		server.saveSnapshot()
+	}
+}
 
+// Serve accepts connections until the listener is closed, rejecting those
+// above MaxConns.
+func (s *Server) Serve(listener net.Listener) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
-				log.Printf("Temporary error accepting connection %v", netErr)
+				slog.Warn("Temporary error accepting connection", "err", netErr)
 				continue
 			}
-			log.Fatalf("Error accepting connection %v", err)
+			return err
+		}
+		// connections are only accepted by this goroutine, so the check
+		// can't race with another increment
+		if s.currConns.Load() >= int64(s.config.MaxConns) {
+			s.rejectedConns.Add(1)
+			slog.Warn("Too many open connections", "remote", conn.RemoteAddr())
+			conn.Write([]byte("ERROR Too many open connections\r\n"))
+			conn.Close()
+			continue
 		}
-		go handleConnection(conn, store)
+		s.track(conn)
+		go s.handleConnection(conn)
 	}
 }
 
-func handleConnection(conn net.Conn, store *store.HashTable) {
+// track counts a new connection, its handler must untrack it.
+func (s *Server) track(conn net.Conn) {
+	s.currConns.Add(1)
+	s.totalConns.Add(1)
+	s.handlers.Add(1)
+	s.connsMu.Lock()
+	s.conns[conn] = struct{}{}
+	s.connsMu.Unlock()
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.connsMu.Lock()
+	delete(s.conns, conn)
+	s.connsMu.Unlock()
+	s.currConns.Add(-1)
+	s.handlers.Done()
+}
+
+// extendReadDeadline gives the client another 5 minutes to send a command.
+// It returns false once the server drains, the connection should be closed.
+func (s *Server) extendReadDeadline(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Minute)); err != nil {
+		slog.Warn("Error setting read deadline", "err", err)
+		return false
+	}
+	// checked after the deadline is set, so drain can't miss the connection
+	return !s.draining.Load()
+}
+
+// drain stops the connections once the listener is closed: the reads waiting
+// for a command are interrupted, the commands in progress are answered, and
+// it returns when every handler is done.
+func (s *Server) drain() {
+	s.draining.Store(true)
+	s.connsMu.Lock()
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.connsMu.Unlock()
+	s.handlers.Wait()
+}
+
+// loadSnapshot restores the cache saved by the previous run. The snapshot is
+// removed once loaded, so a crash later on can't bring back stale items.
+func (s *Server) loadSnapshot() {
+	f, err := os.Open(s.config.SnapshotFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Error opening snapshot", "file", s.config.SnapshotFile, "err", err)
+		}
+		return
+	}
+	defer f.Close()
+
+	start := time.Now()
+	loaded, err := s.store.LoadSnapshot(f)
+	if err != nil {
+		slog.Warn("Ignoring snapshot", "file", s.config.SnapshotFile, "err", err)
+		return
+	}
+	slog.Info("Loaded snapshot", "file", s.config.SnapshotFile, "items", loaded, "took", time.Since(start))
+	if err := os.Remove(s.config.SnapshotFile); err != nil {
+		slog.Warn("Error removing snapshot", "file", s.config.SnapshotFile, "err", err)
+	}
+}
+
+// saveSnapshot writes the cache to a temporary file renamed over the
+// snapshot, so an interrupted shutdown doesn't leave a truncated snapshot.
+func (s *Server) saveSnapshot() {
+	tmp := s.config.SnapshotFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		slog.Error("Error creating snapshot", "file", tmp, "err", err)
+		return
+	}
+	start := time.Now()
+	written, err := s.store.WriteSnapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.config.SnapshotFile)
+	}
+	if err != nil {
+		slog.Error("Error writing snapshot", "file", s.config.SnapshotFile, "err", err)
+		os.Remove(tmp)
+		return
+	}
+	slog.Info("Saved snapshot", "file", s.config.SnapshotFile, "items", written, "took", time.Since(start))
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
 	defer func() {
-		log.Printf("Closing connection from %s\n", conn.RemoteAddr())
+		s.untrack(conn)
+		slog.Debug("Closing connection", "remote", conn.RemoteAddr())
 		if err := conn.Close(); err != nil {
-			log.Printf("Error closing connection %v\n", err)
+			slog.Warn("Error closing connection", "err", err)
 		}
 	}()
-	log.Printf("Accepted connection from %s\n", conn.RemoteAddr())
+	slog.Debug("Accepted connection", "remote", conn.RemoteAddr())
 
 	reader := bufio.NewReader(conn)
 	parser := commandsparser.NewParser()
 
+	// binary protocol clients are recognised by the magic of their first request
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Minute)); err != nil {
+		slog.Warn("Error setting read deadline", "err", err)
+		return
+	}
+	if first, err := reader.Peek(1); err == nil && first[0] == binaryRequestMagic {
+		s.handleBinaryConnection(conn, reader)
+		return
+	}
+
 	for {
-		fmt.Printf("Waiting for command\n")
 		// Set a read deadline to prevent hanging connections
-		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Minute)); err != nil {
-			log.Printf("Error setting read deadline: %v", err)
+		if !s.extendReadDeadline(conn) {
 			return
 		}
 
 		cmd, err := parser.Parse(reader)
 		if err != nil {
-			if err == io.EOF {
-				log.Printf("Client closed connection")
+			if errors.Is(err, io.EOF) {
+				slog.Debug("Client closed connection", "remote", conn.RemoteAddr())
 				return
 			}
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				log.Printf("Read timeout")
+				slog.Debug("Read timeout", "remote", conn.RemoteAddr())
 				return
 			}
-			log.Printf("Error parsing command: %v", err)
-			if _, err := conn.Write([]byte("ERROR\r\n")); err != nil {
-				log.Printf("Error writing error response: %v", err)
+			slog.Debug("Error parsing command", "remote", conn.RemoteAddr(), "err", err)
+			reply := "ERROR\r\n"
+			if errors.Is(err, commandsparser.ErrTooLarge) {
+				reply = "SERVER_ERROR " + err.Error() + "\r\n"
+			}
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				slog.Warn("Error writing error response", "err", err)
 				return
 			}
 			continue
 		}
-		fmt.Printf("Command: %+v\n", cmd)
-		if cmd.Name == commandsparser.ExitCommand || cmd.Name == commandsparser.EndCommand {
-			log.Printf("End command received")
+		slog.Log(context.Background(), levelTrace, "Command", "remote", conn.RemoteAddr(), "name", cmd.Name, "key", cmd.Key)
+		switch cmd.Name {
+		case commandsparser.QuitCommand, commandsparser.ExitCommand, commandsparser.EndCommand:
 			return
 		}
 
-		handleCommand(cmd, store, conn)
+		s.handleCommand(cmd, conn)
 	}
 
 }
 
-func handleCommand(cmd *commandsparser.Command, store *store.HashTable, conn net.Conn) {
+func (s *Server) handleCommand(cmd *commandsparser.Command, conn net.Conn) {
+	ht := s.store
 	switch cmd.Name {
 	case commandsparser.SetCommand:
-		store.Set(cmd.Key, cmd.Flags, cmd.Expiry, cmd.Value)
-		if !cmd.Noreply {
-			if _, err := conn.Write([]byte("STORED\r\n")); err != nil {
-				log.Printf("Error writing response: %v", err)
+		writeStoreResult(conn, cmd, ht.Set(cmd.Key, cmd.Flags, cmd.Expiry, cmd.Value))
+	case commandsparser.AddCommand:
+		writeStoreResult(conn, cmd, ht.Add(cmd.Key, cmd.Flags, cmd.Expiry, cmd.Value))
+	case commandsparser.ReplaceCommand:
+		writeStoreResult(conn, cmd, ht.Replace(cmd.Key, cmd.Flags, cmd.Expiry, cmd.Value))
+	case commandsparser.AppendCommand:
+		// append and prepend ignore the flags and exptime of the command
+		writeStoreResult(conn, cmd, ht.Append(cmd.Key, cmd.Value))
+	case commandsparser.PrependCommand:
+		writeStoreResult(conn, cmd, ht.Prepend(cmd.Key, cmd.Value))
+	case commandsparser.CasCommand:
+		// Store takes a zero unique as no cas at all, but no item has it
+		if cmd.CasUnique == 0 {
+			writeStoreResult(conn, cmd, store.Exists)
+			return
+		}
+		result, _ := ht.Store(store.ModeSet, cmd.Key, cmd.Flags, cmd.Expiry, cmd.Value, cmd.CasUnique)
+		writeStoreResult(conn, cmd, result)
+	case commandsparser.GetCommand, commandsparser.GetsCommand:
+		// misses are left out, END terminates the list of items
+		for _, key := range cmd.Keys {
+			if item, ok := ht.Get(key); ok {
+				writeItem(conn, cmd, key, item)
 			}
 		}
-	case commandsparser.GetCommand:
-		item, ok := store.Get(cmd.Key)
-		if !ok {
-			if _, err := conn.Write([]byte("NOT_FOUND\r\n")); err != nil {
-				log.Printf("Error writing response: %v", err)
+		writeResponse(conn, false, "END")
+	case commandsparser.GatCommand, commandsparser.GatsCommand:
+		for _, key := range cmd.Keys {
+			if item, ok := ht.GetAndTouch(key, cmd.Expiry); ok {
+				writeItem(conn, cmd, key, item)
 			}
+		}
+		writeResponse(conn, false, "END")
+	case commandsparser.DeleteCommand:
+		if !ht.Delete(cmd.Key) {
+			writeResponse(conn, cmd.Noreply, "NOT_FOUND")
 			return
 		}
-		res := fmt.Sprintf("VALUE %s %d %d\r\n", cmd.Key, item.Flags, len(item.Data))
-		if _, err := conn.Write([]byte(res)); err != nil {
-			log.Printf("Error writing response: %v", err)
+		writeResponse(conn, cmd.Noreply, "DELETED")
+	case commandsparser.IncrCommand, commandsparser.DecrCommand:
+		incr := ht.Incr
+		if cmd.Name == commandsparser.DecrCommand {
+			incr = ht.Decr
 		}
-		res = string(item.Data) + "\r\n"
-		if _, err := conn.Write([]byte(res)); err != nil {
-			log.Printf("Error writing response: %v", err)
+		value, err := incr(cmd.Key, cmd.Delta)
+		switch err {
+		case nil:
+			writeResponse(conn, cmd.Noreply, strconv.FormatUint(value, 10))
+		case store.ErrNotFound:
+			writeResponse(conn, cmd.Noreply, "NOT_FOUND")
+		default:
+			writeResponse(conn, cmd.Noreply, "CLIENT_ERROR "+err.Error())
 		}
-
-	case commandsparser.DeleteCommand:
-		store.Delete(cmd.Key)
-		if !cmd.Noreply {
-			if _, err := conn.Write([]byte("DELETED\r\n")); err != nil {
-				log.Printf("Error writing response: %v", err)
-			}
+	case commandsparser.TouchCommand:
+		if !ht.Touch(cmd.Key, cmd.Expiry) {
+			writeResponse(conn, cmd.Noreply, "NOT_FOUND")
+			return
 		}
+		writeResponse(conn, cmd.Noreply, "TOUCHED")
+	case commandsparser.StatsCommand:
+		s.writeStats(conn, cmd)
+	case commandsparser.FlushAllCommand:
+		ht.FlushAll(time.Duration(cmd.Expiry) * time.Second)
+		writeResponse(conn, cmd.Noreply, "OK")
+	case commandsparser.VersionCommand:
+		writeResponse(conn, false, "VERSION "+version)
+	case commandsparser.VerbosityCommand:
+		s.setVerbosity(cmd.Delta)
+		writeResponse(conn, cmd.Noreply, "OK")
+	case commandsparser.MetaGetCommand, commandsparser.MetaSetCommand, commandsparser.MetaDeleteCommand,
+		commandsparser.MetaArithmeticCommand, commandsparser.MetaNoopCommand:
+		handleMetaCommand(cmd, ht, conn)
 	default:
-		if _, err := conn.Write([]byte("ERROR\r\n")); err != nil {
-			log.Printf("Error writing response: %v", err)
+		writeResponse(conn, false, "ERROR")
+	}
+}
+
+// writeItem writes the item returned by a retrieval command, gets and gats
+// add the CAS unique of the item.
+func writeItem(conn net.Conn, cmd *commandsparser.Command, key string, item store.HashTableITem) {
+	res := fmt.Sprintf("VALUE %s %d %d", key, item.Flags, len(item.Data))
+	if cmd.Name == commandsparser.GetsCommand || cmd.Name == commandsparser.GatsCommand {
+		res += fmt.Sprintf(" %d", item.CasUnique)
+	}
+	writeResponse(conn, false, res)
+	writeResponse(conn, false, string(item.Data))
+}
+
+func writeStoreResult(conn net.Conn, cmd *commandsparser.Command, result store.StoreResult) {
+	switch result {
+	case store.Stored:
+		writeResponse(conn, cmd.Noreply, "STORED")
+	case store.NotStored:
+		writeResponse(conn, cmd.Noreply, "NOT_STORED")
+	case store.Exists:
+		writeResponse(conn, cmd.Noreply, "EXISTS")
+	case store.NotFound:
+		writeResponse(conn, cmd.Noreply, "NOT_FOUND")
+	case store.TooLarge:
+		writeResponse(conn, cmd.Noreply, "SERVER_ERROR object too large for cache")
+	case store.OutOfMemory:
+		writeResponse(conn, cmd.Noreply, "SERVER_ERROR "+store.ErrOutOfMemory.Error())
+	}
+}
+
+// writeStats answers "stats" and its "settings", "slabs" and "items"
+// variants.
+func (s *Server) writeStats(conn net.Conn, cmd *commandsparser.Command) {
+	ht := s.store
+	if len(cmd.Args) == 0 {
+		now := time.Now()
+		st := ht.Stats()
+		writeStat(conn, "pid", os.Getpid())
+		writeStat(conn, "uptime", int64(now.Sub(s.started).Seconds()))
+		writeStat(conn, "time", now.Unix())
+		writeStat(conn, "version", version)
+		writeStat(conn, "curr_connections", s.currConns.Load())
+		writeStat(conn, "total_connections", s.totalConns.Load())
+		writeStat(conn, "rejected_connections", s.rejectedConns.Load())
+		writeStat(conn, "cmd_get", st.GetHits+st.GetMisses)
+		writeStat(conn, "cmd_set", st.CmdSet)
+		writeStat(conn, "cmd_flush", st.CmdFlush)
+		writeStat(conn, "cmd_touch", st.TouchHits+st.TouchMisses)
+		writeStat(conn, "get_hits", st.GetHits)
+		writeStat(conn, "get_misses", st.GetMisses)
+		writeStat(conn, "touch_hits", st.TouchHits)
+		writeStat(conn, "touch_misses", st.TouchMisses)
+		writeStat(conn, "bytes", st.Bytes)
+		writeStat(conn, "curr_items", st.CurrItems)
+		writeStat(conn, "total_items", st.TotalItems)
+		writeStat(conn, "evictions", st.Evictions)
+		writeStat(conn, "reclaimed", st.Reclaimed)
+		writeStat(conn, "slabs_moved", st.SlabsMoved)
+		writeStat(conn, "limit_maxbytes", st.LimitMaxBytes)
+		writeResponse(conn, false, "END")
+		return
+	}
+
+	classes, malloced := ht.SlabStats()
+	switch cmd.Args[0] {
+	case "settings":
+		writeStat(conn, "maxbytes", int64(s.config.MemoryLimit)<<20)
+		writeStat(conn, "maxconns", s.config.MaxConns)
+		writeStat(conn, "tcpport", s.config.Port)
+		writeStat(conn, "verbosity", s.verbosity.Load())
+		writeStat(conn, "evictions", "on")
+		writeStat(conn, "growth_factor", fmt.Sprintf("%.2f", store.GrowthFactor))
+		writeStat(conn, "chunk_size", store.ChunkSizeMin)
+		writeStat(conn, "item_size_max", store.ItemSizeMax)
+		writeStat(conn, "binding_protocol", "auto-negotiate")
+		writeStat(conn, "memory_file", s.config.SnapshotFile)
+	case "slabs":
+		for _, c := range classes {
+			writeStat(conn, fmt.Sprintf("%d:chunk_size", c.ID), c.ChunkSize)
+			writeStat(conn, fmt.Sprintf("%d:chunks_per_page", c.ID), c.ChunksPerPage)
+			writeStat(conn, fmt.Sprintf("%d:total_pages", c.ID), c.TotalPages)
+			writeStat(conn, fmt.Sprintf("%d:total_chunks", c.ID), c.TotalChunks)
+			writeStat(conn, fmt.Sprintf("%d:used_chunks", c.ID), c.UsedChunks)
+			writeStat(conn, fmt.Sprintf("%d:free_chunks", c.ID), c.FreeChunks)
+		}
+		writeStat(conn, "active_slabs", len(classes))
+		writeStat(conn, "total_malloced", malloced)
+	case "items":
+		for _, c := range classes {
+			writeStat(conn, fmt.Sprintf("items:%d:number", c.ID), c.Items)
+			writeStat(conn, fmt.Sprintf("items:%d:age", c.ID), int64(c.Age.Seconds()))
+			writeStat(conn, fmt.Sprintf("items:%d:evicted", c.ID), c.Evicted)
+			writeStat(conn, fmt.Sprintf("items:%d:evicted_time", c.ID), int64(c.EvictedTime.Seconds()))
+			writeStat(conn, fmt.Sprintf("items:%d:reclaimed", c.ID), c.Reclaimed)
+			writeStat(conn, fmt.Sprintf("items:%d:outofmemory", c.ID), c.OutOfMemory)
 		}
+	default:
+		writeResponse(conn, false, "ERROR")
+		return
+	}
+	writeResponse(conn, false, "END")
+}
+
+func writeStat(conn net.Conn, name string, value any) {
+	writeResponse(conn, false, fmt.Sprintf("STAT %s %v", name, value))
+}
+
+// writeResponse writes a line terminated by \r\n unless the client asked for
+// noreply.
+func writeResponse(conn net.Conn, noreply bool, line string) {
+	if noreply {
+		return
+	}
+	if _, err := conn.Write([]byte(line + "\r\n")); err != nil {
+		slog.Warn("Error writing response", "err", err)
 	}
 }
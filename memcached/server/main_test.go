@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"ccmemcached/store"
+)
+
+func newTestServer(config ServerConfig) *Server {
+	if config.MemoryLimit == 0 {
+		config.MemoryLimit = 64
+	}
+	if config.MaxConns == 0 {
+		config.MaxConns = 1024
+	}
+	return NewServer(config, new(slog.LevelVar))
+}
+
+// testConn is a connection to the server over a pipe. The pipe is
+// synchronous, so every request has to be read back before the next one.
+type testConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func connect(t *testing.T, s *Server) *testConn {
+	t.Helper()
+	conn, remote := net.Pipe()
+	s.track(conn)
+	go s.handleConnection(conn)
+	t.Cleanup(func() { remote.Close() })
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testConn{t: t, conn: remote, reader: bufio.NewReader(remote)}
+}
+
+func (c *testConn) send(request string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(request)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testConn) readLine() string {
+	c.t.Helper()
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading: %v", err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// expect sends the request and checks the lines of the response.
+func (c *testConn) expect(request string, lines ...string) {
+	c.t.Helper()
+	c.send(request)
+	for _, want := range lines {
+		if got := c.readLine(); got != want {
+			c.t.Fatalf("%q: expected %q, got %q", request, want, got)
+		}
+	}
+}
+
+// stats returns the STAT lines of a stats command, up to END.
+func (c *testConn) stats(request string) map[string]string {
+	c.t.Helper()
+	c.send(request)
+	stats := make(map[string]string)
+	for {
+		line := c.readLine()
+		if line == "END" {
+			return stats
+		}
+		name, value, ok := strings.Cut(strings.TrimPrefix(line, "STAT "), " ")
+		if !ok || !strings.HasPrefix(line, "STAT ") {
+			c.t.Fatalf("%q: unexpected line %q", request, line)
+		}
+		stats[name] = value
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := newTestServer(ServerConfig{Port: 11211, MemoryLimit: 8, MaxConns: 10})
+	c := connect(t, s)
+	c.expect("set a 0 0 5\r\nhello\r\n", "STORED")
+	c.expect("get a b\r\n", "VALUE a 0 5", "hello", "END")
+	c.expect("touch b 10\r\n", "NOT_FOUND")
+
+	stats := c.stats("stats\r\n")
+	for name, want := range map[string]string{
+		"version":              version,
+		"curr_connections":     "1",
+		"total_connections":    "1",
+		"rejected_connections": "0",
+		"cmd_get":              "2",
+		"cmd_set":              "1",
+		"cmd_touch":            "1",
+		"get_hits":             "1",
+		"get_misses":           "1",
+		"touch_misses":         "1",
+		"curr_items":           "1",
+		"total_items":          "1",
+		"bytes":                "6",
+		"limit_maxbytes":       strconv.Itoa(8 << 20),
+	} {
+		if stats[name] != want {
+			t.Errorf("stat %s: expected %q, got %q", name, want, stats[name])
+		}
+	}
+
+	settings := c.stats("stats settings\r\n")
+	if settings["maxbytes"] != strconv.Itoa(8<<20) || settings["maxconns"] != "10" || settings["tcpport"] != "11211" || settings["verbosity"] != "0" {
+		t.Errorf("unexpected settings %v", settings)
+	}
+	slabs := c.stats("stats slabs\r\n")
+	if slabs["active_slabs"] != "1" || slabs["total_malloced"] != strconv.Itoa(1<<20) {
+		t.Errorf("unexpected slab stats %v", slabs)
+	}
+	if items := c.stats("stats items\r\n"); len(items) != 6 {
+		t.Errorf("expected the stats of one class, got %v", items)
+	}
+	c.expect("stats nonsense\r\n", "ERROR")
+}
+
+func TestFlushAll(t *testing.T) {
+	s := newTestServer(ServerConfig{})
+	c := connect(t, s)
+	c.expect("set a 0 0 1\r\na\r\n", "STORED")
+	c.expect("flush_all\r\n", "OK")
+	c.expect("get a\r\n", "END")
+
+	c.expect("set a 0 0 1\r\na\r\n", "STORED")
+	c.send("flush_all 1 noreply\r\n")
+	// the items stored until the delay has passed are flushed then
+	c.expect("set b 0 0 1\r\nb\r\n", "STORED")
+	c.expect("get a b\r\n", "VALUE a 0 1", "a", "VALUE b 0 1", "b", "END")
+	time.Sleep(1100 * time.Millisecond)
+	c.expect("get a b\r\n", "END")
+	c.expect("set c 0 0 1\r\nc\r\n", "STORED")
+	c.expect("get c\r\n", "VALUE c 0 1", "c", "END")
+
+	if stats := c.stats("stats\r\n"); stats["cmd_flush"] != "2" {
+		t.Errorf("expected 2 flushes, got %s", stats["cmd_flush"])
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	s := newTestServer(ServerConfig{Verbosity: 1})
+	if s.logLevel.Level() != slog.LevelDebug {
+		t.Errorf("expected -v to log at debug level, got %v", s.logLevel.Level())
+	}
+	c := connect(t, s)
+	c.expect("verbosity 2\r\n", "OK")
+	if s.logLevel.Level() != levelTrace {
+		t.Errorf("expected verbosity 2 to log commands, got %v", s.logLevel.Level())
+	}
+	if settings := c.stats("stats settings\r\n"); settings["verbosity"] != "2" {
+		t.Errorf("expected verbosity 2, got %s", settings["verbosity"])
+	}
+	c.send("verbosity 0 noreply\r\n")
+	c.expect("version\r\n", "VERSION "+version)
+	if s.logLevel.Level() != slog.LevelInfo {
+		t.Errorf("expected verbosity 0 to log at info level, got %v", s.logLevel.Level())
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	s := newTestServer(ServerConfig{MaxConns: 1})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- s.Serve(listener) }()
+	dial := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	request := func(conn net.Conn, reader *bufio.Reader, line string) string {
+		t.Helper()
+		conn.Write([]byte(line))
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		return reply
+	}
+
+	first, firstReader := dial()
+	if reply := request(first, firstReader, "version\r\n"); reply != "VERSION "+version+"\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	second, secondReader := dial()
+	if reply := request(second, secondReader, "version\r\n"); reply != "ERROR Too many open connections\r\n" {
+		t.Errorf("expected the connection over -c to be rejected, got %q", reply)
+	}
+	if s.rejectedConns.Load() != 1 {
+		t.Errorf("expected 1 rejected connection, got %d", s.rejectedConns.Load())
+	}
+
+	// the slot is given back once the connection is closed
+	first.Close()
+	for deadline := time.Now().Add(2 * time.Second); s.currConns.Load() != 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	third, thirdReader := dial()
+	if reply := request(third, thirdReader, "version\r\n"); reply != "VERSION "+version+"\r\n" {
+		t.Errorf("expected a connection once the first was closed, got %q", reply)
+	}
+
+	listener.Close()
+	if err := <-done; err != nil {
+		t.Errorf("expected Serve to stop cleanly, got %v", err)
+	}
+}
+
+func TestCas(t *testing.T) {
+	c := connect(t, newTestServer(ServerConfig{}))
+	c.expect("cas a 0 0 1 1\r\nx\r\n", "NOT_FOUND")
+	c.expect("set a 3 0 1\r\nx\r\n", "STORED")
+	c.send("gets a\r\n")
+	fields := strings.Fields(c.readLine())
+	if data, end := c.readLine(), c.readLine(); data != "x" || end != "END" {
+		t.Fatalf("unexpected gets response %q %q", data, end)
+	}
+	cas := fields[len(fields)-1]
+
+	c.expect("cas a 0 0 1 0\r\ny\r\n", "EXISTS")
+	c.expect("cas a 5 0 1 "+cas+"\r\ny\r\n", "STORED")
+	c.expect("cas a 0 0 1 "+cas+"\r\nz\r\n", "EXISTS")
+	c.expect("get a\r\n", "VALUE a 5 1", "y", "END")
+	c.expect("cas a 0 0 1 "+cas+" noreply\r\nz\r\nget a\r\n", "VALUE a 5 1", "y", "END")
+}
+
+func TestDrain(t *testing.T) {
+	s := newTestServer(ServerConfig{})
+	c := connect(t, s)
+	c.expect("set a 0 0 1\r\nx\r\n", "STORED")
+
+	// the idle connection is closed rather than waited for
+	drained := make(chan struct{})
+	go func() {
+		s.drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(2 * time.Second):
+		t.Fatal("drain didn't return")
+	}
+	if _, err := c.reader.ReadString('\n'); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	if n := s.currConns.Load(); n != 0 {
+		t.Errorf("expected no open connection, got %d", n)
+	}
+}
+
+func TestValueTooLarge(t *testing.T) {
+	c := connect(t, newTestServer(ServerConfig{}))
+	size := store.ItemSizeMax + 1
+	c.expect("set a 0 0 "+strconv.Itoa(size)+"\r\n"+strings.Repeat("x", size)+"\r\n",
+		"SERVER_ERROR object too large for cache")
+	c.expect("get a\r\n", "END")
+}
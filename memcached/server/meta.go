@@ -0,0 +1,279 @@
+package main
+
+import (
+	commandsparser "ccmemcached/parser"
+	"ccmemcached/store"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleMetaCommand answers the meta commands (mg, ms, md, ma, mn). Their
+// flags select what is returned: the q flag hides the success and miss
+// codes (HD, EN, NF) so clients can pipeline them and end with mn.
+func handleMetaCommand(cmd *commandsparser.Command, ht *store.HashTable, conn net.Conn) {
+	switch cmd.Name {
+	case commandsparser.MetaGetCommand:
+		metaGet(cmd, ht, conn)
+	case commandsparser.MetaSetCommand:
+		metaSet(cmd, ht, conn)
+	case commandsparser.MetaDeleteCommand:
+		metaDelete(cmd, ht, conn)
+	case commandsparser.MetaArithmeticCommand:
+		metaArithmetic(cmd, ht, conn)
+	case commandsparser.MetaNoopCommand:
+		writeResponse(conn, false, "MN")
+	}
+}
+
+// mg <key> <flags>*
+func metaGet(cmd *commandsparser.Command, ht *store.HashTable, conn net.Conn) {
+	var item store.HashTableITem
+	var ok bool
+	if token, touch := cmd.MetaFlag('T'); touch {
+		ttl, err := strconv.ParseInt(token, 10, 64)
+		if err != nil {
+			writeResponse(conn, false, "CLIENT_ERROR bad token in command line format")
+			return
+		}
+		item, ok = ht.GetAndTouch(cmd.Key, ttl)
+	} else {
+		item, ok = ht.Get(cmd.Key)
+	}
+	if !ok {
+		writeResponse(conn, cmd.Noreply, "EN")
+		return
+	}
+
+	flags := metaReturnFlags(cmd, item)
+	if _, ok := cmd.MetaFlag('v'); ok {
+		writeResponse(conn, false, strings.TrimSpace(fmt.Sprintf("VA %d %s", len(item.Data), flags)))
+		writeResponse(conn, false, string(item.Data))
+		return
+	}
+	writeResponse(conn, false, strings.TrimSpace("HD "+flags))
+}
+
+// ms <key> <datalen> <flags>*
+func metaSet(cmd *commandsparser.Command, ht *store.HashTable, conn net.Conn) {
+	var flags uint32
+	var ttl int64
+	var casUnique uint64
+	var err error
+	if token, ok := cmd.MetaFlag('F'); ok {
+		if flags, err = parseUint32(token); err != nil {
+			writeResponse(conn, false, "CLIENT_ERROR bad token in command line format")
+			return
+		}
+	}
+	if token, ok := cmd.MetaFlag('T'); ok {
+		if ttl, err = strconv.ParseInt(token, 10, 64); err != nil {
+			writeResponse(conn, false, "CLIENT_ERROR bad token in command line format")
+			return
+		}
+	}
+	if token, ok := cmd.MetaFlag('C'); ok {
+		if casUnique, err = strconv.ParseUint(token, 10, 64); err != nil {
+			writeResponse(conn, false, "CLIENT_ERROR bad token in command line format")
+			return
+		}
+	}
+
+	mode := store.ModeSet
+	if token, ok := cmd.MetaFlag('M'); ok {
+		switch strings.ToUpper(token) {
+		case "S":
+		case "E":
+			mode = store.ModeAdd
+		case "R":
+			mode = store.ModeReplace
+		case "A":
+			mode = store.ModeAppend
+		case "P":
+			mode = store.ModePrepend
+		default:
+			writeResponse(conn, false, "CLIENT_ERROR invalid mode for ms")
+			return
+		}
+	}
+
+	res, newCas := ht.Store(mode, cmd.Key, flags, ttl, cmd.Value, casUnique)
+	returned := metaReturnFlags(cmd, store.HashTableITem{CasUnique: newCas})
+	switch res {
+	case store.Stored:
+		writeResponse(conn, cmd.Noreply, strings.TrimSpace("HD "+returned))
+	case store.NotStored:
+		writeResponse(conn, false, strings.TrimSpace("NS "+returned))
+	case store.Exists:
+		writeResponse(conn, false, strings.TrimSpace("EX "+returned))
+	case store.NotFound:
+		writeResponse(conn, cmd.Noreply, strings.TrimSpace("NF "+returned))
+	case store.TooLarge:
+		writeResponse(conn, false, "SERVER_ERROR object too large for cache")
+	case store.OutOfMemory:
+		writeResponse(conn, false, "SERVER_ERROR "+store.ErrOutOfMemory.Error())
+	}
+}
+
+// md <key> <flags>*
+func metaDelete(cmd *commandsparser.Command, ht *store.HashTable, conn net.Conn) {
+	var casUnique uint64
+	if token, ok := cmd.MetaFlag('C'); ok {
+		var err error
+		if casUnique, err = strconv.ParseUint(token, 10, 64); err != nil {
+			writeResponse(conn, false, "CLIENT_ERROR bad token in command line format")
+			return
+		}
+	}
+
+	returned := metaReturnFlags(cmd, store.HashTableITem{})
+	switch ht.CompareAndDelete(cmd.Key, casUnique) {
+	case store.Stored:
+		writeResponse(conn, cmd.Noreply, strings.TrimSpace("HD "+returned))
+	case store.Exists:
+		writeResponse(conn, false, strings.TrimSpace("EX "+returned))
+	default:
+		writeResponse(conn, cmd.Noreply, strings.TrimSpace("NF "+returned))
+	}
+}
+
+// ma <key> <flags>*
+func metaArithmetic(cmd *commandsparser.Command, ht *store.HashTable, conn net.Conn) {
+	delta, initial := uint64(1), uint64(0)
+	var vivifyTTL int64
+	_, vivify := cmd.MetaFlag('N')
+	var err error
+	if token, ok := cmd.MetaFlag('D'); ok {
+		delta, err = strconv.ParseUint(token, 10, 64)
+	}
+	if token, ok := cmd.MetaFlag('J'); ok && err == nil {
+		initial, err = strconv.ParseUint(token, 10, 64)
+	}
+	if token, ok := cmd.MetaFlag('N'); ok && err == nil {
+		vivifyTTL, err = strconv.ParseInt(token, 10, 64)
+	}
+	if err != nil {
+		writeResponse(conn, false, "CLIENT_ERROR bad token in command line format")
+		return
+	}
+
+	decr := false
+	if token, ok := cmd.MetaFlag('M'); ok {
+		switch strings.ToUpper(token) {
+		case "I", "+":
+		case "D", "-":
+			decr = true
+		default:
+			writeResponse(conn, false, "CLIENT_ERROR invalid mode for ma")
+			return
+		}
+	}
+
+	value, casUnique, err := incrOrCreate(ht, cmd.Key, delta, decr, vivify, initial, vivifyTTL)
+	switch err {
+	case nil:
+	case store.ErrNotFound:
+		writeResponse(conn, cmd.Noreply, strings.TrimSpace("NF "+metaReturnFlags(cmd, store.HashTableITem{})))
+		return
+	case store.ErrNotNumeric:
+		writeResponse(conn, false, "CLIENT_ERROR "+err.Error())
+		return
+	default:
+		writeResponse(conn, false, "SERVER_ERROR "+err.Error())
+		return
+	}
+
+	if token, ok := cmd.MetaFlag('T'); ok {
+		if ttl, err := strconv.ParseInt(token, 10, 64); err == nil {
+			ht.Touch(cmd.Key, ttl)
+		}
+	}
+	item, _ := ht.Get(cmd.Key)
+	item.CasUnique = casUnique
+	number := strconv.FormatUint(value, 10)
+	item.Data = []byte(number)
+	flags := metaReturnFlags(cmd, item)
+	if _, ok := cmd.MetaFlag('v'); ok {
+		writeResponse(conn, false, strings.TrimSpace(fmt.Sprintf("VA %d %s", len(number), flags)))
+		writeResponse(conn, false, number)
+		return
+	}
+	writeResponse(conn, cmd.Noreply, strings.TrimSpace("HD "+flags))
+}
+
+// incrOrCreate increments or decrements the counter, with vivify a missing
+// counter is created with the initial value (shared by ma and the binary
+// incr/decr).
+func incrOrCreate(ht *store.HashTable, key string, delta uint64, decr, vivify bool, initial uint64, ttl int64) (uint64, uint64, error) {
+	for {
+		value, casUnique, err := ht.IncrDecr(key, delta, decr)
+		if err != store.ErrNotFound || !vivify {
+			return value, casUnique, err
+		}
+		res, casUnique := ht.Store(store.ModeAdd, key, 0, ttl, []byte(strconv.FormatUint(initial, 10)), 0)
+		switch res {
+		case store.Stored:
+			return initial, casUnique, nil
+		case store.NotStored:
+			// created by another client in the meantime, update it instead
+			continue
+		default:
+			return 0, 0, store.ErrOutOfMemory
+		}
+	}
+}
+
+// metaReturnFlags renders the flags the client asked to get back, in the
+// order it asked for them.
+func metaReturnFlags(cmd *commandsparser.Command, item store.HashTableITem) string {
+	var flags []string
+	_, base64Key := cmd.MetaFlag('b')
+	for _, f := range cmd.MetaFlags {
+		switch f.Name {
+		case 'O':
+			flags = append(flags, "O"+f.Token)
+		case 'k':
+			key := cmd.Key
+			if base64Key {
+				key = base64.StdEncoding.EncodeToString([]byte(key))
+			}
+			flags = append(flags, "k"+key)
+		case 'b':
+			if _, ok := cmd.MetaFlag('k'); ok {
+				flags = append(flags, "b")
+			}
+		}
+		if item.CasUnique == 0 {
+			// nothing stored to describe (miss, delete, failed store)
+			continue
+		}
+		switch f.Name {
+		case 'c':
+			flags = append(flags, fmt.Sprintf("c%d", item.CasUnique))
+		case 'f':
+			flags = append(flags, fmt.Sprintf("f%d", item.Flags))
+		case 's':
+			flags = append(flags, fmt.Sprintf("s%d", len(item.Data)))
+		case 't':
+			flags = append(flags, fmt.Sprintf("t%d", remainingTTL(item)))
+		}
+	}
+	return strings.Join(flags, " ")
+}
+
+// remainingTTL returns the seconds left before the item expires, -1 if it
+// never does.
+func remainingTTL(item store.HashTableITem) int64 {
+	if item.ExpiresAt.IsZero() {
+		return -1
+	}
+	return int64(time.Until(item.ExpiresAt).Round(time.Second).Seconds())
+}
+
+func parseUint32(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 10, 32)
+	return uint32(v), err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// casFlag returns the CAS unique of the c flag of a meta response.
+func casFlag(t *testing.T, line string) uint64 {
+	t.Helper()
+	for _, field := range strings.Fields(line)[1:] {
+		if field[0] == 'c' {
+			cas, err := strconv.ParseUint(field[1:], 10, 64)
+			if err != nil {
+				t.Fatalf("%q: %v", line, err)
+			}
+			return cas
+		}
+	}
+	t.Fatalf("no CAS unique in %q", line)
+	return 0
+}
+
+func TestMetaGetSet(t *testing.T) {
+	c := connect(t, newTestServer(ServerConfig{}))
+	c.send("ms foo 5 F7 c\r\nhello\r\n")
+	cas := casFlag(t, c.readLine())
+
+	c.expect("mg foo v f s k O123\r\n", "VA 5 f7 s5 kfoo O123", "hello")
+	c.expect("mg foo\r\n", "HD")
+	c.expect("mg foo c t\r\n", "HD c"+strconv.FormatUint(cas, 10)+" t-1")
+	c.expect("mg foo t T100\r\n", "HD t100")
+	c.expect("mg Zm9v b k v\r\n", "VA 5 b kZm9v", "hello")
+	c.expect("mg missing v O9\r\n", "EN")
+	c.expect("mg foo TX\r\n", "CLIENT_ERROR bad token in command line format")
+	// q hides the misses, mn ends the pipeline
+	c.expect("mg missing v q\r\nmg foo s q\r\nmn\r\n", "HD s5", "MN")
+
+	c.expect("ms foo 1 ME\r\nx\r\n", "NS")
+	c.expect("ms new 1 MR\r\nx\r\n", "NS")
+	c.expect("ms foo 3 MA\r\n!!!\r\n", "HD")
+	c.expect("ms foo 1 MP\r\n<\r\n", "HD")
+	c.expect("mg foo v\r\n", "VA 9", "<hello!!!")
+	c.expect("ms foo 1 MX\r\nx\r\n", "CLIENT_ERROR invalid mode for ms")
+	c.expect("ms foo 1 Fx\r\nx\r\n", "CLIENT_ERROR bad token in command line format")
+	c.expect("ms quiet 1 q\r\nx\r\nmn\r\n", "MN")
+}
+
+func TestMetaCAS(t *testing.T) {
+	c := connect(t, newTestServer(ServerConfig{}))
+	c.send("ms foo 1 c\r\na\r\n")
+	cas := casFlag(t, c.readLine())
+	stale := strconv.FormatUint(cas+100, 10)
+
+	c.expect("ms foo 1 C"+stale+"\r\nb\r\n", "EX")
+	c.send("ms foo 1 c C" + strconv.FormatUint(cas, 10) + "\r\nc\r\n")
+	if next := casFlag(t, c.readLine()); next == cas {
+		t.Errorf("expected a new CAS unique, got %d again", next)
+	}
+	c.expect("ms missing 1 C5\r\nd\r\n", "NF")
+	c.expect("mg foo v\r\n", "VA 1", "c")
+
+	c.expect("md foo C"+stale+"\r\n", "EX")
+	c.expect("md foo q\r\nmn\r\n", "MN")
+	c.expect("md foo k\r\n", "NF kfoo")
+}
+
+func TestMetaArithmetic(t *testing.T) {
+	c := connect(t, newTestServer(ServerConfig{}))
+	c.expect("ma n\r\n", "NF")
+	// N creates the missing counter with the J initial value
+	c.expect("ma n N0 J10 v\r\n", "VA 2", "10")
+	c.expect("ma n D5 v\r\n", "VA 2", "15")
+	c.expect("ma n\r\n", "HD")
+	c.expect("ma n MD D20 v t\r\n", "VA 1 t-1", "0")
+	c.expect("ma n q\r\nmn\r\n", "MN")
+	c.expect("mg n v\r\n", "VA 1", "1")
+	c.expect("ma n MX\r\n", "CLIENT_ERROR invalid mode for ma")
+	c.expect("ma n Dx\r\n", "CLIENT_ERROR bad token in command line format")
+
+	c.expect("ms s 3\r\nabc\r\n", "HD")
+	c.expect("ma s\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+}
@@ -1,6 +1,34 @@
 package store
 
-import "sync"
+import (
+	"errors"
+	"hash/maphash"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("item not found")
+	ErrNotNumeric  = errors.New("cannot increment or decrement non-numeric value")
+	ErrOutOfMemory = errors.New("out of memory storing object")
+)
+
+// StoreResult is the outcome of a conditional storage command.
+type StoreResult int
+
+const (
+	Stored      StoreResult = iota // STORED
+	NotStored                      // NOT_STORED, the add/replace/append/prepend condition failed
+	Exists                         // EXISTS, the item changed since it was fetched
+	NotFound                       // NOT_FOUND, the item to cas doesn't exist
+	TooLarge                       // SERVER_ERROR, the item doesn't fit in a slab page
+	OutOfMemory                    // SERVER_ERROR, no chunk could be allocated or evicted
+)
+
+// DefaultMemoryLimit is the memory limit of NewHashTable, memcached's default.
+const DefaultMemoryLimit = 64 << 20
 
 type HashTableITem struct {
 	//  <flags> is an arbitrary 16-bit unsigned integer (written out in
@@ -18,41 +46,406 @@ type HashTableITem struct {
 	//  retrieve this item after the expiration time arrives (measured by
 	//  server time). If a negative value is given the item is immediately
 	//  expired.
-	ExpiryTime int64
+	//
+	// The exptime sent by the client is converted to an absolute time when the
+	// item is stored, the zero time means it never expires.
+	ExpiresAt time.Time
 
 	Data []byte
+
+	// CasUnique identifies this version of the item, it changes with every
+	// modification so "cas" can detect concurrent updates.
+	CasUnique uint64
+}
+
+// IsExpired reports whether the expiration time of the item has passed.
+func (item HashTableITem) IsExpired(now time.Time) bool {
+	return !item.ExpiresAt.IsZero() && !now.Before(item.ExpiresAt)
+}
+
+// maxRelativeExpiry is the largest exptime taken as an offset from now (30
+// days), larger values are Unix timestamps.
+const maxRelativeExpiry = 60 * 60 * 24 * 30
+
+// entry is a stored item, its value lives in a chunk of its slab class.
+type entry struct {
+	key        string
+	flags      uint32
+	expiresAt  time.Time
+	storedAt   time.Time
+	casUnique  uint64
+	chunk      slabChunk
+	length     int
+	class      *slabClass
+	lastAccess time.Time
+	prev, next *entry // LRU links within the class
 }
 
+func (e *entry) data() []byte {
+	return e.chunk.mem[:e.length]
+}
+
+// item returns a copy of the entry, the chunk may be reused once the lock is
+// released.
+func (e *entry) item() HashTableITem {
+	return HashTableITem{
+		Flags:     e.flags,
+		ExpiresAt: e.expiresAt,
+		Data:      append([]byte(nil), e.data()...),
+		CasUnique: e.casUnique,
+	}
+}
+
+// HashTable is a bounded cache: values are stored in slab chunks taken from
+// the memory limit, and once a slab class runs out of chunks the least
+// recently used item of that class is evicted to make room, or a page is
+// moved to it from a class, or a shard, with older items.
+//
+// The keys are spread over lock-striped shards, each with its own slab
+// classes and LRU lists, so concurrent clients only contend when they use keys
+// of the same shard. The shards take their pages from a single budget.
 type HashTable struct {
-	Items map[string]HashTableITem
-	mu    sync.RWMutex
+	shards []*shard
+	seed   maphash.Seed
+	budget *pageBudget
+	// casCounter is the last CAS unique handed out, shared by the shards so
+	// uniques never repeat
+	casCounter atomic.Uint64
+	cmdFlush   atomic.Uint64
+	// slabsMoved counts the pages taken from a class for another one
+	slabsMoved atomic.Uint64
+	// flushAt is the time of the last flush_all in Unix nanoseconds, the
+	// items stored before it are invalid once it has passed. 0 until then.
+	flushAt atomic.Int64
+	// flushedAt is the last flushAt that had passed when it was replaced,
+	// the items stored before it stay invalid
+	flushedAt atomic.Int64
+	flushMu   sync.Mutex
+	// now is the server clock, replaced in tests
+	now func() time.Time
 }
 
+// NewHashTable creates a cache limited to DefaultMemoryLimit.
 func NewHashTable() *HashTable {
-	return &HashTable{
-		Items: make(map[string]HashTableITem),
+	return NewHashTableWithLimit(DefaultMemoryLimit)
+}
+
+// NewHashTableWithLimit creates a cache using at most memoryLimit bytes of
+// slab pages, split into up to DefaultShards shards.
+func NewHashTableWithLimit(memoryLimit int64) *HashTable {
+	shards := 1
+	for shards < DefaultShards && memoryLimit/int64(shards*2) >= minShardMemory {
+		shards *= 2
+	}
+	return NewShardedHashTable(memoryLimit, shards)
+}
+
+// NewShardedHashTable creates a cache of memoryLimit bytes split into the
+// given number of shards, rounded up to a power of two. The limit is at least
+// a page, the largest item.
+func NewShardedHashTable(memoryLimit int64, shards int) *HashTable {
+	n := 1
+	for n < shards {
+		n *= 2
+	}
+	ht := &HashTable{
+		seed:   maphash.MakeSeed(),
+		budget: &pageBudget{limit: max(memoryLimit, slabPageSize)},
+		now:    time.Now,
+	}
+	for i := 0; i < n; i++ {
+		ht.shards = append(ht.shards, newShard(ht, ht.budget))
+	}
+	return ht
+}
+
+// rebalance takes a page from a shard holding more than its share of the
+// memory, for the shard s that holds less. s is locked, so busy shards are
+// skipped rather than waited for, which could deadlock.
+func (ht *HashTable) rebalance(s *shard) *slabPage {
+	for _, other := range ht.shards {
+		if other == s || !other.mu.TryLock() {
+			continue
+		}
+		var page *slabPage
+		if other.slabs.malloced > other.share() {
+			if donor := other.donor(nil); donor != nil {
+				page = other.reassign(donor, ht.now())
+			}
+		}
+		other.mu.Unlock()
+		if page != nil {
+			return page
+		}
 	}
+	return nil
+}
+
+// shardFor returns the shard holding key.
+func (ht *HashTable) shardFor(key string) *shard {
+	return ht.shards[maphash.String(ht.seed, key)&uint64(len(ht.shards)-1)]
 }
 
-func (ht *HashTable) Set(key string, flags uint32, expiryTime int64, data []byte) {
-	ht.mu.Lock()
-	defer ht.mu.Unlock()
-	ht.Items[key] = HashTableITem{
-		Flags:      flags,
-		ExpiryTime: expiryTime,
-		Data:       data,
+// expiresAt converts a protocol exptime to the time the item expires: 0 never
+// expires, up to 30 days is relative to now, above that it is a Unix time and
+// a negative exptime expires the item immediately.
+func (ht *HashTable) expiresAt(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return ht.now()
+	case exptime <= maxRelativeExpiry:
+		return ht.now().Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
 	}
 }
 
+// StoreMode selects the condition and the way a storage command stores the
+// item.
+type StoreMode int
+
+const (
+	ModeSet     StoreMode = iota // store unconditionally
+	ModeAdd                      // store only if the key doesn't exist
+	ModeReplace                  // store only if the key exists
+	ModeAppend                   // add the data after the existing value
+	ModePrepend                  // add the data before the existing value
+)
+
+// Store is the storage command shared by the text, meta and binary protocols.
+// A non zero casUnique makes it a compare and swap: the item must exist and
+// still have this CAS unique. Append and prepend keep the flags and expiry of
+// the existing item. It returns the CAS unique of the stored item.
+func (ht *HashTable) Store(mode StoreMode, key string, flags uint32, expiryTime int64, data []byte, casUnique uint64) (StoreResult, uint64) {
+	s := ht.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cmdSet++
+	e, exists := s.lookup(key)
+	if casUnique != 0 {
+		if !exists {
+			return NotFound, 0
+		}
+		if e.casUnique != casUnique {
+			return Exists, 0
+		}
+	}
+
+	switch mode {
+	case ModeAdd:
+		if exists {
+			return NotStored, 0
+		}
+	case ModeReplace:
+		if !exists {
+			return NotStored, 0
+		}
+	case ModeAppend, ModePrepend:
+		if !exists {
+			return NotStored, 0
+		}
+		value := make([]byte, 0, e.length+len(data))
+		if mode == ModeAppend {
+			value = append(append(value, e.data()...), data...)
+		} else {
+			value = append(append(value, data...), e.data()...)
+		}
+		return s.store(key, e.flags, e.expiresAt, value)
+	}
+	return s.store(key, flags, ht.expiresAt(expiryTime), data)
+}
+
+func (ht *HashTable) Set(key string, flags uint32, expiryTime int64, data []byte) StoreResult {
+	res, _ := ht.Store(ModeSet, key, flags, expiryTime, data, 0)
+	return res
+}
+
+// Add stores the item only if the key doesn't exist yet.
+func (ht *HashTable) Add(key string, flags uint32, expiryTime int64, data []byte) StoreResult {
+	res, _ := ht.Store(ModeAdd, key, flags, expiryTime, data, 0)
+	return res
+}
+
+// Replace stores the item only if the key already exists.
+func (ht *HashTable) Replace(key string, flags uint32, expiryTime int64, data []byte) StoreResult {
+	res, _ := ht.Store(ModeReplace, key, flags, expiryTime, data, 0)
+	return res
+}
+
+// Append adds data after the value of an existing key, keeping its flags and
+// expiry.
+func (ht *HashTable) Append(key string, data []byte) StoreResult {
+	res, _ := ht.Store(ModeAppend, key, 0, 0, data, 0)
+	return res
+}
+
+// Prepend adds data before the value of an existing key, keeping its flags
+// and expiry.
+func (ht *HashTable) Prepend(key string, data []byte) StoreResult {
+	res, _ := ht.Store(ModePrepend, key, 0, 0, data, 0)
+	return res
+}
+
+// Incr adds delta to the decimal value of the key, wrapping around at 2^64,
+// and returns the new value.
+func (ht *HashTable) Incr(key string, delta uint64) (uint64, error) {
+	value, _, err := ht.IncrDecr(key, delta, false)
+	return value, err
+}
+
+// Decr subtracts delta from the decimal value of the key, it stops at 0
+// instead of underflowing.
+func (ht *HashTable) Decr(key string, delta uint64) (uint64, error) {
+	value, _, err := ht.IncrDecr(key, delta, true)
+	return value, err
+}
+
+// IncrDecr increments, or decrements when decr is set, the decimal value of
+// the key. It returns the new value and the CAS unique of the updated item.
+func (ht *HashTable) IncrDecr(key string, delta uint64, decr bool) (uint64, uint64, error) {
+	s := ht.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.lookup(key)
+	if !ok {
+		return 0, 0, ErrNotFound
+	}
+	value, err := strconv.ParseUint(string(e.data()), 10, 64)
+	if err != nil {
+		return 0, 0, ErrNotNumeric
+	}
+	switch {
+	case !decr:
+		value += delta
+	case delta > value:
+		value = 0
+	default:
+		value -= delta
+	}
+	res, casUnique := s.store(key, e.flags, e.expiresAt, []byte(strconv.FormatUint(value, 10)))
+	if res != Stored {
+		return 0, 0, ErrOutOfMemory
+	}
+	return value, casUnique, nil
+}
+
+// Touch updates the expiry time of the key without fetching it.
+func (ht *HashTable) Touch(key string, expiryTime int64) bool {
+	s := ht.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.touch(key, expiryTime)
+	return ok
+}
+
+// GetAndTouch updates the expiry time of the key and returns the item.
+func (ht *HashTable) GetAndTouch(key string, expiryTime int64) (HashTableITem, bool) {
+	s := ht.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.touch(key, expiryTime)
+	s.countGet(ok)
+	if !ok {
+		return HashTableITem{}, false
+	}
+	return e.item(), true
+}
+
 func (ht *HashTable) Get(key string) (HashTableITem, bool) {
-	ht.mu.RLock()
-	defer ht.mu.RUnlock()
-	item, ok := ht.Items[key]
-	return item, ok
+	s := ht.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.lookup(key)
+	s.countGet(ok)
+	if !ok {
+		return HashTableITem{}, false
+	}
+	return e.item(), true
+}
+
+// Delete removes the key, it returns false if the key didn't exist.
+func (ht *HashTable) Delete(key string) bool {
+	return ht.CompareAndDelete(key, 0) == Stored
+}
+
+// CompareAndDelete removes the key if its CAS unique is still casUnique, 0
+// deletes unconditionally. It returns Stored once the key is deleted.
+func (ht *HashTable) CompareAndDelete(key string, casUnique uint64) StoreResult {
+	s := ht.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.lookup(key)
+	if !ok {
+		return NotFound
+	}
+	if casUnique != 0 && e.casUnique != casUnique {
+		return Exists
+	}
+	s.remove(e)
+	return Stored
+}
+
+// FlushAll invalidates every item. With a delay, the items stored until it
+// has passed are invalidated then, replacing any pending flush.
+func (ht *HashTable) FlushAll(delay time.Duration) {
+	ht.cmdFlush.Add(1)
+	ht.flushMu.Lock()
+	now := ht.now()
+	if last := ht.flushAt.Load(); last != 0 && last <= now.UnixNano() {
+		ht.flushedAt.Store(last)
+	}
+	ht.flushAt.Store(now.Add(max(delay, 0)).UnixNano())
+	ht.flushMu.Unlock()
+	if delay > 0 {
+		return
+	}
+	for _, s := range ht.shards {
+		s.mu.Lock()
+		for _, e := range s.items {
+			s.remove(e)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// DeleteExpired removes every expired item and returns how many were removed.
+// The shards are locked one at a time.
+func (ht *HashTable) DeleteExpired() int {
+	removed := 0
+	for _, s := range ht.shards {
+		s.mu.Lock()
+		now := ht.now()
+		for _, e := range s.items {
+			if s.isExpired(e, now) {
+				s.remove(e)
+				removed++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return removed
 }
 
-func (ht *HashTable) Delete(key string) {
-	ht.mu.Lock()
-	defer ht.mu.Unlock()
-	delete(ht.Items, key)
+// StartReaper removes expired items every interval in the background, so
+// items that are never accessed again don't hold on to memory. It returns a
+// function stopping the reaper.
+func (ht *HashTable) StartReaper(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ht.DeleteExpired()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
 }
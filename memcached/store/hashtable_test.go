@@ -0,0 +1,687 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAddAndReplace(t *testing.T) {
+	ht := NewHashTable()
+	if res := ht.Replace("key", 0, 0, []byte("a")); res != NotStored {
+		t.Errorf("Replace of a missing key: expected NotStored, got %v", res)
+	}
+	if res := ht.Add("key", 0, 0, []byte("a")); res != Stored {
+		t.Errorf("Add: expected Stored, got %v", res)
+	}
+	if res := ht.Add("key", 0, 0, []byte("b")); res != NotStored {
+		t.Errorf("Add of an existing key: expected NotStored, got %v", res)
+	}
+	if res := ht.Replace("key", 0, 0, []byte("c")); res != Stored {
+		t.Errorf("Replace: expected Stored, got %v", res)
+	}
+	if item, _ := ht.Get("key"); string(item.Data) != "c" {
+		t.Errorf("expected c, got %q", item.Data)
+	}
+}
+
+func TestAppendAndPrepend(t *testing.T) {
+	ht := NewHashTable()
+	if res := ht.Append("key", []byte("x")); res != NotStored {
+		t.Errorf("Append to a missing key: expected NotStored, got %v", res)
+	}
+	ht.Set("key", 7, 0, []byte("b"))
+	ht.Append("key", []byte("c"))
+	ht.Prepend("key", []byte("a"))
+	item, _ := ht.Get("key")
+	if string(item.Data) != "abc" || item.Flags != 7 {
+		t.Errorf("expected abc with flags 7, got %q with flags %d", item.Data, item.Flags)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	ht := NewHashTable()
+	if res, _ := ht.Store(ModeSet, "key", 0, 0, []byte("a"), 1); res != NotFound {
+		t.Errorf("cas of a missing key: expected NotFound, got %v", res)
+	}
+
+	ht.Set("key", 0, 0, []byte("a"))
+	item, _ := ht.Get("key")
+	// another client modifies the item, the stale unique must be rejected
+	ht.Set("key", 0, 0, []byte("b"))
+	if res, _ := ht.Store(ModeSet, "key", 0, 0, []byte("c"), item.CasUnique); res != Exists {
+		t.Errorf("cas with a stale unique: expected Exists, got %v", res)
+	}
+
+	item, _ = ht.Get("key")
+	if res, _ := ht.Store(ModeSet, "key", 0, 0, []byte("c"), item.CasUnique); res != Stored {
+		t.Errorf("cas with the current unique: expected Stored, got %v", res)
+	}
+	updated, _ := ht.Get("key")
+	if string(updated.Data) != "c" || updated.CasUnique == item.CasUnique {
+		t.Errorf("expected c with a new unique, got %q (%d)", updated.Data, updated.CasUnique)
+	}
+}
+
+func TestStoreWithCas(t *testing.T) {
+	ht := NewHashTable()
+	_, cas := ht.Store(ModeSet, "key", 0, 0, []byte("a"), 0)
+	ht.Set("key", 0, 0, []byte("b"))
+	if res, _ := ht.Store(ModeAppend, "key", 0, 0, []byte("c"), cas); res != Exists {
+		t.Errorf("append with a stale unique: expected Exists, got %v", res)
+	}
+
+	item, _ := ht.Get("key")
+	res, cas := ht.Store(ModeAppend, "key", 0, 0, []byte("c"), item.CasUnique)
+	if res != Stored || cas == item.CasUnique {
+		t.Errorf("append with the current unique: expected Stored with a new unique, got %v (%d)", res, cas)
+	}
+	if item, _ := ht.Get("key"); string(item.Data) != "bc" || item.CasUnique != cas {
+		t.Errorf("expected bc with unique %d, got %q (%d)", cas, item.Data, item.CasUnique)
+	}
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	ht := NewHashTable()
+	if res := ht.CompareAndDelete("key", 0); res != NotFound {
+		t.Errorf("delete of a missing key: expected NotFound, got %v", res)
+	}
+
+	_, cas := ht.Store(ModeSet, "key", 0, 0, []byte("a"), 0)
+	if res := ht.CompareAndDelete("key", cas+1); res != Exists {
+		t.Errorf("delete with a stale unique: expected Exists, got %v", res)
+	}
+	if res := ht.CompareAndDelete("key", cas); res != Stored {
+		t.Errorf("delete with the current unique: expected Stored, got %v", res)
+	}
+	if _, ok := ht.Get("key"); ok {
+		t.Error("expected the key to be deleted")
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	ht := NewHashTable()
+	if _, err := ht.Incr("counter", 1); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	ht.Set("counter", 0, 0, []byte(strconv.FormatUint(math.MaxUint64, 10)))
+	if v, err := ht.Incr("counter", 2); err != nil || v != 1 {
+		t.Errorf("incr should wrap around at 2^64, got %d, %v", v, err)
+	}
+	if v, err := ht.Decr("counter", 5); err != nil || v != 0 {
+		t.Errorf("decr should stop at 0, got %d, %v", v, err)
+	}
+	if item, _ := ht.Get("counter"); string(item.Data) != "0" {
+		t.Errorf("expected the value to be 0, got %q", item.Data)
+	}
+
+	ht.Set("name", 0, 0, []byte("islam"))
+	if _, err := ht.Incr("name", 1); err != ErrNotNumeric {
+		t.Errorf("expected ErrNotNumeric, got %v", err)
+	}
+}
+
+// fakeClock lets the tests move the server time forward.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestHashTable() (*HashTable, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	ht := NewHashTable()
+	ht.now = clock.now
+	return ht, clock
+}
+
+func TestRelativeExpiry(t *testing.T) {
+	ht, clock := newTestHashTable()
+	ht.Set("key", 0, 10, []byte("a"))
+	ht.Set("forever", 0, 0, []byte("b"))
+
+	clock.advance(9 * time.Second)
+	if _, ok := ht.Get("key"); !ok {
+		t.Fatal("the item expired early")
+	}
+	clock.advance(time.Second)
+	if _, ok := ht.Get("key"); ok {
+		t.Error("the item should have expired")
+	}
+	if _, ok := ht.shardFor("key").items["key"]; ok {
+		t.Error("the expired item should have been reaped on access")
+	}
+	if _, ok := ht.Get("forever"); !ok {
+		t.Error("an exptime of 0 never expires")
+	}
+}
+
+func TestAbsoluteAndNegativeExpiry(t *testing.T) {
+	ht, clock := newTestHashTable()
+	// more than 30 days is a Unix timestamp
+	ht.Set("absolute", 0, clock.t.Unix()+60, []byte("a"))
+	ht.Set("past", 0, maxRelativeExpiry+1, []byte("a"))
+	ht.Set("negative", 0, -1, []byte("a"))
+
+	if _, ok := ht.Get("absolute"); !ok {
+		t.Error("the item with an absolute exptime expired early")
+	}
+	if _, ok := ht.Get("past"); ok {
+		t.Error("an absolute exptime in the past expires immediately")
+	}
+	if _, ok := ht.Get("negative"); ok {
+		t.Error("a negative exptime expires immediately")
+	}
+	clock.advance(time.Minute)
+	if _, ok := ht.Get("absolute"); ok {
+		t.Error("the item with an absolute exptime should have expired")
+	}
+}
+
+func TestExpiredItemsAreMissing(t *testing.T) {
+	ht, clock := newTestHashTable()
+	ht.Set("key", 0, 1, []byte("1"))
+	clock.advance(time.Second)
+
+	if res := ht.Add("key", 0, 0, []byte("2")); res != Stored {
+		t.Errorf("Add over an expired item: expected Stored, got %v", res)
+	}
+	ht.Touch("key", 5)
+	clock.advance(4 * time.Second)
+	if _, err := ht.Incr("key", 1); err != nil {
+		t.Errorf("touch should have extended the expiry: %v", err)
+	}
+	clock.advance(time.Second)
+	if ht.Touch("key", 5) {
+		t.Error("touching an expired item should fail")
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	ht, clock := newTestHashTable()
+	for i := 0; i < 10; i++ {
+		ht.Set(strconv.Itoa(i), 0, int64(i+1), []byte("x"))
+	}
+	clock.advance(5 * time.Second)
+	if removed := ht.DeleteExpired(); removed != 5 {
+		t.Errorf("expected 5 items to be reaped, got %d", removed)
+	}
+	if n := ht.Stats().CurrItems; n != 5 {
+		t.Errorf("expected 5 items left, got %d", n)
+	}
+}
+
+func TestFlushAll(t *testing.T) {
+	ht, clock := newTestHashTable()
+	ht.Set("a", 0, 0, []byte("a"))
+	ht.Set("b", 0, 5, []byte("b"))
+	ht.FlushAll(10 * time.Second)
+	if _, ok := ht.Get("a"); !ok {
+		t.Fatal("a delayed flush invalidated the item early")
+	}
+	clock.advance(5 * time.Second)
+	if _, ok := ht.Get("b"); ok {
+		t.Error("an item expiring before the flush should keep its expiry")
+	}
+	// items stored until the flush are invalidated too
+	ht.Set("c", 0, 0, []byte("c"))
+	clock.advance(5 * time.Second)
+	if _, ok := ht.Get("a"); ok {
+		t.Error("the item should have been flushed")
+	}
+	if _, ok := ht.Get("c"); ok {
+		t.Error("an item stored before the flush should have been flushed")
+	}
+	ht.Set("d", 0, 0, []byte("d"))
+	clock.advance(time.Second)
+	if _, ok := ht.Get("d"); !ok {
+		t.Error("an item stored after the flush should be kept")
+	}
+
+	// an immediate flush replaces a pending one
+	ht.FlushAll(10 * time.Second)
+	ht.Set("c", 0, 0, []byte("c"))
+	ht.FlushAll(0)
+	clock.advance(time.Second)
+	ht.Set("e", 0, 0, []byte("e"))
+	clock.advance(10 * time.Second)
+	if _, ok := ht.Get("e"); !ok {
+		t.Error("an item stored after the immediate flush should be kept")
+	}
+	ht.FlushAll(0)
+	if s := ht.Stats(); s.CurrItems != 0 || s.Bytes != 0 {
+		t.Errorf("expected an empty cache, got %d items of %d bytes", s.CurrItems, s.Bytes)
+	}
+}
+
+func TestDelayedFlushesInARow(t *testing.T) {
+	ht, clock := newTestHashTable()
+	ht.Set("old", 0, 0, []byte("a"))
+	ht.FlushAll(5 * time.Second)
+	clock.advance(10 * time.Second)
+	// the first flush has passed without old being read, a new delayed
+	// flush must not bring it back
+	ht.Set("new", 0, 0, []byte("b"))
+	ht.FlushAll(5 * time.Second)
+	if _, ok := ht.Get("old"); ok {
+		t.Error("an item flushed by the first flush came back")
+	}
+	if _, ok := ht.Get("new"); !ok {
+		t.Fatal("the second flush invalidated the item early")
+	}
+	clock.advance(5 * time.Second)
+	if _, ok := ht.Get("new"); ok {
+		t.Error("the item should have been flushed by the second flush")
+	}
+}
+
+func TestStats(t *testing.T) {
+	ht := NewHashTable()
+	ht.Set("key", 0, 0, []byte("value"))
+	ht.Add("key", 0, 0, []byte("value"))
+	ht.Get("key")
+	ht.Get("missing")
+	ht.GetAndTouch("key", 10)
+	ht.Touch("missing", 10)
+
+	s := ht.Stats()
+	if s.CurrItems != 1 || s.TotalItems != 1 || s.Bytes != int64(len("key")+len("value")) {
+		t.Errorf("unexpected item stats %+v", s)
+	}
+	if s.CmdSet != 2 || s.GetHits != 2 || s.GetMisses != 1 || s.TouchHits != 1 || s.TouchMisses != 1 {
+		t.Errorf("unexpected command stats %+v", s)
+	}
+	if s.LimitMaxBytes != DefaultMemoryLimit {
+		t.Errorf("expected the default limit, got %d", s.LimitMaxBytes)
+	}
+}
+
+func TestSlabClasses(t *testing.T) {
+	s := newSlabAllocator(&pageBudget{limit: DefaultMemoryLimit})
+	for i := 1; i < len(s.classes); i++ {
+		prev, c := s.classes[i-1], s.classes[i]
+		if c.chunkSize <= prev.chunkSize || c.chunkSize%8 != 0 && c.chunkSize != slabPageSize {
+			t.Errorf("class %d: chunk size %d after %d", c.id, c.chunkSize, prev.chunkSize)
+		}
+	}
+	if c := s.classFor(100); c == nil || c.chunkSize < 100 || c.id != 2 {
+		t.Errorf("expected 100 bytes to go to the second class, got %+v", c)
+	}
+	if c := s.classFor(slabPageSize + 1); c != nil {
+		t.Errorf("expected no class for items larger than a page, got %+v", c)
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	// a single page, so the class is full once its chunks are used
+	ht := NewHashTableWithLimit(slabPageSize)
+	if len(ht.shards) != 1 {
+		t.Fatalf("expected a single shard for a 1MB cache, got %d", len(ht.shards))
+	}
+	value := make([]byte, 10000)
+	class := ht.shards[0].slabs.classFor(itemHeaderSize + 2 + len(value))
+	n := class.chunksPerPage()
+
+	for i := 0; i < n; i++ {
+		if res := ht.Set(strconv.Itoa(i), 0, 0, value); res != Stored {
+			t.Fatalf("Set %d: %v", i, res)
+		}
+	}
+	// reading 0 makes 1 the least recently used item
+	ht.Get("0")
+	ht.Set("new", 0, 0, value)
+
+	if _, ok := ht.Get("1"); ok {
+		t.Error("expected the least recently used item to be evicted")
+	}
+	if _, ok := ht.Get("0"); !ok {
+		t.Error("the recently read item should have survived")
+	}
+	classes, malloced := ht.SlabStats()
+	if len(classes) != 1 || classes[0].Evicted != 1 || classes[0].Items != n {
+		t.Errorf("unexpected stats %+v", classes)
+	}
+	if malloced != slabPageSize {
+		t.Errorf("expected a single page to be allocated, got %d bytes", malloced)
+	}
+}
+
+func TestExpiredItemsAreReclaimedFirst(t *testing.T) {
+	ht, clock := newTestHashTable()
+	ht.shards = []*shard{newShard(ht, &pageBudget{limit: slabPageSize})}
+	value := make([]byte, 10000)
+	n := ht.shards[0].slabs.classFor(itemHeaderSize + 2 + len(value)).chunksPerPage()
+
+	ht.Set("old", 0, 1, value)
+	for i := 1; i < n; i++ {
+		ht.Set(strconv.Itoa(i), 0, 0, value)
+	}
+	clock.advance(time.Second)
+	ht.Set("new", 0, 0, value)
+
+	classes, _ := ht.SlabStats()
+	if classes[0].Reclaimed != 1 || classes[0].Evicted != 0 {
+		t.Errorf("expected the expired item to be reclaimed, got %+v", classes[0])
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	ht := NewHashTable()
+	ht.Set("key", 0, 0, []byte("small"))
+	if res := ht.Set("key", 0, 0, make([]byte, slabPageSize)); res != TooLarge {
+		t.Fatalf("expected TooLarge, got %v", res)
+	}
+	if _, ok := ht.Get("key"); ok {
+		t.Error("a failed set should remove the old value")
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	const limit = 4 * slabPageSize
+	ht := NewHashTableWithLimit(limit)
+	value := make([]byte, 1000)
+	for i := 0; i < 20000; i++ {
+		if res := ht.Set(strconv.Itoa(i), 0, 0, value); res != Stored {
+			t.Fatalf("Set %d: %v", i, res)
+		}
+	}
+	_, malloced := ht.SlabStats()
+	if malloced > limit {
+		t.Errorf("allocated %d bytes over the %d byte limit", malloced, limit)
+	}
+	if _, ok := ht.Get("19999"); !ok {
+		t.Error("the last item should be stored")
+	}
+}
+
+func TestMemoryLimitAcrossShards(t *testing.T) {
+	const limit = 64 * slabPageSize
+	ht := NewHashTableWithLimit(limit)
+	if len(ht.shards) != DefaultShards {
+		t.Fatalf("expected %d shards, got %d", DefaultShards, len(ht.shards))
+	}
+	// items of every class in every shard, each class wants a page per shard
+	var sizes []int
+	for _, c := range ht.shards[0].slabs.classes {
+		sizes = append(sizes, c.chunkSize-itemHeaderSize-8)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				size := sizes[(i+w)%len(sizes)]
+				ht.Set(strconv.Itoa(w)+"-"+strconv.Itoa(i), 0, 0, make([]byte, max(size, 0)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	classes, malloced := ht.SlabStats()
+	if malloced > limit {
+		t.Errorf("allocated %d bytes over the %d byte limit", malloced, limit)
+	}
+	pages := 0
+	for _, c := range classes {
+		pages += c.TotalPages
+	}
+	if int64(pages)*slabPageSize != malloced || malloced != ht.budget.malloced.Load() {
+		t.Errorf("%d pages don't add up to %d bytes allocated", pages, malloced)
+	}
+}
+
+func TestSlabReassignment(t *testing.T) {
+	const limit = 4 * slabPageSize
+	ht := NewShardedHashTable(limit, 1)
+	small, large := make([]byte, 1000), make([]byte, 10000)
+	for i := 0; i < 10000; i++ {
+		ht.Set("small"+strconv.Itoa(i), 0, 0, small)
+	}
+	if ht.Stats().Evictions == 0 {
+		t.Fatal("expected the small items to fill the memory")
+	}
+
+	// the memory is full of small items, pages move to the large ones
+	n := 4 * ht.shards[0].slabs.classFor(itemHeaderSize+8+len(large)).chunksPerPage()
+	for i := 0; i < n; i++ {
+		if res := ht.Set("large"+strconv.Itoa(i), 0, 0, large); res != Stored {
+			t.Fatalf("Set %d: %v", i, res)
+		}
+	}
+	for i := n - n/2; i < n; i++ {
+		if _, ok := ht.Get("large" + strconv.Itoa(i)); !ok {
+			t.Fatalf("large%d should be stored", i)
+		}
+	}
+	classes, malloced := ht.SlabStats()
+	if malloced > limit {
+		t.Errorf("allocated %d bytes over the %d byte limit", malloced, limit)
+	}
+	if len(classes) != 1 || classes[0].ChunkSize < len(large) || ht.Stats().SlabsMoved != 4 {
+		t.Errorf("expected the 4 pages to move to the large items, got %+v", classes)
+	}
+}
+
+func TestMixedSizesAcrossShards(t *testing.T) {
+	const limit = 64 * slabPageSize
+	ht := NewHashTableWithLimit(limit)
+	small, large := make([]byte, 1000), make([]byte, 50000)
+	for i := 0; i < 2*limit/len(small); i++ {
+		ht.Set("small"+strconv.Itoa(i), 0, 0, small)
+	}
+
+	class := ht.shards[0].slabs.classFor(itemHeaderSize + 8 + len(large))
+	n := limit / slabPageSize * class.chunksPerPage()
+	for i := 0; i < n; i++ {
+		if res := ht.Set("large"+strconv.Itoa(i), 0, 0, large); res != Stored {
+			t.Fatalf("Set %d: %v", i, res)
+		}
+	}
+	// a quarter of the capacity fits whatever the spread of the keys
+	for i := n - n/4; i < n; i++ {
+		if _, ok := ht.Get("large" + strconv.Itoa(i)); !ok {
+			t.Fatalf("large%d should be stored", i)
+		}
+	}
+	classes, malloced := ht.SlabStats()
+	if malloced > limit {
+		t.Errorf("allocated %d bytes over the %d byte limit", malloced, limit)
+	}
+	for _, c := range classes {
+		if c.ID == class.id && c.TotalPages < limit/slabPageSize/2 {
+			t.Errorf("expected most pages to move to the large items, got %d", c.TotalPages)
+		}
+	}
+}
+
+func TestSharding(t *testing.T) {
+	if n := len(NewHashTable().shards); n != DefaultShards {
+		t.Errorf("expected %d shards for the default limit, got %d", DefaultShards, n)
+	}
+	ht := NewShardedHashTable(DefaultMemoryLimit, 6)
+	if len(ht.shards) != 8 {
+		t.Fatalf("expected 6 shards to be rounded up to 8, got %d", len(ht.shards))
+	}
+
+	var uniques = make(map[uint64]bool)
+	for i := 0; i < 1000; i++ {
+		_, cas := ht.Store(ModeSet, strconv.Itoa(i), 0, 0, []byte("x"), 0)
+		if uniques[cas] {
+			t.Fatalf("CAS unique %d handed out twice", cas)
+		}
+		uniques[cas] = true
+	}
+	for i, s := range ht.shards {
+		if len(s.items) == 0 {
+			t.Errorf("shard %d holds no keys", i)
+		}
+	}
+	if s := ht.Stats(); s.CurrItems != 1000 || s.LimitMaxBytes != DefaultMemoryLimit {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	ht := NewHashTable()
+	ht.Set("counter", 0, 0, []byte("0"))
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := strconv.Itoa(i % 100)
+				ht.Set(key, 0, 0, []byte(strconv.Itoa(g)))
+				ht.Get(key)
+				ht.Incr("counter", 1)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if s := ht.Stats(); s.CurrItems != 101 {
+		t.Errorf("expected 101 items, got %d", s.CurrItems)
+	}
+	if v, _ := ht.Incr("counter", 0); v != 8000 {
+		t.Errorf("expected 8000 increments, got %d", v)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ht, clock := newTestHashTable()
+	ht.Set("forever", 7, 0, []byte("a"))
+	ht.Set("later", 8, 100, []byte("b"))
+	ht.Set("soon", 9, 10, []byte("c"))
+	ht.Set("gone", 0, -1, []byte("d"))
+	item, _ := ht.Get("later")
+
+	var buf bytes.Buffer
+	if n, err := ht.WriteSnapshot(&buf); err != nil || n != 3 {
+		t.Fatalf("expected 3 items written, got %d (%v)", n, err)
+	}
+
+	// restart after "soon" expired
+	restarted := NewHashTable()
+	restarted.now = func() time.Time { return clock.t.Add(time.Minute) }
+	if n, err := restarted.LoadSnapshot(&buf); err != nil || n != 2 {
+		t.Fatalf("expected 2 items loaded, got %d (%v)", n, err)
+	}
+	if _, ok := restarted.Get("soon"); ok {
+		t.Error("an item that expired since the snapshot should be skipped")
+	}
+	loaded, ok := restarted.Get("later")
+	if !ok || string(loaded.Data) != "b" || loaded.Flags != 8 || !loaded.ExpiresAt.Equal(item.ExpiresAt) || loaded.CasUnique != item.CasUnique {
+		t.Errorf("expected %+v, got %+v", item, loaded)
+	}
+	if forever, _ := restarted.Get("forever"); !forever.ExpiresAt.IsZero() || forever.Flags != 7 {
+		t.Errorf("unexpected item %+v", forever)
+	}
+
+	// new uniques don't collide with the restored ones
+	if _, cas := restarted.Store(ModeSet, "new", 0, 0, []byte("e"), 0); cas <= item.CasUnique {
+		t.Errorf("expected a unique above %d, got %d", item.CasUnique, cas)
+	}
+}
+
+func TestSnapshotKeepsLRUOrder(t *testing.T) {
+	ht := NewHashTableWithLimit(slabPageSize)
+	value := make([]byte, 10000)
+	n := ht.shards[0].slabs.classFor(itemHeaderSize + 2 + len(value)).chunksPerPage()
+	for i := 0; i < n; i++ {
+		ht.Set(strconv.Itoa(i), 0, 0, value)
+	}
+	ht.Get("0")
+
+	var buf bytes.Buffer
+	ht.WriteSnapshot(&buf)
+	restarted := NewHashTableWithLimit(slabPageSize)
+	restarted.LoadSnapshot(&buf)
+	restarted.Set("new", 0, 0, value)
+	if _, ok := restarted.Get("1"); ok {
+		t.Error("expected the least recently used item to be evicted after the restart")
+	}
+	if _, ok := restarted.Get("0"); !ok {
+		t.Error("the recently read item should have survived the restart")
+	}
+}
+
+func TestCorruptSnapshot(t *testing.T) {
+	ht := NewHashTable()
+	ht.Set("key", 0, 0, []byte("value"))
+	var buf bytes.Buffer
+	ht.WriteSnapshot(&buf)
+
+	data := buf.Bytes()
+	data[len(data)-8] ^= 0xff
+	restarted := NewHashTable()
+	if _, err := restarted.LoadSnapshot(bytes.NewReader(data)); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Fatalf("expected ErrCorruptSnapshot, got %v", err)
+	}
+	if n := restarted.Stats().CurrItems; n != 0 {
+		t.Errorf("nothing should be loaded from a corrupt snapshot, got %d items", n)
+	}
+	if _, err := restarted.LoadSnapshot(bytes.NewReader(data[:10])); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Errorf("expected ErrCorruptSnapshot for a truncated snapshot, got %v", err)
+	}
+}
+
+// The parallel benchmarks compare a single shard, where every operation takes
+// the same lock, with the default sharding. Run them with -cpu 1,2,4,8 to
+// see the throughput scale with GOMAXPROCS.
+
+var benchKeys = func() []string {
+	keys := make([]string, 1<<14)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+	return keys
+}()
+
+func benchmarkParallel(b *testing.B, op func(ht *HashTable, key string)) {
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			ht := NewShardedHashTable(DefaultMemoryLimit, shards)
+			value := []byte("value")
+			for _, key := range benchKeys {
+				ht.Set(key, 0, 0, value)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					op(ht, benchKeys[i&(len(benchKeys)-1)])
+					i += 7
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkSetParallel(b *testing.B) {
+	value := []byte("value")
+	benchmarkParallel(b, func(ht *HashTable, key string) {
+		ht.Set(key, 0, 0, value)
+	})
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	benchmarkParallel(b, func(ht *HashTable, key string) {
+		ht.Get(key)
+	})
+}
+
+func BenchmarkMixedParallel(b *testing.B) {
+	value := []byte("value")
+	benchmarkParallel(b, func(ht *HashTable, key string) {
+		// 9 reads for a write, a typical cache workload
+		if len(key)%10 == 0 {
+			ht.Set(key, 0, 0, value)
+		} else {
+			ht.Get(key)
+		}
+	})
+}
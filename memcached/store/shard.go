@@ -0,0 +1,242 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultShards is the largest number of shards NewHashTableWithLimit
+	// splits the cache into.
+	DefaultShards = 16
+	// minShardMemory is the least memory per shard NewHashTableWithLimit
+	// splits the cache for. Every slab class of a shard takes a whole page
+	// the first time it is used, so many shards in a small cache would mostly
+	// hold partially used pages.
+	minShardMemory = 4 * slabPageSize
+)
+
+// shard is a slice of the cache with its own lock, slab classes and LRU
+// lists, its pages come from the budget of the whole cache. A key always maps
+// to the same shard, so operations on keys of different shards don't contend.
+type shard struct {
+	ht    *HashTable
+	mu    sync.Mutex
+	items map[string]*entry
+	slabs *slabAllocator
+
+	// bytes is the size of the keys and values stored
+	bytes int64
+	// counters reported by Stats
+	totalItems, cmdSet     uint64
+	getHits, getMisses     uint64
+	touchHits, touchMisses uint64
+}
+
+func newShard(ht *HashTable, budget *pageBudget) *shard {
+	return &shard{
+		ht:    ht,
+		items: make(map[string]*entry),
+		slabs: newSlabAllocator(budget),
+	}
+}
+
+// The methods below must be called with mu held.
+
+// lookup returns the entry of key, expired items are reaped on access (lazy
+// expiry). A hit marks the entry as recently used.
+func (s *shard) lookup(key string) (*entry, bool) {
+	e, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	now := s.ht.now()
+	if s.isExpired(e, now) {
+		s.remove(e)
+		return nil, false
+	}
+	e.lastAccess = now
+	e.class.bump(e)
+	return e, true
+}
+
+// expiresAt returns when the entry stops being valid: its expiry time, or the
+// earliest flush_all the entry was stored before, if it expires later.
+func (s *shard) expiresAt(e *entry) time.Time {
+	for _, flushAt := range []int64{s.ht.flushedAt.Load(), s.ht.flushAt.Load()} {
+		if flushAt == 0 || !e.storedAt.Before(time.Unix(0, flushAt)) {
+			continue
+		}
+		if deadline := time.Unix(0, flushAt); e.expiresAt.IsZero() || e.expiresAt.After(deadline) {
+			return deadline
+		}
+		break
+	}
+	return e.expiresAt
+}
+
+func (s *shard) isExpired(e *entry, now time.Time) bool {
+	expiresAt := s.expiresAt(e)
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// remove unlinks the entry and gives its chunk back.
+func (s *shard) remove(e *entry) {
+	delete(s.items, e.key)
+	s.bytes -= int64(len(e.key) + e.length)
+	e.class.unlink(e)
+	s.slabs.release(e.class, e.chunk)
+}
+
+// store saves the item in a chunk of its slab class with a new CAS unique,
+// replacing the current item of the key. It returns the CAS unique of the new
+// item.
+func (s *shard) store(key string, flags uint32, expiresAt time.Time, data []byte) (StoreResult, uint64) {
+	class := s.slabs.classFor(itemHeaderSize + len(key) + len(data))
+	if class == nil {
+		// like memcached, a failed set doesn't leave the old value around
+		if old, ok := s.items[key]; ok {
+			s.remove(old)
+		}
+		return TooLarge, 0
+	}
+
+	chunk, ok := s.alloc(class)
+	if !ok {
+		class.outOfMemory++
+		return OutOfMemory, 0
+	}
+	// the old item is released after the allocation, unless it was the one
+	// evicted to make room
+	if old, ok := s.items[key]; ok {
+		s.remove(old)
+	}
+
+	now := s.ht.now()
+	e := &entry{
+		key:        key,
+		flags:      flags,
+		expiresAt:  expiresAt,
+		storedAt:   now,
+		casUnique:  s.ht.casCounter.Add(1),
+		chunk:      chunk,
+		length:     copy(chunk.mem, data),
+		class:      class,
+		lastAccess: now,
+	}
+	s.items[key] = e
+	s.bytes += int64(len(key) + e.length)
+	s.totalItems++
+	class.linkHead(e)
+	return Stored, e.casUnique
+}
+
+// alloc returns a free chunk of the class. Once the memory limit is reached it
+// makes room, in order: it reclaims the expired tail of the class, takes a
+// page from a class of the shard whose least recently used item is older,
+// takes a page from a shard holding more than its share of the memory, and
+// last evicts the least recently used item of the class.
+func (s *shard) alloc(class *slabClass) (slabChunk, bool) {
+	if chunk, ok := s.slabs.alloc(class); ok {
+		return chunk, true
+	}
+	now := s.ht.now()
+	if class.tail != nil && s.isExpired(class.tail, now) {
+		s.evict(class.tail, now)
+		return s.slabs.alloc(class)
+	}
+	if donor := s.donor(class); donor != nil {
+		s.slabs.addPage(class, s.reassign(donor, now))
+		return s.slabs.alloc(class)
+	}
+	if s.slabs.malloced < s.share() {
+		if page := s.ht.rebalance(s); page != nil {
+			s.slabs.addPage(class, page)
+			return s.slabs.alloc(class)
+		}
+	}
+	if class.tail == nil {
+		return slabChunk{}, false
+	}
+	s.evict(class.tail, now)
+	return s.slabs.alloc(class)
+}
+
+// evict removes the entry to reuse its chunk.
+func (s *shard) evict(e *entry, now time.Time) {
+	if s.isExpired(e, now) {
+		e.class.reclaimed++
+	} else {
+		e.class.evicted++
+		e.class.evictedTime = now.Sub(e.lastAccess)
+	}
+	s.remove(e)
+}
+
+// share is the memory a shard holds when the pages are evenly spread.
+func (s *shard) share() int64 {
+	return s.slabs.budget.limit / int64(len(s.ht.shards))
+}
+
+// donor returns the class to take a page from to make room for class: one
+// with an empty page, or else the one whose least recently used item is the
+// oldest, as long as it is older than the one of class. This way pages follow
+// the sizes in use instead of staying with the classes that took them first.
+func (s *shard) donor(class *slabClass) *slabClass {
+	var donor *slabClass
+	for _, c := range s.slabs.classes {
+		if c == class || len(c.pages) == 0 {
+			continue
+		}
+		if c.freeChunks() >= c.chunksPerPage() && c.emptyPage() != nil {
+			return c
+		}
+		if c.tail != nil && (donor == nil || c.tail.lastAccess.Before(donor.tail.lastAccess)) {
+			donor = c
+		}
+	}
+	if donor != nil && class != nil && class.tail != nil && !donor.tail.lastAccess.Before(class.tail.lastAccess) {
+		return nil
+	}
+	return donor
+}
+
+// reassign takes a page away from the donor class: an empty page, or else the
+// page of its least recently used item, whose items are evicted.
+func (s *shard) reassign(donor *slabClass, now time.Time) *slabPage {
+	page := donor.emptyPage()
+	if page == nil {
+		page = donor.tail.chunk.page
+		for e := donor.tail; e != nil && page.used > 0; {
+			prev := e.prev
+			if e.chunk.page == page {
+				s.evict(e, now)
+			}
+			e = prev
+		}
+	}
+	s.slabs.takePage(donor, page)
+	s.ht.slabsMoved.Add(1)
+	return page
+}
+
+// touch looks up the key and updates its expiry time.
+func (s *shard) touch(key string, expiryTime int64) (*entry, bool) {
+	e, ok := s.lookup(key)
+	if ok {
+		s.touchHits++
+		e.expiresAt = s.ht.expiresAt(expiryTime)
+	} else {
+		s.touchMisses++
+	}
+	return e, ok
+}
+
+// countGet records a get hit or miss.
+func (s *shard) countGet(hit bool) {
+	if hit {
+		s.getHits++
+	} else {
+		s.getMisses++
+	}
+}
@@ -0,0 +1,228 @@
+package store
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// slabPageSize is the size of the pages handed to the slab classes, it is
+	// also the largest item the cache can hold.
+	slabPageSize = 1 << 20
+	// slabMinChunkSize is the chunk size of the smallest class.
+	slabMinChunkSize = 96
+	// slabGrowthFactor is the ratio between the chunk sizes of two classes.
+	slabGrowthFactor = 1.25
+	// itemHeaderSize approximates the per item overhead memcached accounts
+	// for (flags, expiry, CAS, LRU links...) when choosing a class.
+	itemHeaderSize = 48
+)
+
+// slabPage is a page of memory split into the chunks of a class.
+type slabPage struct {
+	mem  []byte
+	used int // chunks holding an item
+}
+
+// slabChunk is a piece of a page holding one item.
+type slabChunk struct {
+	mem  []byte
+	page *slabPage
+}
+
+// slabClass hands out chunks of a single size. Its memory comes in pages
+// that are split into chunks, and the items stored in its chunks are kept in
+// a LRU list so the least recently used one can be evicted when the class is
+// full and no page is left.
+type slabClass struct {
+	id        int
+	chunkSize int
+	pages     []*slabPage
+	free      []slabChunk // chunks given back by removed items
+	// carving is the newest page, split into chunks as they are needed, and
+	// carved the number of chunks taken from it so far
+	carving *slabPage
+	carved  int
+
+	// LRU list of the items of the class, head is the most recently used
+	head, tail *entry
+	items      int
+
+	evicted     uint64
+	evictedTime time.Duration // idle time of the last evicted item
+	reclaimed   uint64        // expired items whose chunk was reused
+	outOfMemory uint64
+}
+
+func (c *slabClass) chunksPerPage() int {
+	return slabPageSize / c.chunkSize
+}
+
+// freeChunks is the number of chunks of the class not holding an item.
+func (c *slabClass) freeChunks() int {
+	n := len(c.free)
+	if c.carving != nil {
+		n += c.chunksPerPage() - c.carved
+	}
+	return n
+}
+
+// pageBudget is the memory limit shared by the slab allocators of the shards.
+// Pages are taken from it atomically, so the shards don't share a lock.
+type pageBudget struct {
+	limit    int64
+	malloced atomic.Int64
+}
+
+// take reserves the memory of a page, it returns false once that would exceed
+// the limit.
+func (b *pageBudget) take() bool {
+	for {
+		malloced := b.malloced.Load()
+		if malloced+slabPageSize > b.limit {
+			return false
+		}
+		if b.malloced.CompareAndSwap(malloced, malloced+slabPageSize) {
+			return true
+		}
+	}
+}
+
+// slabAllocator divides the memory of the budget between the slab classes of
+// a shard, pages are assigned to a class when it needs one. Once the budget
+// is used up, the shards move pages between classes with takePage and
+// addPage.
+type slabAllocator struct {
+	classes []*slabClass
+	budget  *pageBudget
+	// malloced is the memory of the pages taken by this allocator
+	malloced int64
+}
+
+func newSlabAllocator(budget *pageBudget) *slabAllocator {
+	s := &slabAllocator{budget: budget}
+	size := slabMinChunkSize
+	for float64(size) <= slabPageSize/slabGrowthFactor {
+		s.classes = append(s.classes, &slabClass{id: len(s.classes) + 1, chunkSize: size})
+		// chunk sizes stay 8 byte aligned
+		size = (int(float64(size)*slabGrowthFactor) + 7) &^ 7
+	}
+	s.classes = append(s.classes, &slabClass{id: len(s.classes) + 1, chunkSize: slabPageSize})
+	return s
+}
+
+// classFor returns the smallest class whose chunks fit size bytes, nil if the
+// item is larger than a page.
+func (s *slabAllocator) classFor(size int) *slabClass {
+	for _, c := range s.classes {
+		if size <= c.chunkSize {
+			return c
+		}
+	}
+	return nil
+}
+
+// alloc returns a free chunk of the class, carving a new page when the memory
+// limit allows. It returns false when the class is full and an item has to be
+// evicted first.
+func (s *slabAllocator) alloc(c *slabClass) (slabChunk, bool) {
+	if c.freeChunks() == 0 && !s.grow(c) {
+		return slabChunk{}, false
+	}
+	var chunk slabChunk
+	if n := len(c.free); n > 0 {
+		chunk = c.free[n-1]
+		c.free = c.free[:n-1]
+	} else {
+		off := c.carved * c.chunkSize
+		chunk = slabChunk{mem: c.carving.mem[off : off+c.chunkSize : off+c.chunkSize], page: c.carving}
+		if c.carved++; c.carved == c.chunksPerPage() {
+			c.carving, c.carved = nil, 0
+		}
+	}
+	chunk.page.used++
+	return chunk, true
+}
+
+// grow assigns a new page to the class, as long as the budget allows. A class
+// whose first page doesn't fit any more can't store items.
+func (s *slabAllocator) grow(c *slabClass) bool {
+	if !s.budget.take() {
+		return false
+	}
+	s.addPage(c, &slabPage{mem: make([]byte, slabPageSize)})
+	return true
+}
+
+// addPage gives the page to the class, which must have no free chunk left.
+func (s *slabAllocator) addPage(c *slabClass, page *slabPage) {
+	c.pages = append(c.pages, page)
+	c.carving, c.carved = page, 0
+	s.malloced += slabPageSize
+}
+
+// release gives the chunk back to its class.
+func (s *slabAllocator) release(c *slabClass, chunk slabChunk) {
+	chunk.page.used--
+	c.free = append(c.free, chunk)
+}
+
+// takePage takes an unused page away from the class, to be added to another
+// one. The page stays counted in the budget.
+func (s *slabAllocator) takePage(c *slabClass, page *slabPage) {
+	c.pages = slices.DeleteFunc(c.pages, func(p *slabPage) bool { return p == page })
+	c.free = slices.DeleteFunc(c.free, func(chunk slabChunk) bool { return chunk.page == page })
+	if c.carving == page {
+		c.carving, c.carved = nil, 0
+	}
+	s.malloced -= slabPageSize
+}
+
+// emptyPage returns a page of the class without items, nil if every page
+// holds some.
+func (c *slabClass) emptyPage() *slabPage {
+	for _, page := range c.pages {
+		if page.used == 0 {
+			return page
+		}
+	}
+	return nil
+}
+
+// LRU list maintenance, the head is the most recently used item.
+
+func (c *slabClass) linkHead(e *entry) {
+	e.prev, e.next = nil, c.head
+	if c.head != nil {
+		c.head.prev = e
+	}
+	c.head = e
+	if c.tail == nil {
+		c.tail = e
+	}
+	c.items++
+}
+
+func (c *slabClass) unlink(e *entry) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		c.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		c.tail = e.prev
+	}
+	e.prev, e.next = nil, nil
+	c.items--
+}
+
+func (c *slabClass) bump(e *entry) {
+	if c.head == e {
+		return
+	}
+	c.unlink(e)
+	c.linkHead(e)
+}
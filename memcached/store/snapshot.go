@@ -0,0 +1,175 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Snapshot file layout, all integers big endian:
+//
+//	header:  "MCSN" | version (1 byte)
+//	item:    key length (2) | flags (4) | expires at, Unix nanoseconds or 0 (8) |
+//	         CAS unique (8) | data length (4) | key | data
+//	end:     key length 0 (2) | CRC-32 of everything before (4)
+const (
+	snapshotMagic   = "MCSN"
+	snapshotVersion = 1
+	snapshotItemHdr = 2 + 4 + 8 + 8 + 4
+)
+
+var ErrCorruptSnapshot = errors.New("corrupt snapshot")
+
+// WriteSnapshot writes every item that hasn't expired, with its flags, expiry
+// and CAS unique, and returns how many were written. The items of a slab
+// class are written from the least to the most recently used so loading
+// them keeps the LRU order. The shards are locked one at a time.
+func (ht *HashTable) WriteSnapshot(w io.Writer) (int, error) {
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	bw.WriteString(snapshotMagic)
+	bw.WriteByte(snapshotVersion)
+
+	written := 0
+	hdr := make([]byte, snapshotItemHdr)
+	for _, s := range ht.shards {
+		s.mu.Lock()
+		now := ht.now()
+		for _, c := range s.slabs.classes {
+			for e := c.tail; e != nil; e = e.prev {
+				if s.isExpired(e, now) {
+					continue
+				}
+				// a pending flush_all becomes the expiry of the item
+				var expiresAt int64
+				if t := s.expiresAt(e); !t.IsZero() {
+					expiresAt = t.UnixNano()
+				}
+				binary.BigEndian.PutUint16(hdr[0:2], uint16(len(e.key)))
+				binary.BigEndian.PutUint32(hdr[2:6], e.flags)
+				binary.BigEndian.PutUint64(hdr[6:14], uint64(expiresAt))
+				binary.BigEndian.PutUint64(hdr[14:22], e.casUnique)
+				binary.BigEndian.PutUint32(hdr[22:26], uint32(e.length))
+				bw.Write(hdr)
+				bw.WriteString(e.key)
+				bw.Write(e.data())
+				written++
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	bw.Write([]byte{0, 0})
+	if err := bw.Flush(); err != nil {
+		return written, err
+	}
+	// the checksum itself isn't part of the checksum
+	if err := binary.Write(w, binary.BigEndian, crc.Sum32()); err != nil {
+		return written, err
+	}
+	return written, nil
+}
+
+// snapshotItem is an item read from a snapshot, kept until the checksum has
+// been verified.
+type snapshotItem struct {
+	key       string
+	flags     uint32
+	expiresAt time.Time
+	casUnique uint64
+	data      []byte
+}
+
+// LoadSnapshot stores the items of a snapshot written by WriteSnapshot,
+// keeping their flags, expiry and CAS unique. Items that expired in the
+// meantime are skipped, and nothing is stored unless the whole snapshot is
+// intact. It returns how many items were loaded.
+func (ht *HashTable) LoadSnapshot(r io.Reader) (int, error) {
+	crc := crc32.NewIEEE()
+	br := bufio.NewReader(r)
+	tr := io.TeeReader(br, crc)
+
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(tr, header); err != nil {
+		return 0, fmt.Errorf("reading snapshot header: %w", err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, fmt.Errorf("%w: bad magic", ErrCorruptSnapshot)
+	}
+	if header[len(snapshotMagic)] != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", header[len(snapshotMagic)])
+	}
+
+	var items []snapshotItem
+	hdr := make([]byte, snapshotItemHdr)
+	for {
+		if _, err := io.ReadFull(tr, hdr[:2]); err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+		}
+		keyLen := int(binary.BigEndian.Uint16(hdr[0:2]))
+		if keyLen == 0 {
+			break
+		}
+		if _, err := io.ReadFull(tr, hdr[2:]); err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+		}
+		flags := binary.BigEndian.Uint32(hdr[2:6])
+		expiresAtNano := int64(binary.BigEndian.Uint64(hdr[6:14]))
+		casUnique := binary.BigEndian.Uint64(hdr[14:22])
+		dataLen := int(binary.BigEndian.Uint32(hdr[22:26]))
+		if dataLen > slabPageSize {
+			return 0, fmt.Errorf("%w: item of %d bytes", ErrCorruptSnapshot, dataLen)
+		}
+		buf := make([]byte, keyLen+dataLen)
+		if _, err := io.ReadFull(tr, buf); err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+		}
+
+		var expiresAt time.Time
+		if expiresAtNano != 0 {
+			expiresAt = time.Unix(0, expiresAtNano)
+			if !ht.now().Before(expiresAt) {
+				continue
+			}
+		}
+		items = append(items, snapshotItem{string(buf[:keyLen]), flags, expiresAt, casUnique, buf[keyLen:]})
+	}
+
+	var sum uint32
+	if err := binary.Read(br, binary.BigEndian, &sum); err != nil {
+		return 0, fmt.Errorf("%w: reading checksum: %v", ErrCorruptSnapshot, err)
+	}
+	if sum != crc.Sum32() {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrCorruptSnapshot)
+	}
+
+	loaded := 0
+	for _, item := range items {
+		if ht.restore(item) {
+			loaded++
+		}
+	}
+	return loaded, nil
+}
+
+// restore stores an item of a snapshot with its original CAS unique, and makes
+// sure the uniques handed out later are greater.
+func (ht *HashTable) restore(item snapshotItem) bool {
+	s := ht.shardFor(item.key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if res, _ := s.store(item.key, item.flags, item.expiresAt, item.data); res != Stored {
+		return false
+	}
+	s.items[item.key].casUnique = item.casUnique
+	for {
+		last := ht.casCounter.Load()
+		if last >= item.casUnique || ht.casCounter.CompareAndSwap(last, item.casUnique) {
+			return true
+		}
+	}
+}
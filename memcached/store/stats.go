@@ -0,0 +1,108 @@
+package store
+
+import "time"
+
+// SlabClassStats describes a slab class that has been assigned memory, for
+// "stats slabs" and "stats items".
+type SlabClassStats struct {
+	ID            int
+	ChunkSize     int
+	ChunksPerPage int
+	TotalPages    int
+	TotalChunks   int
+	UsedChunks    int
+	FreeChunks    int
+
+	Items       int           // Items stored in the class
+	Age         time.Duration // Idle time of the least recently used item
+	Evicted     uint64        // Items evicted to make room
+	EvictedTime time.Duration // Idle time of the last evicted item
+	Reclaimed   uint64        // Expired items whose chunk was reused
+	OutOfMemory uint64        // Stores that failed because nothing could be evicted
+}
+
+// SlabStats returns the stats of every class with at least one page, summed
+// over the shards, and the total memory taken by the pages.
+func (ht *HashTable) SlabStats() ([]SlabClassStats, int64) {
+	var malloced int64
+	var byClass []SlabClassStats
+	for _, sh := range ht.shards {
+		sh.mu.Lock()
+		now := ht.now()
+		if byClass == nil {
+			byClass = make([]SlabClassStats, len(sh.slabs.classes))
+		}
+		for i, c := range sh.slabs.classes {
+			s := &byClass[i]
+			s.ID, s.ChunkSize, s.ChunksPerPage = c.id, c.chunkSize, c.chunksPerPage()
+			s.TotalPages += len(c.pages)
+			s.TotalChunks += len(c.pages) * c.chunksPerPage()
+			s.UsedChunks += len(c.pages)*c.chunksPerPage() - c.freeChunks()
+			s.FreeChunks += c.freeChunks()
+			s.Items += c.items
+			s.Evicted += c.evicted
+			s.EvictedTime = max(s.EvictedTime, c.evictedTime)
+			s.Reclaimed += c.reclaimed
+			s.OutOfMemory += c.outOfMemory
+			if c.tail != nil {
+				s.Age = max(s.Age, now.Sub(c.tail.lastAccess))
+			}
+		}
+		malloced += sh.slabs.malloced
+		sh.mu.Unlock()
+	}
+
+	var stats []SlabClassStats
+	for _, s := range byClass {
+		if s.TotalPages > 0 {
+			stats = append(stats, s)
+		}
+	}
+	return stats, malloced
+}
+
+// Slab settings reported by "stats settings".
+const (
+	ItemSizeMax  = slabPageSize
+	ChunkSizeMin = slabMinChunkSize
+	GrowthFactor = slabGrowthFactor
+)
+
+// TableStats are the item and command counters of the cache, for "stats".
+type TableStats struct {
+	CurrItems     int
+	TotalItems    uint64 // Items stored since the start
+	Bytes         int64  // Size of the keys and values stored
+	LimitMaxBytes int64
+	CmdSet        uint64
+	CmdFlush      uint64
+	GetHits       uint64
+	GetMisses     uint64
+	TouchHits     uint64
+	TouchMisses   uint64
+	Evictions     uint64
+	Reclaimed     uint64
+	SlabsMoved    uint64 // Pages moved from a slab class to another
+}
+
+// Stats returns the counters of the cache, summed over the shards.
+func (ht *HashTable) Stats() TableStats {
+	st := TableStats{CmdFlush: ht.cmdFlush.Load(), LimitMaxBytes: ht.budget.limit, SlabsMoved: ht.slabsMoved.Load()}
+	for _, sh := range ht.shards {
+		sh.mu.Lock()
+		st.CurrItems += len(sh.items)
+		st.TotalItems += sh.totalItems
+		st.Bytes += sh.bytes
+		st.CmdSet += sh.cmdSet
+		st.GetHits += sh.getHits
+		st.GetMisses += sh.getMisses
+		st.TouchHits += sh.touchHits
+		st.TouchMisses += sh.touchMisses
+		for _, c := range sh.slabs.classes {
+			st.Evictions += c.evicted
+			st.Reclaimed += c.reclaimed
+		}
+		sh.mu.Unlock()
+	}
+	return st
+}
@@ -0,0 +1,589 @@
+// Package client is a small NATS client: it publishes and subscribes, with
+// queue groups and headers, and does request/reply over unique inbox
+// subjects.
+package client
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Version = "0.1.0"
+
+	DefaultTimeout = 5 * time.Second
+
+	inboxPrefix = "_INBOX."
+
+	// pendingMsgs is how many messages a subscription buffers for its
+	// handler before dropping them
+	pendingMsgs = 4096
+)
+
+var (
+	ErrTimeout             = errors.New("nats: timeout")
+	ErrConnectionClosed    = errors.New("nats: connection closed")
+	ErrBadSubscription     = errors.New("nats: invalid subscription")
+	ErrHeadersNotSupported = errors.New("nats: headers not supported by this server")
+)
+
+// ServerError is an -ERR sent by the server.
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "nats: " + strings.ToLower(e.Message)
+}
+
+// Msg is a message received on a subscription, or one to publish.
+type Msg struct {
+	Subject string
+	Reply   string
+	Header  Header
+	Data    []byte
+	Sub     *Subscription
+}
+
+// MsgHandler processes the messages of a subscription, on a goroutine of the
+// subscription.
+type MsgHandler func(*Msg)
+
+// Subscription delivers the messages of a subject to a handler.
+type Subscription struct {
+	Subject string
+	Queue   string
+
+	sid     string
+	conn    *Conn
+	handler MsgHandler
+	msgs    chan *Msg
+
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+}
+
+type serverInfo struct {
+	ServerID   string `json:"server_id"`
+	Version    string `json:"version"`
+	Headers    bool   `json:"headers"`
+	MaxPayload int    `json:"max_payload"`
+}
+
+// Conn is a connection to a NATS server, safe for concurrent use.
+type Conn struct {
+	conn net.Conn
+	info serverInfo
+
+	wmu sync.Mutex
+	bw  *bufio.Writer
+
+	mu      sync.Mutex
+	subs    map[string]*Subscription // by sid
+	nextSID uint64
+	pongs   []chan struct{}
+	closed  bool
+	err     error // the last -ERR, or why the connection was closed
+	done    chan struct{}
+
+	// the responses to requests arrive on a single wildcard subscription,
+	// the last token of the reply subject identifies the request
+	respSetup  sync.Mutex
+	respPrefix string
+	respMap    map[string]chan *Msg
+}
+
+// Option sets the credentials of Connect.
+type Option func(*options)
+
+type options struct {
+	user, password, token string
+}
+
+// UserInfo authenticates with a username and password.
+func UserInfo(user, password string) Option {
+	return func(o *options) { o.user, o.password = user, password }
+}
+
+// Token authenticates with a token.
+func Token(token string) Option {
+	return func(o *options) { o.token = token }
+}
+
+// Connect connects to the server at addr (host:port) and waits until the
+// server accepted the connection.
+func Connect(addr string, opts ...Option) (*Conn, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	nc, err := net.DialTimeout("tcp", addr, DefaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		conn:    nc,
+		bw:      bufio.NewWriter(nc),
+		subs:    make(map[string]*Subscription),
+		done:    make(chan struct{}),
+		respMap: make(map[string]chan *Msg),
+	}
+	br := bufio.NewReader(nc)
+
+	// the server speaks first, with INFO
+	nc.SetReadDeadline(time.Now().Add(DefaultTimeout))
+	line, err := br.ReadString('\n')
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("nats: reading INFO: %w", err)
+	}
+	op, args, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+	if !strings.EqualFold(op, "INFO") {
+		nc.Close()
+		return nil, fmt.Errorf("nats: expected INFO, got %q", line)
+	}
+	if err := json.Unmarshal([]byte(args), &c.info); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("nats: parsing INFO: %w", err)
+	}
+	nc.SetReadDeadline(time.Time{})
+
+	connect, _ := json.Marshal(map[string]any{
+		"verbose":    false,
+		"pedantic":   false,
+		"headers":    true,
+		"lang":       "go",
+		"version":    Version,
+		"protocol":   1,
+		"user":       o.user,
+		"pass":       o.password,
+		"auth_token": o.token,
+	})
+	if err := c.send("CONNECT " + string(connect) + "\r\n"); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	go c.readLoop(br)
+
+	// an -ERR, e.g. about the credentials, closes the connection before the
+	// PONG
+	if err := c.Flush(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Publish sends data on the subject.
+func (c *Conn) Publish(subject string, data []byte) error {
+	return c.PublishMsg(&Msg{Subject: subject, Data: data})
+}
+
+// PublishRequest sends data on the subject, asking for replies on reply.
+func (c *Conn) PublishRequest(subject, reply string, data []byte) error {
+	return c.PublishMsg(&Msg{Subject: subject, Reply: reply, Data: data})
+}
+
+// PublishMsg sends the message with its reply subject and headers.
+func (c *Conn) PublishMsg(m *Msg) error {
+	var line strings.Builder
+	var header []byte
+	if len(m.Header) > 0 {
+		if !c.info.Headers {
+			return ErrHeadersNotSupported
+		}
+		header = m.Header.encode()
+		line.WriteString("HPUB " + m.Subject + " ")
+	} else {
+		line.WriteString("PUB " + m.Subject + " ")
+	}
+	if m.Reply != "" {
+		line.WriteString(m.Reply + " ")
+	}
+	if header != nil {
+		line.WriteString(strconv.Itoa(len(header)) + " ")
+	}
+	line.WriteString(strconv.Itoa(len(header)+len(m.Data)) + "\r\n")
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.bw.WriteString(line.String())
+	c.bw.Write(header)
+	c.bw.Write(m.Data)
+	c.bw.WriteString("\r\n")
+	return c.flushLocked()
+}
+
+// Respond publishes data on the reply subject of the message.
+func (m *Msg) Respond(data []byte) error {
+	if m.Sub == nil || m.Reply == "" {
+		return errors.New("nats: message has no reply subject")
+	}
+	return m.Sub.conn.Publish(m.Reply, data)
+}
+
+// Subscribe calls handler for every message published on the subject, which
+// may contain wildcards.
+func (c *Conn) Subscribe(subject string, handler MsgHandler) (*Subscription, error) {
+	return c.subscribe(subject, "", handler)
+}
+
+// QueueSubscribe joins the queue group of the subject, each message goes to
+// a single member of the group.
+func (c *Conn) QueueSubscribe(subject, queue string, handler MsgHandler) (*Subscription, error) {
+	return c.subscribe(subject, queue, handler)
+}
+
+func (c *Conn) subscribe(subject, queue string, handler MsgHandler) (*Subscription, error) {
+	if subject == "" || strings.ContainsAny(subject+queue, " \t\r\n") {
+		return nil, ErrBadSubscription
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrConnectionClosed
+	}
+	c.nextSID++
+	sub := &Subscription{
+		Subject: subject,
+		Queue:   queue,
+		sid:     strconv.FormatUint(c.nextSID, 10),
+		conn:    c,
+		handler: handler,
+		msgs:    make(chan *Msg, pendingMsgs),
+	}
+	c.subs[sub.sid] = sub
+	c.mu.Unlock()
+	go sub.deliverLoop()
+
+	line := "SUB " + subject + " " + sub.sid + "\r\n"
+	if queue != "" {
+		line = "SUB " + subject + " " + queue + " " + sub.sid + "\r\n"
+	}
+	if err := c.send(line); err != nil {
+		c.removeSub(sub)
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Unsubscribe stops the subscription, messages already received are still
+// handled.
+func (s *Subscription) Unsubscribe() error {
+	if !s.conn.removeSub(s) {
+		return ErrBadSubscription
+	}
+	return s.conn.send("UNSUB " + s.sid + "\r\n")
+}
+
+// Dropped returns how many messages were dropped because the handler didn't
+// keep up.
+func (s *Subscription) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+func (s *Subscription) deliverLoop() {
+	for m := range s.msgs {
+		s.handler(m)
+	}
+}
+
+func (s *Subscription) deliver(m *Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.msgs <- m:
+	default:
+		s.dropped++
+	}
+}
+
+func (s *Subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.msgs)
+	}
+}
+
+func (c *Conn) removeSub(sub *Subscription) bool {
+	c.mu.Lock()
+	_, ok := c.subs[sub.sid]
+	delete(c.subs, sub.sid)
+	c.mu.Unlock()
+	sub.close()
+	return ok
+}
+
+// NewInbox returns a unique subject to receive replies on.
+func NewInbox() string {
+	return inboxPrefix + randomToken()
+}
+
+func randomToken() string {
+	b := make([]byte, 11)
+	rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+// Request publishes data on the subject and waits for the first reply.
+func (c *Conn) Request(subject string, data []byte, timeout time.Duration) (*Msg, error) {
+	return c.RequestMsg(&Msg{Subject: subject, Data: data}, timeout)
+}
+
+// RequestMsg publishes the message, with a unique reply subject, and waits
+// for the first reply.
+func (c *Conn) RequestMsg(m *Msg, timeout time.Duration) (*Msg, error) {
+	token, reply, replies, err := c.newResponse()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		c.mu.Lock()
+		delete(c.respMap, token)
+		c.mu.Unlock()
+	}()
+
+	request := *m
+	request.Reply = reply
+	if err := c.PublishMsg(&request); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-timer.C:
+		return nil, ErrTimeout
+	case <-c.done:
+		return nil, c.closeErr()
+	}
+}
+
+// newResponse registers a request and returns its reply subject. The inbox
+// of the connection is subscribed to before the first request goes out.
+func (c *Conn) newResponse() (string, string, chan *Msg, error) {
+	c.respSetup.Lock()
+	c.mu.Lock()
+	prefix := c.respPrefix
+	c.mu.Unlock()
+	if prefix == "" {
+		prefix = NewInbox() + "."
+		if _, err := c.Subscribe(prefix+"*", c.handleResponse); err != nil {
+			c.respSetup.Unlock()
+			return "", "", nil, err
+		}
+		c.mu.Lock()
+		c.respPrefix = prefix
+		c.mu.Unlock()
+	}
+	c.respSetup.Unlock()
+
+	token := randomToken()
+	replies := make(chan *Msg, 1)
+	c.mu.Lock()
+	c.respMap[token] = replies
+	c.mu.Unlock()
+	return token, prefix + token, replies, nil
+}
+
+func (c *Conn) handleResponse(m *Msg) {
+	token := m.Subject[strings.LastIndexByte(m.Subject, '.')+1:]
+	c.mu.Lock()
+	replies, ok := c.respMap[token]
+	delete(c.respMap, token)
+	c.mu.Unlock()
+	if ok {
+		replies <- m
+	}
+}
+
+// Flush waits until the server processed everything sent so far.
+func (c *Conn) Flush() error {
+	return c.FlushTimeout(DefaultTimeout)
+}
+
+// FlushTimeout is Flush with a timeout.
+func (c *Conn) FlushTimeout(timeout time.Duration) error {
+	pong := make(chan struct{})
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return c.closeErr()
+	}
+	c.pongs = append(c.pongs, pong)
+	c.mu.Unlock()
+	if err := c.send("PING\r\n"); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-pong:
+		return nil
+	case <-timer.C:
+		return ErrTimeout
+	case <-c.done:
+		return c.closeErr()
+	}
+}
+
+// Close closes the connection and stops the subscriptions.
+func (c *Conn) Close() error {
+	c.close(nil)
+	return nil
+}
+
+func (c *Conn) close(err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	if c.err == nil {
+		c.err = err
+	}
+	subs := c.subs
+	c.subs = make(map[string]*Subscription)
+	c.mu.Unlock()
+
+	c.conn.Close()
+	close(c.done)
+	for _, sub := range subs {
+		sub.close()
+	}
+}
+
+func (c *Conn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return ErrConnectionClosed
+}
+
+func (c *Conn) send(s string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.bw.WriteString(s)
+	return c.flushLocked()
+}
+
+func (c *Conn) flushLocked() error {
+	if err := c.bw.Flush(); err != nil {
+		c.bw.Reset(c.conn)
+		return fmt.Errorf("%w: %v", ErrConnectionClosed, err)
+	}
+	return nil
+}
+
+// readLoop processes what the server sends until the connection breaks.
+func (c *Conn) readLoop(br *bufio.Reader) {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			c.close(nil)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "MSG":
+			err = c.processMsg(br, strings.Fields(args), false)
+		case "HMSG":
+			err = c.processMsg(br, strings.Fields(args), true)
+		case "PING":
+			err = c.send("PONG\r\n")
+		case "PONG":
+			c.mu.Lock()
+			if len(c.pongs) > 0 {
+				close(c.pongs[0])
+				c.pongs = c.pongs[1:]
+			}
+			c.mu.Unlock()
+		case "-ERR":
+			c.mu.Lock()
+			c.err = &ServerError{Message: strings.Trim(args, "' ")}
+			c.mu.Unlock()
+		case "+OK", "INFO":
+		default:
+			err = fmt.Errorf("nats: unexpected %q", line)
+		}
+		if err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+// processMsg reads MSG <subject> <sid> [reply-to] <#bytes> or
+// HMSG <subject> <sid> [reply-to] <#header bytes> <#total bytes> and the
+// payload that follows.
+func (c *Conn) processMsg(br *bufio.Reader, args []string, headers bool) error {
+	n := 3
+	if headers {
+		n = 4
+	}
+	if len(args) != n && len(args) != n+1 {
+		return fmt.Errorf("nats: invalid message arguments %q", args)
+	}
+	m := &Msg{Subject: args[0]}
+	if len(args) == n+1 {
+		m.Reply = args[2]
+	}
+	total, err := strconv.Atoi(args[len(args)-1])
+	if err != nil || total < 0 {
+		return fmt.Errorf("nats: invalid message size %q", args[len(args)-1])
+	}
+	headerLen := 0
+	if headers {
+		headerLen, err = strconv.Atoi(args[len(args)-2])
+		if err != nil || headerLen < 0 || headerLen > total {
+			return fmt.Errorf("nats: invalid header size %q", args[len(args)-2])
+		}
+	}
+
+	data := make([]byte, total+2)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return err
+	}
+	data = data[:total]
+	if headers {
+		if m.Header, err = decodeHeader(data[:headerLen]); err != nil {
+			return err
+		}
+	}
+	m.Data = data[headerLen:]
+
+	c.mu.Lock()
+	sub := c.subs[args[1]]
+	c.mu.Unlock()
+	if sub != nil {
+		m.Sub = sub
+		sub.deliver(m)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"fmt"
+	"nats/commands"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, opts commands.Options) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go commands.NewServer(opts).Serve(listener)
+	return listener.Addr().String()
+}
+
+func connect(t *testing.T, addr string) *Conn {
+	t.Helper()
+	c, err := Connect(addr)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	addr := startServer(t, commands.Options{})
+	sub, pub := connect(t, addr), connect(t, addr)
+
+	msgs := make(chan *Msg, 10)
+	if _, err := sub.Subscribe("orders.*", func(m *Msg) { msgs <- m }); err != nil {
+		t.Fatal(err)
+	}
+	sub.Flush()
+
+	pub.PublishRequest("orders.new", "reply.here", []byte("plain"))
+	header := Header{}
+	header.Set("trace-id", "42")
+	header.Add("Tag", "a")
+	header.Add("Tag", "b")
+	pub.PublishMsg(&Msg{Subject: "orders.paid", Header: header, Data: []byte("with headers")})
+
+	m := <-msgs
+	if m.Subject != "orders.new" || m.Reply != "reply.here" || string(m.Data) != "plain" || m.Header != nil {
+		t.Errorf("unexpected message %+v", m)
+	}
+	m = <-msgs
+	if m.Subject != "orders.paid" || string(m.Data) != "with headers" {
+		t.Errorf("unexpected message %+v", m)
+	}
+	if m.Header.Get("Trace-Id") != "42" || len(m.Header["Tag"]) != 2 {
+		t.Errorf("unexpected headers %v", m.Header)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	addr := startServer(t, commands.Options{})
+	responder, requester := connect(t, addr), connect(t, addr)
+
+	responder.Subscribe("echo", func(m *Msg) {
+		m.Respond(append([]byte("echo: "), m.Data...))
+	})
+	responder.Flush()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := fmt.Sprintf("request %d", i)
+			reply, err := requester.Request("echo", []byte(data), time.Second)
+			if err != nil {
+				t.Errorf("Request: %v", err)
+				return
+			}
+			if string(reply.Data) != "echo: "+data {
+				t.Errorf("expected the reply to %q, got %q", data, reply.Data)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := requester.Request("nobody.listens", nil, 50*time.Millisecond); err != ErrTimeout {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestServerError(t *testing.T) {
+	addr := startServer(t, commands.Options{})
+	c := connect(t, addr)
+	if _, err := c.Subscribe("foo..bar", func(*Msg) {}); err != nil {
+		t.Fatal(err)
+	}
+	c.Flush()
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if se, ok := err.(*ServerError); !ok || se.Message != "Invalid Subject" {
+		t.Errorf("expected an Invalid Subject error, got %v", err)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	auth := &commands.AuthConfig{Users: []*commands.User{{Username: "alice", Password: "s3cret"}}}
+	addr := startServer(t, commands.Options{Auth: auth})
+
+	c, err := Connect(addr, UserInfo("alice", "s3cret"))
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	c.Close()
+
+	_, err = Connect(addr, UserInfo("alice", "wrong"))
+	if se, ok := err.(*ServerError); !ok || se.Message != "Authorization Violation" {
+		t.Errorf("expected an authorization violation, got %v", err)
+	}
+}
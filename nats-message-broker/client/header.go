@@ -0,0 +1,61 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/textproto"
+)
+
+const headerLine = "NATS/1.0"
+
+// Header holds the headers of a message, with canonical keys like the ones
+// of HTTP.
+type Header map[string][]string
+
+// Get returns the first value of the key.
+func (h Header) Get(key string) string {
+	return textproto.MIMEHeader(h).Get(key)
+}
+
+// Set replaces the values of the key.
+func (h Header) Set(key, value string) {
+	textproto.MIMEHeader(h).Set(key, value)
+}
+
+// Add appends a value to the key.
+func (h Header) Add(key, value string) {
+	textproto.MIMEHeader(h).Add(key, value)
+}
+
+// Del removes the key.
+func (h Header) Del(key string) {
+	textproto.MIMEHeader(h).Del(key)
+}
+
+// encode returns the header block of HPUB:
+// NATS/1.0\r\n<key>: <value>\r\n...\r\n
+func (h Header) encode() []byte {
+	var b bytes.Buffer
+	b.WriteString(headerLine + "\r\n")
+	for key, values := range h {
+		for _, value := range values {
+			b.WriteString(key + ": " + value + "\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func decodeHeader(block []byte) (Header, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(block)))
+	line, err := r.ReadLine()
+	if err != nil || len(line) < len(headerLine) || line[:len(headerLine)] != headerLine {
+		return nil, fmt.Errorf("nats: invalid header block %q", block)
+	}
+	h, err := r.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("nats: invalid header block: %w", err)
+	}
+	return Header(h), nil
+}
@@ -0,0 +1,178 @@
+package commands
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"nats/parser"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AuthConfig lists the users allowed to connect, read from a JSON file:
+//
+//	{
+//	  "users": [
+//	    {"user": "alice", "password": "$2a$11$...",
+//	     "permissions": {"publish": {"allow": ["orders.>"]},
+//	                     "subscribe": {"allow": ["orders.*", "_INBOX.>"], "deny": ["orders.secret"]}}},
+//	    {"token": "$2a$11$..."}
+//	  ]
+//	}
+//
+// Passwords and tokens are bcrypt hashes, or plain text for anything not
+// starting with $2.
+type AuthConfig struct {
+	Users []*User `json:"users"`
+}
+
+// User is identified by a username and password, or by a token alone.
+type User struct {
+	Username    string       `json:"user,omitempty"`
+	Password    string       `json:"password,omitempty"`
+	Token       string       `json:"token,omitempty"`
+	Permissions *Permissions `json:"permissions,omitempty"`
+}
+
+// Permissions restrict the subjects a user publishes and subscribes to,
+// everything is allowed without them.
+type Permissions struct {
+	Publish   *SubjectPermission `json:"publish,omitempty"`
+	Subscribe *SubjectPermission `json:"subscribe,omitempty"`
+}
+
+// SubjectPermission allows the subjects matching Allow, or any subject when
+// Allow is empty, except the ones matching Deny. The patterns may contain
+// wildcards.
+type SubjectPermission struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// LoadAuthFile reads the users of the auth file.
+func LoadAuthFile(path string) (*AuthConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config AuthConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i, u := range config.Users {
+		if (u.Username == "") == (u.Token == "") {
+			return nil, fmt.Errorf("user %d: needs either a user and password or a token", i)
+		}
+		if u.Permissions == nil {
+			continue
+		}
+		for _, p := range []*SubjectPermission{u.Permissions.Publish, u.Permissions.Subscribe} {
+			if p == nil {
+				continue
+			}
+			for _, subject := range append(p.Allow, p.Deny...) {
+				if !IsValidSubject(subject) {
+					return nil, fmt.Errorf("user %d: invalid subject in permissions: %q", i, subject)
+				}
+			}
+		}
+	}
+	return &config, nil
+}
+
+// authenticate returns the user matching the credentials of CONNECT.
+func (a *AuthConfig) authenticate(cc parser.ConnectCommand) (*User, bool) {
+	for _, u := range a.Users {
+		if u.Token != "" {
+			if cc.AuthToken != "" && checkSecret(u.Token, cc.AuthToken) {
+				return u, true
+			}
+			continue
+		}
+		if cc.Username == u.Username && checkSecret(u.Password, cc.Password) {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+func checkSecret(stored, given string) bool {
+	if strings.HasPrefix(stored, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(given)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(given)) == 1
+}
+
+func (u *User) canPublish(subject string) bool {
+	return u == nil || u.Permissions == nil || u.Permissions.Publish.allows(subject)
+}
+
+func (u *User) canSubscribe(subject string) bool {
+	return u == nil || u.Permissions == nil || u.Permissions.Subscribe.allows(subject)
+}
+
+// subscribeDeny returns the subjects the user can't receive. A wildcard
+// subscription covering some of them is allowed, the messages on those
+// subjects are dropped on delivery instead.
+func (u *User) subscribeDeny() []string {
+	if u == nil || u.Permissions == nil || u.Permissions.Subscribe == nil {
+		return nil
+	}
+	return u.Permissions.Subscribe.Deny
+}
+
+// denies reports whether the subscription must not get messages on the
+// literal subject.
+func (sub *Subscription) denies(subject string) bool {
+	for _, pattern := range sub.deny {
+		if subjectMatches(pattern, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the subject, which may contain wildcards, only
+// covers allowed subjects.
+func (p *SubjectPermission) allows(subject string) bool {
+	if p == nil {
+		return true
+	}
+	allowed := len(p.Allow) == 0
+	for _, pattern := range p.Allow {
+		if isSubset(subject, pattern) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+	for _, pattern := range p.Deny {
+		if isSubset(subject, pattern) {
+			return false
+		}
+	}
+	return true
+}
+
+// isSubset reports whether every subject matched by subject is matched by
+// pattern as well, e.g. orders.new and orders.* are subsets of orders.>.
+func isSubset(subject, pattern string) bool {
+	st := strings.Split(subject, ".")
+	pt := strings.Split(pattern, ".")
+	for i, token := range pt {
+		if token == fwc {
+			return len(st) > i
+		}
+		if i >= len(st) || st[i] == fwc {
+			return false
+		}
+		if token != pwc && token != st[i] {
+			return false
+		}
+	}
+	return len(st) == len(pt)
+}
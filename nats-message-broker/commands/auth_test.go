@@ -0,0 +1,125 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeAuthFile(t *testing.T) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenHash, _ := bcrypt.GenerateFromPassword([]byte("t0ken"), bcrypt.MinCost)
+	path := filepath.Join(t.TempDir(), "auth.json")
+	config := `{"users": [
+		{"user": "alice", "password": "` + string(hash) + `",
+		 "permissions": {"publish": {"allow": ["orders.>"], "deny": ["orders.secret"]},
+		                 "subscribe": {"allow": ["orders.*"], "deny": ["orders.secret"]}}},
+		{"user": "bob", "password": "plain"},
+		{"token": "` + string(tokenHash) + `"}
+	]}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthentication(t *testing.T) {
+	auth, err := LoadAuthFile(writeAuthFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(Options{Auth: auth})
+
+	for connect, ok := range map[string]bool{
+		`{"user":"alice","pass":"s3cret"}`: true,
+		`{"user":"alice","pass":"wrong"}`:  false,
+		`{"user":"bob","pass":"plain"}`:    true,
+		`{"auth_token":"t0ken"}`:           true,
+		`{"auth_token":"wrong"}`:           false,
+		`{}`:                               false,
+	} {
+		c := newTestClient(t, s)
+		err := c.run("CONNECT " + connect + "\r\n")
+		if (err == nil) != ok {
+			t.Errorf("CONNECT %s: unexpected result %v", connect, err)
+		}
+	}
+
+	c := newTestClient(t, s)
+	if err := c.run("SUB orders.* 1\r\n"); err != ErrAuthViolation {
+		t.Errorf("expected SUB before CONNECT to be refused, got %v", err)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	auth, err := LoadAuthFile(writeAuthFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(Options{Auth: auth})
+	c := newTestClient(t, s)
+	c.send(t, `CONNECT {"user":"alice","pass":"s3cret"}`+"\r\n")
+
+	for cmd, allowed := range map[string]bool{
+		"PUB orders.new 0\r\n\r\n":    true,
+		"PUB orders.eu.new 0\r\n\r\n": true,
+		"PUB orders.secret 0\r\n\r\n": false,
+		"PUB payments 0\r\n\r\n":      false,
+		"SUB orders.new 1\r\n":        true,
+		"SUB orders.* 2\r\n":          true,
+		"SUB orders.> 3\r\n":          false,
+		"SUB > 4\r\n":                 false,
+		"SUB orders.secret 5\r\n":     false,
+	} {
+		err := c.run(cmd)
+		if allowed && err != nil {
+			t.Errorf("%q: unexpected error %v", strings.TrimSpace(cmd), err)
+		}
+		if !allowed && err != ErrPermissionViolation {
+			t.Errorf("%q: expected a permission violation, got %v", strings.TrimSpace(cmd), err)
+		}
+	}
+}
+
+func TestWildcardSubscriptionSkipsDeniedSubjects(t *testing.T) {
+	auth, err := LoadAuthFile(writeAuthFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(Options{Auth: auth})
+	alice, bob := newTestClient(t, s), newTestClient(t, s)
+	alice.send(t, `CONNECT {"user":"alice","pass":"s3cret"}`+"\r\nSUB orders.* 1\r\nSUB orders.* workers 2\r\n")
+	bob.send(t, `CONNECT {"user":"bob","pass":"plain"}`+"\r\nSUB orders.* workers 1\r\n")
+
+	// alice's queue member passes the denied message on to bob's
+	pub := newTestClient(t, s)
+	pub.send(t, `CONNECT {"user":"bob","pass":"plain"}`+"\r\n")
+	for i := 0; i < 10; i++ {
+		publish(t, pub, "orders.secret", "", "classified")
+	}
+	publish(t, pub, "orders.new", "", "order")
+	waitForMsgs(t, 12, alice, bob)
+	for _, m := range alice.messages() {
+		if m.subject != "orders.new" {
+			t.Errorf("alice got a denied message %+v", m)
+		}
+	}
+	if bob.msgs() < 10 {
+		t.Errorf("expected bob to get the denied messages, got %d", bob.msgs())
+	}
+}
+
+func TestLoadAuthFileRejectsInvalidSubjects(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	os.WriteFile(path, []byte(`{"users": [{"user": "a", "password": "b", "permissions": {"publish": {"allow": ["foo..bar"]}}}]}`), 0o600)
+	if _, err := LoadAuthFile(path); err == nil {
+		t.Error("expected an error for an invalid subject")
+	}
+}
@@ -2,23 +2,479 @@ package commands
 
 import (
 	"fmt"
+	"math/rand/v2"
 	"nats/parser"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func HandleCommand(cmd *parser.Cmd, conn net.Conn) error {
-	// Switch over the command name as a []byte to avoid string conversion
+const (
+	DefaultPort          = 4222
+	DefaultMaxPayload    = 1024 * 1024
+	DefaultPingInterval  = 2 * time.Minute
+	DefaultMaxPingsOut   = 2
+	DefaultAuthTimeout   = 2 * time.Second
+	DefaultMaxPending    = 64 * 1024 * 1024
+	DefaultWriteDeadline = 10 * time.Second
+)
+
+// Options configures the server.
+type Options struct {
+	Host       string
+	Port       int
+	MaxPayload int
+
+	// PingInterval is how often the server pings the clients, a client is
+	// closed once MaxPingsOut pings are left without a PONG.
+	PingInterval time.Duration
+	MaxPingsOut  int
+
+	// Auth, when set, requires the clients to authenticate in CONNECT
+	// within AuthTimeout.
+	Auth        *AuthConfig
+	AuthTimeout time.Duration
+
+	// A client is a slow consumer, and gets disconnected, once more than
+	// MaxPending bytes wait to be sent to it or a write takes longer than
+	// WriteDeadline.
+	MaxPending    int
+	WriteDeadline time.Duration
+
+	// HTTPPort serves the monitoring endpoints when it isn't 0.
+	HTTPPort int
+
+	// ClusterPort accepts the routes of the other servers of the cluster when
+	// it isn't 0, Routes are the addresses (host:port) of the route
+	// listeners of the servers to connect to.
+	ClusterPort int
+	Routes      []string
+	// ClusterToken is the secret the servers of the cluster present when
+	// they open a route to each other. It is required along with Auth, an
+	// open route port would let anyone subscribe to and publish anything.
+	ClusterToken string
+}
+
+// msgCounters counts the messages, and their bytes, of a client or of the
+// whole server.
+type msgCounters struct {
+	inMsgs, inBytes   atomic.Int64
+	outMsgs, outBytes atomic.Int64
+}
+
+func (m *msgCounters) countIn(size int) {
+	m.inMsgs.Add(1)
+	m.inBytes.Add(int64(size))
+}
+
+func (m *msgCounters) countOut(size int) {
+	m.outMsgs.Add(1)
+	m.outBytes.Add(int64(size))
+}
+
+// Server routes the messages published by the clients to the subscriptions
+// of every connection.
+type Server struct {
+	opts    Options
+	info    ServerInfo
+	sublist *Sublist
+	nextID  atomic.Uint64
+	js      *jetStream // nil unless enabled
+	cluster cluster
+
+	start         time.Time
+	stats         msgCounters
+	slowConsumers atomic.Int64
+
+	mu      sync.Mutex
+	clients map[uint64]*Client
+}
+
+func NewServer(opts Options) *Server {
+	if opts.Port == 0 {
+		opts.Port = DefaultPort
+	}
+	if opts.MaxPayload == 0 {
+		opts.MaxPayload = DefaultMaxPayload
+	}
+	if opts.PingInterval == 0 {
+		opts.PingInterval = DefaultPingInterval
+	}
+	if opts.MaxPingsOut == 0 {
+		opts.MaxPingsOut = DefaultMaxPingsOut
+	}
+	if opts.AuthTimeout == 0 {
+		opts.AuthTimeout = DefaultAuthTimeout
+	}
+	if opts.MaxPending == 0 {
+		opts.MaxPending = DefaultMaxPending
+	}
+	if opts.WriteDeadline == 0 {
+		opts.WriteDeadline = DefaultWriteDeadline
+	}
+	return &Server{
+		opts:    opts,
+		info:    newServerInfo(opts),
+		start:   time.Now(),
+		sublist: NewSublist(),
+		cluster: newCluster(),
+		clients: make(map[uint64]*Client),
+	}
+}
+
+// Client is a connection to the server and its subscriptions.
+type Client struct {
+	id     uint64
+	conn   net.Conn
+	server *Server
+
+	// the client's own replies and the messages published by the other
+	// connections are queued for the writer goroutine
+	out outbound
+
+	// verbose clients get +OK for every command, as asked in CONNECT
+	verbose atomic.Bool
+	// headers clients get HMSG, the others only the payload of messages
+	// published with headers
+	headers  atomic.Bool
+	pingsOut atomic.Int32
+
+	// route is set for the connections to the other servers of the
+	// cluster, which aren't listed with the clients
+	route *route
+
+	// user is the authenticated user, nil without auth. It is only used by
+	// the read loop of the connection.
+	user       *User
+	authorized atomic.Bool
+
+	start        time.Time
+	lastActivity atomic.Int64 // Unix nanoseconds of the last command
+	stats        msgCounters
+
+	closeOnce  sync.Once
+	done       chan struct{}
+	writerDone chan struct{}
+	closeErr   error
+
+	mu   sync.Mutex
+	subs map[string]*Subscription // by sid
+	// what the client told about itself in CONNECT
+	name, lang, version, username string
+}
+
+// NewClient registers a new connection.
+func (s *Server) NewClient(conn net.Conn) *Client {
+	c := s.newClient(conn, s.nextID.Add(1))
+	s.mu.Lock()
+	s.clients[c.id] = c
+	s.mu.Unlock()
+	return c
+}
+
+func (s *Server) newClient(conn net.Conn, id uint64) *Client {
+	c := &Client{
+		id:     id,
+		conn:   conn,
+		server: s,
+		start:  time.Now(),
+		done:   make(chan struct{}),
+		subs:   make(map[string]*Subscription),
+
+		writerDone: make(chan struct{}),
+	}
+	c.out.cond = sync.NewCond(&c.out.mu)
+	go c.writeLoop()
+	return c
+}
+
+// RemoveClient drops the connection and its subscriptions once it is closed.
+func (s *Server) RemoveClient(c *Client) {
+	s.mu.Lock()
+	delete(s.clients, c.id)
+	s.mu.Unlock()
+	s.removeSubs(c)
+}
+
+func (s *Server) removeSubs(c *Client) {
+	c.mu.Lock()
+	subs := c.subs
+	c.subs = make(map[string]*Subscription)
+	c.mu.Unlock()
+	for _, sub := range subs {
+		s.removeSub(sub)
+	}
+}
+
+// insertSub adds the subscription to the sublist, and tells the routes
+// about the interest of a local client.
+func (s *Server) insertSub(sub *Subscription) {
+	s.sublist.Insert(sub)
+	s.updateInterest(sub, 1)
+}
+
+func (s *Server) removeSub(sub *Subscription) {
+	if s.sublist.Remove(sub) {
+		s.updateInterest(sub, -1)
+	}
+}
+
+// HandleCommand runs a command of the client. Errors the client must hear
+// about are a *ProtocolError.
+func (s *Server) HandleCommand(cmd *parser.Cmd, c *Client) error {
+	c.lastActivity.Store(time.Now().UnixNano())
+	if s.opts.Auth != nil && !c.authorized.Load() {
+		switch cmd.Name {
+		case parser.CONNECT, parser.PING, parser.PONG:
+		default:
+			return ErrAuthViolation
+		}
+	}
+
+	var err error
 	switch cmd.Name {
+	case parser.PING:
+		return c.write([]byte("PONG\r\n"))
+	case parser.PONG:
+		c.pingsOut.Store(0)
+		return nil
 	case parser.CONNECT:
-		return connectCMD(conn)
-	// case bytes.Equal(cmdName, []byte("CONNECT")):
-	// 	return cmd.parseCONNECT(line[spaceIndex+1:]) // Pass JSON part only
+		if s.opts.Auth != nil {
+			user, ok := s.opts.Auth.authenticate(cmd.ConnectData)
+			if !ok {
+				return ErrAuthViolation
+			}
+			c.user = user
+			c.authorized.Store(true)
+		}
+		c.mu.Lock()
+		c.name, c.lang, c.version = cmd.ConnectData.Name, cmd.ConnectData.Lang, cmd.ConnectData.Version
+		if c.user != nil {
+			c.username = c.user.Username
+		}
+		c.mu.Unlock()
+		c.verbose.Store(cmd.ConnectData.Verbose)
+		c.headers.Store(cmd.ConnectData.Headers)
+	case parser.SUB:
+		err = s.subCMD(cmd, c)
+	case parser.UNSUB:
+		err = s.unsubCMD(cmd, c)
+	case parser.PUB, parser.HPUB:
+		err = s.pubCMD(cmd, c)
 	default:
-		return fmt.Errorf("Unknown Command: %s", cmd.Name)
+		return ErrUnknownOperation
+	}
+	if err != nil {
+		return err
+	}
+	if c.verbose.Load() {
+		return c.write([]byte("+OK\r\n"))
+	}
+	return nil
+}
+
+func (s *Server) subCMD(cmd *parser.Cmd, c *Client) error {
+	sub := &Subscription{client: c, subject: string(cmd.Subject), queue: string(cmd.Queue), sid: string(cmd.ID), deny: c.user.subscribeDeny()}
+	if !IsValidSubject(sub.subject) {
+		return ErrInvalidSubject
+	}
+	if !c.user.canSubscribe(sub.subject) {
+		return ErrPermissionViolation
+	}
+	c.mu.Lock()
+	if _, ok := c.subs[sub.sid]; ok {
+		c.mu.Unlock()
+		return fmt.Errorf("Duplicate subscription id: %s", sub.sid)
+	}
+	c.subs[sub.sid] = sub
+	c.mu.Unlock()
+	s.insertSub(sub)
+	return nil
+}
+
+func (s *Server) unsubCMD(cmd *parser.Cmd, c *Client) error {
+	c.mu.Lock()
+	sub, ok := c.subs[string(cmd.ID)]
+	c.mu.Unlock()
+	if !ok {
+		// unknown sids are ignored, the subscription may have reached its
+		// max_msgs already
+		return nil
+	}
+	if cmd.MaxMsgs > 0 && !s.sublist.AutoUnsubscribe(sub, cmd.MaxMsgs) {
+		return nil
+	}
+	s.removeSub(sub)
+	c.forget(sub)
+	return nil
+}
+
+// pubCMD delivers the message to every plain subscription of the subject and
+// to a random member of each queue group.
+func (s *Server) pubCMD(cmd *parser.Cmd, c *Client) error {
+	if len(cmd.Header)+len(cmd.Bytes) > s.opts.MaxPayload {
+		return ErrMaxPayload
+	}
+	subject := string(cmd.Subject)
+	if !IsValidLiteralSubject(subject) {
+		return ErrInvalidSubject
+	}
+	if !c.user.canPublish(subject) {
+		return ErrPermissionViolation
+	}
+	size := len(cmd.Header) + len(cmd.Bytes)
+	c.stats.countIn(size)
+	s.stats.countIn(size)
+	if s.js != nil {
+		switch {
+		case strings.HasPrefix(subject, jsAPIPrefix):
+			s.js.handleAPI(subject, cmd.ReplyTo, cmd.Bytes)
+			return nil
+		case strings.HasPrefix(subject, jsAckPrefix):
+			s.js.handleAck(subject, cmd.Bytes)
+			return nil
+		}
+		s.js.capture(subject, cmd.ReplyTo, cmd.Header, cmd.Bytes)
 	}
+	s.route(subject, subject, cmd.ReplyTo, cmd.Header, cmd.Bytes)
+	return nil
 }
 
-func connectCMD(conn net.Conn) error {
-	_, err := conn.Write([]byte("+OK\r\n"))
-	return err
+// route delivers a message to the subscriptions matching matchSubject, as a
+// message on subject. The two only differ for the deliveries of consumers,
+// which keep the subject the message was published on, except on the other
+// servers of the cluster which get them on matchSubject.
+func (s *Server) route(matchSubject, subject string, replyTo, header, payload []byte) {
+	s.routeMsg(matchSubject, subject, replyTo, header, payload, nil, false)
+}
+
+// routeMsg delivers the message to the local subscriptions and, unless it
+// comes from a route, forwards it once to every route with interest in it.
+// A queue group only goes across a route when it has no local member left,
+// a message from a route is only delivered to the queue groups it lists.
+func (s *Server) routeMsg(matchSubject, subject string, replyTo, header, payload []byte, queues [][]byte, fromRoute bool) {
+	result := s.sublist.Match(matchSubject)
+	var forward map[*Client][]string
+	forwardTo := func(c *Client, queue string) {
+		if forward == nil {
+			forward = make(map[*Client][]string)
+		}
+		queues := forward[c]
+		if queue != "" {
+			queues = append(queues, queue)
+		}
+		forward[c] = queues
+	}
+
+	for _, sub := range result.psubs {
+		switch {
+		case sub.client.route == nil:
+			s.deliverMsg(sub, subject, replyTo, header, payload)
+		case !fromRoute:
+			forwardTo(sub.client, "")
+		}
+	}
+	for _, members := range result.qsubs {
+		queue := members[0].queue
+		if fromRoute && !containsQueue(queues, queue) {
+			continue
+		}
+		// members that got their max_msgs already pass the message on
+		var routes []*Subscription
+		start := rand.IntN(len(members))
+		delivered := false
+		for i := range members {
+			member := members[(start+i)%len(members)]
+			if member.client.route != nil {
+				routes = append(routes, member)
+				continue
+			}
+			if s.deliverMsg(member, subject, replyTo, header, payload) {
+				delivered = true
+				break
+			}
+		}
+		if !delivered && !fromRoute && len(routes) > 0 {
+			forwardTo(routes[rand.IntN(len(routes))].client, queue)
+		}
+	}
+	for c, queues := range forward {
+		c.sendRouteMsg(matchSubject, replyTo, header, payload, queues)
+	}
+}
+
+// hasInterest reports whether anyone subscribes to the subject.
+func (s *Server) hasInterest(subject string) bool {
+	result := s.sublist.Match(subject)
+	return len(result.psubs) > 0 || len(result.qsubs) > 0
+}
+
+// deliverMsg sends the message to the subscription, unless it got its
+// max_msgs already, and removes the subscription after the last one.
+func (s *Server) deliverMsg(sub *Subscription, subject string, replyTo, header, payload []byte) bool {
+	if sub.denies(subject) {
+		return false
+	}
+	ok, last := sub.deliver()
+	if !ok {
+		return false
+	}
+	// a failing subscriber doesn't concern the publisher, its own read loop
+	// notices the broken connection
+	sub.client.sendMsg(subject, sub.sid, replyTo, header, payload)
+	if last {
+		s.removeSub(sub)
+		sub.client.forget(sub)
+	}
+	return true
+}
+
+// forget drops the subscription from the client, once it left the sublist.
+func (c *Client) forget(sub *Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subs[sub.sid] == sub {
+		delete(c.subs, sub.sid)
+	}
+}
+
+// sendMsg writes MSG <subject> <sid> [reply-to] <#bytes>\r\n<payload>\r\n, or
+// HMSG <subject> <sid> [reply-to] <#header bytes> <#total bytes>\r\n<headers><payload>\r\n
+// when there are headers and the client supports them.
+func (c *Client) sendMsg(subject, sid string, replyTo, header, payload []byte) error {
+	if !c.headers.Load() {
+		header = nil
+	}
+	frame := make([]byte, 0, len(subject)+len(sid)+len(replyTo)+len(header)+len(payload)+48)
+	if header != nil {
+		frame = append(frame, "HMSG "...)
+	} else {
+		frame = append(frame, "MSG "...)
+	}
+	frame = append(frame, subject...)
+	frame = append(frame, ' ')
+	frame = append(frame, sid...)
+	frame = append(frame, ' ')
+	if len(replyTo) > 0 {
+		frame = append(frame, replyTo...)
+		frame = append(frame, ' ')
+	}
+	if header != nil {
+		frame = strconv.AppendInt(frame, int64(len(header)), 10)
+		frame = append(frame, ' ')
+	}
+	frame = strconv.AppendInt(frame, int64(len(header)+len(payload)), 10)
+	frame = append(frame, "\r\n"...)
+	frame = append(frame, header...)
+	frame = append(frame, payload...)
+	frame = append(frame, "\r\n"...)
+	if err := c.write(frame); err != nil {
+		return err
+	}
+	c.stats.countOut(len(header) + len(payload))
+	c.server.stats.countOut(len(header) + len(payload))
+	return nil
 }
@@ -0,0 +1,289 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"nats/parser"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClient is a client connected through a pipe, recording what the server
+// writes to it.
+type testClient struct {
+	*Client
+	mu  sync.Mutex
+	out bytes.Buffer
+}
+
+func newTestClient(t *testing.T, s *Server) *testClient {
+	t.Helper()
+	conn, remote := net.Pipe()
+	tc := &testClient{Client: s.NewClient(conn)}
+	go io.Copy(tc, remote)
+	t.Cleanup(func() {
+		s.RemoveClient(tc.Client)
+		tc.Close()
+	})
+	return tc
+}
+
+func (tc *testClient) Write(b []byte) (int, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.out.Write(b)
+}
+
+// send runs the protocol lines as if the client had sent them.
+func (tc *testClient) send(t *testing.T, lines string) {
+	t.Helper()
+	if err := tc.run(lines); err != nil {
+		t.Fatalf("%q: %v", lines, err)
+	}
+}
+
+// run is send returning the first error.
+func (tc *testClient) run(lines string) error {
+	reader := bufio.NewReader(strings.NewReader(lines))
+	for {
+		cmd, err := parser.Parse(reader, tc.server.opts.MaxPayload)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := tc.server.HandleCommand(cmd, tc.Client); err != nil {
+			return err
+		}
+	}
+}
+
+func (tc *testClient) msgs() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return strings.Count(tc.out.String(), "MSG ")
+}
+
+// waitForMsgs waits until the clients received n messages in total, the
+// pipes are drained asynchronously.
+func waitForMsgs(t *testing.T, n int, clients ...*testClient) {
+	t.Helper()
+	total := 0
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		total = 0
+		for _, c := range clients {
+			total += c.msgs()
+		}
+		if total >= n {
+			break
+		}
+	}
+	if total != n {
+		t.Fatalf("expected %d messages, got %d", n, total)
+	}
+}
+
+func TestPubSubFanOut(t *testing.T) {
+	s := NewServer(Options{})
+	exact, star, tail := newTestClient(t, s), newTestClient(t, s), newTestClient(t, s)
+	exact.send(t, "SUB foo.bar 1\r\n")
+	star.send(t, "SUB foo.* 1\r\n")
+	// a client gets one message per matching subscription
+	tail.send(t, "SUB foo.> 1\r\nSUB > 2\r\n")
+	other := newTestClient(t, s)
+	other.send(t, "SUB baz 1\r\n")
+
+	publisher := newTestClient(t, s)
+	publisher.send(t, "PUB foo.bar reply 5\r\nhello\r\n")
+	publisher.send(t, "PUB foo.bar.baz 3\r\nbye\r\n")
+
+	waitForMsgs(t, 1, exact)
+	waitForMsgs(t, 1, star)
+	waitForMsgs(t, 4, tail)
+	if m := exact.messages()[0]; m.subject != "foo.bar" || m.reply != "reply" || string(m.data) != "hello" {
+		t.Errorf("unexpected message %+v", m)
+	}
+	if other.msgs() != 0 {
+		t.Errorf("expected no message on another subject, got %d", other.msgs())
+	}
+
+	for _, line := range []string{"SUB foo..bar 3\r\n", "SUB foo.>.bar 3\r\n", "PUB foo.* 0\r\n\r\n"} {
+		if err := publisher.run(line); err != ErrInvalidSubject {
+			t.Errorf("%q: expected an invalid subject, got %v", line, err)
+		}
+	}
+	if err := exact.run("SUB foo 1\r\n"); err == nil {
+		t.Error("expected a duplicate sid to be refused")
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	s := NewServer(Options{})
+	sub := newTestClient(t, s)
+	sub.send(t, "SUB foo 1\r\nSUB foo 2\r\n")
+	publisher := newTestClient(t, s)
+	publisher.send(t, "PUB foo 1\r\na\r\n")
+	waitForMsgs(t, 2, sub)
+
+	sub.send(t, "UNSUB 1\r\n")
+	// unknown sids are ignored
+	sub.send(t, "UNSUB 1\r\nUNSUB 42\r\n")
+	publisher.send(t, "PUB foo 1\r\nb\r\n")
+	waitForMsgs(t, 3, sub)
+	if n := s.sublist.Count(); n != 1 {
+		t.Errorf("expected 1 subscription left, got %d", n)
+	}
+}
+
+func TestUnsubscribeMaxMsgs(t *testing.T) {
+	s := NewServer(Options{})
+	sub := newTestClient(t, s)
+	sub.send(t, "SUB foo 1\r\nUNSUB 1 3\r\n")
+	publisher := newTestClient(t, s)
+	for i := 0; i < 5; i++ {
+		publisher.send(t, "PUB foo 1\r\nx\r\n")
+	}
+	waitForMsgs(t, 3, sub)
+	time.Sleep(20 * time.Millisecond)
+	if n := sub.msgs(); n != 3 {
+		t.Errorf("expected 3 messages, got %d", n)
+	}
+	if n := s.sublist.Count(); n != 0 {
+		t.Errorf("expected the subscription to be removed, %d left", n)
+	}
+
+	// a max already reached unsubscribes at once
+	sub.send(t, "SUB bar 2\r\n")
+	publisher.send(t, "PUB bar 1\r\nx\r\nPUB bar 1\r\nx\r\n")
+	waitForMsgs(t, 5, sub)
+	sub.send(t, "UNSUB 2 2\r\n")
+	publisher.send(t, "PUB bar 1\r\nx\r\n")
+	time.Sleep(20 * time.Millisecond)
+	if n := sub.msgs(); n != 5 || s.sublist.Count() != 0 {
+		t.Errorf("expected 5 messages and no subscription, got %d and %d", n, s.sublist.Count())
+	}
+}
+
+func TestQueueGroups(t *testing.T) {
+	s := NewServer(Options{})
+	workers := []*testClient{newTestClient(t, s), newTestClient(t, s), newTestClient(t, s)}
+	workers[0].send(t, "SUB jobs workers 1\r\n")
+	workers[1].send(t, "SUB jobs workers 1\r\n")
+	// members of a group may use different subjects
+	workers[2].send(t, "SUB * workers 1\r\n")
+	plain := newTestClient(t, s)
+	plain.send(t, "SUB jobs 1\r\n")
+	audit := newTestClient(t, s)
+	audit.send(t, "SUB jobs audit 1\r\n")
+
+	publisher := newTestClient(t, s)
+	for i := 0; i < 100; i++ {
+		publisher.send(t, "PUB jobs 3\r\njob\r\n")
+	}
+
+	waitForMsgs(t, 100, plain)
+	waitForMsgs(t, 100, audit)
+	waitForMsgs(t, 100, workers...)
+	for i, w := range workers {
+		if w.msgs() == 0 {
+			t.Errorf("worker %d got no message", i)
+		}
+	}
+}
+
+func TestQueueGroupSkipsExhaustedMembers(t *testing.T) {
+	s := NewServer(Options{})
+	a, b := newTestClient(t, s), newTestClient(t, s)
+	a.send(t, "SUB jobs workers 1\r\nUNSUB 1 2\r\n")
+	b.send(t, "SUB jobs workers 1\r\n")
+
+	publisher := newTestClient(t, s)
+	for i := 0; i < 20; i++ {
+		publisher.send(t, "PUB jobs 3\r\njob\r\n")
+	}
+
+	waitForMsgs(t, 20, a, b)
+	if n := a.msgs(); n > 2 {
+		t.Errorf("expected at most 2 messages for the auto-unsubscribed member, got %d", n)
+	}
+	if n := s.sublist.Count(); a.msgs() == 2 && n != 1 {
+		t.Errorf("expected the exhausted member to be removed, %d subscriptions left", n)
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	s := NewServer(Options{MaxPending: 4096, WriteDeadline: 50 * time.Millisecond})
+	// nobody reads the other end of the pipe
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	stuck := s.NewClient(conn)
+	stuck.subs["1"] = &Subscription{client: stuck, subject: "jobs", sid: "1"}
+	s.sublist.Insert(stuck.subs["1"])
+	fast := newTestClient(t, s)
+	fast.send(t, "SUB jobs 1\r\n")
+
+	publisher := newTestClient(t, s)
+	var publishing time.Duration
+	for i := 0; i < 100; i++ {
+		start := time.Now()
+		publisher.send(t, "PUB jobs 100\r\n"+strings.Repeat("x", 100)+"\r\n")
+		publishing += time.Since(start)
+		// the fast consumer keeps up
+		waitForMsgs(t, i+1, fast)
+	}
+	// blocking on the stuck client would take a write deadline per message
+	if publishing > time.Second {
+		t.Errorf("publishing took %v, held up by the slow consumer", publishing)
+	}
+
+	select {
+	case <-stuck.writerDone:
+	case <-time.After(time.Second):
+		t.Fatal("expected the slow consumer to be disconnected")
+	}
+	if err := stuck.write([]byte("PING\r\n")); err != errClientClosed {
+		t.Errorf("expected writes to a closed client to fail, got %v", err)
+	}
+}
+
+// connectPipe runs a connection of the server over a pipe as Serve would,
+// and returns the client end once the INFO is read.
+func connectPipe(t *testing.T, s *Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, remote := net.Pipe()
+	go s.handleConnection(conn)
+	t.Cleanup(func() { remote.Close() })
+	remote.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(remote)
+	if line := readLine(t, reader); !strings.HasPrefix(line, "INFO ") {
+		t.Fatalf("expected INFO, got %q", line)
+	}
+	return remote, reader
+}
+
+func readLine(t *testing.T, reader *bufio.Reader) string {
+	t.Helper()
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	return line
+}
+
+func TestMaxPayloadViolation(t *testing.T) {
+	for _, line := range []string{"PUB foo 4611686018427387904\r\n", "PUB foo 2000000000\r\n", "HPUB foo 12 2000000000\r\n"} {
+		conn, reader := connectPipe(t, NewServer(Options{MaxPayload: 1024}))
+		go conn.Write([]byte(line))
+		if got := readLine(t, reader); got != "-ERR 'Maximum Payload Violation'\r\n" {
+			t.Errorf("%q: unexpected reply %q", line, got)
+		}
+		if _, err := reader.ReadString('\n'); err != io.EOF {
+			t.Errorf("%q: expected the connection to be closed, got %v", line, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package commands
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"nats/parser"
+	"net"
+	"time"
+)
+
+// Serve accepts connections on the listener until it is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Printf("Temporary error accepting connection %v", netErr)
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+// handleConnection runs the commands of a connection until it is closed.
+func (s *Server) handleConnection(conn net.Conn) {
+	client := s.NewClient(conn)
+	defer func() {
+		s.RemoveClient(client)
+		if err := client.Close(); err != nil {
+			log.Printf("Error closing connection: %v", err)
+		}
+	}()
+	if err := client.SendInfo(); err != nil {
+		log.Printf("Error sending INFO: %v", err)
+		return
+	}
+	go client.PingLoop()
+	if s.opts.Auth != nil {
+		timer := time.AfterFunc(s.opts.AuthTimeout, func() {
+			if !client.authorized.Load() {
+				client.SendErr(ErrAuthTimeout.Message)
+				client.Close()
+			}
+		})
+		defer timer.Stop()
+	}
+	s.readLoop(client, s.HandleCommand)
+}
+
+// readLoop runs the commands read from the connection of the client with
+// handle, until the connection is closed or breaks the protocol.
+func (s *Server) readLoop(client *Client, handle func(*parser.Cmd, *Client) error) {
+	conn := client.conn
+	reader := bufio.NewReader(conn)
+	for {
+		// Set a read deadline to prevent hanging connections
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Minute)); err != nil {
+			log.Printf("Error setting read deadline: %v", err)
+			return
+		}
+		cmd, err := parser.Parse(reader, s.opts.MaxPayload)
+
+		if err != nil {
+			if err == io.EOF {
+				log.Printf("Client closed connection")
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Printf("Read timeout")
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				// closed by the server, e.g. a stale connection
+				return
+			}
+			if errors.Is(err, parser.ErrMaxPayload) {
+				client.SendErr(ErrMaxPayload.Message)
+				return
+			}
+			// the rest of the stream can't be trusted after a parse error
+			log.Printf("Error parsing command: %v", err)
+			client.SendErr(ErrUnknownOperation.Message)
+			return
+		}
+
+		if err := handle(cmd, client); err != nil {
+			if errors.Is(err, errClientClosed) {
+				return
+			}
+			var protoErr *ProtocolError
+			if !errors.As(err, &protoErr) {
+				log.Printf("Error handling command: %v", err)
+				continue
+			}
+			if err := client.SendErr(protoErr.Message); err != nil || protoErr.Fatal {
+				return
+			}
+		}
+	}
+}
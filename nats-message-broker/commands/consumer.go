@@ -0,0 +1,373 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAckWait       = 30 * time.Second
+	DefaultMaxAckPending = 1000
+
+	// consumerSaveInterval is how often the state of a consumer is written
+	// once deliveries or acknowledgements changed it.
+	consumerSaveInterval = 100 * time.Millisecond
+)
+
+// Where a new consumer starts in its stream.
+const (
+	DeliverAll             = "all"
+	DeliverLast            = "last"
+	DeliverNew             = "new"
+	DeliverByStartSequence = "by_start_sequence"
+	DeliverByStartTime     = "by_start_time"
+)
+
+// ConsumerConfig is the configuration of a durable push consumer, which
+// delivers the messages of its stream to DeliverSubject.
+type ConsumerConfig struct {
+	Durable        string        `json:"durable_name"`
+	DeliverSubject string        `json:"deliver_subject"`
+	DeliverPolicy  string        `json:"deliver_policy,omitempty"`
+	OptStartSeq    uint64        `json:"opt_start_seq,omitempty"`
+	OptStartTime   *time.Time    `json:"opt_start_time,omitempty"`
+	AckWait        time.Duration `json:"ack_wait,omitempty"`
+	MaxDeliver     int           `json:"max_deliver,omitempty"`
+	MaxAckPending  int           `json:"max_ack_pending,omitempty"`
+	FilterSubject  string        `json:"filter_subject,omitempty"`
+}
+
+// SequencePair is a position in the consumer and in its stream.
+type SequencePair struct {
+	Consumer uint64 `json:"consumer_seq"`
+	Stream   uint64 `json:"stream_seq"`
+}
+
+// ConsumerInfo describes the progress of a consumer.
+type ConsumerInfo struct {
+	Stream        string         `json:"stream_name"`
+	Name          string         `json:"name"`
+	Config        ConsumerConfig `json:"config"`
+	Delivered     SequencePair   `json:"delivered"`
+	AckFloor      SequencePair   `json:"ack_floor"`
+	NumAckPending int            `json:"num_ack_pending"`
+	NumPending    uint64         `json:"num_pending"`
+}
+
+// consumerFile is the state of a consumer saved to disk.
+type consumerFile struct {
+	Config      ConsumerConfig `json:"config"`
+	NextSeq     uint64         `json:"next_seq"`
+	ConsumerSeq uint64         `json:"consumer_seq"`
+	Pending     map[uint64]int `json:"pending,omitempty"` // deliveries by stream sequence
+}
+
+// pendingMsg is a message delivered but not acknowledged yet.
+type pendingMsg struct {
+	deliveries int
+	sentAt     time.Time
+}
+
+// consumer delivers the messages of its stream in order, then redelivers the
+// ones not acknowledged within AckWait. Every message before nextSeq is
+// either acknowledged or pending.
+type consumer struct {
+	stream *stream
+	path   string
+
+	mu      sync.Mutex
+	config  ConsumerConfig
+	nextSeq uint64
+	cseq    uint64
+	pending map[uint64]*pendingMsg
+	// dirty is set when the state changed since it was last saved
+	dirty bool
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+func validateConsumerConfig(config *ConsumerConfig) error {
+	if !isValidName(config.Durable) {
+		return fmt.Errorf("invalid durable name %q", config.Durable)
+	}
+	if !IsValidLiteralSubject(config.DeliverSubject) {
+		return fmt.Errorf("invalid deliver subject %q", config.DeliverSubject)
+	}
+	if config.FilterSubject != "" && !IsValidSubject(config.FilterSubject) {
+		return fmt.Errorf("invalid filter subject %q", config.FilterSubject)
+	}
+	switch config.DeliverPolicy {
+	case "":
+		config.DeliverPolicy = DeliverAll
+	case DeliverAll, DeliverLast, DeliverNew:
+	case DeliverByStartSequence:
+		if config.OptStartSeq == 0 {
+			return fmt.Errorf("%s needs opt_start_seq", DeliverByStartSequence)
+		}
+	case DeliverByStartTime:
+		if config.OptStartTime == nil {
+			return fmt.Errorf("%s needs opt_start_time", DeliverByStartTime)
+		}
+	default:
+		return fmt.Errorf("unknown deliver policy %q", config.DeliverPolicy)
+	}
+	if config.AckWait <= 0 {
+		config.AckWait = DefaultAckWait
+	}
+	if config.MaxAckPending <= 0 {
+		config.MaxAckPending = DefaultMaxAckPending
+	}
+	return nil
+}
+
+// newConsumer creates a consumer starting where its deliver policy says.
+func newConsumer(st *stream, path string, config ConsumerConfig) (*consumer, error) {
+	c := &consumer{stream: st, path: path, config: config, pending: make(map[uint64]*pendingMsg)}
+	first, last := st.bounds()
+	switch config.DeliverPolicy {
+	case DeliverAll:
+		c.nextSeq = first
+	case DeliverLast:
+		c.nextSeq = max(last, first)
+	case DeliverNew:
+		c.nextSeq = last + 1
+	case DeliverByStartSequence:
+		c.nextSeq = config.OptStartSeq
+	case DeliverByStartTime:
+		c.nextSeq = st.seqAfter(*config.OptStartTime)
+	}
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+	c.start()
+	return c, nil
+}
+
+// loadConsumer resumes a saved consumer, redelivering its pending messages
+// right away.
+func loadConsumer(st *stream, path string) (*consumer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var saved consumerFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	c := &consumer{
+		stream:  st,
+		path:    path,
+		config:  saved.Config,
+		nextSeq: saved.NextSeq,
+		cseq:    saved.ConsumerSeq,
+		pending: make(map[uint64]*pendingMsg),
+	}
+	for seq, deliveries := range saved.Pending {
+		c.pending[seq] = &pendingMsg{deliveries: deliveries}
+	}
+	c.start()
+	return c, nil
+}
+
+func (c *consumer) start() {
+	c.wake = make(chan struct{}, 1)
+	c.quit = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.run()
+}
+
+// signal wakes the consumer up, after a new message or an acknowledgement.
+func (c *consumer) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *consumer) stop() {
+	close(c.quit)
+	<-c.done
+}
+
+// run delivers the messages and saves the state of the consumer, it is the
+// only writer of the state file once the consumer started.
+func (c *consumer) run() {
+	defer close(c.done)
+	// check for expired acknowledgements a few times per AckWait
+	ticker := time.NewTicker(min(max(c.config.AckWait/4, 10*time.Millisecond), time.Second))
+	defer ticker.Stop()
+	saveTicker := time.NewTicker(consumerSaveInterval)
+	defer saveTicker.Stop()
+	for {
+		c.deliver()
+		select {
+		case <-c.wake:
+		case <-ticker.C:
+		case <-saveTicker.C:
+			c.saveIfDirty()
+		case <-c.quit:
+			c.saveIfDirty()
+			return
+		}
+	}
+}
+
+// deliver redelivers the messages whose AckWait expired and sends the new
+// ones, as long as someone subscribes to the deliver subject.
+func (c *consumer) deliver() {
+	server := c.stream.js.server
+	if !server.hasInterest(c.config.DeliverSubject) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	changed := false
+
+	var expired []uint64
+	for seq, p := range c.pending {
+		if now.Sub(p.sentAt) >= c.config.AckWait {
+			expired = append(expired, seq)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+	for _, seq := range expired {
+		p := c.pending[seq]
+		m := c.stream.get(seq)
+		if m == nil || (c.config.MaxDeliver > 0 && p.deliveries >= c.config.MaxDeliver) {
+			delete(c.pending, seq)
+			changed = true
+			continue
+		}
+		c.send(m, p, now)
+		changed = true
+	}
+
+	for len(c.pending) < c.config.MaxAckPending {
+		m := c.stream.get(c.nextSeq)
+		if m == nil {
+			// skip the messages dropped by the retention of the stream
+			if first, _ := c.stream.bounds(); c.nextSeq < first {
+				c.nextSeq = first
+				changed = true
+				continue
+			}
+			break
+		}
+		c.nextSeq++
+		changed = true
+		if c.config.FilterSubject != "" && !subjectMatches(c.config.FilterSubject, m.subject) {
+			continue
+		}
+		p := &pendingMsg{}
+		c.pending[m.seq] = p
+		c.send(m, p, now)
+	}
+
+	if changed {
+		c.dirty = true
+	}
+}
+
+// send delivers the message with a reply subject to acknowledge it:
+// $JS.ACK.<stream>.<consumer>.<deliveries>.<stream seq>.<consumer seq>
+// mu must be held.
+func (c *consumer) send(m *storedMsg, p *pendingMsg, now time.Time) {
+	p.deliveries++
+	p.sentAt = now
+	c.cseq++
+	reply := fmt.Sprintf("%s%s.%s.%d.%d.%d", jsAckPrefix, c.stream.config.Name, c.config.Durable, p.deliveries, m.seq, c.cseq)
+	c.stream.js.server.route(c.config.DeliverSubject, m.subject, []byte(reply), m.header, m.data)
+}
+
+// ack processes the acknowledgement of a message: +ACK (or an empty body)
+// and +TERM are final, -NAK asks for a redelivery now and +WPI for more
+// time.
+func (c *consumer) ack(seq uint64, body []byte) {
+	c.mu.Lock()
+	p, ok := c.pending[seq]
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	switch {
+	case bytes.HasPrefix(body, []byte("-NAK")):
+		p.sentAt = time.Time{}
+	case bytes.HasPrefix(body, []byte("+WPI")):
+		p.sentAt = time.Now()
+	default:
+		delete(c.pending, seq)
+	}
+	c.dirty = true
+	c.mu.Unlock()
+	c.signal()
+}
+
+// saveIfDirty writes the state of the consumer if it changed since the last
+// save. The file is written without holding mu, so deliveries and
+// acknowledgements don't wait for the disk.
+func (c *consumer) saveIfDirty() {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return
+	}
+	saved := c.state()
+	c.dirty = false
+	c.mu.Unlock()
+	if err := writeJSONFile(c.path, saved); err != nil {
+		log.Printf("Error saving consumer %s: %v", c.config.Durable, err)
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+	}
+}
+
+// save writes the state of the consumer, before it starts.
+func (c *consumer) save() error {
+	if err := writeJSONFile(c.path, c.state()); err != nil {
+		log.Printf("Error saving consumer %s: %v", c.config.Durable, err)
+		return err
+	}
+	return nil
+}
+
+// state returns the state of the consumer to save. mu must be held once the
+// consumer started.
+func (c *consumer) state() consumerFile {
+	saved := consumerFile{Config: c.config, NextSeq: c.nextSeq, ConsumerSeq: c.cseq, Pending: make(map[uint64]int)}
+	for seq, p := range c.pending {
+		saved.Pending[seq] = p.deliveries
+	}
+	return saved
+}
+
+func (c *consumer) info() ConsumerInfo {
+	_, last := c.stream.bounds()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ackFloor := c.nextSeq - 1
+	for seq := range c.pending {
+		ackFloor = min(ackFloor, seq-1)
+	}
+	info := ConsumerInfo{
+		Stream:        c.stream.config.Name,
+		Name:          c.config.Durable,
+		Config:        c.config,
+		Delivered:     SequencePair{Consumer: c.cseq, Stream: c.nextSeq - 1},
+		AckFloor:      SequencePair{Stream: ackFloor},
+		NumAckPending: len(c.pending),
+	}
+	if last >= c.nextSeq {
+		info.NumPending = last - c.nextSeq + 1
+	}
+	return info
+}
@@ -0,0 +1,167 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// Message log layout, one record per message, all integers big endian:
+//
+//	sequence (8) | time, Unix nanoseconds (8) | subject length (2) |
+//	header length (4) | data length (4) | subject | header | data |
+//	CRC-32 of everything before in the record (4)
+const msgRecordHdr = 8 + 8 + 2 + 4 + 4
+
+var errCorruptLog = errors.New("corrupt message log")
+
+// storedMsg is a message captured by a stream.
+type storedMsg struct {
+	seq     uint64
+	time    time.Time
+	subject string
+	header  []byte
+	data    []byte
+}
+
+// size is the size of the record of the message in the log.
+func (m *storedMsg) size() int64 {
+	return int64(msgRecordHdr + len(m.subject) + len(m.header) + len(m.data) + 4)
+}
+
+// msgLog is the append-only file holding the messages of a stream.
+type msgLog struct {
+	path string
+	f    *os.File
+}
+
+// openLog opens the log at path, creating it if needed, and returns the
+// messages it holds. A record torn by a crash at the end of the file is
+// truncated away.
+func openLog(path string) (*msgLog, []*storedMsg, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	var msgs []*storedMsg
+	var offset int64
+	br := bufio.NewReader(f)
+	for {
+		m, err := readRecord(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, errCorruptLog) {
+				f.Close()
+				return nil, nil, err
+			}
+			if err := f.Truncate(offset); err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+			break
+		}
+		msgs = append(msgs, m)
+		offset += m.size()
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &msgLog{path: path, f: f}, msgs, nil
+}
+
+func readRecord(r io.Reader) (*storedMsg, error) {
+	hdr := make([]byte, msgRecordHdr)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	subjectLen := int(binary.BigEndian.Uint16(hdr[16:18]))
+	headerLen := int(binary.BigEndian.Uint32(hdr[18:22]))
+	dataLen := int(binary.BigEndian.Uint32(hdr[22:26]))
+	if headerLen > DefaultMaxPayload*64 || dataLen > DefaultMaxPayload*64 {
+		return nil, fmt.Errorf("%w: record of %d bytes", errCorruptLog, headerLen+dataLen)
+	}
+	body := make([]byte, subjectLen+headerLen+dataLen+4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(hdr)
+	crc.Write(body[:len(body)-4])
+	if crc.Sum32() != binary.BigEndian.Uint32(body[len(body)-4:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptLog)
+	}
+
+	m := &storedMsg{
+		seq:     binary.BigEndian.Uint64(hdr[0:8]),
+		time:    time.Unix(0, int64(binary.BigEndian.Uint64(hdr[8:16]))),
+		subject: string(body[:subjectLen]),
+	}
+	if headerLen > 0 {
+		m.header = body[subjectLen : subjectLen+headerLen]
+	}
+	m.data = body[subjectLen+headerLen : len(body)-4]
+	return m, nil
+}
+
+func encodeRecord(m *storedMsg) []byte {
+	b := make([]byte, msgRecordHdr, m.size())
+	binary.BigEndian.PutUint64(b[0:8], m.seq)
+	binary.BigEndian.PutUint64(b[8:16], uint64(m.time.UnixNano()))
+	binary.BigEndian.PutUint16(b[16:18], uint16(len(m.subject)))
+	binary.BigEndian.PutUint32(b[18:22], uint32(len(m.header)))
+	binary.BigEndian.PutUint32(b[22:26], uint32(len(m.data)))
+	b = append(b, m.subject...)
+	b = append(b, m.header...)
+	b = append(b, m.data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+// append writes the message at the end of the log.
+func (l *msgLog) append(m *storedMsg) error {
+	_, err := l.f.Write(encodeRecord(m))
+	return err
+}
+
+// rewrite replaces the log with one holding only msgs, to reclaim the space
+// of the messages dropped by the retention of the stream.
+func (l *msgLog) rewrite(msgs []*storedMsg) error {
+	tmp := l.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	for _, m := range msgs {
+		bw.Write(encodeRecord(m))
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		f.Close()
+		return err
+	}
+	l.f.Close()
+	l.f = f
+	return nil
+}
+
+func (l *msgLog) close() error {
+	return l.f.Close()
+}
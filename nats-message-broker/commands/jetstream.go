@@ -0,0 +1,408 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JetStream-lite is driven with requests on the $JS.API subjects, each
+// answered with JSON on the reply subject of the request:
+//
+//	STREAM.CREATE.<stream>                 StreamConfig
+//	STREAM.INFO.<stream>
+//	STREAM.DELETE.<stream>
+//	STREAM.NAMES
+//	STREAM.MSG.GET.<stream>                {"seq": n}
+//	CONSUMER.CREATE.<stream>               {"config": ConsumerConfig}
+//	CONSUMER.DURABLE.CREATE.<stream>.<name> {"config": ConsumerConfig}
+//	CONSUMER.INFO.<stream>.<name>
+//	CONSUMER.DELETE.<stream>.<name>
+//	CONSUMER.NAMES.<stream>
+//
+// Consumers deliver with a reply subject under $JS.ACK to acknowledge the
+// message on.
+const (
+	jsAPIPrefix = "$JS.API."
+	jsAckPrefix = "$JS.ACK."
+)
+
+// jetStream holds the streams, each in its own directory under dir.
+type jetStream struct {
+	server *Server
+	dir    string
+
+	// mu serializes the API requests
+	mu      sync.Mutex
+	streams map[string]*stream
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+type apiError struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+}
+
+type apiErrorResponse struct {
+	Error *apiError `json:"error"`
+}
+
+type streamInfo struct {
+	Config StreamConfig `json:"config"`
+	State  StreamState  `json:"state"`
+}
+
+type pubAck struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+}
+
+type storedMsgResponse struct {
+	Message struct {
+		Subject string    `json:"subject"`
+		Seq     uint64    `json:"seq"`
+		Header  []byte    `json:"hdrs,omitempty"`
+		Data    []byte    `json:"data"`
+		Time    time.Time `json:"time"`
+	} `json:"message"`
+}
+
+// EnableJetStream loads the streams stored in dir and starts capturing the
+// messages published on their subjects.
+func (s *Server) EnableJetStream(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	js := &jetStream{
+		server:  s,
+		dir:     dir,
+		streams: make(map[string]*stream),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		st, err := openStream(js, filepath.Join(dir, e.Name()), nil)
+		if err != nil {
+			js.close()
+			return fmt.Errorf("loading stream %s: %w", e.Name(), err)
+		}
+		js.streams[st.config.Name] = st
+	}
+	go js.retentionLoop()
+	s.js = js
+	s.info.JetStream = true
+	return nil
+}
+
+// retentionLoop drops the messages older than the MaxAge of their stream.
+func (js *jetStream) retentionLoop() {
+	defer close(js.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-js.quit:
+			return
+		case now := <-ticker.C:
+			for _, st := range js.streamList() {
+				st.mu.Lock()
+				st.enforceRetention(now)
+				st.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (js *jetStream) streamList() []*stream {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	streams := make([]*stream, 0, len(js.streams))
+	for _, st := range js.streams {
+		streams = append(streams, st)
+	}
+	return streams
+}
+
+// capture stores the message in the streams of its subject. A publisher
+// asking for a reply gets the acknowledgement of the stream.
+func (js *jetStream) capture(subject string, reply, header, data []byte) {
+	for _, st := range js.streamList() {
+		if !st.captures(subject) {
+			continue
+		}
+		seq, err := st.store(subject, header, data)
+		if err != nil {
+			log.Printf("Error storing message in stream %s: %v", st.config.Name, err)
+			js.respond(reply, apiErrorResponse{&apiError{500, err.Error()}})
+			continue
+		}
+		js.respond(reply, pubAck{Stream: st.config.Name, Seq: seq})
+	}
+}
+
+func (js *jetStream) respond(reply []byte, v any) {
+	if len(reply) == 0 {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding JetStream response: %v", err)
+		return
+	}
+	js.server.route(string(reply), string(reply), nil, nil, data)
+}
+
+// handleAck routes an acknowledgement to its consumer.
+func (js *jetStream) handleAck(subject string, body []byte) {
+	tokens := strings.Split(strings.TrimPrefix(subject, jsAckPrefix), ".")
+	if len(tokens) != 5 {
+		return
+	}
+	seq, err := strconv.ParseUint(tokens[3], 10, 64)
+	if err != nil {
+		return
+	}
+	js.mu.Lock()
+	st := js.streams[tokens[0]]
+	js.mu.Unlock()
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	c := st.consumers[tokens[1]]
+	st.mu.Unlock()
+	if c != nil {
+		c.ack(seq, body)
+	}
+}
+
+// handleAPI answers a $JS.API request.
+func (js *jetStream) handleAPI(subject string, reply, body []byte) {
+	js.mu.Lock()
+	resp, apiErr := js.api(strings.Split(strings.TrimPrefix(subject, jsAPIPrefix), "."), body)
+	js.mu.Unlock()
+	if apiErr != nil {
+		js.respond(reply, apiErrorResponse{apiErr})
+		return
+	}
+	js.respond(reply, resp)
+}
+
+func badRequest(format string, args ...any) *apiError {
+	return &apiError{400, fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...any) *apiError {
+	return &apiError{404, fmt.Sprintf(format, args...)}
+}
+
+// api runs a request. mu must be held.
+func (js *jetStream) api(tokens []string, body []byte) (any, *apiError) {
+	op := strings.Join(tokens, ".")
+	arg := func(i int) string {
+		if i < len(tokens) {
+			return tokens[i]
+		}
+		return ""
+	}
+	switch {
+	case op == "STREAM.NAMES":
+		names := make([]string, 0, len(js.streams))
+		for name := range js.streams {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return map[string]any{"streams": names}, nil
+	case len(tokens) == 3 && strings.HasPrefix(op, "STREAM.CREATE."):
+		return js.createStream(arg(2), body)
+	case len(tokens) == 3 && strings.HasPrefix(op, "STREAM.INFO."):
+		st := js.streams[arg(2)]
+		if st == nil {
+			return nil, notFound("stream not found")
+		}
+		return streamInfo{st.config, st.state()}, nil
+	case len(tokens) == 3 && strings.HasPrefix(op, "STREAM.DELETE."):
+		st := js.streams[arg(2)]
+		if st == nil {
+			return nil, notFound("stream not found")
+		}
+		st.close()
+		delete(js.streams, arg(2))
+		if err := os.RemoveAll(st.dir); err != nil {
+			return nil, &apiError{500, err.Error()}
+		}
+		return map[string]bool{"success": true}, nil
+	case len(tokens) == 4 && strings.HasPrefix(op, "STREAM.MSG.GET."):
+		st := js.streams[arg(3)]
+		if st == nil {
+			return nil, notFound("stream not found")
+		}
+		var req struct {
+			Seq uint64 `json:"seq"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, badRequest("invalid request: %v", err)
+		}
+		m := st.get(req.Seq)
+		if m == nil {
+			return nil, notFound("no message found")
+		}
+		var resp storedMsgResponse
+		resp.Message.Subject, resp.Message.Seq, resp.Message.Time = m.subject, m.seq, m.time
+		resp.Message.Header, resp.Message.Data = m.header, m.data
+		return resp, nil
+	case len(tokens) == 3 && strings.HasPrefix(op, "CONSUMER.CREATE."):
+		return js.createConsumer(arg(2), "", body)
+	case len(tokens) == 5 && strings.HasPrefix(op, "CONSUMER.DURABLE.CREATE."):
+		return js.createConsumer(arg(3), arg(4), body)
+	case len(tokens) == 3 && strings.HasPrefix(op, "CONSUMER.NAMES."):
+		st := js.streams[arg(2)]
+		if st == nil {
+			return nil, notFound("stream not found")
+		}
+		st.mu.Lock()
+		names := make([]string, 0, len(st.consumers))
+		for name := range st.consumers {
+			names = append(names, name)
+		}
+		st.mu.Unlock()
+		sort.Strings(names)
+		return map[string]any{"consumers": names}, nil
+	case len(tokens) == 4 && (strings.HasPrefix(op, "CONSUMER.INFO.") || strings.HasPrefix(op, "CONSUMER.DELETE.")):
+		st := js.streams[arg(2)]
+		if st == nil {
+			return nil, notFound("stream not found")
+		}
+		st.mu.Lock()
+		c := st.consumers[arg(3)]
+		if c != nil && arg(1) == "DELETE" {
+			delete(st.consumers, arg(3))
+		}
+		st.mu.Unlock()
+		if c == nil {
+			return nil, notFound("consumer not found")
+		}
+		if arg(1) == "INFO" {
+			return c.info(), nil
+		}
+		c.stop()
+		if err := os.Remove(c.path); err != nil {
+			return nil, &apiError{500, err.Error()}
+		}
+		return map[string]bool{"success": true}, nil
+	default:
+		return nil, badRequest("unknown JetStream API request %s", op)
+	}
+}
+
+func (js *jetStream) createStream(name string, body []byte) (any, *apiError) {
+	var config StreamConfig
+	if err := json.Unmarshal(body, &config); err != nil {
+		return nil, badRequest("invalid stream configuration: %v", err)
+	}
+	if config.Name == "" {
+		config.Name = name
+	}
+	if config.Name != name {
+		return nil, badRequest("stream name in subject does not match request")
+	}
+	if err := validateStreamConfig(&config); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if st, ok := js.streams[name]; ok {
+		if fmt.Sprint(st.config) != fmt.Sprint(config) {
+			return nil, badRequest("stream name already in use with a different configuration")
+		}
+		return streamInfo{st.config, st.state()}, nil
+	}
+	for _, st := range js.streams {
+		for _, a := range st.config.Subjects {
+			for _, b := range config.Subjects {
+				if isSubset(a, b) || isSubset(b, a) {
+					return nil, badRequest("subjects overlap with stream %s", st.config.Name)
+				}
+			}
+		}
+	}
+
+	st, err := openStream(js, filepath.Join(js.dir, name), &config)
+	if err != nil {
+		return nil, &apiError{500, err.Error()}
+	}
+	js.streams[name] = st
+	return streamInfo{st.config, st.state()}, nil
+}
+
+func (js *jetStream) createConsumer(streamName, durable string, body []byte) (any, *apiError) {
+	st := js.streams[streamName]
+	if st == nil {
+		return nil, notFound("stream not found")
+	}
+	var req struct {
+		Stream string         `json:"stream_name"`
+		Config ConsumerConfig `json:"config"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest("invalid consumer configuration: %v", err)
+	}
+	config := req.Config
+	if durable != "" {
+		if config.Durable == "" {
+			config.Durable = durable
+		}
+		if config.Durable != durable {
+			return nil, badRequest("consumer name in subject does not match durable name in request")
+		}
+	}
+	if err := validateConsumerConfig(&config); err != nil {
+		return nil, badRequest("%v", err)
+	}
+
+	st.mu.Lock()
+	existing := st.consumers[config.Durable]
+	st.mu.Unlock()
+	if existing != nil {
+		if fmt.Sprint(existing.config) != fmt.Sprint(config) {
+			return nil, badRequest("consumer already exists with a different configuration")
+		}
+		return existing.info(), nil
+	}
+
+	c, err := newConsumer(st, filepath.Join(st.dir, "consumers", config.Durable+".json"), config)
+	if err != nil {
+		return nil, &apiError{500, err.Error()}
+	}
+	st.mu.Lock()
+	st.consumers[config.Durable] = c
+	st.mu.Unlock()
+	return c.info(), nil
+}
+
+// close stops the consumers and closes the logs.
+func (js *jetStream) close() {
+	select {
+	case <-js.quit:
+		return
+	default:
+	}
+	close(js.quit)
+	for _, st := range js.streamList() {
+		st.close()
+	}
+}
@@ -0,0 +1,255 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testMsg struct {
+	subject, reply string
+	data           []byte
+}
+
+// messages parses the MSG frames the client received.
+func (tc *testClient) messages() []testMsg {
+	tc.mu.Lock()
+	out := tc.out.String()
+	tc.mu.Unlock()
+	var msgs []testMsg
+	for {
+		i := strings.Index(out, "MSG ")
+		if i < 0 {
+			return msgs
+		}
+		line, rest, ok := strings.Cut(out[i:], "\r\n")
+		if !ok {
+			return msgs
+		}
+		args := strings.Fields(line)[1:]
+		size, _ := strconv.Atoi(args[len(args)-1])
+		if len(rest) < size+2 {
+			return msgs
+		}
+		m := testMsg{subject: args[0], data: []byte(rest[:size])}
+		if len(args) == 4 {
+			m.reply = args[2]
+		}
+		msgs = append(msgs, m)
+		out = rest[size+2:]
+	}
+}
+
+// waitMessages waits for the client to have received n messages.
+func (tc *testClient) waitMessages(t *testing.T, n int) []testMsg {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if msgs := tc.messages(); len(msgs) >= n {
+			return msgs
+		}
+	}
+	t.Fatalf("expected %d messages, got %d", n, len(tc.messages()))
+	return nil
+}
+
+func newJetStreamServer(t *testing.T, dir string) *Server {
+	t.Helper()
+	s := NewServer(Options{})
+	if err := s.EnableJetStream(dir); err != nil {
+		t.Fatalf("EnableJetStream: %v", err)
+	}
+	t.Cleanup(s.js.close)
+	return s
+}
+
+// jsRequest sends a $JS.API request and decodes the response into v.
+func jsRequest(t *testing.T, s *Server, subject, body string, v any) {
+	t.Helper()
+	c := newTestClient(t, s)
+	c.send(t, "SUB _INBOX.api 1\r\n")
+	c.send(t, fmt.Sprintf("PUB %s _INBOX.api %d\r\n%s\r\n", jsAPIPrefix+subject, len(body), body))
+	msgs := c.waitMessages(t, 1)
+	if err := json.Unmarshal(msgs[0].data, v); err != nil {
+		t.Fatalf("%s: decoding %q: %v", subject, msgs[0].data, err)
+	}
+}
+
+func publish(t *testing.T, c *testClient, subject, reply, data string) {
+	t.Helper()
+	c.send(t, fmt.Sprintf("PUB %s %s %d\r\n%s\r\n", subject, reply, len(data), data))
+}
+
+func TestStreamAndConsumer(t *testing.T) {
+	s := newJetStreamServer(t, t.TempDir())
+	var info streamInfo
+	jsRequest(t, s, "STREAM.CREATE.ORDERS", `{"subjects": ["orders.>"]}`, &info)
+	if info.Config.Name != "ORDERS" {
+		t.Fatalf("unexpected stream %+v", info)
+	}
+
+	publisher := newTestClient(t, s)
+	publisher.send(t, "SUB _INBOX.acks 1\r\n")
+	for i := 1; i <= 3; i++ {
+		publish(t, publisher, fmt.Sprintf("orders.%d", i), "_INBOX.acks", fmt.Sprintf("order %d", i))
+	}
+	for i, m := range publisher.waitMessages(t, 3) {
+		var ack pubAck
+		json.Unmarshal(m.data, &ack)
+		if ack.Stream != "ORDERS" || ack.Seq != uint64(i+1) {
+			t.Errorf("unexpected ack %s", m.data)
+		}
+	}
+
+	worker := newTestClient(t, s)
+	worker.send(t, "SUB deliver.worker 1\r\n")
+	var ci ConsumerInfo
+	jsRequest(t, s, "CONSUMER.DURABLE.CREATE.ORDERS.worker",
+		`{"config": {"deliver_subject": "deliver.worker", "ack_wait": 100000000}}`, &ci)
+	if ci.Name != "worker" {
+		t.Fatalf("unexpected consumer %+v", ci)
+	}
+
+	msgs := worker.waitMessages(t, 3)
+	for i, m := range msgs {
+		if m.subject != fmt.Sprintf("orders.%d", i+1) || string(m.data) != fmt.Sprintf("order %d", i+1) {
+			t.Errorf("unexpected delivery %+v", m)
+		}
+		if want := fmt.Sprintf("$JS.ACK.ORDERS.worker.1.%d.%d", i+1, i+1); m.reply != want {
+			t.Errorf("expected reply %s, got %s", want, m.reply)
+		}
+	}
+	// acknowledge the first two only, the third comes back after ack_wait
+	publish(t, worker, msgs[0].reply, "", "+ACK")
+	publish(t, worker, msgs[1].reply, "", "")
+	redelivered := worker.waitMessages(t, 4)[3]
+	if redelivered.subject != "orders.3" || !strings.HasPrefix(redelivered.reply, "$JS.ACK.ORDERS.worker.2.3.") {
+		t.Errorf("unexpected redelivery %+v", redelivered)
+	}
+
+	jsRequest(t, s, "CONSUMER.INFO.ORDERS.worker", "", &ci)
+	if ci.AckFloor.Stream != 2 || ci.NumAckPending != 1 || ci.Delivered.Stream != 3 {
+		t.Errorf("unexpected consumer info %+v", ci)
+	}
+}
+
+func TestStreamPersistence(t *testing.T) {
+	dir := t.TempDir()
+	s := newJetStreamServer(t, dir)
+	var info streamInfo
+	jsRequest(t, s, "STREAM.CREATE.EVENTS", `{"subjects": ["events.*"]}`, &info)
+	publisher := newTestClient(t, s)
+	for i := 1; i <= 3; i++ {
+		publish(t, publisher, "events.new", "", fmt.Sprintf("event %d", i))
+	}
+	worker := newTestClient(t, s)
+	worker.send(t, "SUB deliver.events 1\r\n")
+	var ci ConsumerInfo
+	jsRequest(t, s, "CONSUMER.CREATE.EVENTS", `{"config": {"durable_name": "audit", "deliver_subject": "deliver.events"}}`, &ci)
+	publish(t, worker, worker.waitMessages(t, 3)[0].reply, "", "+ACK")
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if ci = s.js.streams["EVENTS"].consumers["audit"].info(); ci.NumAckPending == 2 {
+			break
+		}
+	}
+	s.js.close()
+
+	// the stream and the consumer pick up where they were
+	s = newJetStreamServer(t, dir)
+	jsRequest(t, s, "STREAM.INFO.EVENTS", "", &info)
+	if info.State.Msgs != 3 || info.State.LastSeq != 3 {
+		t.Fatalf("unexpected state after restart %+v", info.State)
+	}
+	worker = newTestClient(t, s)
+	worker.send(t, "SUB deliver.events 1\r\n")
+	msgs := worker.waitMessages(t, 2)
+	if string(msgs[0].data) != "event 2" || string(msgs[1].data) != "event 3" {
+		t.Errorf("expected the unacknowledged events, got %+v", msgs)
+	}
+
+	publisher = newTestClient(t, s)
+	publisher.send(t, "SUB _INBOX.acks 1\r\n")
+	publish(t, publisher, "events.new", "_INBOX.acks", "event 4")
+	var ack pubAck
+	json.Unmarshal(publisher.waitMessages(t, 1)[0].data, &ack)
+	if ack.Seq != 4 {
+		t.Errorf("expected sequence 4, got %d", ack.Seq)
+	}
+}
+
+func TestConsumerStateIsSaved(t *testing.T) {
+	s := newJetStreamServer(t, t.TempDir())
+	var info streamInfo
+	jsRequest(t, s, "STREAM.CREATE.JOBS", `{"subjects": ["jobs"]}`, &info)
+	publisher := newTestClient(t, s)
+	for i := 1; i <= 3; i++ {
+		publish(t, publisher, "jobs", "", fmt.Sprintf("job %d", i))
+	}
+	worker := newTestClient(t, s)
+	worker.send(t, "SUB deliver.jobs 1\r\n")
+	var ci ConsumerInfo
+	jsRequest(t, s, "CONSUMER.DURABLE.CREATE.JOBS.runner", `{"config": {"deliver_subject": "deliver.jobs"}}`, &ci)
+	publish(t, worker, worker.waitMessages(t, 3)[0].reply, "", "+ACK")
+
+	// the acknowledgement reaches the file without the server stopping
+	path := s.js.streams["JOBS"].consumers["runner"].path
+	var saved consumerFile
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("reading the consumer state: %v", err)
+		}
+		saved = consumerFile{}
+		json.Unmarshal(data, &saved)
+		if len(saved.Pending) == 2 {
+			break
+		}
+	}
+	if saved.NextSeq != 4 || len(saved.Pending) != 2 || saved.Pending[1] != 0 {
+		t.Errorf("unexpected saved state %+v", saved)
+	}
+}
+
+func TestStreamRetentionAndReplay(t *testing.T) {
+	s := newJetStreamServer(t, t.TempDir())
+	var info streamInfo
+	jsRequest(t, s, "STREAM.CREATE.LOGS", `{"subjects": ["logs"], "max_msgs": 2}`, &info)
+	publisher := newTestClient(t, s)
+	for i := 1; i <= 5; i++ {
+		publish(t, publisher, "logs", "", fmt.Sprintf("line %d", i))
+	}
+	jsRequest(t, s, "STREAM.INFO.LOGS", "", &info)
+	if info.State.Msgs != 2 || info.State.FirstSeq != 4 || info.State.LastSeq != 5 {
+		t.Errorf("unexpected state %+v", info.State)
+	}
+
+	var resp apiErrorResponse
+	jsRequest(t, s, "STREAM.MSG.GET.LOGS", `{"seq": 1}`, &resp)
+	if resp.Error == nil || resp.Error.Code != 404 {
+		t.Errorf("expected the dropped message to be gone, got %+v", resp)
+	}
+	var msg storedMsgResponse
+	jsRequest(t, s, "STREAM.MSG.GET.LOGS", `{"seq": 5}`, &msg)
+	if string(msg.Message.Data) != "line 5" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	// replaying from a dropped sequence starts at the oldest message
+	reader := newTestClient(t, s)
+	reader.send(t, "SUB replay 1\r\n")
+	var ci ConsumerInfo
+	jsRequest(t, s, "CONSUMER.CREATE.LOGS",
+		`{"config": {"durable_name": "replay", "deliver_subject": "replay", "deliver_policy": "by_start_sequence", "opt_start_seq": 1}}`, &ci)
+	msgs := reader.waitMessages(t, 2)
+	if string(msgs[0].data) != "line 4" || string(msgs[1].data) != "line 5" {
+		t.Errorf("unexpected replay %+v", msgs)
+	}
+
+	jsRequest(t, s, "CONSUMER.CREATE.LOGS", `{"config": {"durable_name": "bad.name", "deliver_subject": "x"}}`, &resp)
+	if resp.Error == nil || resp.Error.Code != 400 {
+		t.Errorf("expected an invalid consumer name to be refused, got %+v", resp)
+	}
+}
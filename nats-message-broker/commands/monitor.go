@@ -0,0 +1,254 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DefaultConnzLimit is the number of connections /connz lists by default.
+const DefaultConnzLimit = 1024
+
+// Varz is the state of the server, served on /varz.
+type Varz struct {
+	ServerID         string    `json:"server_id"`
+	ServerName       string    `json:"server_name"`
+	Version          string    `json:"version"`
+	Go               string    `json:"go"`
+	Host             string    `json:"host"`
+	Port             int       `json:"port"`
+	HTTPPort         int       `json:"http_port"`
+	ClusterPort      int       `json:"cluster_port,omitempty"`
+	MaxPayload       int       `json:"max_payload"`
+	MaxPending       int       `json:"max_pending"`
+	PingInterval     string    `json:"ping_interval"`
+	MaxPingsOut      int       `json:"ping_max"`
+	AuthRequired     bool      `json:"auth_required,omitempty"`
+	JetStream        bool      `json:"jetstream,omitempty"`
+	Start            time.Time `json:"start"`
+	Now              time.Time `json:"now"`
+	Uptime           string    `json:"uptime"`
+	Connections      int       `json:"connections"`
+	TotalConnections uint64    `json:"total_connections"`
+	InMsgs           int64     `json:"in_msgs"`
+	OutMsgs          int64     `json:"out_msgs"`
+	InBytes          int64     `json:"in_bytes"`
+	OutBytes         int64     `json:"out_bytes"`
+	SlowConsumers    int64     `json:"slow_consumers"`
+	Subscriptions    int       `json:"subscriptions"`
+	Routes           int       `json:"routes"`
+}
+
+// Connz lists the connections, served on /connz.
+type Connz struct {
+	Now      time.Time   `json:"now"`
+	NumConns int         `json:"num_connections"`
+	Total    int         `json:"total"`
+	Offset   int         `json:"offset"`
+	Limit    int         `json:"limit"`
+	Conns    []*ConnInfo `json:"connections"`
+}
+
+// ConnInfo describes a connection in /connz.
+type ConnInfo struct {
+	Cid            uint64    `json:"cid"`
+	IP             string    `json:"ip,omitempty"`
+	Port           int       `json:"port,omitempty"`
+	Start          time.Time `json:"start"`
+	LastActivity   time.Time `json:"last_activity"`
+	Uptime         string    `json:"uptime"`
+	Idle           string    `json:"idle"`
+	PendingBytes   int       `json:"pending_bytes"`
+	InMsgs         int64     `json:"in_msgs"`
+	OutMsgs        int64     `json:"out_msgs"`
+	InBytes        int64     `json:"in_bytes"`
+	OutBytes       int64     `json:"out_bytes"`
+	NumSubs        int       `json:"subscriptions"`
+	Name           string    `json:"name,omitempty"`
+	Lang           string    `json:"lang,omitempty"`
+	Version        string    `json:"version,omitempty"`
+	AuthorizedUser string    `json:"authorized_user,omitempty"`
+	Subs           []string  `json:"subscriptions_list,omitempty"`
+}
+
+// Subsz describes the subscriptions, served on /subsz.
+type Subsz struct {
+	Now time.Time `json:"now"`
+	SublistStats
+}
+
+// ConnzOptions selects the connections listed by /connz, from the query
+// parameters subs, offset and limit.
+type ConnzOptions struct {
+	Subs   bool
+	Offset int
+	Limit  int
+}
+
+// ServeMonitoring serves the monitoring endpoints over HTTP until the
+// listener is closed.
+func (s *Server) ServeMonitoring(listener net.Listener) error {
+	err := http.Serve(listener, s.monitorHandler())
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) monitorHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /varz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONResponse(w, s.Varz())
+	})
+	mux.HandleFunc("GET /connz", func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseConnzOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSONResponse(w, s.Connz(opts))
+	})
+	mux.HandleFunc("GET /subsz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONResponse(w, s.Subsz())
+	})
+	return mux
+}
+
+func writeJSONResponse(w http.ResponseWriter, v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing monitoring response: %v", err)
+	}
+}
+
+func parseConnzOptions(query url.Values) (ConnzOptions, error) {
+	opts := ConnzOptions{Limit: DefaultConnzLimit}
+	switch query.Get("subs") {
+	case "", "0", "false":
+	case "1", "true", "detail":
+		opts.Subs = true
+	default:
+		return opts, fmt.Errorf("invalid subs %q", query.Get("subs"))
+	}
+	for name, dst := range map[string]*int{"offset": &opts.Offset, "limit": &opts.Limit} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid %s %q", name, value)
+		}
+		*dst = n
+	}
+	return opts, nil
+}
+
+// Varz returns the state of the server.
+func (s *Server) Varz() *Varz {
+	now := time.Now()
+	s.mu.Lock()
+	connections := len(s.clients)
+	s.mu.Unlock()
+	return &Varz{
+		ServerID:         s.info.ServerID,
+		ServerName:       s.info.ServerName,
+		Version:          s.info.Version,
+		Go:               s.info.Go,
+		Host:             s.info.Host,
+		Port:             s.info.Port,
+		HTTPPort:         s.opts.HTTPPort,
+		ClusterPort:      s.opts.ClusterPort,
+		MaxPayload:       s.opts.MaxPayload,
+		MaxPending:       s.opts.MaxPending,
+		PingInterval:     s.opts.PingInterval.String(),
+		MaxPingsOut:      s.opts.MaxPingsOut,
+		AuthRequired:     s.info.AuthRequired,
+		JetStream:        s.js != nil,
+		Start:            s.start,
+		Now:              now,
+		Uptime:           now.Sub(s.start).Round(time.Second).String(),
+		Connections:      connections,
+		TotalConnections: s.nextID.Load(),
+		InMsgs:           s.stats.inMsgs.Load(),
+		OutMsgs:          s.stats.outMsgs.Load(),
+		InBytes:          s.stats.inBytes.Load(),
+		OutBytes:         s.stats.outBytes.Load(),
+		SlowConsumers:    s.slowConsumers.Load(),
+		Subscriptions:    s.sublist.Count(),
+		Routes:           s.routeCount(),
+	}
+}
+
+// Connz returns the connections, in the order they connected.
+func (s *Server) Connz(opts ConnzOptions) *Connz {
+	now := time.Now()
+	s.mu.Lock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+
+	connz := &Connz{Now: now, Total: len(clients), Offset: opts.Offset, Limit: opts.Limit}
+	clients = clients[min(opts.Offset, len(clients)):]
+	clients = clients[:min(opts.Limit, len(clients))]
+	connz.Conns = make([]*ConnInfo, 0, len(clients))
+	for _, c := range clients {
+		connz.Conns = append(connz.Conns, c.connInfo(now, opts.Subs))
+	}
+	connz.NumConns = len(connz.Conns)
+	return connz
+}
+
+func (c *Client) connInfo(now time.Time, withSubs bool) *ConnInfo {
+	info := &ConnInfo{
+		Cid:          c.id,
+		Start:        c.start,
+		LastActivity: c.start,
+		Uptime:       now.Sub(c.start).Round(time.Second).String(),
+		PendingBytes: c.pendingBytes(),
+		InMsgs:       c.stats.inMsgs.Load(),
+		OutMsgs:      c.stats.outMsgs.Load(),
+		InBytes:      c.stats.inBytes.Load(),
+		OutBytes:     c.stats.outBytes.Load(),
+	}
+	if last := c.lastActivity.Load(); last != 0 {
+		info.LastActivity = time.Unix(0, last)
+	}
+	info.Idle = now.Sub(info.LastActivity).Round(time.Second).String()
+	if host, port, err := net.SplitHostPort(c.conn.RemoteAddr().String()); err == nil {
+		info.IP = host
+		info.Port, _ = strconv.Atoi(port)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info.Name, info.Lang, info.Version, info.AuthorizedUser = c.name, c.lang, c.version, c.username
+	info.NumSubs = len(c.subs)
+	if withSubs {
+		for _, sub := range c.subs {
+			info.Subs = append(info.Subs, sub.subject)
+		}
+		sort.Strings(info.Subs)
+	}
+	return info
+}
+
+// Subsz returns the statistics of the subscriptions.
+func (s *Server) Subsz() *Subsz {
+	return &Subsz{Now: time.Now(), SublistStats: s.sublist.Stats()}
+}
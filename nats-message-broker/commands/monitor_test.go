@@ -0,0 +1,100 @@
+package commands
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func getJSON(t *testing.T, url string, v any) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestMonitoring(t *testing.T) {
+	s := NewServer(Options{})
+	monitor := httptest.NewServer(s.monitorHandler())
+	defer monitor.Close()
+
+	sub := newTestClient(t, s)
+	sub.send(t, "CONNECT {\"name\":\"worker\",\"lang\":\"go\"}\r\nSUB foo 1\r\nSUB bar.* 2\r\n")
+	pub := newTestClient(t, s)
+	pub.send(t, "PUB foo 5\r\nhello\r\nPUB bar.x 3\r\nabc\r\nPUB nobody 2\r\nhi\r\n")
+	waitForMsgs(t, 2, sub)
+
+	var varz Varz
+	getJSON(t, monitor.URL+"/varz", &varz)
+	if varz.ServerID != s.info.ServerID || varz.Connections != 2 || varz.TotalConnections != 2 || varz.Subscriptions != 2 {
+		t.Errorf("unexpected varz %+v", varz)
+	}
+	if varz.InMsgs != 3 || varz.InBytes != 10 || varz.OutMsgs != 2 || varz.OutBytes != 8 {
+		t.Errorf("unexpected counters in %d/%d out %d/%d", varz.InMsgs, varz.InBytes, varz.OutMsgs, varz.OutBytes)
+	}
+
+	var connz Connz
+	getJSON(t, monitor.URL+"/connz?subs=1", &connz)
+	if connz.NumConns != 2 || connz.Total != 2 {
+		t.Fatalf("unexpected connz %+v", connz)
+	}
+	first, second := connz.Conns[0], connz.Conns[1]
+	if first.Cid != sub.id || first.Name != "worker" || first.Lang != "go" || first.NumSubs != 2 ||
+		!reflect.DeepEqual(first.Subs, []string{"bar.*", "foo"}) || first.OutMsgs != 2 || first.OutBytes != 8 {
+		t.Errorf("unexpected subscriber %+v", first)
+	}
+	if second.Cid != pub.id || second.InMsgs != 3 || second.InBytes != 10 || second.Subs != nil {
+		t.Errorf("unexpected publisher %+v", second)
+	}
+
+	var page Connz
+	getJSON(t, monitor.URL+"/connz?offset=1&limit=5", &page)
+	if page.NumConns != 1 || page.Conns[0].Cid != pub.id || page.Conns[0].Subs != nil {
+		t.Errorf("unexpected page %+v", page)
+	}
+	if code := getJSON(t, monitor.URL+"/connz?limit=x", &page); code != http.StatusBadRequest {
+		t.Errorf("expected an invalid limit to be refused, got %d", code)
+	}
+
+	var subsz Subsz
+	getJSON(t, monitor.URL+"/subsz", &subsz)
+	if subsz.NumSubs != 2 || subsz.NumInserts != 2 || subsz.NumMatches < 3 || subsz.MaxFanout != 1 {
+		t.Errorf("unexpected subsz %+v", subsz)
+	}
+}
+
+func TestMonitoringPendingBytes(t *testing.T) {
+	s := NewServer(Options{})
+	// nobody reads the pipe, the writer blocks on the first frame and the
+	// second one stays queued
+	conn, remote := net.Pipe()
+	c := s.NewClient(conn)
+	defer func() {
+		remote.Close()
+		s.RemoveClient(c)
+		c.Close()
+	}()
+	c.sendMsg("foo", "1", nil, nil, []byte("abc"))
+	for c.pendingBytes() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.sendMsg("foo", "1", nil, nil, []byte("abc"))
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if s.Connz(ConnzOptions{Limit: DefaultConnzLimit}).Conns[0].PendingBytes == len("MSG foo 1 3\r\nabc\r\n") {
+			return
+		}
+	}
+	t.Errorf("unexpected pending bytes %+v", s.Connz(ConnzOptions{Limit: DefaultConnzLimit}).Conns[0])
+}
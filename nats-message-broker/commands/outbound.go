@@ -0,0 +1,106 @@
+package commands
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var errClientClosed = errors.New("client closed")
+
+// outbound is the queue of bytes waiting to be sent to a client. Writers
+// append to it without blocking, the writer goroutine of the client sends
+// everything queued with a single write.
+type outbound struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	closing bool // nothing is queued anymore, the rest is flushed
+}
+
+// write queues b for the client. A client that let more than MaxPending bytes
+// pile up is a slow consumer: what is pending is dropped and the client is
+// disconnected after a last -ERR, the publisher isn't held up.
+func (c *Client) write(b []byte) error {
+	c.out.mu.Lock()
+	if c.out.closing {
+		c.out.mu.Unlock()
+		return errClientClosed
+	}
+	if len(c.out.pending)+len(b) > c.server.opts.MaxPending {
+		c.out.pending = append(c.out.pending[:0], "-ERR '"+ErrSlowConsumer.Message+"'\r\n"...)
+		c.out.mu.Unlock()
+		log.Printf("Slow consumer %d: more than %d bytes pending", c.id, c.server.opts.MaxPending)
+		c.server.slowConsumers.Add(1)
+		c.shutdown()
+		return ErrSlowConsumer
+	}
+	c.out.pending = append(c.out.pending, b...)
+	c.out.cond.Signal()
+	c.out.mu.Unlock()
+	return nil
+}
+
+// pendingBytes returns the number of bytes queued for the client.
+func (c *Client) pendingBytes() int {
+	c.out.mu.Lock()
+	defer c.out.mu.Unlock()
+	return len(c.out.pending)
+}
+
+// writeLoop sends what is queued until the client is closed, then flushes
+// the rest and closes the connection.
+func (c *Client) writeLoop() {
+	defer close(c.writerDone)
+	var buf []byte
+	for {
+		c.out.mu.Lock()
+		for len(c.out.pending) == 0 && !c.out.closing {
+			c.out.cond.Wait()
+		}
+		// swap the buffers, the writers keep appending to the spare one
+		buf, c.out.pending = c.out.pending, buf[:0]
+		closing := c.out.closing
+		c.out.mu.Unlock()
+
+		if len(buf) > 0 {
+			c.conn.SetWriteDeadline(time.Now().Add(c.server.opts.WriteDeadline))
+			if _, err := c.conn.Write(buf); err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					log.Printf("Slow consumer %d: write timed out", c.id)
+					c.server.slowConsumers.Add(1)
+				}
+				c.shutdown()
+				c.closeErr = c.conn.Close()
+				return
+			}
+		}
+		if closing {
+			c.closeErr = c.conn.Close()
+			return
+		}
+	}
+}
+
+// shutdown stops queuing and tells the writer goroutine to close the
+// connection once the rest is flushed. It doesn't wait for it.
+func (c *Client) shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.out.mu.Lock()
+		c.out.closing = true
+		c.out.cond.Signal()
+		c.out.mu.Unlock()
+	})
+}
+
+// Close flushes what is queued and closes the connection, its read loop
+// then removes the client.
+func (c *Client) Close() error {
+	c.shutdown()
+	<-c.writerDone
+	return c.closeErr
+}
@@ -0,0 +1,122 @@
+package commands
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	Version = "0.1.0"
+
+	// protocol 1 lets the clients learn about the servers of a cluster
+	protocolVersion = 1
+)
+
+// ProtocolError is reported to the client as -ERR '<message>'. Fatal errors
+// close the connection after that.
+type ProtocolError struct {
+	Message string
+	Fatal   bool
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+var (
+	ErrUnknownOperation = &ProtocolError{Message: "Unknown Protocol Operation", Fatal: true}
+	ErrInvalidSubject   = &ProtocolError{Message: "Invalid Subject"}
+	ErrMaxPayload       = &ProtocolError{Message: "Maximum Payload Violation", Fatal: true}
+	ErrStaleConnection  = &ProtocolError{Message: "Stale Connection", Fatal: true}
+	ErrSlowConsumer     = &ProtocolError{Message: "Slow Consumer", Fatal: true}
+	ErrAuthViolation    = &ProtocolError{Message: "Authorization Violation", Fatal: true}
+	ErrAuthTimeout      = &ProtocolError{Message: "Authentication Timeout", Fatal: true}
+	// a forbidden PUB or SUB leaves the connection open
+	ErrPermissionViolation = &ProtocolError{Message: "Authorization Violation"}
+
+	// between the servers of a cluster
+	ErrRouteHandshake = &ProtocolError{Message: "Route Handshake Expected", Fatal: true}
+	ErrRouteToSelf    = &ProtocolError{Message: "Route To Self", Fatal: true}
+	ErrDuplicateRoute = &ProtocolError{Message: "Duplicate Route", Fatal: true}
+)
+
+// ServerInfo is the JSON of the INFO banner sent to every new connection.
+type ServerInfo struct {
+	ServerID     string `json:"server_id"`
+	ServerName   string `json:"server_name"`
+	Version      string `json:"version"`
+	Go           string `json:"go"`
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	Headers      bool   `json:"headers"`
+	AuthRequired bool   `json:"auth_required,omitempty"`
+	JetStream    bool   `json:"jetstream,omitempty"`
+	MaxPayload   int    `json:"max_payload"`
+	Proto        int    `json:"proto"`
+	ClientID     uint64 `json:"client_id,omitempty"`
+}
+
+func newServerInfo(opts Options) ServerInfo {
+	id := make([]byte, 11)
+	rand.Read(id)
+	serverID := strings.ToUpper(hex.EncodeToString(id))
+	host := opts.Host
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return ServerInfo{
+		ServerID:     serverID,
+		ServerName:   serverID,
+		Version:      Version,
+		Go:           runtime.Version(),
+		Host:         host,
+		Port:         opts.Port,
+		MaxPayload:   opts.MaxPayload,
+		Headers:      true,
+		AuthRequired: opts.Auth != nil,
+		Proto:        protocolVersion,
+	}
+}
+
+// SendInfo writes the INFO banner the client waits for before CONNECT.
+func (c *Client) SendInfo() error {
+	info := c.server.info
+	info.ClientID = c.id
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return c.write(append(append([]byte("INFO "), b...), "\r\n"...))
+}
+
+// SendErr writes -ERR '<message>'.
+func (c *Client) SendErr(message string) error {
+	return c.write([]byte("-ERR '" + message + "'\r\n"))
+}
+
+// PingLoop pings the client every PingInterval until it is closed, and closes
+// it once MaxPingsOut pings are left unanswered.
+func (c *Client) PingLoop() {
+	ticker := time.NewTicker(c.server.opts.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if int(c.pingsOut.Add(1)) > c.server.opts.MaxPingsOut {
+			c.SendErr(ErrStaleConnection.Message)
+			c.Close()
+			return
+		}
+		if err := c.write([]byte("PING\r\n")); err != nil {
+			c.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendInfo(t *testing.T) {
+	auth, err := LoadAuthFile(writeAuthFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(Options{Host: "127.0.0.1", Port: 4222, MaxPayload: 2048, Auth: auth})
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	go s.handleConnection(conn)
+	remote.SetDeadline(time.Now().Add(2 * time.Second))
+	line := readLine(t, bufio.NewReader(remote))
+
+	payload, ok := strings.CutPrefix(line, "INFO ")
+	if !ok || !strings.HasSuffix(payload, "\r\n") {
+		t.Fatalf("expected an INFO line, got %q", line)
+	}
+	var info ServerInfo
+	if err := json.Unmarshal([]byte(payload), &info); err != nil {
+		t.Fatal(err)
+	}
+	want := ServerInfo{
+		ServerID:     info.ServerID,
+		ServerName:   info.ServerID,
+		Version:      Version,
+		Go:           runtime.Version(),
+		Host:         "127.0.0.1",
+		Port:         4222,
+		Headers:      true,
+		AuthRequired: true,
+		MaxPayload:   2048,
+		Proto:        protocolVersion,
+		ClientID:     1,
+	}
+	if info != want || len(info.ServerID) != 22 {
+		t.Errorf("unexpected INFO %+v", info)
+	}
+}
+
+func TestPingLoopClosesStaleConnection(t *testing.T) {
+	s := NewServer(Options{PingInterval: 20 * time.Millisecond, MaxPingsOut: 2})
+	_, reader := connectPipe(t, s)
+	// nothing answers the pings
+	for i := 0; i < 2; i++ {
+		if line := readLine(t, reader); line != "PING\r\n" {
+			t.Fatalf("expected PING, got %q", line)
+		}
+	}
+	if line := readLine(t, reader); line != "-ERR 'Stale Connection'\r\n" {
+		t.Fatalf("expected a stale connection, got %q", line)
+	}
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestPingLoopKeepsAnsweringConnection(t *testing.T) {
+	s := NewServer(Options{PingInterval: 20 * time.Millisecond, MaxPingsOut: 2})
+	conn, reader := connectPipe(t, s)
+	for i := 0; i < 5; i++ {
+		if line := readLine(t, reader); line != "PING\r\n" {
+			t.Fatalf("expected PING, got %q", line)
+		}
+		if _, err := conn.Write([]byte("PONG\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	conn, reader := connectPipe(t, NewServer(Options{}))
+	go conn.Write([]byte("CONNECT {\"verbose\":true}\r\nSUB foo 1\r\nPUB foo 2\r\nhi\r\nUNSUB 1\r\nPING\r\n"))
+	for _, want := range []string{"+OK\r\n", "+OK\r\n", "MSG foo 1 2\r\n", "hi\r\n", "+OK\r\n", "+OK\r\n", "PONG\r\n"} {
+		if got := readLine(t, reader); got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+
+	// errors are sent instead of +OK, until verbose is turned off again
+	conn, reader = connectPipe(t, NewServer(Options{}))
+	go conn.Write([]byte("CONNECT {\"verbose\":true}\r\nSUB foo..bar 1\r\nCONNECT {}\r\nSUB foo 1\r\nPING\r\n"))
+	for _, want := range []string{"+OK\r\n", "-ERR 'Invalid Subject'\r\n", "PONG\r\n"} {
+		if got := readLine(t, reader); got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
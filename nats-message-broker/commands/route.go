@@ -0,0 +1,464 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"nats/parser"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RouteReconnectDelay is the time between two attempts to connect to a
+// configured route.
+const RouteReconnectDelay = time.Second
+
+// The servers of a cluster are all connected to each other by routes. Over
+// a route a server sends:
+//
+//	CONNECT {"auth_token"}                           first from the server opening the route
+//	INFO {"server_id","host","port","connect_urls"}  first, then to gossip new routes
+//	RS+ <subject> [queue group]                      when a local client first subscribes
+//	RS- <subject> [queue group]                      when the last one unsubscribes
+//	RMSG <subject> [+ <reply-to> <queue>... | | <queue>... | <reply-to>] <#bytes>
+//	HMSG <subject> [same] <#header bytes> <#total bytes>
+//
+// A message published by a local client is forwarded once to every route
+// with interest in it, and the receiving server only delivers it to its own
+// clients: since the cluster is a full mesh, nothing takes more than one hop.
+// With a ClusterToken, an accepted route must present it in CONNECT within
+// AuthTimeout, the servers of the cluster then trust each other with every
+// subject. Streams stay local to the server they are created on.
+type cluster struct {
+	mu       sync.Mutex
+	port     int           // of the route listener, once it is served
+	quit     chan struct{} // closed once the route listener is
+	routes   map[string]*Client
+	interest map[interestKey]int // local subscriptions by subject and queue
+	dialing  map[string]bool     // route addresses being connected to
+	nextID   atomic.Uint64
+}
+
+type interestKey struct {
+	subject, queue string
+}
+
+// route is the state of a client that is a route to another server.
+type route struct {
+	url       string // address dialed, empty for the accepted routes
+	remoteID  string // server id of the other end, set by its first INFO
+	remoteURL string // address of the route listener of the other end
+}
+
+func newCluster() cluster {
+	return cluster{
+		quit:     make(chan struct{}),
+		routes:   make(map[string]*Client),
+		interest: make(map[interestKey]int),
+		dialing:  make(map[string]bool),
+	}
+}
+
+// ServeRoutes accepts the routes of the other servers of the cluster and
+// connects to the configured ones, until the listener is closed. The routes
+// are then closed as well.
+func (s *Server) ServeRoutes(listener net.Listener) error {
+	if s.opts.Auth != nil && s.opts.ClusterToken == "" {
+		return errors.New("routes need a cluster token when clients authenticate")
+	}
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	s.cluster.mu.Lock()
+	s.cluster.port, _ = strconv.Atoi(port)
+	s.cluster.mu.Unlock()
+	defer s.closeRoutes()
+	s.solicitRoutes(s.opts.Routes, true)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Printf("Temporary error accepting route %v", netErr)
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handleRoute(conn, "")
+	}
+}
+
+func (s *Server) closeRoutes() {
+	s.cluster.mu.Lock()
+	defer s.cluster.mu.Unlock()
+	close(s.cluster.quit)
+	for _, c := range s.cluster.routes {
+		c.shutdown()
+	}
+}
+
+// solicitRoutes connects to the route addresses not connected yet. Only the
+// configured routes are connected to again once lost, those learned from
+// the other servers come back by themselves.
+func (s *Server) solicitRoutes(urls []string, retry bool) {
+	s.cluster.mu.Lock()
+	defer s.cluster.mu.Unlock()
+	for _, url := range urls {
+		if s.cluster.dialing[url] || s.routeTo(url) {
+			continue
+		}
+		s.cluster.dialing[url] = true
+		go s.solicitRoute(url, retry)
+	}
+}
+
+// routeTo reports whether a route to the address is connected. mu must be
+// held.
+func (s *Server) routeTo(url string) bool {
+	for _, c := range s.cluster.routes {
+		if c.route.remoteURL == url {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) solicitRoute(url string, retry bool) {
+	defer func() {
+		s.cluster.mu.Lock()
+		delete(s.cluster.dialing, url)
+		s.cluster.mu.Unlock()
+	}()
+	for {
+		var remoteID string
+		conn, err := net.DialTimeout("tcp", url, RouteReconnectDelay)
+		if err != nil {
+			log.Printf("Error connecting to route %s: %v", url, err)
+		} else {
+			remoteID = s.handleRoute(conn, url)
+		}
+		if !retry || remoteID == s.info.ServerID {
+			return
+		}
+		// the route may have lost to one the other server opened, there is
+		// nothing to do while that one lasts
+		for {
+			select {
+			case <-s.cluster.quit:
+				return
+			case <-time.After(RouteReconnectDelay):
+			}
+			s.cluster.mu.Lock()
+			_, connected := s.cluster.routes[remoteID]
+			s.cluster.mu.Unlock()
+			if !connected {
+				break
+			}
+		}
+	}
+}
+
+// handleRoute runs the commands of a route until it is closed, and returns
+// the server id of the other end.
+func (s *Server) handleRoute(conn net.Conn, url string) string {
+	c := s.newClient(conn, s.cluster.nextID.Add(1))
+	c.route = &route{url: url}
+	defer func() {
+		s.removeRoute(c)
+		c.Close()
+	}()
+	// the routes opened by the server are trusted, it chose where to
+	if url != "" && s.opts.ClusterToken != "" {
+		connect, err := json.Marshal(parser.ConnectCommand{AuthToken: s.opts.ClusterToken})
+		if err == nil {
+			err = c.write(append(append([]byte("CONNECT "), connect...), "\r\n"...))
+		}
+		if err != nil {
+			log.Printf("Error sending CONNECT to route: %v", err)
+			return ""
+		}
+	}
+	c.authorized.Store(url != "" || s.opts.ClusterToken == "")
+	if err := c.sendRouteInfo(nil); err != nil {
+		log.Printf("Error sending INFO to route: %v", err)
+		return ""
+	}
+	if !c.authorized.Load() {
+		timer := time.AfterFunc(s.opts.AuthTimeout, func() {
+			if !c.authorized.Load() {
+				c.SendErr(ErrAuthTimeout.Message)
+				c.Close()
+			}
+		})
+		defer timer.Stop()
+	}
+	go c.PingLoop()
+	s.readLoop(c, s.handleRouteCommand)
+	return c.route.remoteID
+}
+
+// sendRouteInfo writes the INFO of the server, with the addresses of the
+// routes the other end should connect to. Without urls, those of every
+// route of the server.
+func (c *Client) sendRouteInfo(urls []string) error {
+	c.server.cluster.mu.Lock()
+	defer c.server.cluster.mu.Unlock()
+	return c.sendRouteInfoLocked(urls)
+}
+
+// sendRouteInfoLocked is sendRouteInfo with the mu of the cluster held.
+func (c *Client) sendRouteInfoLocked(urls []string) error {
+	s := c.server
+	info := parser.InfoCommand{ServerID: s.info.ServerID, Host: s.opts.Host, Port: s.cluster.port, ConnectURLs: urls}
+	if urls == nil {
+		for _, r := range s.cluster.routes {
+			if r != c && r.route.remoteURL != "" {
+				info.ConnectURLs = append(info.ConnectURLs, r.route.remoteURL)
+			}
+		}
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return c.write(append(append([]byte("INFO "), b...), "\r\n"...))
+}
+
+// handleRouteCommand runs a command received from a route.
+func (s *Server) handleRouteCommand(cmd *parser.Cmd, c *Client) error {
+	if cmd.Name == parser.CONNECT {
+		if !c.authorized.Load() {
+			if !checkSecret(s.opts.ClusterToken, cmd.ConnectData.AuthToken) {
+				return ErrAuthViolation
+			}
+			c.authorized.Store(true)
+		}
+		return nil
+	}
+	if !c.authorized.Load() {
+		return ErrAuthViolation
+	}
+	if c.route.remoteID == "" && cmd.Name != parser.INFO {
+		return ErrRouteHandshake
+	}
+	switch cmd.Name {
+	case parser.PING:
+		return c.write([]byte("PONG\r\n"))
+	case parser.PONG:
+		c.pingsOut.Store(0)
+	case parser.ERR:
+		log.Printf("Route %s closed: %s", c.route.remoteID, cmd.Bytes)
+		c.shutdown()
+		return errClientClosed
+	case parser.INFO:
+		if c.route.remoteID == "" {
+			if err := s.registerRoute(c, cmd.InfoData); err != nil {
+				return err
+			}
+		}
+		s.solicitRoutes(cmd.InfoData.ConnectURLs, false)
+	case parser.RSPLUS:
+		sub := &Subscription{client: c, subject: string(cmd.Subject), queue: string(cmd.Queue)}
+		sub.sid = sub.subject + " " + sub.queue
+		if !IsValidSubject(sub.subject) {
+			return ErrInvalidSubject
+		}
+		c.mu.Lock()
+		_, ok := c.subs[sub.sid]
+		if !ok {
+			c.subs[sub.sid] = sub
+		}
+		c.mu.Unlock()
+		if !ok {
+			s.insertSub(sub)
+		}
+	case parser.RSMINUS:
+		c.mu.Lock()
+		sub, ok := c.subs[string(cmd.Subject)+" "+string(cmd.Queue)]
+		c.mu.Unlock()
+		if ok {
+			s.removeSub(sub)
+			c.forget(sub)
+		}
+	case parser.RMSG, parser.HMSG:
+		s.stats.countIn(len(cmd.Header) + len(cmd.Bytes))
+		subject := string(cmd.Subject)
+		if !IsValidLiteralSubject(subject) {
+			return ErrInvalidSubject
+		}
+		s.routeMsg(subject, subject, cmd.ReplyTo, cmd.Header, cmd.Bytes, cmd.Queues, true)
+	default:
+		return ErrUnknownOperation
+	}
+	return nil
+}
+
+// registerRoute adds the route once the other end introduced itself. Two
+// servers may open a route to each other at the same time: both keep the
+// one opened by the server with the smallest id.
+func (s *Server) registerRoute(c *Client, info parser.InfoCommand) error {
+	if info.ServerID == "" {
+		return ErrRouteHandshake
+	}
+	c.route.remoteID = info.ServerID
+	if info.ServerID == s.info.ServerID {
+		return ErrRouteToSelf
+	}
+	if info.Port != 0 {
+		host := info.Host
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host, _, _ = net.SplitHostPort(c.conn.RemoteAddr().String())
+		}
+		c.route.remoteURL = net.JoinHostPort(host, strconv.Itoa(info.Port))
+	}
+
+	s.cluster.mu.Lock()
+	defer s.cluster.mu.Unlock()
+	select {
+	case <-s.cluster.quit:
+		return errClientClosed
+	default:
+	}
+	if old := s.cluster.routes[info.ServerID]; old != nil {
+		if s.routeOpener(old) <= s.routeOpener(c) {
+			return ErrDuplicateRoute
+		}
+		old.SendErr(ErrDuplicateRoute.Message)
+		old.shutdown()
+	}
+	s.cluster.routes[info.ServerID] = c
+	log.Printf("Route to %s (%s) connected", info.ServerID, c.conn.RemoteAddr())
+
+	// tell the new server about the local interest, and the other servers
+	// about the new one
+	for key := range s.cluster.interest {
+		c.write(rsLine("RS+", key))
+	}
+	if c.route.remoteURL != "" {
+		for _, r := range s.cluster.routes {
+			if r != c {
+				r.sendRouteInfoLocked([]string{c.route.remoteURL})
+			}
+		}
+	}
+	return nil
+}
+
+// routeOpener returns the id of the server that opened the route.
+func (s *Server) routeOpener(c *Client) string {
+	if c.route.url != "" {
+		return s.info.ServerID
+	}
+	return c.route.remoteID
+}
+
+// removeRoute drops the route and the interest it brought.
+func (s *Server) removeRoute(c *Client) {
+	s.cluster.mu.Lock()
+	if s.cluster.routes[c.route.remoteID] == c {
+		delete(s.cluster.routes, c.route.remoteID)
+		log.Printf("Route to %s closed", c.route.remoteID)
+	}
+	s.cluster.mu.Unlock()
+	s.removeSubs(c)
+}
+
+func rsLine(op string, key interestKey) []byte {
+	line := op + " " + key.subject
+	if key.queue != "" {
+		line += " " + key.queue
+	}
+	return []byte(line + "\r\n")
+}
+
+// updateInterest counts the local subscription in or out, the routes hear
+// about the first subscription of a subject and queue group and about the
+// last one leaving.
+func (s *Server) updateInterest(sub *Subscription, delta int) {
+	if sub.client.route != nil {
+		return
+	}
+	key := interestKey{sub.subject, sub.queue}
+	s.cluster.mu.Lock()
+	defer s.cluster.mu.Unlock()
+	n := s.cluster.interest[key] + delta
+	if n > 0 {
+		s.cluster.interest[key] = n
+	} else {
+		delete(s.cluster.interest, key)
+	}
+	var line []byte
+	switch {
+	case delta > 0 && n == 1:
+		line = rsLine("RS+", key)
+	case delta < 0 && n == 0:
+		line = rsLine("RS-", key)
+	default:
+		return
+	}
+	for _, c := range s.cluster.routes {
+		c.write(line)
+	}
+}
+
+// sendRouteMsg forwards a message to the server at the other end of the
+// route, for its plain subscriptions and one member of each of the queue
+// groups.
+func (c *Client) sendRouteMsg(subject string, replyTo, header, payload []byte, queues []string) error {
+	frame := make([]byte, 0, len(subject)+len(replyTo)+len(header)+len(payload)+64)
+	if header != nil {
+		frame = append(frame, "HMSG "...)
+	} else {
+		frame = append(frame, "RMSG "...)
+	}
+	frame = append(frame, subject...)
+	frame = append(frame, ' ')
+	switch {
+	case len(queues) > 0 && len(replyTo) > 0:
+		frame = append(frame, "+ "...)
+		frame = append(frame, replyTo...)
+		frame = append(frame, ' ')
+	case len(queues) > 0:
+		frame = append(frame, "| "...)
+	case len(replyTo) > 0:
+		frame = append(frame, replyTo...)
+		frame = append(frame, ' ')
+	}
+	for _, queue := range queues {
+		frame = append(frame, queue...)
+		frame = append(frame, ' ')
+	}
+	if header != nil {
+		frame = strconv.AppendInt(frame, int64(len(header)), 10)
+		frame = append(frame, ' ')
+	}
+	frame = strconv.AppendInt(frame, int64(len(header)+len(payload)), 10)
+	frame = append(frame, "\r\n"...)
+	frame = append(frame, header...)
+	frame = append(frame, payload...)
+	frame = append(frame, "\r\n"...)
+	if err := c.write(frame); err != nil {
+		return err
+	}
+	c.server.stats.countOut(len(header) + len(payload))
+	return nil
+}
+
+// routeCount returns the number of routes connected.
+func (s *Server) routeCount() int {
+	s.cluster.mu.Lock()
+	defer s.cluster.mu.Unlock()
+	return len(s.cluster.routes)
+}
+
+func containsQueue(queues [][]byte, queue string) bool {
+	return slices.ContainsFunc(queues, func(q []byte) bool { return string(q) == queue })
+}
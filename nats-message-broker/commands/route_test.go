@@ -0,0 +1,226 @@
+package commands
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startCluster starts n servers with opts, all configured with a route to
+// the first one only, and waits for the others to be found through it.
+func startCluster(t *testing.T, n int, opts Options) ([]*Server, []net.Listener) {
+	t.Helper()
+	var servers []*Server
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			opts.Routes = []string{listeners[0].Addr().String()}
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		s := NewServer(opts)
+		go s.ServeRoutes(listener)
+		servers, listeners = append(servers, s), append(listeners, listener)
+	}
+	for _, s := range servers {
+		waitFor(t, "routes", func() bool { return s.routeCount() == n-1 })
+	}
+	return servers, listeners
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestClusterForwardsOnInterest(t *testing.T) {
+	servers, _ := startCluster(t, 3, Options{})
+	sub1, sub2 := newTestClient(t, servers[1]), newTestClient(t, servers[2])
+	sub1.send(t, "SUB foo.* 1\r\n")
+	sub2.send(t, "SUB foo.bar 1\r\nSUB foo.> 2\r\n")
+	waitFor(t, "interest", func() bool {
+		return len(servers[0].sublist.Match("foo.bar").psubs) == 3
+	})
+
+	pub := newTestClient(t, servers[0])
+	publish(t, pub, "foo.bar", "reply", "hello")
+	publish(t, pub, "nobody", "", "lost")
+	waitForMsgs(t, 3, sub1, sub2)
+	// every server got the message once, and kept it to its own clients
+	time.Sleep(50 * time.Millisecond)
+	if sub1.msgs() != 1 || sub2.msgs() != 2 {
+		t.Fatalf("expected 1 and 2 messages, got %d and %d", sub1.msgs(), sub2.msgs())
+	}
+	if m := sub1.messages()[0]; m.subject != "foo.bar" || m.reply != "reply" || string(m.data) != "hello" {
+		t.Errorf("unexpected message %+v", m)
+	}
+
+	sub1.send(t, "UNSUB 1\r\n")
+	servers[2].RemoveClient(sub2.Client)
+	waitFor(t, "interest removal", func() bool { return !servers[0].hasInterest("foo.bar") })
+}
+
+func TestClusterQueueGroups(t *testing.T) {
+	servers, _ := startCluster(t, 3, Options{})
+	remote1, remote2 := newTestClient(t, servers[1]), newTestClient(t, servers[2])
+	remote1.send(t, "SUB work workers 1\r\n")
+	remote2.send(t, "SUB work workers 1\r\n")
+	waitFor(t, "interest", func() bool {
+		qsubs := servers[0].sublist.Match("work").qsubs
+		return len(qsubs) == 1 && len(qsubs[0]) == 2
+	})
+
+	pub := newTestClient(t, servers[0])
+	for i := 0; i < 20; i++ {
+		publish(t, pub, "work", "", "job")
+	}
+	waitForMsgs(t, 20, remote1, remote2)
+	time.Sleep(50 * time.Millisecond)
+	if remote1.msgs()+remote2.msgs() != 20 || remote1.msgs() == 0 || remote2.msgs() == 0 {
+		t.Fatalf("expected the jobs spread over both members, got %d and %d", remote1.msgs(), remote2.msgs())
+	}
+
+	// a local member takes everything
+	local := newTestClient(t, servers[0])
+	local.send(t, "SUB work workers 1\r\n")
+	for i := 0; i < 10; i++ {
+		publish(t, pub, "work", "", "job")
+	}
+	waitForMsgs(t, 10, local)
+	if remote1.msgs()+remote2.msgs() != 20 {
+		t.Errorf("expected the remote members to get nothing more, got %d", remote1.msgs()+remote2.msgs())
+	}
+}
+
+func TestClusterRouteLoss(t *testing.T) {
+	servers, listeners := startCluster(t, 3, Options{})
+	sub := newTestClient(t, servers[2])
+	sub.send(t, "SUB foo 1\r\n")
+	waitFor(t, "interest", func() bool { return servers[0].hasInterest("foo") })
+
+	// closing its route listener takes the server out of the cluster
+	listeners[2].Close()
+	for i, want := range []int{1, 1, 0} {
+		waitFor(t, "route loss", func() bool { return servers[i].routeCount() == want })
+	}
+	if servers[0].hasInterest("foo") {
+		t.Error("expected the interest of the lost server to be gone")
+	}
+}
+
+func TestClusterDuplicateRoutes(t *testing.T) {
+	// both servers connect to each other, a single route must remain
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		listeners = append(listeners, listener)
+	}
+	a := NewServer(Options{Routes: []string{listeners[1].Addr().String()}})
+	b := NewServer(Options{Routes: []string{listeners[0].Addr().String()}})
+	go a.ServeRoutes(listeners[0])
+	go b.ServeRoutes(listeners[1])
+	waitFor(t, "routes", func() bool { return a.routeCount() == 1 && b.routeCount() == 1 })
+
+	sub := newTestClient(t, b)
+	sub.send(t, "SUB foo 1\r\n")
+	waitFor(t, "interest", func() bool { return a.hasInterest("foo") })
+	// give a lost duplicate the time to be retried
+	time.Sleep(2 * RouteReconnectDelay)
+	publish(t, newTestClient(t, a), "foo", "", "once")
+	waitForMsgs(t, 1, sub)
+	time.Sleep(50 * time.Millisecond)
+	if sub.msgs() != 1 || a.routeCount() != 1 || b.routeCount() != 1 {
+		t.Errorf("expected one message over one route, got %d messages and %d/%d routes", sub.msgs(), a.routeCount(), b.routeCount())
+	}
+}
+
+func TestClusterTokenRequiredWithAuth(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	s := NewServer(Options{Auth: &AuthConfig{}})
+	if err := s.ServeRoutes(listener); err == nil {
+		t.Error("expected routes without a cluster token to be refused")
+	}
+}
+
+func TestClusterRouteAuthentication(t *testing.T) {
+	servers, listeners := startCluster(t, 2, Options{ClusterToken: "s3cret"})
+	sub := newTestClient(t, servers[1])
+	sub.send(t, "SUB foo 1\r\n")
+	waitFor(t, "interest", func() bool { return servers[0].hasInterest("foo") })
+	publish(t, newTestClient(t, servers[0]), "foo", "", "hello")
+	waitForMsgs(t, 1, sub)
+
+	for name, connect := range map[string]string{
+		"no token":    "",
+		"wrong token": `CONNECT {"auth_token":"wrong"}` + "\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", listeners[0].Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			if _, err := conn.Write([]byte(connect + `INFO {"server_id":"intruder"}` + "\r\nRS+ >\r\n")); err != nil {
+				t.Fatal(err)
+			}
+			reader := bufio.NewReader(conn)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					t.Fatalf("expected an authorization error, got %v", err)
+				}
+				if strings.HasPrefix(line, "-ERR") {
+					if line != "-ERR 'Authorization Violation'\r\n" {
+						t.Errorf("unexpected error %q", line)
+					}
+					break
+				}
+			}
+			if servers[0].routeCount() != 1 || servers[0].hasInterest("bar") {
+				t.Errorf("expected the intruder not to be routed, got %d routes", servers[0].routeCount())
+			}
+		})
+	}
+}
+
+func TestClusterWrongToken(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	a := NewServer(Options{ClusterToken: "s3cret"})
+	go a.ServeRoutes(listener)
+
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { other.Close() })
+	b := NewServer(Options{ClusterToken: "wrong", Routes: []string{listener.Addr().String()}})
+	go b.ServeRoutes(other)
+
+	time.Sleep(2 * RouteReconnectDelay)
+	if a.routeCount() != 0 || b.routeCount() != 0 {
+		t.Errorf("expected no route with the wrong token, got %d and %d", a.routeCount(), b.routeCount())
+	}
+}
@@ -0,0 +1,323 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StreamConfig is the configuration of a stream: the subjects it captures
+// and how long it keeps the messages. A zero limit is no limit.
+type StreamConfig struct {
+	Name     string        `json:"name"`
+	Subjects []string      `json:"subjects"`
+	MaxAge   time.Duration `json:"max_age,omitempty"`
+	MaxMsgs  int64         `json:"max_msgs,omitempty"`
+	MaxBytes int64         `json:"max_bytes,omitempty"`
+}
+
+// StreamState describes the messages a stream holds.
+type StreamState struct {
+	Msgs      uint64    `json:"messages"`
+	Bytes     uint64    `json:"bytes"`
+	FirstSeq  uint64    `json:"first_seq"`
+	FirstTime time.Time `json:"first_ts"`
+	LastSeq   uint64    `json:"last_seq"`
+	LastTime  time.Time `json:"last_ts"`
+	Consumers int       `json:"consumer_count"`
+}
+
+// streamSeqs is saved before the log is compacted.
+type streamSeqs struct {
+	LastSeq uint64 `json:"last_seq"`
+}
+
+// stream captures the messages published on its subjects to its log. The
+// messages are kept in memory as well, in sequence order without gaps since
+// the retention only drops the oldest ones.
+type stream struct {
+	js  *jetStream
+	dir string
+
+	mu        sync.Mutex
+	config    StreamConfig
+	msgs      []*storedMsg
+	lastSeq   uint64
+	lastTime  time.Time
+	bytes     int64
+	deadBytes int64 // of the dropped messages still in the log
+	log       *msgLog
+	consumers map[string]*consumer
+}
+
+func validateStreamConfig(config *StreamConfig) error {
+	if !isValidName(config.Name) {
+		return fmt.Errorf("invalid stream name %q", config.Name)
+	}
+	if len(config.Subjects) == 0 {
+		config.Subjects = []string{config.Name}
+	}
+	for _, subject := range config.Subjects {
+		if !IsValidSubject(subject) {
+			return fmt.Errorf("invalid subject %q", subject)
+		}
+		if strings.HasPrefix(subject, "$JS.") {
+			return fmt.Errorf("subject %q overlaps the JetStream API", subject)
+		}
+	}
+	if config.MaxAge < 0 || config.MaxMsgs < 0 || config.MaxBytes < 0 {
+		return fmt.Errorf("negative limit")
+	}
+	return nil
+}
+
+// isValidName reports whether name can be used as a stream or consumer
+// name, which are subject tokens of the API.
+func isValidName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ".*> \t\r\n/\\")
+}
+
+// openStream loads the stream stored in dir, or creates it with config when
+// config isn't nil.
+func openStream(js *jetStream, dir string, config *StreamConfig) (*stream, error) {
+	configPath := filepath.Join(dir, "config.json")
+	if config == nil {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		config = &StreamConfig{}
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", configPath, err)
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Join(dir, "consumers"), 0o755); err != nil {
+			return nil, err
+		}
+		if err := writeJSONFile(configPath, config); err != nil {
+			return nil, err
+		}
+	}
+
+	logFile, msgs, err := openLog(filepath.Join(dir, "msgs.log"))
+	if err != nil {
+		return nil, err
+	}
+	st := &stream{
+		js:        js,
+		dir:       dir,
+		config:    *config,
+		msgs:      msgs,
+		log:       logFile,
+		consumers: make(map[string]*consumer),
+	}
+	for _, m := range msgs {
+		st.bytes += m.size()
+	}
+	if len(msgs) > 0 {
+		last := msgs[len(msgs)-1]
+		st.lastSeq, st.lastTime = last.seq, last.time
+	}
+	// the compacted log may have lost the last sequence
+	var saved streamSeqs
+	if data, err := os.ReadFile(filepath.Join(dir, "state.json")); err == nil {
+		json.Unmarshal(data, &saved)
+	}
+	if saved.LastSeq > st.lastSeq {
+		st.lastSeq = saved.LastSeq
+	}
+	st.mu.Lock()
+	st.enforceRetention(time.Now())
+	st.mu.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(dir, "consumers"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		c, err := loadConsumer(st, filepath.Join(dir, "consumers", e.Name()))
+		if err != nil {
+			st.close()
+			return nil, err
+		}
+		st.consumers[c.config.Durable] = c
+	}
+	return st, nil
+}
+
+// captures reports whether the stream stores the messages of the subject.
+func (st *stream) captures(subject string) bool {
+	for _, pattern := range st.config.Subjects {
+		if subjectMatches(pattern, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// store appends the message to the stream and returns its sequence.
+func (st *stream) store(subject string, header, data []byte) (uint64, error) {
+	st.mu.Lock()
+	m := &storedMsg{seq: st.lastSeq + 1, time: time.Now(), subject: subject, header: header, data: data}
+	if err := st.log.append(m); err != nil {
+		st.mu.Unlock()
+		return 0, err
+	}
+	st.msgs = append(st.msgs, m)
+	st.lastSeq, st.lastTime = m.seq, m.time
+	st.bytes += m.size()
+	st.enforceRetention(m.time)
+	consumers := st.consumerList()
+	st.mu.Unlock()
+
+	for _, c := range consumers {
+		c.signal()
+	}
+	return m.seq, nil
+}
+
+// enforceRetention drops the oldest messages beyond the limits, and
+// compacts the log once it holds more dropped than live bytes. mu must be
+// held.
+func (st *stream) enforceRetention(now time.Time) {
+	drop := 0
+	for drop < len(st.msgs) {
+		m := st.msgs[drop]
+		live := int64(len(st.msgs) - drop)
+		if (st.config.MaxMsgs > 0 && live > st.config.MaxMsgs) ||
+			(st.config.MaxBytes > 0 && st.bytes > st.config.MaxBytes) ||
+			(st.config.MaxAge > 0 && now.Sub(m.time) > st.config.MaxAge) {
+			st.bytes -= m.size()
+			st.deadBytes += m.size()
+			drop++
+			continue
+		}
+		break
+	}
+	if drop == 0 {
+		return
+	}
+	st.msgs = append([]*storedMsg(nil), st.msgs[drop:]...)
+	if st.deadBytes > st.bytes {
+		if err := writeJSONFile(filepath.Join(st.dir, "state.json"), streamSeqs{LastSeq: st.lastSeq}); err != nil {
+			log.Printf("Error saving stream %s: %v", st.config.Name, err)
+			return
+		}
+		if err := st.log.rewrite(st.msgs); err != nil {
+			log.Printf("Error compacting stream %s: %v", st.config.Name, err)
+			return
+		}
+		st.deadBytes = 0
+	}
+}
+
+// firstSeq returns the sequence of the oldest message, or the one the next
+// message gets when the stream is empty. mu must be held.
+func (st *stream) firstSeq() uint64 {
+	if len(st.msgs) == 0 {
+		return st.lastSeq + 1
+	}
+	return st.msgs[0].seq
+}
+
+// bounds returns the sequences of the oldest and of the last message.
+func (st *stream) bounds() (first, last uint64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.firstSeq(), st.lastSeq
+}
+
+// get returns the message of the sequence, nil if it was dropped or isn't
+// stored yet.
+func (st *stream) get(seq uint64) *storedMsg {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	first := st.firstSeq()
+	if seq < first || seq > st.lastSeq {
+		return nil
+	}
+	return st.msgs[seq-first]
+}
+
+// seqAfter returns the sequence of the first message stored at or after t.
+func (st *stream) seqAfter(t time.Time) uint64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	i := sort.Search(len(st.msgs), func(i int) bool { return !st.msgs[i].time.Before(t) })
+	if i == len(st.msgs) {
+		return st.lastSeq + 1
+	}
+	return st.msgs[i].seq
+}
+
+func (st *stream) state() StreamState {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	state := StreamState{
+		Msgs:      uint64(len(st.msgs)),
+		Bytes:     uint64(st.bytes),
+		FirstSeq:  st.firstSeq(),
+		LastSeq:   st.lastSeq,
+		LastTime:  st.lastTime,
+		Consumers: len(st.consumers),
+	}
+	if len(st.msgs) > 0 {
+		state.FirstTime = st.msgs[0].time
+	}
+	return state
+}
+
+// consumerList returns the consumers of the stream. mu must be held.
+func (st *stream) consumerList() []*consumer {
+	consumers := make([]*consumer, 0, len(st.consumers))
+	for _, c := range st.consumers {
+		consumers = append(consumers, c)
+	}
+	return consumers
+}
+
+// close stops the consumers and closes the log.
+func (st *stream) close() error {
+	st.mu.Lock()
+	consumers := st.consumerList()
+	st.mu.Unlock()
+	for _, c := range consumers {
+		c.stop()
+	}
+	return st.log.close()
+}
+
+// writeJSONFile replaces the file atomically. The new content is synced
+// before the rename, so a crash leaves either the old or the new file.
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,396 @@
+package commands
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// pwc matches any single token, fwc one or more tokens at the end.
+	pwc = "*"
+	fwc = ">"
+
+	// maxCacheSize bounds the match cache, a full cache drops an arbitrary
+	// entry for each new one.
+	maxCacheSize = 1024
+)
+
+// Subscription is the interest of a client in a subject, identified by the
+// sid the client chose.
+type Subscription struct {
+	client  *Client
+	subject string
+	queue   string // queue group, empty for plain subscriptions
+	sid     string
+	// deny holds the subscribe deny patterns of the user, a wildcard
+	// subscription may cover subjects the user can't receive
+	deny []string
+
+	// max is the number of messages to deliver before the subscription is
+	// removed (UNSUB with max_msgs), 0 means unlimited.
+	max       atomic.Int64
+	delivered atomic.Int64
+}
+
+// Sublist is the registry of the subscriptions of every connection. The
+// subscriptions are stored in a trie of subject tokens, where the * and >
+// wildcards have their own branches, and the results of Match are cached
+// until a subscription that could change them comes or goes.
+type Sublist struct {
+	mu    sync.RWMutex
+	root  *level
+	count int
+	cache map[string]*SublistResult
+
+	// counters reported by Stats
+	inserts, removes   uint64 // under mu
+	matches, cacheHits atomic.Uint64
+}
+
+// SublistStats describes the subscriptions and the match cache.
+type SublistStats struct {
+	NumSubs      int     `json:"num_subscriptions"`
+	NumCache     int     `json:"num_cache"`
+	NumInserts   uint64  `json:"num_inserts"`
+	NumRemoves   uint64  `json:"num_removes"`
+	NumMatches   uint64  `json:"num_matches"`
+	CacheHitRate float64 `json:"cache_hit_rate"`
+	MaxFanout    int     `json:"max_fanout"`
+	AvgFanout    float64 `json:"avg_fanout"`
+}
+
+// SublistResult holds the subscriptions matching a subject: every plain
+// subscription gets the message, and a single member of each queue group.
+type SublistResult struct {
+	psubs []*Subscription
+	qsubs [][]*Subscription
+}
+
+// level holds the children of a node: one per literal token, plus the
+// wildcard branches.
+type level struct {
+	nodes    map[string]*node
+	pwc, fwc *node
+}
+
+type node struct {
+	next  *level
+	psubs map[*Subscription]struct{}
+	qsubs map[string]map[*Subscription]struct{} // by queue group
+}
+
+func newLevel() *level {
+	return &level{nodes: make(map[string]*node)}
+}
+
+func newNode() *node {
+	return &node{psubs: make(map[*Subscription]struct{}), qsubs: make(map[string]map[*Subscription]struct{})}
+}
+
+func (n *node) isEmpty() bool {
+	return len(n.psubs) == 0 && len(n.qsubs) == 0 && n.next.isEmpty()
+}
+
+func (l *level) isEmpty() bool {
+	return len(l.nodes) == 0 && l.pwc == nil && l.fwc == nil
+}
+
+func NewSublist() *Sublist {
+	return &Sublist{root: newLevel(), cache: make(map[string]*SublistResult)}
+}
+
+// Insert adds the subscription, its subject must be valid.
+func (s *Sublist) Insert(sub *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.root
+	var n *node
+	for _, token := range strings.Split(sub.subject, ".") {
+		switch token {
+		case pwc:
+			if l.pwc == nil {
+				l.pwc = newNode()
+			}
+			n = l.pwc
+		case fwc:
+			if l.fwc == nil {
+				l.fwc = newNode()
+			}
+			n = l.fwc
+		default:
+			if n = l.nodes[token]; n == nil {
+				n = newNode()
+				l.nodes[token] = n
+			}
+		}
+		if n.next == nil {
+			n.next = newLevel()
+		}
+		l = n.next
+	}
+	if sub.queue == "" {
+		n.psubs[sub] = struct{}{}
+	} else {
+		if n.qsubs[sub.queue] == nil {
+			n.qsubs[sub.queue] = make(map[*Subscription]struct{})
+		}
+		n.qsubs[sub.queue][sub] = struct{}{}
+	}
+	s.count++
+	s.inserts++
+	s.invalidate(sub.subject)
+}
+
+// Remove deletes the subscription and prunes the branches left empty. It
+// returns false if the subscription wasn't in the sublist.
+func (s *Sublist) Remove(sub *Subscription) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.remove(s.root, strings.Split(sub.subject, "."), sub) {
+		return false
+	}
+	s.count--
+	s.removes++
+	s.invalidate(sub.subject)
+	return true
+}
+
+func (s *Sublist) remove(l *level, tokens []string, sub *Subscription) bool {
+	var n *node
+	switch tokens[0] {
+	case pwc:
+		n = l.pwc
+	case fwc:
+		n = l.fwc
+	default:
+		n = l.nodes[tokens[0]]
+	}
+	if n == nil {
+		return false
+	}
+
+	if len(tokens) == 1 {
+		if !n.removeSub(sub) {
+			return false
+		}
+	} else if !s.remove(n.next, tokens[1:], sub) {
+		return false
+	}
+
+	// prune the node once nothing hangs from it
+	if n.isEmpty() {
+		switch tokens[0] {
+		case pwc:
+			l.pwc = nil
+		case fwc:
+			l.fwc = nil
+		default:
+			delete(l.nodes, tokens[0])
+		}
+	}
+	return true
+}
+
+func (n *node) removeSub(sub *Subscription) bool {
+	subs := n.psubs
+	if sub.queue != "" {
+		subs = n.qsubs[sub.queue]
+	}
+	if _, ok := subs[sub]; !ok {
+		return false
+	}
+	delete(subs, sub)
+	if sub.queue != "" && len(subs) == 0 {
+		delete(n.qsubs, sub.queue)
+	}
+	return true
+}
+
+// invalidate drops the cached results the subscription subject can change.
+// mu must be held.
+func (s *Sublist) invalidate(subject string) {
+	for literal := range s.cache {
+		if subjectMatches(subject, literal) {
+			delete(s.cache, literal)
+		}
+	}
+}
+
+// Match returns the subscriptions interested in a message published on the
+// literal subject. The result is shared with the cache and must not be
+// modified.
+func (s *Sublist) Match(subject string) *SublistResult {
+	s.matches.Add(1)
+	s.mu.RLock()
+	result, ok := s.cache[subject]
+	s.mu.RUnlock()
+	if ok {
+		s.cacheHits.Add(1)
+		return result
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if result, ok := s.cache[subject]; ok {
+		s.cacheHits.Add(1)
+		return result
+	}
+	// the members of a queue group may subscribe to different subjects
+	groups := make(map[string][]*Subscription)
+	result = &SublistResult{}
+	matchLevel(s.root, strings.Split(subject, "."), result, groups)
+	for _, members := range groups {
+		result.qsubs = append(result.qsubs, members)
+	}
+	if len(s.cache) >= maxCacheSize {
+		for literal := range s.cache {
+			delete(s.cache, literal)
+			break
+		}
+	}
+	s.cache[subject] = result
+	return result
+}
+
+func matchLevel(l *level, tokens []string, result *SublistResult, groups map[string][]*Subscription) {
+	for i, token := range tokens {
+		last := i == len(tokens)-1
+		if l.fwc != nil {
+			l.fwc.collect(result, groups)
+		}
+		if l.pwc != nil {
+			if last {
+				l.pwc.collect(result, groups)
+			} else {
+				matchLevel(l.pwc.next, tokens[i+1:], result, groups)
+			}
+		}
+		n := l.nodes[token]
+		if n == nil {
+			return
+		}
+		if last {
+			n.collect(result, groups)
+		}
+		l = n.next
+	}
+}
+
+func (n *node) collect(result *SublistResult, groups map[string][]*Subscription) {
+	for sub := range n.psubs {
+		result.psubs = append(result.psubs, sub)
+	}
+	for queue, members := range n.qsubs {
+		for sub := range members {
+			groups[queue] = append(groups[queue], sub)
+		}
+	}
+}
+
+// AutoUnsubscribe limits the subscription to max messages in total. It
+// returns true if the subscription has received them already, in which case
+// the caller removes it.
+func (s *Sublist) AutoUnsubscribe(sub *Subscription, max int) bool {
+	sub.max.Store(int64(max))
+	return sub.delivered.Load() >= int64(max)
+}
+
+// deliver counts a message for the subscription. It returns false once the
+// subscription got its max_msgs, and last for the final message, after which
+// the subscription must be removed.
+func (sub *Subscription) deliver() (ok, last bool) {
+	n := sub.delivered.Add(1)
+	max := sub.max.Load()
+	if max > 0 && n > max {
+		return false, false
+	}
+	return true, max > 0 && n == max
+}
+
+// Count returns the number of subscriptions.
+func (s *Sublist) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.count
+}
+
+// Stats returns the counters of the sublist. The fanouts are those of the
+// cached results.
+func (s *Sublist) Stats() SublistStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := SublistStats{
+		NumSubs:    s.count,
+		NumCache:   len(s.cache),
+		NumInserts: s.inserts,
+		NumRemoves: s.removes,
+		NumMatches: s.matches.Load(),
+	}
+	if stats.NumMatches > 0 {
+		stats.CacheHitRate = float64(s.cacheHits.Load()) / float64(stats.NumMatches)
+	}
+	total := 0
+	for _, result := range s.cache {
+		fanout := len(result.psubs) + len(result.qsubs)
+		stats.MaxFanout = max(stats.MaxFanout, fanout)
+		total += fanout
+	}
+	if len(s.cache) > 0 {
+		stats.AvgFanout = float64(total) / float64(len(s.cache))
+	}
+	return stats
+}
+
+// subjectMatches reports whether the literal subject matches the subscription
+// subject, which may contain wildcards.
+func subjectMatches(pattern, literal string) bool {
+	pt := strings.Split(pattern, ".")
+	lt := strings.Split(literal, ".")
+	for i, token := range pt {
+		if token == fwc {
+			return len(lt) > i
+		}
+		if i >= len(lt) || (token != pwc && token != lt[i]) {
+			return false
+		}
+	}
+	return len(pt) == len(lt)
+}
+
+// IsValidSubject reports whether the subject can be subscribed to: non empty
+// tokens separated by dots, without whitespace. The wildcards * and > are
+// whole tokens, and > can only be the last one.
+func IsValidSubject(subject string) bool {
+	return validSubject(subject, true)
+}
+
+// IsValidLiteralSubject reports whether messages can be published on the
+// subject: a valid subject without wildcards.
+func IsValidLiteralSubject(subject string) bool {
+	return validSubject(subject, false)
+}
+
+func validSubject(subject string, wildcards bool) bool {
+	if subject == "" {
+		return false
+	}
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		if token == "" || strings.ContainsAny(token, " \t\r\n") {
+			return false
+		}
+		switch token {
+		case pwc:
+			if !wildcards {
+				return false
+			}
+		case fwc:
+			if !wildcards || i != len(tokens)-1 {
+				return false
+			}
+		}
+	}
+	return true
+}
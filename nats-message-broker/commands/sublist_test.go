@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// sids lists the plain subscriptions and the queue group members matched.
+func sids(r *SublistResult) []string {
+	var result []string
+	for _, sub := range r.psubs {
+		result = append(result, sub.sid)
+	}
+	for _, members := range r.qsubs {
+		for _, sub := range members {
+			result = append(result, sub.sid)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestSublistWildcards(t *testing.T) {
+	s := NewSublist()
+	for sid, subject := range map[string]string{
+		"1": "foo.bar",
+		"2": "foo.*",
+		"3": "foo.>",
+		"4": "*.bar",
+		"5": ">",
+		"6": "foo.*.baz",
+		"7": "foo",
+	} {
+		s.Insert(&Subscription{subject: subject, sid: sid})
+	}
+
+	for subject, want := range map[string]string{
+		"foo.bar":     "[1 2 3 4 5]",
+		"foo.baz":     "[2 3 5]",
+		"foo.bar.baz": "[3 5 6]",
+		"foo":         "[5 7]",
+		"bar":         "[5]",
+		"baz.bar":     "[4 5]",
+	} {
+		if got := fmt.Sprint(sids(s.Match(subject))); got != want {
+			t.Errorf("Match(%q) = %s, want %s", subject, got, want)
+		}
+	}
+}
+
+func TestSublistCacheInvalidation(t *testing.T) {
+	s := NewSublist()
+	a := &Subscription{subject: "foo.bar", sid: "a"}
+	s.Insert(a)
+	if got := len(sids(s.Match("foo.bar"))); got != 1 {
+		t.Fatalf("expected 1 match, got %d", got)
+	}
+
+	b := &Subscription{subject: "foo.>", sid: "b"}
+	s.Insert(b)
+	if got := len(sids(s.Match("foo.bar"))); got != 2 {
+		t.Fatalf("expected 2 matches after SUB, got %d", got)
+	}
+	s.Remove(a)
+	if got := fmt.Sprint(sids(s.Match("foo.bar"))); got != "[b]" {
+		t.Fatalf("expected [b] after UNSUB, got %s", got)
+	}
+	s.Remove(b)
+	if got := len(sids(s.Match("foo.bar"))); got != 0 || s.Count() != 0 {
+		t.Fatalf("expected an empty sublist, got %d matches and %d subscriptions", got, s.Count())
+	}
+	if !s.root.isEmpty() {
+		t.Error("expected the trie to be pruned")
+	}
+}
+
+func TestValidSubjects(t *testing.T) {
+	for subject, want := range map[string]bool{
+		"foo":          true,
+		"foo.bar":      true,
+		"foo.*.baz":    true,
+		"foo.>":        true,
+		">":            true,
+		"foo*.bar":     true,
+		"":             false,
+		"foo.":         false,
+		".foo":         false,
+		"foo..bar":     false,
+		"foo bar":      false,
+		"foo.>.bar":    false,
+		"foo\tbar.baz": false,
+	} {
+		if got := IsValidSubject(subject); got != want {
+			t.Errorf("IsValidSubject(%q) = %v, want %v", subject, got, want)
+		}
+	}
+	if IsValidLiteralSubject("foo.*") || IsValidLiteralSubject("foo.>") || !IsValidLiteralSubject("foo.bar") {
+		t.Error("wildcards must not be valid in a publish subject")
+	}
+}
+
+// newBenchSublist subscribes to n subjects of the form
+// orders.<region>.<customer>, a tenth of them with wildcards.
+func newBenchSublist(n int) *Sublist {
+	s := NewSublist()
+	for i := 0; i < n; i++ {
+		subject := fmt.Sprintf("orders.region%d.customer%d", i%50, i)
+		switch i % 10 {
+		case 0:
+			subject = fmt.Sprintf("orders.*.customer%d", i)
+		case 1:
+			subject = fmt.Sprintf("orders.region%d.>", i%50)
+		}
+		s.Insert(&Subscription{subject: subject, sid: fmt.Sprint(i)})
+	}
+	return s
+}
+
+func BenchmarkSublistMatch(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		s := newBenchSublist(n)
+		subjects := make([]string, 100)
+		for i := range subjects {
+			subjects[i] = fmt.Sprintf("orders.region%d.customer%d", i%50, i*7)
+		}
+
+		b.Run(fmt.Sprintf("cached/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.Match(subjects[i%len(subjects)])
+			}
+		})
+		b.Run(fmt.Sprintf("uncached/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				subject := subjects[i%len(subjects)]
+				s.mu.Lock()
+				delete(s.cache, subject)
+				s.mu.Unlock()
+				s.Match(subject)
+			}
+		})
+	}
+}
@@ -1,3 +1,5 @@
 module nats
 
 go 1.23.1
+
+require golang.org/x/crypto v0.36.0
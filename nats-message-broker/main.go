@@ -1,69 +1,81 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
-	"io"
+	"flag"
 	"log"
 	"nats/commands"
-	"nats/parser"
 	"net"
-	"time"
+	"strconv"
+	"strings"
 )
 
-func main() {
+func parseOptions() commands.Options {
+	var opts commands.Options
+	flag.StringVar(&opts.Host, "a", "", "Address to listen on")
+	flag.IntVar(&opts.Port, "p", commands.DefaultPort, "Port to listen on")
+	flag.IntVar(&opts.MaxPayload, "max_payload", commands.DefaultMaxPayload, "Maximum message payload in bytes")
+	flag.DurationVar(&opts.PingInterval, "ping_interval", commands.DefaultPingInterval, "Interval between server pings")
+	flag.IntVar(&opts.MaxPingsOut, "max_pings_out", commands.DefaultMaxPingsOut, "Unanswered pings before a connection is closed")
+	authFile := flag.String("auth", "", "JSON file of the users allowed to connect")
+	flag.DurationVar(&opts.AuthTimeout, "auth_timeout", commands.DefaultAuthTimeout, "Time given to clients to authenticate")
+	flag.IntVar(&opts.MaxPending, "max_pending", commands.DefaultMaxPending, "Bytes pending for a client before it is disconnected as a slow consumer")
+	flag.DurationVar(&opts.WriteDeadline, "write_deadline", commands.DefaultWriteDeadline, "Time a write to a client may take before it is disconnected as a slow consumer")
+	flag.IntVar(&opts.HTTPPort, "m", 0, "HTTP port of the monitoring endpoints, 0 to disable")
+	flag.IntVar(&opts.ClusterPort, "cluster_port", 0, "Port to accept the routes of the cluster on, 0 to disable")
+	flag.StringVar(&opts.ClusterToken, "cluster_token", "", "Secret the servers of the cluster authenticate their routes with, required with -auth")
+	routes := flag.String("routes", "", "Comma separated addresses (host:port) of the routes to connect to")
+	flag.Parse()
 
-	listner, err := net.Listen("tcp", ":4222")
-	if err != nil {
-		panic(err)
-	}
-	for {
-		conn, err := listner.Accept()
+	if *authFile != "" {
+		auth, err := commands.LoadAuthFile(*authFile)
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
-				log.Printf("Temporary error accepting connection %v", netErr)
-				continue
-			}
-			log.Fatalf("Error accepting connection %v", err)
+			log.Fatalf("Error loading auth file: %v", err)
 		}
-		go handleConnection(conn)
+		opts.Auth = auth
+	}
+	if *routes != "" {
+		opts.Routes = strings.Split(*routes, ",")
 	}
+	return opts
 }
 
-func handleConnection(conn net.Conn) {
-	defer func() {
-		err := conn.Close()
-		fmt.Println("Connection closed")
-		if err != nil {
-			fmt.Println("Error closing connection", err.Error())
-		}
-	}()
-	reader := bufio.NewReader(conn)
-	for {
-		// Set a read deadline to prevent hanging connections
-		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Minute)); err != nil {
-			log.Printf("Error setting read deadline: %v", err)
-			return
+func main() {
+	jetStream := flag.Bool("js", false, "Enable JetStream")
+	storeDir := flag.String("sd", "jetstream", "Directory of the JetStream streams")
+	opts := parseOptions()
+	server := commands.NewServer(opts)
+	if *jetStream {
+		if err := server.EnableJetStream(*storeDir); err != nil {
+			log.Fatalf("Error enabling JetStream: %v", err)
 		}
-		cmd, err := parser.Parse(reader)
-
+	}
+	if opts.HTTPPort != 0 {
+		monitor, err := net.Listen("tcp", net.JoinHostPort(opts.Host, strconv.Itoa(opts.HTTPPort)))
 		if err != nil {
-			if err == io.EOF {
-				log.Printf("Client closed connection")
-				return
-			}
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				log.Printf("Read timeout")
-				return
-			}
-			log.Printf("Error parsing command: %v", err)
-			if _, err := conn.Write([]byte("ERROR\r\n")); err != nil {
-				log.Printf("Error writing error response: %v", err)
-				return
+			log.Fatalf("Error listening for monitoring: %v", err)
+		}
+		go func() {
+			if err := server.ServeMonitoring(monitor); err != nil {
+				log.Printf("Error serving monitoring: %v", err)
 			}
-			continue
+		}()
+	}
+	if opts.ClusterPort != 0 {
+		cluster, err := net.Listen("tcp", net.JoinHostPort(opts.Host, strconv.Itoa(opts.ClusterPort)))
+		if err != nil {
+			log.Fatalf("Error listening for routes: %v", err)
 		}
-
-		commands.HandleCommand(cmd, conn)
+		go func() {
+			if err := server.ServeRoutes(cluster); err != nil {
+				log.Fatalf("Error serving routes: %v", err)
+			}
+		}()
+	}
+	listner, err := net.Listen("tcp", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)))
+	if err != nil {
+		panic(err)
+	}
+	if err := server.Serve(listner); err != nil {
+		log.Fatalf("Error accepting connection %v", err)
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
@@ -13,34 +14,66 @@ type CmdName string
 
 const (
 	PUB     CmdName = "PUB"
+	HPUB    CmdName = "HPUB"
 	SUB     CmdName = "SUB"
 	UNSUB   CmdName = "UNSUB"
 	MSG     CmdName = "MSG"
+	HMSG    CmdName = "HMSG"
 	PONG    CmdName = "PONG"
 	PING    CmdName = "PING"
 	INFO    CmdName = "INFO"
 	CONNECT CmdName = "CONNECT"
+
+	// between the servers of a cluster
+	RSPLUS  CmdName = "RS+"
+	RSMINUS CmdName = "RS-"
+	RMSG    CmdName = "RMSG"
+	ERR     CmdName = "-ERR"
 )
 
 type Cmd struct {
 	Name        CmdName
-	Bytes       []byte
+	Bytes       []byte // payload of PUB, message of -ERR
+	Header      []byte // NATS/1.0 header block of HPUB
 	Subject     []byte
-	ID          []byte
+	ReplyTo     []byte   // optional reply subject of PUB
+	Queue       []byte   // optional queue group of SUB, RS+ and RS-
+	Queues      [][]byte // queue groups of RMSG to deliver to
+	ID          []byte   // subscription id of SUB and UNSUB
+	MaxMsgs     int      // UNSUB: messages to deliver before unsubscribing, 0 unsubscribes now
 	ConnectData ConnectCommand
+	InfoData    InfoCommand
+}
+
+// InfoCommand is the INFO the servers of a cluster exchange on their routes.
+type InfoCommand struct {
+	ServerID string `json:"server_id"`
+	Host     string `json:"host,omitempty"`
+	Port     int    `json:"port,omitempty"` // of the route listener
+	// routes the receiver should connect to as well
+	ConnectURLs []string `json:"connect_urls,omitempty"`
 }
 
 type ConnectCommand struct {
 	Name      string `json:"name,omitempty"`
 	Protocol  int    `json:"protocol,omitempty"`
 	AuthToken string `json:"auth_token,omitempty"`
-	Username  string `json:"username,omitempty"`
-	Password  string `json:"password,omitempty"`
+	Username  string `json:"user,omitempty"`
+	Password  string `json:"pass,omitempty"`
 	Verbose   bool   `json:"verbose,omitempty"`
+	Headers   bool   `json:"headers,omitempty"`
+	Pedantic  bool   `json:"pedantic,omitempty"`
+	Lang      string `json:"lang,omitempty"`
+	Version   string `json:"version,omitempty"`
 }
 
-// parse takes a io.Reader and returns a cmd, and error
-func Parse(reader io.Reader) (*Cmd, error) {
+// ErrMaxPayload is returned for a message larger than the maxPayload given
+// to Parse, before anything is allocated for it.
+var ErrMaxPayload = errors.New("Maximum payload exceeded")
+
+// parse takes a io.Reader and returns a cmd, and error. Messages can't be
+// larger than maxPayload bytes.
+func Parse(reader io.Reader, maxPayload int) (*Cmd, error) {
 	buffReader := bufio.NewReader(reader)
 	// Read until newline without allocation
 	line, err := buffReader.ReadSlice('\n')
@@ -48,37 +81,59 @@ func Parse(reader io.Reader) (*Cmd, error) {
 		return nil, err
 	}
 
-	// Find the first space to separate the command name
-	spaceIndex := bytes.IndexByte(line, ' ')
-
-	if spaceIndex < 0 {
+	// Split the command name from its arguments, PING and PONG have none
+	line = bytes.TrimRight(line, "\r\n")
+	cmdName, args := line, []byte(nil)
+	if i := bytes.IndexAny(line, " \t"); i >= 0 {
+		cmdName, args = line[:i], line[i+1:]
+	}
+	if len(cmdName) == 0 {
 		return nil, fmt.Errorf("Empty Command")
 	}
+	cmd := &Cmd{Name: CmdName(bytes.ToUpper(cmdName))}
 
-	cmdName := line[:spaceIndex]
-	cmd := &Cmd{Name: CmdName(cmdName)} // No allocation on command name
-
-	// Switch over the command name as a []byte to avoid string conversion
+	// Switch over the command name as a []byte to avoid string conversion,
+	// the protocol is case insensitive
 	switch {
-	case bytes.Equal(cmdName, []byte("PUB")):
-		return cmd.parsePUB(line[spaceIndex+1:], buffReader) // Pass rest of line
-	case bytes.Equal(cmdName, []byte("CONNECT")):
-		return cmd.parseCONNECT(line[spaceIndex+1:]) // Pass JSON part only
+	case bytes.EqualFold(cmdName, []byte("PUB")):
+		return cmd.parsePUB(args, buffReader, maxPayload) // Pass rest of line
+	case bytes.EqualFold(cmdName, []byte("HPUB")):
+		return cmd.parseHPUB(args, buffReader, maxPayload)
+	case bytes.EqualFold(cmdName, []byte("SUB")):
+		return cmd.parseSUB(args)
+	case bytes.EqualFold(cmdName, []byte("UNSUB")):
+		return cmd.parseUNSUB(args)
+	case bytes.EqualFold(cmdName, []byte("CONNECT")):
+		return cmd.parseCONNECT(args) // Pass JSON part only
+	case bytes.EqualFold(cmdName, []byte("PING")), bytes.EqualFold(cmdName, []byte("PONG")):
+		return cmd, nil
+	case bytes.EqualFold(cmdName, []byte("INFO")):
+		return cmd.parseINFO(args)
+	case bytes.EqualFold(cmdName, []byte("RS+")), bytes.EqualFold(cmdName, []byte("RS-")):
+		return cmd.parseRS(args)
+	case bytes.EqualFold(cmdName, []byte("-ERR")):
+		cmd.Bytes = bytes.Clone(bytes.Trim(args, "'"))
+		return cmd, nil
+	case bytes.EqualFold(cmdName, []byte("RMSG")):
+		return cmd.parseRMSG(args, buffReader, false, maxPayload)
+	case bytes.EqualFold(cmdName, []byte("HMSG")):
+		return cmd.parseRMSG(args, buffReader, true, maxPayload)
 	default:
 		return nil, fmt.Errorf("Unknown Command: %s", cmdName)
 	}
 }
 
-func (c *Cmd) parsePUB(fields []byte, reader *bufio.Reader) (*Cmd, error) {
+func (c *Cmd) parsePUB(fields []byte, reader *bufio.Reader, maxPayload int) (*Cmd, error) {
 	parts := bytes.Fields(fields) // Parses without creating strings
 	if len(parts) < 2 {
 		return nil, fmt.Errorf("Insufficient arguments for PUB")
 	}
-	c.Subject = parts[0]
+	// the line is overwritten by the next read of the reader, keep copies
+	c.Subject = bytes.Clone(parts[0])
 	bytesLength := -1
 	var err error
 	if len(parts) == 3 {
-		c.ID = parts[1]
+		c.ReplyTo = bytes.Clone(parts[1])
 		bytesLength, err = strconv.Atoi(string(parts[2]))
 
 		if err != nil {
@@ -90,6 +145,12 @@ func (c *Cmd) parsePUB(fields []byte, reader *bufio.Reader) (*Cmd, error) {
 			return nil, fmt.Errorf("Error parsing bytes length: %w", err)
 		}
 	}
+	if bytesLength < 0 {
+		return nil, fmt.Errorf("Invalid bytes length: %d", bytesLength)
+	}
+	if bytesLength > maxPayload {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMaxPayload, bytesLength)
+	}
 	c.Bytes = make([]byte, bytesLength)
 	if _, err := io.ReadFull(reader, c.Bytes); err != nil {
 		return nil, fmt.Errorf("reading value: %w", err)
@@ -104,6 +165,79 @@ func (c *Cmd) parsePUB(fields []byte, reader *bufio.Reader) (*Cmd, error) {
 
 }
 
+// HPUB <subject> [reply-to] <#header bytes> <#total bytes>\r\n<headers><payload>\r\n
+func (c *Cmd) parseHPUB(fields []byte, reader *bufio.Reader, maxPayload int) (*Cmd, error) {
+	parts := bytes.Fields(fields)
+	if len(parts) < 3 || len(parts) > 4 {
+		return nil, fmt.Errorf("Invalid arguments for HPUB")
+	}
+	c.Subject = bytes.Clone(parts[0])
+	if len(parts) == 4 {
+		c.ReplyTo = bytes.Clone(parts[1])
+	}
+	headerLength, err := strconv.Atoi(string(parts[len(parts)-2]))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing header length: %w", err)
+	}
+	totalLength, err := strconv.Atoi(string(parts[len(parts)-1]))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing bytes length: %w", err)
+	}
+	if headerLength <= 0 || totalLength < headerLength {
+		return nil, fmt.Errorf("Invalid lengths for HPUB: %d %d", headerLength, totalLength)
+	}
+	if totalLength > maxPayload {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMaxPayload, totalLength)
+	}
+
+	data := make([]byte, totalLength)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, fmt.Errorf("reading value: %w", err)
+	}
+	if _, err := reader.ReadString('\n'); err != nil {
+		return nil, fmt.Errorf("reading trailing newline: %w", err)
+	}
+	if !bytes.HasPrefix(data, []byte("NATS/1.0")) {
+		return nil, fmt.Errorf("Invalid header block")
+	}
+	c.Header, c.Bytes = data[:headerLength], data[headerLength:]
+	c.Name = HPUB
+	return c, nil
+}
+
+// SUB <subject> [queue group] <sid>
+func (c *Cmd) parseSUB(fields []byte) (*Cmd, error) {
+	parts := bytes.Fields(fields)
+	switch len(parts) {
+	case 2:
+		c.Subject, c.ID = bytes.Clone(parts[0]), bytes.Clone(parts[1])
+	case 3:
+		c.Subject, c.Queue, c.ID = bytes.Clone(parts[0]), bytes.Clone(parts[1]), bytes.Clone(parts[2])
+	default:
+		return nil, fmt.Errorf("Invalid arguments for SUB")
+	}
+	c.Name = SUB
+	return c, nil
+}
+
+// UNSUB <sid> [max_msgs]
+func (c *Cmd) parseUNSUB(fields []byte) (*Cmd, error) {
+	parts := bytes.Fields(fields)
+	if len(parts) < 1 || len(parts) > 2 {
+		return nil, fmt.Errorf("Invalid arguments for UNSUB")
+	}
+	c.ID = bytes.Clone(parts[0])
+	if len(parts) == 2 {
+		maxMsgs, err := strconv.Atoi(string(parts[1]))
+		if err != nil || maxMsgs < 0 {
+			return nil, fmt.Errorf("Invalid max_msgs for UNSUB: %s", parts[1])
+		}
+		c.MaxMsgs = maxMsgs
+	}
+	c.Name = UNSUB
+	return c, nil
+}
+
 func (c *Cmd) parseCONNECT(payload []byte) (*Cmd, error) {
 	var connectData ConnectCommand
 
@@ -118,6 +252,96 @@ func (c *Cmd) parseCONNECT(payload []byte) (*Cmd, error) {
 	return c, nil
 }
 
+func (c *Cmd) parseINFO(payload []byte) (*Cmd, error) {
+	if err := json.Unmarshal(payload, &c.InfoData); err != nil {
+		return nil, fmt.Errorf("Failed to parse INFO command: %w", err)
+	}
+	c.Name = INFO
+	return c, nil
+}
+
+// RS+ <subject> [queue group] and RS- <subject> [queue group]
+func (c *Cmd) parseRS(fields []byte) (*Cmd, error) {
+	parts := bytes.Fields(fields)
+	if len(parts) < 1 || len(parts) > 2 {
+		return nil, fmt.Errorf("Invalid arguments for %s", c.Name)
+	}
+	c.Subject = bytes.Clone(parts[0])
+	if len(parts) == 2 {
+		c.Queue = bytes.Clone(parts[1])
+	}
+	return c, nil
+}
+
+// RMSG <subject> [+ <reply-to> <queue>... | | <queue>... | <reply-to>] <#bytes>\r\n<payload>\r\n
+// HMSG <subject> [same] <#header bytes> <#total bytes>\r\n<headers><payload>\r\n
+func (c *Cmd) parseRMSG(fields []byte, reader *bufio.Reader, headers bool, maxPayload int) (*Cmd, error) {
+	parts := bytes.Fields(fields)
+	sizes := 1
+	if headers {
+		sizes = 2
+	}
+	if len(parts) < 1+sizes {
+		return nil, fmt.Errorf("Insufficient arguments for %s", c.Name)
+	}
+	c.Subject = bytes.Clone(parts[0])
+	switch args := parts[1 : len(parts)-sizes]; {
+	case len(args) == 0:
+	case bytes.Equal(args[0], []byte("+")) && len(args) >= 3:
+		c.ReplyTo = bytes.Clone(args[1])
+		c.Queues = cloneAll(args[2:])
+	case bytes.Equal(args[0], []byte("|")) && len(args) >= 2:
+		c.Queues = cloneAll(args[1:])
+	case len(args) == 1:
+		c.ReplyTo = bytes.Clone(args[0])
+	default:
+		return nil, fmt.Errorf("Invalid arguments for %s", c.Name)
+	}
+
+	headerLength := 0
+	totalLength, err := strconv.Atoi(string(parts[len(parts)-1]))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing bytes length: %w", err)
+	}
+	if headers {
+		if headerLength, err = strconv.Atoi(string(parts[len(parts)-2])); err != nil {
+			return nil, fmt.Errorf("Error parsing header length: %w", err)
+		}
+		if headerLength <= 0 {
+			return nil, fmt.Errorf("Invalid header length for %s: %d", c.Name, headerLength)
+		}
+	}
+	if totalLength < headerLength {
+		return nil, fmt.Errorf("Invalid lengths for %s: %d %d", c.Name, headerLength, totalLength)
+	}
+	if totalLength > maxPayload {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMaxPayload, totalLength)
+	}
+	data := make([]byte, totalLength)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, fmt.Errorf("reading value: %w", err)
+	}
+	if _, err := reader.ReadString('\n'); err != nil {
+		return nil, fmt.Errorf("reading trailing newline: %w", err)
+	}
+	if headers {
+		if !bytes.HasPrefix(data, []byte("NATS/1.0")) {
+			return nil, fmt.Errorf("Invalid header block")
+		}
+		c.Header = data[:headerLength]
+	}
+	c.Bytes = data[headerLength:]
+	return c, nil
+}
+
+func cloneAll(parts [][]byte) [][]byte {
+	clones := make([][]byte, len(parts))
+	for i, part := range parts {
+		clones[i] = bytes.Clone(part)
+	}
+	return clones
+}
+
 func (c *Cmd) String() string {
-	return fmt.Sprintf("Name: %s, Subject: %s, ID: %s, Bytes: %s", c.Name, string(c.Subject), c.ID, c.Bytes)
+	return fmt.Sprintf("Name: %s, Subject: %s, ReplyTo: %s, Queue: %s, ID: %s, Bytes: %s", c.Name, string(c.Subject), c.ReplyTo, c.Queue, c.ID, c.Bytes)
 }
@@ -0,0 +1,209 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testMaxPayload = 1024
+
+func parse(t *testing.T, input string) (*Cmd, error) {
+	t.Helper()
+	return Parse(bufio.NewReader(strings.NewReader(input)), testMaxPayload)
+}
+
+func TestParsePUB(t *testing.T) {
+	cmd, err := parse(t, "PUB foo reply 5\r\nhello\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Name != PUB || string(cmd.Subject) != "foo" || string(cmd.ReplyTo) != "reply" || string(cmd.Bytes) != "hello" {
+		t.Errorf("unexpected command %s", cmd)
+	}
+}
+
+func TestParsePayloadLengths(t *testing.T) {
+	tests := []struct {
+		name, input string
+		maxPayload  bool // the error is ErrMaxPayload
+	}{
+		{"negative", "PUB foo -1\r\n\r\n", false},
+		{"not a number", "PUB foo x\r\n\r\n", false},
+		{"huge", "PUB foo 4611686018427387904\r\n", true},
+		{"overflowing", "PUB foo 99999999999999999999\r\n", false},
+		{"over the limit", "PUB foo 1025\r\n", true},
+		{"negative header", "HPUB foo -12 10\r\n", false},
+		{"header over total", "HPUB foo 12 10\r\n", false},
+		{"huge with headers", "HPUB foo 12 4611686018427387904\r\n", true},
+		{"over the limit with headers", "HPUB foo 12 1025\r\n", true},
+		{"negative routed", "RMSG foo -1\r\n", false},
+		{"huge routed", "RMSG foo | q 4611686018427387904\r\n", true},
+		{"over the limit routed", "RMSG foo reply 1025\r\n", true},
+		{"huge routed with headers", "HMSG foo + reply q 12 4611686018427387904\r\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parse(t, tt.input)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if errors.Is(err, ErrMaxPayload) != tt.maxPayload {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+
+	cmd, err := parse(t, "PUB foo 1024\r\n"+strings.Repeat("x", 1024)+"\r\n")
+	if err != nil || len(cmd.Bytes) != 1024 {
+		t.Errorf("expected a payload at the limit to be accepted, got %v", err)
+	}
+}
+
+func TestParseSUB(t *testing.T) {
+	tests := []struct {
+		input, subject, queue, id string
+	}{
+		{"SUB foo 1\r\n", "foo", "", "1"},
+		{"sub foo.* workers 2\r\n", "foo.*", "workers", "2"},
+		{"SUB\tfoo.>   3\r\n", "foo.>", "", "3"},
+	}
+	for _, tt := range tests {
+		cmd, err := parse(t, tt.input)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+		if cmd.Name != SUB || string(cmd.Subject) != tt.subject || string(cmd.Queue) != tt.queue || string(cmd.ID) != tt.id {
+			t.Errorf("%q: unexpected command %s", tt.input, cmd)
+		}
+	}
+	for _, input := range []string{"SUB\r\n", "SUB foo\r\n", "SUB foo q 1 extra\r\n"} {
+		if _, err := parse(t, input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseUNSUB(t *testing.T) {
+	tests := []struct {
+		input, id string
+		maxMsgs   int
+	}{
+		{"UNSUB 1\r\n", "1", 0},
+		{"unsub 2 5\r\n", "2", 5},
+		{"UNSUB 3 0\r\n", "3", 0},
+	}
+	for _, tt := range tests {
+		cmd, err := parse(t, tt.input)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+		if cmd.Name != UNSUB || string(cmd.ID) != tt.id || cmd.MaxMsgs != tt.maxMsgs {
+			t.Errorf("%q: unexpected command %s, max_msgs %d", tt.input, cmd, cmd.MaxMsgs)
+		}
+	}
+	for _, input := range []string{"UNSUB\r\n", "UNSUB 1 x\r\n", "UNSUB 1 -1\r\n", "UNSUB 1 2 3\r\n"} {
+		if _, err := parse(t, input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseCONNECT(t *testing.T) {
+	cmd, err := parse(t, `CONNECT {"name":"app","verbose":true,"headers":true,"user":"alice","pass":"s3cret","auth_token":"t0ken","lang":"go","version":"1.0"}`+"\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ConnectCommand{Name: "app", Verbose: true, Headers: true, Username: "alice", Password: "s3cret", AuthToken: "t0ken", Lang: "go", Version: "1.0"}
+	if cmd.Name != CONNECT || cmd.ConnectData != want {
+		t.Errorf("unexpected CONNECT %+v", cmd.ConnectData)
+	}
+	if _, err := parse(t, "CONNECT {\r\n"); err == nil {
+		t.Error("expected an error for invalid JSON")
+	}
+}
+
+func TestParsePingPong(t *testing.T) {
+	for input, name := range map[string]CmdName{"PING\r\n": PING, "pong\r\n": PONG, "PING\n": PING} {
+		cmd, err := parse(t, input)
+		if err != nil || cmd.Name != name {
+			t.Errorf("%q: expected %s, got %v %v", input, name, cmd, err)
+		}
+	}
+	for _, input := range []string{"\r\n", "FOO bar\r\n"} {
+		if _, err := parse(t, input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseHPUB(t *testing.T) {
+	cmd, err := parse(t, "HPUB foo reply 12 17\r\nNATS/1.0\r\n\r\nhello\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Name != HPUB || string(cmd.ReplyTo) != "reply" || string(cmd.Header) != "NATS/1.0\r\n\r\n" || string(cmd.Bytes) != "hello" {
+		t.Errorf("unexpected command %s, header %q", cmd, cmd.Header)
+	}
+	if _, err := parse(t, "HPUB foo 5 5\r\nhello\r\n"); err == nil {
+		t.Error("expected an error for a header block without NATS/1.0")
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	cmd, err := parse(t, `INFO {"server_id":"a","host":"127.0.0.1","port":6222,"connect_urls":["b:6222"]}`+"\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := cmd.InfoData
+	if cmd.Name != INFO || info.ServerID != "a" || info.Host != "127.0.0.1" || info.Port != 6222 || len(info.ConnectURLs) != 1 || info.ConnectURLs[0] != "b:6222" {
+		t.Errorf("unexpected INFO %+v", info)
+	}
+
+	cmd, err = parse(t, "RS+ foo.* workers\r\n")
+	if err != nil || cmd.Name != RSPLUS || string(cmd.Subject) != "foo.*" || string(cmd.Queue) != "workers" {
+		t.Errorf("unexpected RS+ %v %v", cmd, err)
+	}
+	cmd, err = parse(t, "RS- foo\r\n")
+	if err != nil || cmd.Name != RSMINUS || string(cmd.Subject) != "foo" || cmd.Queue != nil {
+		t.Errorf("unexpected RS- %v %v", cmd, err)
+	}
+	cmd, err = parse(t, "-ERR 'Authorization Violation'\r\n")
+	if err != nil || cmd.Name != ERR || string(cmd.Bytes) != "Authorization Violation" {
+		t.Errorf("unexpected -ERR %v %v", cmd, err)
+	}
+
+	tests := []struct {
+		input, reply, data string
+		queues             []string
+	}{
+		{"RMSG foo 5\r\nhello\r\n", "", "hello", nil},
+		{"RMSG foo reply 5\r\nhello\r\n", "reply", "hello", nil},
+		{"RMSG foo | q1 q2 5\r\nhello\r\n", "", "hello", []string{"q1", "q2"}},
+		{"RMSG foo + reply q1 5\r\nhello\r\n", "reply", "hello", []string{"q1"}},
+	}
+	for _, tt := range tests {
+		cmd, err := parse(t, tt.input)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+		var queues []string
+		for _, q := range cmd.Queues {
+			queues = append(queues, string(q))
+		}
+		if cmd.Name != RMSG || string(cmd.Subject) != "foo" || string(cmd.ReplyTo) != tt.reply || string(cmd.Bytes) != tt.data || strings.Join(queues, " ") != strings.Join(tt.queues, " ") {
+			t.Errorf("%q: unexpected command %s, queues %q", tt.input, cmd, queues)
+		}
+	}
+
+	cmd, err = parse(t, "HMSG foo | q 12 17\r\nNATS/1.0\r\n\r\nhello\r\n")
+	if err != nil || cmd.Name != HMSG || string(cmd.Header) != "NATS/1.0\r\n\r\n" || string(cmd.Bytes) != "hello" || len(cmd.Queues) != 1 {
+		t.Errorf("unexpected HMSG %v %v", cmd, err)
+	}
+	for _, input := range []string{"RS+\r\n", "RS+ a b c\r\n", "RMSG foo\r\n", "RMSG foo + reply 5\r\nhello\r\n", "INFO {\r\n"} {
+		if _, err := parse(t, input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}